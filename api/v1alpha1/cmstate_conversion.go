@@ -0,0 +1,59 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+)
+
+// ConvertTo converts the CMState to the v1alpha2 hub
+func (src *CMState) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1alpha2.CMState)
+	dst.ObjectMeta = src.ObjectMeta
+	dst.Spec = v1alpha2.CMStateSpec{
+		Audience: src.Spec.Audience,
+		Target:   src.Spec.Target,
+		TemplateRef: v1alpha2.TemplateRef{
+			Name:  src.Spec.CMTemplate,
+			Scope: src.Spec.TemplateScope,
+		},
+		AudienceTracking: src.Spec.AudienceTracking,
+		StateScope:       src.Spec.StateScope,
+		Evicted:          src.Spec.Evicted,
+	}
+	dst.Status = src.Status
+	return nil
+}
+
+// ConvertFrom converts the v1alpha2 hub to the CMState
+func (dst *CMState) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1alpha2.CMState)
+	dst.ObjectMeta = src.ObjectMeta
+	dst.Spec = CMStateSpec{
+		Audience:         src.Spec.Audience,
+		Target:           src.Spec.Target,
+		CMTemplate:       src.Spec.TemplateRef.Name,
+		TemplateScope:    src.Spec.TemplateRef.Scope,
+		AudienceTracking: src.Spec.AudienceTracking,
+		StateScope:       src.Spec.StateScope,
+		Evicted:          src.Spec.Evicted,
+	}
+	dst.Status = src.Status
+	return nil
+}
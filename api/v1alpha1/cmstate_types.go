@@ -18,44 +18,60 @@ package v1alpha1
 
 import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-)
 
-type CMAudience struct {
-	Kind string `json:"kind"`
-	Name string `json:"name"`
-}
+	"github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+)
 
-// Important: Run "make" to regenerate code after modifying this file
 // CMStateSpec defines the desired state of CMState
+// +kubebuilder:validation:XValidation:rule="!has(self.audienceTracking) || self.audienceTracking != 'Pod' || self.audience.all(a, a.kind == 'Pod' || a.kind == 'Job')",message="audiences tracked per Pod only list pods and Jobs"
 type CMStateSpec struct {
-	Audience   []CMAudience `json:"audience"`
-	Target     string       `json:"target,omitempty"`
-	CMTemplate string       `json:"cmtemplate"`
-}
-
-// CMStateStatus defines the observed state of CMState
-type CMStateStatus struct {
-	// Represents the observations of a Memcached's current state.
-	// condition types may define expected values and meanings for this field, and whether the values
-	// are considered a guaranteed API.
-	// For further information see: https://github.com/kubernetes/community/blob/master/contributors/devel/sig-architecture/api-conventions.md#typical-status-properties
-
-	// Conditions store the status conditions of the Memcached instances
-	// +operator-sdk:csv:customresourcedefinitions:type=status
-	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
+	Audience []v1alpha2.CMAudience `json:"audience"`
+	Target   string                `json:"target,omitempty"`
+	// CMTemplate is the name of the template the CMState is rendered from
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=253
+	CMTemplate string `json:"cmtemplate"`
+	// TemplateScope is whether CMTemplate names a CMTemplate or a
+	// NamespacedCMTemplate in the namespace of the CMState, Cluster when unset
+	// +optional
+	TemplateScope v1alpha2.TemplateScope `json:"templateScope,omitempty"`
+	// AudienceTracking is how the audience is tracked, the audienceTracking
+	// of the template when the CMState was created. Unset for CMStates created
+	// before it was recorded.
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="audienceTracking is immutable"
+	// +optional
+	AudienceTracking v1alpha2.AudienceTracking `json:"audienceTracking,omitempty"`
+	// StateScope is which pods share the CMState, the stateScope of the
+	// template when the CMState was created. CMStates of a pod are deleted as
+	// soon as their audience is empty. Unset for CMStates shared by all pods
+	// of the template.
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="stateScope is immutable"
+	// +optional
+	StateScope v1alpha2.StateScope `json:"stateScope,omitempty"`
+	// Evicted are the pods that left the audience when they were evicted. A
+	// retried eviction or the deletion that follows doesn't count them down
+	// again, and the CMState is kept while a pod whose eviction was refused
+	// still runs. The operator drops them once they are gone.
+	// +optional
+	Evicted []v1alpha2.EvictedPod `json:"evicted,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 //+kubebuilder:resource:scope=Namespaced
+//+kubebuilder:printcolumn:name="Template",type=string,JSONPath=`.spec.cmtemplate`
+//+kubebuilder:printcolumn:name="Audience",type=integer,JSONPath=`.status.audience`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Available")].status`
+//+kubebuilder:printcolumn:name="ConfigMap",type=string,JSONPath=`.status.configMap`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // CMState is the Schema for the cmstates API
 type CMState struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec   CMStateSpec   `json:"spec,omitempty"`
-	Status CMStateStatus `json:"status,omitempty"`
+	Spec   CMStateSpec            `json:"spec,omitempty"`
+	Status v1alpha2.CMStateStatus `json:"status,omitempty"`
 }
 
 //+kubebuilder:object:root=true
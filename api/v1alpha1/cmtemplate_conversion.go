@@ -0,0 +1,171 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"sort"
+
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+)
+
+// ConvertTo converts the CMTemplate to the v1alpha2 hub
+func (src *CMTemplate) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1alpha2.CMTemplate)
+	dst.ObjectMeta = src.ObjectMeta
+	dst.Spec = convertSpecTo(&src.Spec)
+	dst.Status = src.Status
+	return nil
+}
+
+// ConvertFrom converts the v1alpha2 hub to the CMTemplate
+func (dst *CMTemplate) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1alpha2.CMTemplate)
+	dst.ObjectMeta = src.ObjectMeta
+	dst.Spec = convertSpecFrom(&src.Spec)
+	dst.Status = src.Status
+	return nil
+}
+
+// convertSpecTo converts the spec to its v1alpha2 shape
+func convertSpecTo(src *CMTemplateSpec) v1alpha2.CMTemplateSpec {
+	return v1alpha2.CMTemplateSpec{
+		Template: v1alpha2.Template{
+			AnnotationReplace:   toReplacements(src.Template.AnnotationReplace),
+			LabelReplace:        toReplacements(src.Template.LabelReplace),
+			FieldReplace:        src.Template.FieldReplace,
+			Data:                src.Template.CMTemplate,
+			BinaryData:          src.Template.BinaryData,
+			Engine:              src.Template.Engine,
+			Delimiters:          src.Template.Delimiters,
+			Syntax:              src.Template.Syntax,
+			OptionalAnnotations: src.Template.OptionalAnnotations,
+			TargetAnnotation:    src.Template.TargetAnnotation,
+		},
+		Inject:                 src.Inject,
+		BaseTemplate:           src.BaseTemplate,
+		PodSelector:            src.PodSelector,
+		AudienceTracking:       src.AudienceTracking,
+		StateScope:             src.StateScope,
+		Disabled:               src.Disabled,
+		AllowedServiceAccounts: src.AllowedServiceAccounts,
+		TargetNamespaces:       src.TargetNamespaces,
+		Computed:               src.Computed,
+		Outputs:                src.Outputs,
+		Target:                 src.Target,
+		Immutable:              src.Immutable,
+		Versioning:             src.Versioning,
+		UpdateStrategy:         src.UpdateStrategy,
+		ReloadTargets:          src.ReloadTargets,
+		TTLSecondsAfterEmpty:   src.TTLSecondsAfterEmpty,
+		CleanupPolicy:          src.CleanupPolicy,
+		MaxRenderedBytes:       src.MaxRenderedBytes,
+		ConfigMapName:          src.ConfigMapName,
+		ConfigMapNamePrefix:    src.ConfigMapNamePrefix,
+		Metadata:               src.Metadata,
+		DataFrom:               src.DataFrom,
+		AllowSecretToConfigMap: src.AllowSecretToConfigMap,
+		Aliases:                src.Aliases,
+	}
+}
+
+// convertSpecFrom converts the v1alpha2 spec to its v1alpha1 shape
+func convertSpecFrom(src *v1alpha2.CMTemplateSpec) CMTemplateSpec {
+	return CMTemplateSpec{
+		Template: Template{
+			AnnotationReplace:   fromReplacements(src.Template.AnnotationReplace),
+			LabelReplace:        fromReplacements(src.Template.LabelReplace),
+			FieldReplace:        src.Template.FieldReplace,
+			CMTemplate:          src.Template.Data,
+			BinaryData:          src.Template.BinaryData,
+			Engine:              src.Template.Engine,
+			Delimiters:          src.Template.Delimiters,
+			Syntax:              src.Template.Syntax,
+			OptionalAnnotations: src.Template.OptionalAnnotations,
+			TargetAnnotation:    src.Template.TargetAnnotation,
+		},
+		Inject:                 src.Inject,
+		BaseTemplate:           src.BaseTemplate,
+		PodSelector:            src.PodSelector,
+		AudienceTracking:       src.AudienceTracking,
+		StateScope:             src.StateScope,
+		Disabled:               src.Disabled,
+		AllowedServiceAccounts: src.AllowedServiceAccounts,
+		TargetNamespaces:       src.TargetNamespaces,
+		Computed:               src.Computed,
+		Outputs:                src.Outputs,
+		Target:                 src.Target,
+		Immutable:              src.Immutable,
+		Versioning:             src.Versioning,
+		UpdateStrategy:         src.UpdateStrategy,
+		ReloadTargets:          src.ReloadTargets,
+		TTLSecondsAfterEmpty:   src.TTLSecondsAfterEmpty,
+		CleanupPolicy:          src.CleanupPolicy,
+		MaxRenderedBytes:       src.MaxRenderedBytes,
+		ConfigMapName:          src.ConfigMapName,
+		ConfigMapNamePrefix:    src.ConfigMapNamePrefix,
+		Metadata:               src.Metadata,
+		DataFrom:               src.DataFrom,
+		AllowSecretToConfigMap: src.AllowSecretToConfigMap,
+		Aliases:                src.Aliases,
+	}
+}
+
+// toReplacements lists the replacements sorted by their key
+func toReplacements(replacements map[string]Replacement) []v1alpha2.KeyedReplacement {
+	if replacements == nil {
+		return nil
+	}
+	listed := make([]v1alpha2.KeyedReplacement, 0, len(replacements))
+	for key, replacement := range replacements {
+		listed = append(listed, v1alpha2.KeyedReplacement{
+			Key: key,
+			Replacement: v1alpha2.Replacement{
+				Placeholder: replacement.Placeholder,
+				Default:     replacement.Default,
+				Required:    replacement.Required,
+				Pattern:     replacement.Pattern,
+				Type:        replacement.Type,
+				Enum:        replacement.Enum,
+				AppliesTo:   replacement.AppliesTo,
+			},
+		})
+	}
+	sort.Slice(listed, func(i, j int) bool { return listed[i].Key < listed[j].Key })
+	return listed
+}
+
+// fromReplacements maps the replacements by their key
+func fromReplacements(replacements []v1alpha2.KeyedReplacement) map[string]Replacement {
+	if replacements == nil {
+		return nil
+	}
+	mapped := make(map[string]Replacement, len(replacements))
+	for _, replacement := range replacements {
+		mapped[replacement.Key] = Replacement{
+			Placeholder: replacement.Placeholder,
+			Default:     replacement.Default,
+			Required:    replacement.Required,
+			Pattern:     replacement.Pattern,
+			Type:        replacement.Type,
+			Enum:        replacement.Enum,
+			AppliesTo:   replacement.AppliesTo,
+		}
+	}
+	return mapped
+}
@@ -17,16 +17,137 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"encoding/json"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
 type Template struct {
-	AnnotationReplace map[string]string `json:"annotationreplace"`
-	CMTemplate        map[string]string `json:"cmtemplate"`
-	TargetAnnotation  string            `json:"targetAnnotation"`
+	// AnnotationReplace maps the pod annotations to the placeholders they
+	// replace, pods missing any of them are denied unless it has a default.
+	// An entry is either the placeholder or an object with the placeholder and
+	// a default. The GoTemplate engine doesn't replace the placeholders, it
+	// exposes the annotations as .Annotations instead. Templates with a base
+	// template may leave it to the base.
+	// +kubebuilder:validation:Type=object
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:MaxProperties=64
+	// +optional
+	AnnotationReplace map[string]Replacement `json:"annotationreplace"`
+	// LabelReplace maps pod labels to the placeholders they replace, the way
+	// AnnotationReplace maps annotations. A key in both is replaced with the
+	// annotation of pods having it and the label otherwise, as described by
+	// its AnnotationReplace entry. The GoTemplate engine exposes the values
+	// as .Labels.
+	// +kubebuilder:validation:Type=object
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:MaxProperties=64
+	// +optional
+	LabelReplace map[string]Replacement `json:"labelReplace,omitempty"`
+	// FieldReplace maps replacement keys to the pod fields replacing their
+	// placeholder. The values are read when the pod is admitted, the CMState
+	// carries those of the pod creating it. The GoTemplate engine exposes
+	// them as .Fields.
+	// +kubebuilder:validation:MaxProperties=64
+	// +kubebuilder:validation:XValidation:rule="self.all(k, k.matches('^([a-z0-9]([-a-z0-9]*[a-z0-9])?([.][a-z0-9]([-a-z0-9]*[a-z0-9])?)*/)?[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$'))",message="keys must be qualified names"
+	// +optional
+	FieldReplace map[string]v1alpha2.FieldReplacement `json:"fieldReplace,omitempty"`
+	// CMTemplate is rendered into the data of the generated ConfigMap
+	// +kubebuilder:validation:MaxProperties=256
+	// +kubebuilder:validation:XValidation:rule="self.all(k, k.matches('^[-._a-zA-Z0-9]+$'))",message="keys must consist of alphanumeric characters, '-', '_' or '.'"
+	CMTemplate map[string]string `json:"cmtemplate"`
+	// BinaryData is copied to the binaryData of the generated ConfigMap as
+	// is, nothing in it is replaced
+	// +optional
+	BinaryData map[string][]byte `json:"binaryData,omitempty"`
+	// Engine renders the CMTemplate data, Replace (the default) replaces the
+	// placeholders, GoTemplate executes every value as a Go text/template
+	// +optional
+	Engine v1alpha2.TemplateEngine `json:"engine,omitempty"`
+	// Delimiters replace the {{ and }} action delimiters of the GoTemplate
+	// engine, so data using them itself, like Vault agent templates, doesn't
+	// need escaping
+	// +optional
+	Delimiters *v1alpha2.Delimiters `json:"delimiters,omitempty"`
+	// Syntax declares the syntax of data keys, of the template and its
+	// outputs, their rendered value is parsed with. A ConfigMap whose data
+	// fails to parse isn't written, the one rendered before stays.
+	// +optional
+	Syntax map[string]v1alpha2.DataSyntax `json:"syntax,omitempty"`
+	// OptionalAnnotations are the keys of AnnotationReplace pods may leave
+	// out, entries setting required take precedence
+	// +kubebuilder:validation:MaxItems=64
+	// +optional
+	OptionalAnnotations []string `json:"optionalAnnotations,omitempty"`
+	// TargetAnnotation is the pod annotation receiving the generated ConfigMap name,
+	// used when inject.annotationKeys is not set
+	// +kubebuilder:validation:Pattern=`^([a-z0-9]([-a-z0-9]*[a-z0-9])?([.][a-z0-9]([-a-z0-9]*[a-z0-9])?)*/)?[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`
+	// +optional
+	TargetAnnotation string `json:"targetAnnotation,omitempty"`
+}
+
+// Replacement is what an annotation of AnnotationReplace, or a label of
+// LabelReplace, replaces. It is written as the placeholder alone, or as an
+// object when it sets more than that.
+type Replacement struct {
+	// Placeholder is replaced by the value of the annotation or label
+	Placeholder string `json:"placeholder"`
+	// Default is the value of the annotation or label for pods that don't
+	// set it
+	// +optional
+	Default *string `json:"default,omitempty"`
+	// Required denies pods that don't set the annotation or label when true,
+	// and renders it empty for them when false. Unset, it is required unless
+	// OptionalAnnotations lists it.
+	// +optional
+	Required *bool `json:"required,omitempty"`
+	// Pattern is an RE2 regular expression the whole value of the annotation
+	// or label has to match, pods setting it to anything else are denied
+	// +optional
+	Pattern string `json:"pattern,omitempty"`
+	// Type is what the value is parsed as, string (the default), int or
+	// bool. Pod values are normalized to it, so True and 1 render as true.
+	// +optional
+	Type v1alpha2.ReplacementType `json:"type,omitempty"`
+	// Enum lists the values allowed, after normalizing them to the type
+	// +kubebuilder:validation:MaxItems=64
+	// +optional
+	Enum []string `json:"enum,omitempty"`
+	// AppliesTo limits the Replace engine to replacing the placeholder in
+	// these data keys, of the template or of its outputs, rather than in
+	// all of them
+	// +kubebuilder:validation:MaxItems=64
+	// +optional
+	AppliesTo []string `json:"appliesTo,omitempty"`
+}
+
+// UnmarshalJSON reads a replacement written as the placeholder alone, the way
+// every replacement was written before they could have a default
+func (in *Replacement) UnmarshalJSON(data []byte) error {
+	var placeholder string
+	if err := json.Unmarshal(data, &placeholder); err == nil {
+		*in = Replacement{Placeholder: placeholder}
+		return nil
+	}
+	type replacement Replacement
+	return json.Unmarshal(data, (*replacement)(in))
+}
+
+// MarshalJSON writes a replacement with only a placeholder as the placeholder
+// alone, so templates read back the way they were written
+func (in Replacement) MarshalJSON() ([]byte, error) {
+	if in.Default == nil && in.Required == nil && in.Pattern == "" && in.Type == "" && in.Enum == nil && in.AppliesTo == nil {
+		return json.Marshal(in.Placeholder)
+	}
+	type replacement Replacement
+	return json.Marshal(replacement(in))
 }
 
 // CMTemplateSpec defines the desired state of CMTemplate
@@ -35,25 +156,152 @@ type CMTemplateSpec struct {
 	// Important: Run "make" to regenerate code after modifying this file
 
 	Template Template `json:"template,omitempty"`
-}
-
-// CMTemplateStatus defines the observed state of CMTemplate
-type CMTemplateStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// +optional
+	Inject *v1alpha2.Inject `json:"inject,omitempty"`
+	// BaseTemplate names a CMTemplate whose data, annotationreplace and
+	// inject settings this one inherits, its own keys and settings win. The
+	// base may have a base of its own.
+	// +optional
+	BaseTemplate string `json:"baseTemplate,omitempty"`
+	// PodSelector selects the pods to inject without a cmtemplate annotation,
+	// the annotation takes precedence
+	// +optional
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+	// AudienceTracking records pods in the audience per Pod (the default) or
+	// per owning workload
+	// +optional
+	AudienceTracking v1alpha2.AudienceTracking `json:"audienceTracking,omitempty"`
+	// StateScope is Template (the default) to share a CMState between all
+	// pods of the template in a namespace, Owner to render one per owning
+	// workload or Pod to render one per pod. The CMState is named after the
+	// owner or the pod.
+	// +optional
+	StateScope v1alpha2.StateScope `json:"stateScope,omitempty"`
+	// Disabled stops the template from being injected into new pods, the pods
+	// and CMStates using it already keep working
+	// +optional
+	Disabled bool `json:"disabled,omitempty"`
+	// AllowedServiceAccounts are the service accounts pods have to run as to
+	// get the template, as namespace/name where both parts may be glob
+	// patterns like team-*/vault-*. Pods running as any service account get it
+	// when empty.
+	// +optional
+	AllowedServiceAccounts []string `json:"allowedServiceAccounts,omitempty"`
+	// TargetNamespaces are the namespaces pods have to be in to get the
+	// template, and CMStates to be in to be rendered. Pods in any namespace
+	// get it when empty.
+	// +optional
+	TargetNamespaces *v1alpha2.TargetNamespaces `json:"targetNamespaces,omitempty"`
+	// Computed are values computed by CEL expressions from the values the
+	// CMState is rendered with, replaced like them. An expression failing to
+	// evaluate fails the rendering of the CMState.
+	// +listType=map
+	// +listMapKey=key
+	// +optional
+	Computed []v1alpha2.ComputedValue `json:"computed,omitempty"`
+	// Outputs are further ConfigMaps rendered for every CMState of the
+	// template, besides the one of template.cmtemplate. They share its
+	// replacements, engine and audience.
+	// +optional
+	Outputs []v1alpha2.Output `json:"outputs,omitempty"`
+	// Target is the kind of object the template and its outputs render
+	// into, a ConfigMap unless set
+	// +optional
+	Target *v1alpha2.Target `json:"target,omitempty"`
+	// Immutable renders into immutable ConfigMaps named after the hash of
+	// what they are rendered from, a change renders a new one new pods are
+	// injected with. The ones no pod uses anymore are deleted.
+	// +optional
+	Immutable bool `json:"immutable,omitempty"`
+	// Versioning is inPlace to update the ConfigMap when the template
+	// changes, or hashSuffix to render a new ConfigMap suffixed with the hash
+	// of its content instead. The previous one is kept until no pod of the
+	// audience uses it anymore. Unset, immutable templates are versioned by
+	// hashSuffix and the others in place.
+	// +optional
+	Versioning v1alpha2.Versioning `json:"versioning,omitempty"`
+	// UpdateStrategy is Always (the default) to render the ConfigMaps of the
+	// CMStates anew when the template changes, or OnCreate to keep them as
+	// they were rendered when the CMState was created
+	// +optional
+	UpdateStrategy v1alpha2.UpdateStrategy `json:"updateStrategy,omitempty"`
+	// ReloadTargets restarts the Deployments and StatefulSets of the audience
+	// once their ConfigMap was rendered anew, for consumers that only read it
+	// at startup. The same workload is restarted at most once per the
+	// operator's --reload-interval.
+	// +optional
+	ReloadTargets bool `json:"reloadTargets,omitempty"`
+	// TTLSecondsAfterEmpty is how long a CMState of the template is kept once
+	// its audience is empty before it is deleted along with its ConfigMap,
+	// instead of the operator's --empty-audience-grace-period. A pod joining
+	// in the meantime keeps it.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	TTLSecondsAfterEmpty *int32 `json:"ttlSecondsAfterEmpty,omitempty"`
+	// CleanupPolicy is Block (the default) to keep a deleted template until
+	// no CMState is rendered from it anymore, or Cascade to delete its
+	// CMStates and their ConfigMaps first
+	// +optional
+	CleanupPolicy v1alpha2.CleanupPolicy `json:"cleanupPolicy,omitempty"`
+	// MaxRenderedBytes is the most data and binary data a ConfigMap of the
+	// template may hold once rendered, below the 1MiB a ConfigMap can hold.
+	// A CMState rendering more keeps its previous ConfigMap.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=1048576
+	// +optional
+	MaxRenderedBytes *int32 `json:"maxRenderedBytes,omitempty"`
+	// ConfigMapName is the name of the generated ConfigMap, instead of the
+	// cmstate-<template> the CMState is named. Pods overriding values get the
+	// hash of their overrides appended to it.
+	// +kubebuilder:validation:MaxLength=244
+	// +optional
+	ConfigMapName string `json:"configMapName,omitempty"`
+	// ConfigMapNamePrefix replaces the cmstate- prefix of the generated
+	// ConfigMap name
+	// +kubebuilder:validation:MaxLength=63
+	// +optional
+	ConfigMapNamePrefix string `json:"configMapNamePrefix,omitempty"`
+	// Metadata are labels and annotations added to the CMStates and
+	// ConfigMaps generated for the template, the ones the operator sets
+	// itself win over them
+	// +optional
+	Metadata *v1alpha2.Metadata `json:"metadata,omitempty"`
+	// DataFrom adds data maintained elsewhere to template.cmtemplate when
+	// rendering, so it doesn't have to be copied into the template. A change
+	// to it renders the ConfigMaps anew.
+	// +optional
+	DataFrom []v1alpha2.DataFromSource `json:"dataFrom,omitempty"`
+	// AllowSecretToConfigMap lets the data of the Secrets dataFrom references
+	// be rendered into a ConfigMap, readable by anyone reading ConfigMaps.
+	// Without it templates referencing Secrets have to render into Secrets.
+	// Only CMTemplates can set it.
+	// +optional
+	AllowSecretToConfigMap bool `json:"allowSecretToConfigMap,omitempty"`
+	// Aliases are other names pods can ask for the template under, so it can
+	// be renamed without changing every pod. They are unique across the
+	// names and aliases of all CMTemplates, CMStates are named after the
+	// name itself.
+	// +kubebuilder:validation:MaxItems=16
+	// +optional
+	Aliases []string `json:"aliases,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 //+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Target-Kind",type=string,JSONPath=`.status.targetKind`
+//+kubebuilder:printcolumn:name="States",type=integer,JSONPath=`.status.cmStates`
+//+kubebuilder:printcolumn:name="Audience",type=integer,JSONPath=`.status.audience`
+//+kubebuilder:printcolumn:name="Valid",type=string,JSONPath=`.status.conditions[?(@.type=="Valid")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // CMTemplate is the Schema for the cmtemplates API
 type CMTemplate struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec   CMTemplateSpec   `json:"spec,omitempty"`
-	Status CMTemplateStatus `json:"status,omitempty"`
+	Spec   CMTemplateSpec            `json:"spec,omitempty"`
+	Status v1alpha2.CMTemplateStatus `json:"status,omitempty"`
 }
 
 //+kubebuilder:object:root=true
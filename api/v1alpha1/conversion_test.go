@@ -0,0 +1,189 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"sort"
+
+	fuzz "github.com/google/gofuzz"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fuzzRounds is how many fuzzed objects every round trip converts
+const fuzzRounds = 200
+
+// newFuzzer fills objects at random. The type meta is left to the conversion
+// webhook, and replacements listed by key only hold one entry per key, sorted,
+// which is what they convert back to.
+func newFuzzer() *fuzz.Fuzzer {
+	return fuzz.New().NilChance(0.2).NumElements(0, 3).Funcs(
+		func(*metav1.TypeMeta, fuzz.Continue) {},
+		func(replacements *[]v1alpha2.KeyedReplacement, c fuzz.Continue) {
+			byKey := make(map[string]v1alpha2.Replacement)
+			c.Fuzz(&byKey)
+			if len(byKey) == 0 {
+				*replacements = nil
+				return
+			}
+			*replacements = make([]v1alpha2.KeyedReplacement, 0, len(byKey))
+			for key, replacement := range byKey {
+				*replacements = append(*replacements, v1alpha2.KeyedReplacement{Key: key, Replacement: replacement})
+			}
+			sort.Slice(*replacements, func(i, j int) bool { return (*replacements)[i].Key < (*replacements)[j].Key })
+		},
+	)
+}
+
+var _ = Describe("Conversion", func() {
+	var fuzzer *fuzz.Fuzzer
+
+	BeforeEach(func() {
+		fuzzer = newFuzzer()
+	})
+
+	Context("of CMTemplates", func() {
+		It("keeps the hub through a round trip", func() {
+			for i := 0; i < fuzzRounds; i++ {
+				hub := &v1alpha2.CMTemplate{}
+				fuzzer.Fuzz(hub)
+				spoke := &CMTemplate{}
+				Expect(spoke.ConvertFrom(hub.DeepCopy())).To(Succeed())
+				back := &v1alpha2.CMTemplate{}
+				Expect(spoke.ConvertTo(back)).To(Succeed())
+				Expect(apiequality.Semantic.DeepEqual(hub, back)).To(BeTrue(), "round trip of %#v", hub)
+			}
+		})
+
+		It("keeps the spoke through a round trip", func() {
+			for i := 0; i < fuzzRounds; i++ {
+				spoke := &CMTemplate{}
+				fuzzer.Fuzz(spoke)
+				hub := &v1alpha2.CMTemplate{}
+				Expect(spoke.DeepCopy().ConvertTo(hub)).To(Succeed())
+				back := &CMTemplate{}
+				Expect(back.ConvertFrom(hub)).To(Succeed())
+				Expect(apiequality.Semantic.DeepEqual(spoke, back)).To(BeTrue(), "round trip of %#v", spoke)
+			}
+		})
+
+		It("renames the cmtemplate and lists the replacements by key", func() {
+			spoke := &CMTemplate{Spec: CMTemplateSpec{Template: Template{
+				AnnotationReplace: map[string]Replacement{
+					"vault.hashicorp.com/role":    {Placeholder: "{role}"},
+					"vault.hashicorp.com/address": {Placeholder: "{address}", Pattern: "https://.*"},
+				},
+				CMTemplate: map[string]string{"config.hcl": "role = {role}"},
+			}}}
+			hub := &v1alpha2.CMTemplate{}
+			Expect(spoke.ConvertTo(hub)).To(Succeed())
+			Expect(hub.Spec.Template.Data).To(Equal(map[string]string{"config.hcl": "role = {role}"}))
+			Expect(hub.Spec.Template.AnnotationReplace).To(Equal([]v1alpha2.KeyedReplacement{
+				{Key: "vault.hashicorp.com/address", Replacement: v1alpha2.Replacement{Placeholder: "{address}", Pattern: "https://.*"}},
+				{Key: "vault.hashicorp.com/role", Replacement: v1alpha2.Replacement{Placeholder: "{role}"}},
+			}))
+		})
+
+		It("lists replacements written as the placeholder alone or as an object", func() {
+			spoke := &CMTemplate{}
+			Expect(json.Unmarshal([]byte(`{"spec": {"template": {
+				"annotationreplace": {
+					"vault.hashicorp.com/role": "{role}",
+					"vault.hashicorp.com/address": {"placeholder": "{address}", "pattern": "https://.*"}
+				},
+				"labelReplace": {"team": "{team}"},
+				"cmtemplate": {"config.hcl": "role = {role}"}
+			}}}`), spoke)).To(Succeed())
+			hub := &v1alpha2.CMTemplate{}
+			Expect(spoke.ConvertTo(hub)).To(Succeed())
+			Expect(hub.Spec.Template.AnnotationReplace).To(Equal([]v1alpha2.KeyedReplacement{
+				{Key: "vault.hashicorp.com/address", Replacement: v1alpha2.Replacement{Placeholder: "{address}", Pattern: "https://.*"}},
+				{Key: "vault.hashicorp.com/role", Replacement: v1alpha2.Replacement{Placeholder: "{role}"}},
+			}))
+			Expect(hub.Spec.Template.LabelReplace).To(Equal([]v1alpha2.KeyedReplacement{
+				{Key: "team", Replacement: v1alpha2.Replacement{Placeholder: "{team}"}},
+			}))
+		})
+
+		It("keeps the hash of templates stored as v1alpha1", func() {
+			spoke := &CMTemplate{Spec: CMTemplateSpec{Template: Template{
+				AnnotationReplace: map[string]Replacement{
+					"vault.hashicorp.com/role":    {Placeholder: "{role}"},
+					"vault.hashicorp.com/address": {Placeholder: "{address}", Pattern: "https://.*"},
+				},
+				LabelReplace: map[string]Replacement{"team": {Placeholder: "{team}"}},
+				CMTemplate:   map[string]string{"config.hcl": "role = {role}\naddress = {address}\nteam = {team}"},
+			}}}
+			hub := &v1alpha2.CMTemplate{}
+			Expect(spoke.ConvertTo(hub)).To(Succeed())
+			// the hash v1alpha1 computed for the template
+			Expect(hub.Spec.TemplateHash()).To(Equal("0e3706808620482dedb46d9d5b7488905c282b0534956e346d384b2f845a221c"))
+		})
+	})
+
+	Context("of NamespacedCMTemplates", func() {
+		It("keeps the hub through a round trip", func() {
+			for i := 0; i < fuzzRounds; i++ {
+				hub := &v1alpha2.NamespacedCMTemplate{}
+				fuzzer.Fuzz(hub)
+				spoke := &NamespacedCMTemplate{}
+				Expect(spoke.ConvertFrom(hub.DeepCopy())).To(Succeed())
+				back := &v1alpha2.NamespacedCMTemplate{}
+				Expect(spoke.ConvertTo(back)).To(Succeed())
+				Expect(apiequality.Semantic.DeepEqual(hub, back)).To(BeTrue(), "round trip of %#v", hub)
+			}
+		})
+	})
+
+	Context("of CMStates", func() {
+		It("keeps the hub through a round trip", func() {
+			for i := 0; i < fuzzRounds; i++ {
+				hub := &v1alpha2.CMState{}
+				fuzzer.Fuzz(hub)
+				spoke := &CMState{}
+				Expect(spoke.ConvertFrom(hub.DeepCopy())).To(Succeed())
+				back := &v1alpha2.CMState{}
+				Expect(spoke.ConvertTo(back)).To(Succeed())
+				Expect(apiequality.Semantic.DeepEqual(hub, back)).To(BeTrue(), "round trip of %#v", hub)
+			}
+		})
+
+		It("keeps the spoke through a round trip", func() {
+			for i := 0; i < fuzzRounds; i++ {
+				spoke := &CMState{}
+				fuzzer.Fuzz(spoke)
+				hub := &v1alpha2.CMState{}
+				Expect(spoke.DeepCopy().ConvertTo(hub)).To(Succeed())
+				back := &CMState{}
+				Expect(back.ConvertFrom(hub)).To(Succeed())
+				Expect(apiequality.Semantic.DeepEqual(spoke, back)).To(BeTrue(), "round trip of %#v", spoke)
+			}
+		})
+
+		It("references the template by name and scope", func() {
+			spoke := &CMState{Spec: CMStateSpec{CMTemplate: "vault-agent", TemplateScope: v1alpha2.TemplateScopeNamespaced}}
+			hub := &v1alpha2.CMState{}
+			Expect(spoke.ConvertTo(hub)).To(Succeed())
+			Expect(hub.Spec.TemplateRef).To(Equal(v1alpha2.TemplateRef{Name: "vault-agent", Scope: v1alpha2.TemplateScopeNamespaced}))
+		})
+	})
+})
@@ -0,0 +1,39 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+)
+
+// ConvertTo converts the NamespacedCMTemplate to the v1alpha2 hub
+func (src *NamespacedCMTemplate) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1alpha2.NamespacedCMTemplate)
+	dst.ObjectMeta = src.ObjectMeta
+	dst.Spec = convertSpecTo(&src.Spec)
+	return nil
+}
+
+// ConvertFrom converts the v1alpha2 hub to the NamespacedCMTemplate
+func (dst *NamespacedCMTemplate) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1alpha2.NamespacedCMTemplate)
+	dst.ObjectMeta = src.ObjectMeta
+	dst.Spec = convertSpecFrom(&src.Spec)
+	return nil
+}
@@ -22,25 +22,11 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
-// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *CMAudience) DeepCopyInto(out *CMAudience) {
-	*out = *in
-}
-
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CMAudience.
-func (in *CMAudience) DeepCopy() *CMAudience {
-	if in == nil {
-		return nil
-	}
-	out := new(CMAudience)
-	in.DeepCopyInto(out)
-	return out
-}
-
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CMState) DeepCopyInto(out *CMState) {
 	*out = *in
@@ -105,39 +91,26 @@ func (in *CMStateSpec) DeepCopyInto(out *CMStateSpec) {
 	*out = *in
 	if in.Audience != nil {
 		in, out := &in.Audience, &out.Audience
-		*out = make([]CMAudience, len(*in))
-		copy(*out, *in)
-	}
-}
-
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CMStateSpec.
-func (in *CMStateSpec) DeepCopy() *CMStateSpec {
-	if in == nil {
-		return nil
+		*out = make([]v1alpha2.CMAudience, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
 	}
-	out := new(CMStateSpec)
-	in.DeepCopyInto(out)
-	return out
-}
-
-// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *CMStateStatus) DeepCopyInto(out *CMStateStatus) {
-	*out = *in
-	if in.Conditions != nil {
-		in, out := &in.Conditions, &out.Conditions
-		*out = make([]v1.Condition, len(*in))
+	if in.Evicted != nil {
+		in, out := &in.Evicted, &out.Evicted
+		*out = make([]v1alpha2.EvictedPod, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CMStateStatus.
-func (in *CMStateStatus) DeepCopy() *CMStateStatus {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CMStateSpec.
+func (in *CMStateSpec) DeepCopy() *CMStateSpec {
 	if in == nil {
 		return nil
 	}
-	out := new(CMStateStatus)
+	out := new(CMStateSpec)
 	in.DeepCopyInto(out)
 	return out
 }
@@ -148,7 +121,7 @@ func (in *CMTemplate) DeepCopyInto(out *CMTemplate) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CMTemplate.
@@ -205,6 +178,70 @@ func (in *CMTemplateList) DeepCopyObject() runtime.Object {
 func (in *CMTemplateSpec) DeepCopyInto(out *CMTemplateSpec) {
 	*out = *in
 	in.Template.DeepCopyInto(&out.Template)
+	if in.Inject != nil {
+		in, out := &in.Inject, &out.Inject
+		*out = new(v1alpha2.Inject)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PodSelector != nil {
+		in, out := &in.PodSelector, &out.PodSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AllowedServiceAccounts != nil {
+		in, out := &in.AllowedServiceAccounts, &out.AllowedServiceAccounts
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.TargetNamespaces != nil {
+		in, out := &in.TargetNamespaces, &out.TargetNamespaces
+		*out = new(v1alpha2.TargetNamespaces)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Computed != nil {
+		in, out := &in.Computed, &out.Computed
+		*out = make([]v1alpha2.ComputedValue, len(*in))
+		copy(*out, *in)
+	}
+	if in.Outputs != nil {
+		in, out := &in.Outputs, &out.Outputs
+		*out = make([]v1alpha2.Output, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Target != nil {
+		in, out := &in.Target, &out.Target
+		*out = new(v1alpha2.Target)
+		**out = **in
+	}
+	if in.TTLSecondsAfterEmpty != nil {
+		in, out := &in.TTLSecondsAfterEmpty, &out.TTLSecondsAfterEmpty
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MaxRenderedBytes != nil {
+		in, out := &in.MaxRenderedBytes, &out.MaxRenderedBytes
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Metadata != nil {
+		in, out := &in.Metadata, &out.Metadata
+		*out = new(v1alpha2.Metadata)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DataFrom != nil {
+		in, out := &in.DataFrom, &out.DataFrom
+		*out = make([]v1alpha2.DataFromSource, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Aliases != nil {
+		in, out := &in.Aliases, &out.Aliases
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CMTemplateSpec.
@@ -218,16 +255,94 @@ func (in *CMTemplateSpec) DeepCopy() *CMTemplateSpec {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *CMTemplateStatus) DeepCopyInto(out *CMTemplateStatus) {
+func (in *NamespacedCMTemplate) DeepCopyInto(out *NamespacedCMTemplate) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NamespacedCMTemplate.
+func (in *NamespacedCMTemplate) DeepCopy() *NamespacedCMTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(NamespacedCMTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *NamespacedCMTemplate) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NamespacedCMTemplateList) DeepCopyInto(out *NamespacedCMTemplateList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]NamespacedCMTemplate, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NamespacedCMTemplateList.
+func (in *NamespacedCMTemplateList) DeepCopy() *NamespacedCMTemplateList {
+	if in == nil {
+		return nil
+	}
+	out := new(NamespacedCMTemplateList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *NamespacedCMTemplateList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Replacement) DeepCopyInto(out *Replacement) {
 	*out = *in
+	if in.Default != nil {
+		in, out := &in.Default, &out.Default
+		*out = new(string)
+		**out = **in
+	}
+	if in.Required != nil {
+		in, out := &in.Required, &out.Required
+		*out = new(bool)
+		**out = **in
+	}
+	if in.Enum != nil {
+		in, out := &in.Enum, &out.Enum
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AppliesTo != nil {
+		in, out := &in.AppliesTo, &out.AppliesTo
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CMTemplateStatus.
-func (in *CMTemplateStatus) DeepCopy() *CMTemplateStatus {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Replacement.
+func (in *Replacement) DeepCopy() *Replacement {
 	if in == nil {
 		return nil
 	}
-	out := new(CMTemplateStatus)
+	out := new(Replacement)
 	in.DeepCopyInto(out)
 	return out
 }
@@ -237,7 +352,21 @@ func (in *Template) DeepCopyInto(out *Template) {
 	*out = *in
 	if in.AnnotationReplace != nil {
 		in, out := &in.AnnotationReplace, &out.AnnotationReplace
-		*out = make(map[string]string, len(*in))
+		*out = make(map[string]Replacement, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.LabelReplace != nil {
+		in, out := &in.LabelReplace, &out.LabelReplace
+		*out = make(map[string]Replacement, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.FieldReplace != nil {
+		in, out := &in.FieldReplace, &out.FieldReplace
+		*out = make(map[string]v1alpha2.FieldReplacement, len(*in))
 		for key, val := range *in {
 			(*out)[key] = val
 		}
@@ -249,6 +378,38 @@ func (in *Template) DeepCopyInto(out *Template) {
 			(*out)[key] = val
 		}
 	}
+	if in.BinaryData != nil {
+		in, out := &in.BinaryData, &out.BinaryData
+		*out = make(map[string][]byte, len(*in))
+		for key, val := range *in {
+			var outVal []byte
+			if val == nil {
+				(*out)[key] = nil
+			} else {
+				in, out := &val, &outVal
+				*out = make([]byte, len(*in))
+				copy(*out, *in)
+			}
+			(*out)[key] = outVal
+		}
+	}
+	if in.Delimiters != nil {
+		in, out := &in.Delimiters, &out.Delimiters
+		*out = new(v1alpha2.Delimiters)
+		**out = **in
+	}
+	if in.Syntax != nil {
+		in, out := &in.Syntax, &out.Syntax
+		*out = make(map[string]v1alpha2.DataSyntax, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.OptionalAnnotations != nil {
+		in, out := &in.OptionalAnnotations, &out.OptionalAnnotations
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Template.
@@ -0,0 +1,287 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// CMAudience is a consumer of the ConfigMap tracked by a CMState.
+//
+// Pods are tracked under their own name when it is known at admission time.
+// Pods created through generateName don't have a name yet, those share a single
+// entry named after the generateName with Count holding the number of replicas.
+// Entries written before Count existed have it unset and are treated as one
+// shared reference that is only dropped once the owning workload is gone.
+// Templates tracking audiences per owner record the owning workload instead,
+// e.g. a Deployment, with Count holding the number of its pods.
+// Pods of a Job are always recorded under the Job, with Members holding the id
+// of each of its pods so their bursts of deletions can't miscount.
+type CMAudience struct {
+	// Kind is Pod for pods tracked themselves, or the kind of the workload
+	// owning them, one of AudienceKinds
+	// +kubebuilder:validation:Enum=Pod;ReplicaSet;Deployment;StatefulSet;DaemonSet;Job;ReplicationController
+	// +kubebuilder:validation:MaxLength=63
+	Kind string `json:"kind"`
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+	// Namespace of the audience member
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// UID of the audience member, only known for members admitted with a name
+	// +optional
+	UID types.UID `json:"uid,omitempty"`
+	// AddedAt is when the member joined the audience
+	// +optional
+	AddedAt *metav1.Time `json:"addedAt,omitempty"`
+	// Count is the number of pods sharing this generateName or owner entry
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Count int32 `json:"count,omitempty"`
+	// Members are the ids of the pods counted in the entry, stamped on each
+	// pod at admission since their UIDs aren't assigned yet
+	// +optional
+	Members []types.UID `json:"members,omitempty"`
+	// ConfigMap is the ConfigMap the pods of the entry were last injected
+	// with. Previous ConfigMaps are kept while an entry records them.
+	// +optional
+	ConfigMap string `json:"configMap,omitempty"`
+}
+
+// AudienceKinds are the kinds of audience entries, pods and the workloads
+// owning them
+var AudienceKinds = []string{"Pod", "ReplicaSet", "Deployment", "StatefulSet", "DaemonSet", "Job", "ReplicationController"}
+
+// IsAudienceKind reports whether an audience entry can be of the kind
+func IsAudienceKind(kind string) bool {
+	for _, audienceKind := range AudienceKinds {
+		if kind == audienceKind {
+			return true
+		}
+	}
+	return false
+}
+
+// TemplateRef names the template a CMState is rendered from
+type TemplateRef struct {
+	// Name of the CMTemplate, or of the NamespacedCMTemplate in the namespace
+	// of the CMState
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=253
+	Name string `json:"name"`
+	// Scope is whether Name names a CMTemplate or a NamespacedCMTemplate,
+	// Cluster when unset
+	// +optional
+	Scope TemplateScope `json:"scope,omitempty"`
+}
+
+// Important: Run "make" to regenerate code after modifying this file
+// CMStateSpec defines the desired state of CMState
+// +kubebuilder:validation:XValidation:rule="!has(self.audienceTracking) || self.audienceTracking != 'Pod' || self.audience.all(a, a.kind == 'Pod' || a.kind == 'Job')",message="audiences tracked per Pod only list pods and Jobs"
+type CMStateSpec struct {
+	Audience    []CMAudience `json:"audience"`
+	Target      string       `json:"target,omitempty"`
+	TemplateRef TemplateRef  `json:"templateRef"`
+	// AudienceTracking is how the audience is tracked, the audienceTracking
+	// of the template when the CMState was created. Unset for CMStates created
+	// before it was recorded.
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="audienceTracking is immutable"
+	// +optional
+	AudienceTracking AudienceTracking `json:"audienceTracking,omitempty"`
+	// StateScope is which pods share the CMState, the stateScope of the
+	// template when the CMState was created. CMStates of a pod are deleted as
+	// soon as their audience is empty. Unset for CMStates shared by all pods
+	// of the template.
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="stateScope is immutable"
+	// +optional
+	StateScope StateScope `json:"stateScope,omitempty"`
+	// Evicted are the pods that left the audience when they were evicted. A
+	// retried eviction or the deletion that follows doesn't count them down
+	// again, and the CMState is kept while a pod whose eviction was refused
+	// still runs. The operator drops them once they are gone.
+	// +optional
+	Evicted []EvictedPod `json:"evicted,omitempty"`
+}
+
+// EvictedPod is a pod that left the audience when it was evicted
+type EvictedPod struct {
+	// Name of the evicted pod
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+	// UID of the evicted pod
+	UID types.UID `json:"uid"`
+	// EvictedAt is when its eviction was admitted
+	EvictedAt metav1.Time `json:"evictedAt"`
+}
+
+// CMStateStatus defines the observed state of CMState
+type CMStateStatus struct {
+	// Represents the observations of a Memcached's current state.
+	// condition types may define expected values and meanings for this field, and whether the values
+	// are considered a guaranteed API.
+	// For further information see: https://github.com/kubernetes/community/blob/master/contributors/devel/sig-architecture/api-conventions.md#typical-status-properties
+
+	// Conditions store the status conditions of the Memcached instances
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
+
+	// EmptySince is when the audience was last observed to become empty
+	// +optional
+	EmptySince *metav1.Time `json:"emptySince,omitempty"`
+
+	// ConfigMap is the ConfigMap new pods are injected with, for CMStates of
+	// immutable templates the current immutable one
+	// +optional
+	ConfigMap string `json:"configMap,omitempty"`
+	// Audience is the number of pods and owners in the audience
+	// +optional
+	Audience int32 `json:"audience"`
+	// PreviousConfigMaps are the immutable ConfigMaps rendered before,
+	// newest first. They are deleted once no pod uses them, the most recent
+	// are kept regardless.
+	// +optional
+	PreviousConfigMaps []string `json:"previousConfigMaps,omitempty"`
+	// RenderedKind is the kind of object the ConfigMap was last rendered as,
+	// the previous ones are deleted as that kind
+	// +optional
+	RenderedKind TargetKind `json:"renderedKind,omitempty"`
+	// RenderedFromGeneration is the generation of the CMTemplate the
+	// ConfigMap was last rendered from, with the OnCreate update strategy the
+	// one it is pinned at
+	// +optional
+	RenderedFromGeneration int64 `json:"renderedFromGeneration,omitempty"`
+	// ReloadRequestedAt is when the ConfigMap was rendered anew for a template
+	// reloading its targets, while workloads of the audience are yet to be
+	// restarted
+	// +optional
+	ReloadRequestedAt *metav1.Time `json:"reloadRequestedAt,omitempty"`
+	// LastRenderTime is when the ConfigMap was last rendered and written
+	// +optional
+	LastRenderTime *metav1.Time `json:"lastRenderTime,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Namespaced
+//+kubebuilder:storageversion
+//+kubebuilder:printcolumn:name="Template",type=string,JSONPath=`.spec.templateRef.name`
+//+kubebuilder:printcolumn:name="Audience",type=integer,JSONPath=`.status.audience`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Available")].status`
+//+kubebuilder:printcolumn:name="ConfigMap",type=string,JSONPath=`.status.configMap`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// CMState is the Schema for the cmstates API
+type CMState struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CMStateSpec   `json:"spec,omitempty"`
+	Status CMStateStatus `json:"status,omitempty"`
+}
+
+// AudienceSize returns the number of pods and owners the audience lists by
+// name or id, which is what its size grows with. Pods an entry only counts
+// don't add to it.
+func (in *CMStateSpec) AudienceSize() int {
+	size := 0
+	for _, entry := range in.Audience {
+		if len(entry.Members) > 0 {
+			size += len(entry.Members)
+		} else {
+			size++
+		}
+	}
+	return size
+}
+
+//+kubebuilder:object:root=true
+
+// CMStateList contains a list of CMState
+type CMStateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CMState `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CMState{}, &CMStateList{})
+}
+
+// ReplacementValues returns the values the CMState renders the template
+// with, by key. Its annotations hold them verbatim, CMStates created before
+// that only have them as labels, and those created before the template had
+// a default for a key have neither.
+func (in *CMState) ReplacementValues(tmpl *Template) map[string]string {
+	values := make(map[string]string)
+	value := func(key string) {
+		if v, ok := in.GetAnnotations()[key]; ok {
+			values[key] = v
+		} else if v, ok := in.GetLabels()[key]; ok {
+			values[key] = v
+		} else if v, ok := tmpl.DefaultValue(key); ok {
+			values[key] = v
+		}
+	}
+	for key := range tmpl.Replacements() {
+		value(key)
+	}
+	for key := range tmpl.FieldReplace {
+		value(key)
+	}
+	return values
+}
+
+// nameHashLength is the number of hex characters of the hash appended to
+// sanitized CMState names, and to the names of those with overrides
+const nameHashLength = 8
+
+// illegalNameCharacters matches what is kept out of generated CMState names
+var illegalNameCharacters = regexp.MustCompile(`[^a-z0-9-]`)
+
+// CMStateName returns the name of the CMState for the template. Names with
+// characters other than lowercase alphanumerics and dashes, or that run past
+// the length limit, get those replaced and are truncated, with a hash of the
+// template name appended so templates like my.config and my-config keep apart.
+func CMStateName(cmTemplateName string) string {
+	name := fmt.Sprintf("cmstate-%s", cmTemplateName)
+	if !illegalNameCharacters.MatchString(name) && len(name) <= validation.DNS1123SubdomainMaxLength {
+		return name
+	}
+
+	hash := sha256.Sum256([]byte(cmTemplateName))
+	suffix := hex.EncodeToString(hash[:])[:nameHashLength]
+
+	sanitized := illegalNameCharacters.ReplaceAllString(strings.ToLower(name), "-")
+	if limit := validation.DNS1123SubdomainMaxLength - nameHashLength - 1; len(sanitized) > limit {
+		sanitized = sanitized[:limit]
+	}
+	return strings.TrimRight(sanitized, "-") + "-" + suffix
+}
+
+// LegacyCMStateName returns the name CMStates were created under before names
+// were sanitized, CMStates of templates whose name changed are still found by it
+func LegacyCMStateName(cmTemplateName string) string {
+	return strings.ToLower(strings.ReplaceAll(fmt.Sprintf("cmstate-%s", cmTemplateName), "_", "-"))
+}
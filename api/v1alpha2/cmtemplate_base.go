@@ -0,0 +1,166 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// DefaultMaxBaseTemplateDepth is how many base templates a chain may have
+// unless the operator is configured otherwise
+const DefaultMaxBaseTemplateDepth = 5
+
+const (
+	// ReasonBaseTemplateNotFound is a base template of the chain missing
+	ReasonBaseTemplateNotFound = "BaseTemplateNotFound"
+	// ReasonBaseTemplateCycle is a chain leading back to a template in it
+	ReasonBaseTemplateCycle = "BaseTemplateCycle"
+	// ReasonBaseTemplateTooDeep is a chain longer than allowed
+	ReasonBaseTemplateTooDeep = "BaseTemplateTooDeep"
+)
+
+// BaseTemplateError is a chain of base templates that can't be resolved,
+// its Reason tells why
+// +kubebuilder:object:generate=false
+type BaseTemplateError struct {
+	Reason  string
+	Message string
+}
+
+func (e *BaseTemplateError) Error() string {
+	return e.Message
+}
+
+// TemplateGetter reads a base template by name, a missing one is a NotFound
+// error
+// +kubebuilder:object:generate=false
+type TemplateGetter func(name string) (*CMTemplate, error)
+
+// BaseChain returns the base templates of the template, its own base first.
+// A chain that can't be resolved is returned as far as it got along with a
+// BaseTemplateError, a maxDepth of 0 doesn't limit its length.
+func (in *CMTemplate) BaseChain(maxDepth int, get TemplateGetter) ([]*CMTemplate, error) {
+	var chain []*CMTemplate
+	names := []string{in.Name}
+	seen := map[string]bool{in.Name: true}
+	for base := in.Spec.BaseTemplate; base != ""; {
+		names = append(names, base)
+		if seen[base] {
+			return chain, &BaseTemplateError{Reason: ReasonBaseTemplateCycle,
+				Message: fmt.Sprintf("base templates form a cycle: %s", strings.Join(names, " -> "))}
+		}
+		seen[base] = true
+		if maxDepth > 0 && len(chain) == maxDepth {
+			return chain, &BaseTemplateError{Reason: ReasonBaseTemplateTooDeep,
+				Message: fmt.Sprintf("base templates are nested deeper than %d: %s", maxDepth, strings.Join(names, " -> "))}
+		}
+
+		cmTemplate, err := get(base)
+		if apierrors.IsNotFound(err) {
+			return chain, &BaseTemplateError{Reason: ReasonBaseTemplateNotFound,
+				Message: fmt.Sprintf("base template '%s' not found", base)}
+		}
+		if err != nil {
+			return chain, err
+		}
+		chain = append(chain, cmTemplate)
+		base = cmTemplate.Spec.BaseTemplate
+	}
+	return chain, nil
+}
+
+// ResolveBase merges the data, AnnotationReplace and inject settings of the
+// base templates of the template under its own, the template's keys and
+// settings win over those of its bases and those of a base over the bases
+// further up. Nothing is merged when the chain can't be resolved.
+func (in *CMTemplate) ResolveBase(maxDepth int, get TemplateGetter) error {
+	chain, err := in.BaseChain(maxDepth, get)
+	if err != nil {
+		return err
+	}
+	for _, base := range chain {
+		in.Spec.mergeBase(&base.Spec)
+	}
+	return nil
+}
+
+// mergeBase fills in what the spec inherits from the base and doesn't set
+// itself
+func (in *CMTemplateSpec) mergeBase(base *CMTemplateSpec) {
+	in.Template.Data = mergeMap(base.Template.Data, in.Template.Data)
+	in.Template.BinaryData = mergeMap(base.Template.BinaryData, in.Template.BinaryData)
+	in.Template.AnnotationReplace = mergeReplacements(base.Template.AnnotationReplace, in.Template.AnnotationReplace)
+
+	if base.Inject == nil {
+		return
+	}
+	if in.Inject == nil {
+		in.Inject = base.Inject.DeepCopy()
+		return
+	}
+	inject := in.Inject
+	if len(inject.AnnotationKeys) == 0 {
+		inject.AnnotationKeys = base.Inject.AnnotationKeys
+	}
+	if inject.Volume == nil {
+		inject.Volume = base.Inject.Volume.DeepCopy()
+	}
+	if len(inject.EnvFrom) == 0 {
+		inject.EnvFrom = base.Inject.EnvFrom
+	}
+	if len(inject.InitContainers) == 0 {
+		inject.InitContainers = base.Inject.InitContainers
+	}
+	inject.PodAnnotations = mergeMap(base.Inject.PodAnnotations, inject.PodAnnotations)
+	if len(inject.OverridePodAnnotations) == 0 {
+		inject.OverridePodAnnotations = base.Inject.OverridePodAnnotations
+	}
+}
+
+// mergeMap returns the entries of base overridden by those of the child, nil
+// when neither has any
+func mergeMap[V any](base, child map[string]V) map[string]V {
+	if len(base) == 0 {
+		return child
+	}
+	merged := make(map[string]V, len(base)+len(child))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range child {
+		merged[key] = value
+	}
+	return merged
+}
+
+// mergeReplacements returns the replacements of the child followed by those
+// of base it doesn't list itself
+func mergeReplacements(base, child []KeyedReplacement) []KeyedReplacement {
+	if len(base) == 0 {
+		return child
+	}
+	merged := append(make([]KeyedReplacement, 0, len(base)+len(child)), child...)
+	for _, replacement := range base {
+		if _, ok := FindReplacement(child, replacement.Key); !ok {
+			merged = append(merged, replacement)
+		}
+	}
+	return merged
+}
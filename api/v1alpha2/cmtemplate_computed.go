@@ -0,0 +1,153 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker"
+	"github.com/google/cel-go/ext"
+	"k8s.io/utils/lru"
+)
+
+// ComputedValue is a value computed by a CEL expression from the values the
+// CMState is rendered with, joining them under its key
+type ComputedValue struct {
+	// Key of the value, the GoTemplate engine exposes it as .Computed.<key>
+	Key string `json:"key"`
+	// Expression is a CEL expression evaluating to a string. It can read
+	// annotations, labels and fields, the maps of the values the template
+	// replaces, and podNamespace and podName, e.g.
+	// labels["tier"] == "frontend" ? "role-a" : "role-b".
+	Expression string `json:"expression"`
+	// Placeholder is replaced by the value, required by the Replace engine
+	// +optional
+	Placeholder string `json:"placeholder,omitempty"`
+}
+
+// ComputedCostLimit is the CEL cost an expression of a computed value may
+// take, both as estimated when the template is validated and when evaluated
+const ComputedCostLimit = 1000000
+
+// computedInputSize is the size assumed for the maps and strings computed
+// values read when estimating their cost
+const computedInputSize = 1024
+
+// ComputedInput is what the expressions of computed values are evaluated
+// against
+// +kubebuilder:object:generate=false
+type ComputedInput struct {
+	Annotations map[string]string
+	Labels      map[string]string
+	Fields      map[string]string
+	Namespace   string
+	PodName     string
+}
+
+var (
+	computedEnv     *cel.Env
+	computedEnvErr  error
+	computedEnvOnce sync.Once
+	// compiledComputed caches the programs of the expressions by their
+	// source, every CMState of the template evaluates them
+	compiledComputed = lru.New(compiledCacheSize)
+)
+
+// computedEnvironment returns the CEL environment computed values are
+// compiled in
+func computedEnvironment() (*cel.Env, error) {
+	computedEnvOnce.Do(func() {
+		stringMap := cel.MapType(cel.StringType, cel.StringType)
+		computedEnv, computedEnvErr = cel.NewEnv(
+			cel.Variable("annotations", stringMap),
+			cel.Variable("labels", stringMap),
+			cel.Variable("fields", stringMap),
+			cel.Variable("podNamespace", cel.StringType),
+			cel.Variable("podName", cel.StringType),
+			ext.Strings(),
+		)
+	})
+	return computedEnv, computedEnvErr
+}
+
+// computedCostEstimator bounds the size of the inputs, which CEL can't know
+type computedCostEstimator struct{}
+
+func (computedCostEstimator) EstimateSize(checker.AstNode) *checker.SizeEstimate {
+	return &checker.SizeEstimate{Min: 0, Max: computedInputSize}
+}
+
+func (computedCostEstimator) EstimateCallCost(string, string, *checker.AstNode, []checker.AstNode) *checker.CallEstimate {
+	return nil
+}
+
+// Compile compiles and type checks the expression, failing when it doesn't
+// evaluate to a string or may cost more than ComputedCostLimit
+func (in *ComputedValue) Compile() (cel.Program, error) {
+	if program, ok := compiledComputed.Get(in.Expression); ok {
+		return program.(cel.Program), nil
+	}
+	env, err := computedEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(in.Expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if !cel.StringType.IsAssignableType(ast.OutputType()) {
+		return nil, fmt.Errorf("evaluates to %s rather than a string", ast.OutputType())
+	}
+	cost, err := env.EstimateCost(ast, computedCostEstimator{})
+	if err != nil {
+		return nil, err
+	}
+	if cost.Max > ComputedCostLimit {
+		return nil, fmt.Errorf("estimated cost %d exceeds the limit of %d", cost.Max, ComputedCostLimit)
+	}
+	program, err := env.Program(ast, cel.CostLimit(ComputedCostLimit))
+	if err != nil {
+		return nil, err
+	}
+	compiledComputed.Add(in.Expression, program)
+	return program, nil
+}
+
+// Evaluate evaluates the expression against the input
+func (in *ComputedValue) Evaluate(input *ComputedInput) (string, error) {
+	program, err := in.Compile()
+	if err != nil {
+		return "", err
+	}
+	out, _, err := program.Eval(map[string]interface{}{
+		"annotations":  input.Annotations,
+		"labels":       input.Labels,
+		"fields":       input.Fields,
+		"podNamespace": input.Namespace,
+		"podName":      input.PodName,
+	})
+	if err != nil {
+		return "", err
+	}
+	value, ok := out.Value().(string)
+	if !ok {
+		return "", fmt.Errorf("evaluated to %v rather than a string", out.Value())
+	}
+	return value, nil
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DataFromSource is data maintained outside the template that is added to
+// its template data when rendering, from either a ConfigMap or a Secret
+type DataFromSource struct {
+	// ConfigMapRef adds the data of a ConfigMap
+	// +optional
+	ConfigMapRef *DataRef `json:"configMapRef,omitempty"`
+	// SecretRef adds the data of a Secret. Only templates rendering into a
+	// Secret, or setting allowSecretToConfigMap, may reference one.
+	// +optional
+	SecretRef *DataRef `json:"secretRef,omitempty"`
+}
+
+// DataRef references the data of a ConfigMap or Secret
+type DataRef struct {
+	// Name of the ConfigMap or Secret
+	Name string `json:"name"`
+	// Namespace of the ConfigMap or Secret, the namespace of the CMState when
+	// empty. Other namespaces are only read when the operator runs with
+	// --allow-cross-namespace-data-from, and never by NamespacedCMTemplates.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// Key of the data to add, all of it when empty
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
+// ObjectGetter reads a ConfigMap or Secret referenced by dataFrom, a missing
+// one is a NotFound error
+// +kubebuilder:object:generate=false
+type ObjectGetter func(key types.NamespacedName, obj client.Object) error
+
+// ref returns the reference of the source with the kind it references
+func (in *DataFromSource) ref() (*DataRef, string) {
+	if in.SecretRef != nil {
+		return in.SecretRef, "Secret"
+	}
+	return in.ConfigMapRef, "ConfigMap"
+}
+
+// References reports whether the source references the object of the kind
+// for the CMStates of the namespace, references without a namespace read from
+// the namespace of the CMState
+func (in *DataFromSource) References(kind string, key types.NamespacedName, namespace string) bool {
+	ref, refKind := in.ref()
+	if ref == nil || refKind != kind || ref.Name != key.Name {
+		return false
+	}
+	if ref.Namespace != "" {
+		namespace = ref.Namespace
+	}
+	return namespace == key.Namespace
+}
+
+// ResolveDataFrom adds the data spec.dataFrom references to the template data
+// the CMStates of the namespace are rendered from. The keys of the template
+// win over referenced ones, and later references over earlier ones.
+//
+// References that can't be resolved, because the object or its key is
+// missing or it is in another namespace without allowCrossNamespace, are left
+// out and returned described. So are Secrets the template would copy into a
+// ConfigMap without allowing it. Only failing to read one is an error.
+//
+// Namespaced templates are written by the teams of their namespace, they only
+// read from it and never copy Secrets into ConfigMaps, whatever the operator
+// allows, so they can't use it to read what their team can't.
+func (in *CMTemplate) ResolveDataFrom(namespace string, allowCrossNamespace bool, get ObjectGetter) ([]string, error) {
+	if len(in.Spec.DataFrom) == 0 {
+		return nil, nil
+	}
+	allowSecretToConfigMap := in.Spec.AllowSecretToConfigMap
+	if in.Scope() == TemplateScopeNamespaced {
+		namespace, allowCrossNamespace, allowSecretToConfigMap = in.Namespace, false, false
+	}
+	var missing []string
+	data := make(map[string]string)
+	for i := range in.Spec.DataFrom {
+		ref, kind := in.Spec.DataFrom[i].ref()
+		if ref == nil {
+			continue
+		}
+		key := types.NamespacedName{Namespace: namespace, Name: ref.Name}
+		if ref.Namespace != "" {
+			key.Namespace = ref.Namespace
+		}
+		if key.Namespace != namespace && !allowCrossNamespace {
+			missing = append(missing, fmt.Sprintf("%s %s is in another namespace", kind, key))
+			continue
+		}
+		if kind == "Secret" && in.Spec.TargetKind() != TargetKindSecret && !allowSecretToConfigMap {
+			missing = append(missing, fmt.Sprintf("Secret %s isn't copied into a ConfigMap without allowSecretToConfigMap", key))
+			continue
+		}
+
+		var values map[string]string
+		var err error
+		if kind == "Secret" {
+			values, err = secretData(get, key)
+		} else {
+			values, err = configMapData(get, key)
+		}
+		if apierrors.IsNotFound(err) {
+			missing = append(missing, fmt.Sprintf("%s %s not found", kind, key))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ref.Key == "" {
+			for k, value := range values {
+				data[k] = value
+			}
+			continue
+		}
+		value, ok := values[ref.Key]
+		if !ok {
+			missing = append(missing, fmt.Sprintf("%s %s has no key %s", kind, key, ref.Key))
+			continue
+		}
+		data[ref.Key] = value
+	}
+	for key, value := range in.Spec.Template.Data {
+		data[key] = value
+	}
+	in.Spec.Template.Data = data
+	return missing, nil
+}
+
+func configMapData(get ObjectGetter, key types.NamespacedName) (map[string]string, error) {
+	cm := &corev1.ConfigMap{}
+	if err := get(key, cm); err != nil {
+		return nil, err
+	}
+	return cm.Data, nil
+}
+
+func secretData(get ObjectGetter, key types.NamespacedName) (map[string]string, error) {
+	secret := &corev1.Secret{}
+	if err := get(key, secret); err != nil {
+		return nil, err
+	}
+	data := make(map[string]string, len(secret.Data))
+	for k, value := range secret.Data {
+		data[k] = string(value)
+	}
+	return data, nil
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Default fills in the documented defaults of the fields the template leaves
+// empty, so the stored template is fully specified. Fields that are set are
+// never changed.
+func (in *CMTemplate) Default() {
+	spec := &in.Spec
+	if spec.Template.Engine == "" {
+		spec.Template.Engine = TemplateEngineReplace
+	}
+	if spec.UpdateStrategy == "" {
+		spec.UpdateStrategy = UpdateStrategyAlways
+	}
+	if spec.CleanupPolicy == "" {
+		spec.CleanupPolicy = CleanupPolicyBlock
+	}
+	if spec.AudienceTracking == "" {
+		spec.AudienceTracking = AudienceTrackingPod
+	}
+	if spec.StateScope == "" {
+		spec.StateScope = StateScopeTemplate
+	}
+	if spec.Target == nil {
+		spec.Target = &Target{}
+	}
+	if spec.Target.Kind == "" {
+		spec.Target.Kind = TargetKindConfigMap
+	}
+	if spec.Target.Kind == TargetKindSecret && spec.Target.Type == "" {
+		spec.Target.Type = corev1.SecretTypeOpaque
+	}
+}
+
+// undefaulted returns the template and target without the defaults Default
+// fills in, the content hash of a template doesn't change when it's defaulted
+func (in *CMTemplateSpec) undefaulted() (Template, *Target) {
+	tmpl := in.Template
+	if tmpl.Engine == TemplateEngineReplace {
+		tmpl.Engine = ""
+	}
+	if in.Target == nil {
+		return tmpl, nil
+	}
+	target := *in.Target
+	if target.Kind == TargetKindConfigMap {
+		target.Kind = ""
+	}
+	if target.Kind == TargetKindSecret && target.Type == corev1.SecretTypeOpaque {
+		target.Type = ""
+	}
+	if target == (Target{}) {
+		return tmpl, nil
+	}
+	return tmpl, &target
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ManagedByLabel marks the CMStates and ConfigMaps the operator generates
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	// ManagedByValue is the value of ManagedByLabel
+	ManagedByValue = "cmstate-injector-operator"
+	// TemplateLabel names the CMTemplate a CMState or ConfigMap is generated for
+	TemplateLabel = "cache.spicedelver.me/cmtemplate"
+	// ContentHashLabel holds the content hash of the ConfigMaps of immutable
+	// and hash versioned templates, which they are named after
+	ContentHashLabel = "cache.spicedelver.me/content-hash"
+
+	// PropagatedLabelsAnnotation lists the labels propagated from the
+	// template, so the ones it drops are removed again
+	PropagatedLabelsAnnotation = "cache.spicedelver.me/propagated-labels"
+	// PropagatedAnnotationsAnnotation lists the annotations propagated from
+	// the template
+	PropagatedAnnotationsAnnotation = "cache.spicedelver.me/propagated-annotations"
+)
+
+// Metadata are the labels and annotations added to the objects generated for
+// a template
+type Metadata struct {
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// operatorOwned reports whether the operator sets the key itself, the
+// metadata of the template never overrides it
+func operatorOwned(key string) bool {
+	switch key {
+	case ManagedByLabel, TemplateLabel, ContentHashLabel, PropagatedLabelsAnnotation, PropagatedAnnotationsAnnotation:
+		return true
+	}
+	return false
+}
+
+// ApplyMetadata labels the object as generated for the template and
+// propagates the labels and annotations of spec.metadata to it, reporting
+// whether that changed it. Keys the object has without them having been
+// propagated, like the values a CMState carries, win over the template, and
+// those propagated before that the template dropped are removed.
+func (in *CMTemplate) ApplyMetadata(obj metav1.Object) bool {
+	metadata := in.Spec.Metadata
+	if metadata == nil {
+		metadata = &Metadata{}
+	}
+	labels, annotations := obj.GetLabels(), obj.GetAnnotations()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+
+	changed := labels[ManagedByLabel] != ManagedByValue || labels[TemplateLabel] != in.Name
+	labels[ManagedByLabel], labels[TemplateLabel] = ManagedByValue, in.Name
+	changed = propagate(labels, annotations, PropagatedLabelsAnnotation, metadata.Labels) || changed
+	changed = propagate(annotations, annotations, PropagatedAnnotationsAnnotation, metadata.Annotations) || changed
+
+	obj.SetLabels(labels)
+	if len(annotations) > 0 {
+		obj.SetAnnotations(annotations)
+	}
+	return changed
+}
+
+// propagate sets the wanted keys in current, apart from those it has that
+// weren't propagated before, and removes the ones propagated before that
+// aren't wanted anymore. The propagated keys are recorded in the annotations
+// under the record key.
+func propagate(current, annotations map[string]string, record string, wanted map[string]string) bool {
+	previous := make(map[string]bool)
+	if keys := annotations[record]; keys != "" {
+		for _, key := range strings.Split(keys, ",") {
+			previous[key] = true
+		}
+	}
+
+	changed := false
+	var propagated []string
+	for key, value := range wanted {
+		if _, ok := current[key]; (ok && !previous[key]) || operatorOwned(key) {
+			continue
+		}
+		if current[key] != value {
+			current[key] = value
+			changed = true
+		}
+		propagated = append(propagated, key)
+	}
+	for key := range previous {
+		if _, ok := wanted[key]; !ok {
+			delete(current, key)
+			changed = true
+		}
+	}
+
+	sort.Strings(propagated)
+	keys := strings.Join(propagated, ",")
+	if keys != annotations[record] {
+		if keys == "" {
+			delete(annotations, record)
+		} else {
+			annotations[record] = keys
+		}
+		changed = true
+	}
+	return changed
+}
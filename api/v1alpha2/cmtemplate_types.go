@@ -0,0 +1,1076 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/utils/lru"
+)
+
+// EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
+// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
+
+// Template is the data rendered into the ConfigMap and what is replaced in it
+type Template struct {
+	// AnnotationReplace lists the pod annotations and the placeholders they
+	// replace, pods missing any of them are denied unless it has a default.
+	// The GoTemplate engine doesn't replace the placeholders, it exposes the
+	// annotations as .Annotations instead. Templates with a base template may
+	// leave it to the base.
+	// +listType=map
+	// +listMapKey=key
+	// +kubebuilder:validation:MaxItems=64
+	// +optional
+	AnnotationReplace []KeyedReplacement `json:"annotationReplace,omitempty"`
+	// LabelReplace lists pod labels and the placeholders they replace, the way
+	// AnnotationReplace lists annotations. A key in both is replaced with the
+	// annotation of pods having it and the label otherwise, as described by
+	// its AnnotationReplace entry. The GoTemplate engine exposes the values
+	// as .Labels.
+	// +listType=map
+	// +listMapKey=key
+	// +kubebuilder:validation:MaxItems=64
+	// +optional
+	LabelReplace []KeyedReplacement `json:"labelReplace,omitempty"`
+	// FieldReplace maps replacement keys to the pod fields replacing their
+	// placeholder. The values are read when the pod is admitted, the CMState
+	// carries those of the pod creating it. The GoTemplate engine exposes
+	// them as .Fields.
+	// +kubebuilder:validation:MaxProperties=64
+	// +kubebuilder:validation:XValidation:rule="self.all(k, k.matches('^([a-z0-9]([-a-z0-9]*[a-z0-9])?([.][a-z0-9]([-a-z0-9]*[a-z0-9])?)*/)?[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$'))",message="keys must be qualified names"
+	// +optional
+	FieldReplace map[string]FieldReplacement `json:"fieldReplace,omitempty"`
+	// Data is rendered into the data of the generated ConfigMap, it is the
+	// cmtemplate of v1alpha1
+	// +kubebuilder:validation:MaxProperties=256
+	// +kubebuilder:validation:XValidation:rule="self.all(k, k.matches('^[-._a-zA-Z0-9]+$'))",message="keys must consist of alphanumeric characters, '-', '_' or '.'"
+	Data map[string]string `json:"data"`
+	// BinaryData is copied to the binaryData of the generated ConfigMap as
+	// is, nothing in it is replaced
+	// +optional
+	BinaryData map[string][]byte `json:"binaryData,omitempty"`
+	// Engine renders the data, Replace (the default) replaces the
+	// placeholders, GoTemplate executes every value as a Go text/template
+	// +optional
+	Engine TemplateEngine `json:"engine,omitempty"`
+	// Delimiters replace the {{ and }} action delimiters of the GoTemplate
+	// engine, so data using them itself, like Vault agent templates, doesn't
+	// need escaping
+	// +optional
+	Delimiters *Delimiters `json:"delimiters,omitempty"`
+	// Syntax declares the syntax of data keys, of the template and its
+	// outputs, their rendered value is parsed with. A ConfigMap whose data
+	// fails to parse isn't written, the one rendered before stays.
+	// +optional
+	Syntax map[string]DataSyntax `json:"syntax,omitempty"`
+	// OptionalAnnotations are the keys of AnnotationReplace pods may leave
+	// out, entries setting required take precedence
+	// +kubebuilder:validation:MaxItems=64
+	// +optional
+	OptionalAnnotations []string `json:"optionalAnnotations,omitempty"`
+	// TargetAnnotation is the pod annotation receiving the generated ConfigMap name,
+	// used when inject.annotationKeys is not set
+	// +kubebuilder:validation:Pattern=`^([a-z0-9]([-a-z0-9]*[a-z0-9])?([.][a-z0-9]([-a-z0-9]*[a-z0-9])?)*/)?[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`
+	// +optional
+	TargetAnnotation string `json:"targetAnnotation,omitempty"`
+}
+
+// KeyedReplacement is an annotation of AnnotationReplace, or a label of
+// LabelReplace, and what it replaces
+type KeyedReplacement struct {
+	// Key is the annotation or label
+	// +kubebuilder:validation:MaxLength=317
+	// +kubebuilder:validation:Pattern=`^([a-z0-9]([-a-z0-9]*[a-z0-9])?([.][a-z0-9]([-a-z0-9]*[a-z0-9])?)*/)?[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`
+	Key         string `json:"key"`
+	Replacement `json:",inline"`
+}
+
+// Replacement is what an annotation of AnnotationReplace, or a label of
+// LabelReplace, replaces
+type Replacement struct {
+	// Placeholder is replaced by the value of the annotation or label
+	Placeholder string `json:"placeholder"`
+	// Default is the value of the annotation or label for pods that don't
+	// set it
+	// +optional
+	Default *string `json:"default,omitempty"`
+	// Required denies pods that don't set the annotation or label when true,
+	// and renders it empty for them when false. Unset, it is required unless
+	// OptionalAnnotations lists it.
+	// +optional
+	Required *bool `json:"required,omitempty"`
+	// Pattern is an RE2 regular expression the whole value of the annotation
+	// or label has to match, pods setting it to anything else are denied
+	// +optional
+	Pattern string `json:"pattern,omitempty"`
+	// Type is what the value is parsed as, string (the default), int or
+	// bool. Pod values are normalized to it, so True and 1 render as true.
+	// +optional
+	Type ReplacementType `json:"type,omitempty"`
+	// Enum lists the values allowed, after normalizing them to the type
+	// +kubebuilder:validation:MaxItems=64
+	// +optional
+	Enum []string `json:"enum,omitempty"`
+	// AppliesTo limits the Replace engine to replacing the placeholder in
+	// these data keys, of the template or of its outputs, rather than in
+	// all of them
+	// +kubebuilder:validation:MaxItems=64
+	// +optional
+	AppliesTo []string `json:"appliesTo,omitempty"`
+}
+
+// compiledCacheSize bounds the compiled patterns and computed value programs
+// kept around, the least recently used are dropped once templates changed
+// their sources often enough
+const compiledCacheSize = 1024
+
+// ReplacementType is the type the value of a replacement is parsed as
+// +kubebuilder:validation:Enum=string;int;bool
+type ReplacementType string
+
+const (
+	// ReplacementTypeString keeps the value as it is
+	ReplacementTypeString ReplacementType = "string"
+	// ReplacementTypeInt parses the value as a decimal integer
+	ReplacementTypeInt ReplacementType = "int"
+	// ReplacementTypeBool parses the value the way strconv.ParseBool does
+	ReplacementTypeBool ReplacementType = "bool"
+)
+
+// FieldReplacement is a pod field replacing a placeholder
+type FieldReplacement struct {
+	// FieldPath is the pod field, spec.nodeName is only known for pods
+	// admitted with it set
+	// +kubebuilder:validation:Enum=metadata.name;metadata.namespace;spec.serviceAccountName;spec.nodeName
+	FieldPath string `json:"fieldPath"`
+	// Placeholder is replaced by the value of the field
+	Placeholder string `json:"placeholder"`
+}
+
+// FieldPaths are the pod fields FieldReplace supports
+var FieldPaths = []string{"metadata.name", "metadata.namespace", "spec.serviceAccountName", "spec.nodeName"}
+
+// compiledPatterns caches the compiled patterns of the replacements by their
+// source, templates are validated and matched against on every admission
+var compiledPatterns = lru.New(compiledCacheSize)
+
+// Regexp returns the compiled pattern, matching the whole value
+func (in *Replacement) Regexp() (*regexp.Regexp, error) {
+	if compiled, ok := compiledPatterns.Get(in.Pattern); ok {
+		return compiled.(*regexp.Regexp), nil
+	}
+	compiled, err := regexp.Compile("^(?:" + in.Pattern + ")$")
+	if err != nil {
+		return nil, err
+	}
+	compiledPatterns.Add(in.Pattern, compiled)
+	return compiled, nil
+}
+
+// Matches reports whether the value matches the pattern, a replacement
+// without one matches anything. An invalid pattern matches nothing.
+func (in *Replacement) Matches(value string) bool {
+	if in.Pattern == "" {
+		return true
+	}
+	compiled, err := in.Regexp()
+	return err == nil && compiled.MatchString(value)
+}
+
+// Normalize parses the value as the type of the replacement and returns it
+// formatted the one way the type is rendered, failing values of another type
+// or not listed in the enum
+func (in *Replacement) Normalize(value string) (string, error) {
+	switch in.Type {
+	case ReplacementTypeInt:
+		parsed, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return value, errors.New("must be an int")
+		}
+		value = strconv.FormatInt(parsed, 10)
+	case ReplacementTypeBool:
+		parsed, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return value, errors.New("must be a bool")
+		}
+		value = strconv.FormatBool(parsed)
+	}
+	if len(in.Enum) == 0 {
+		return value, nil
+	}
+	for _, allowed := range in.Enum {
+		if value == allowed {
+			return value, nil
+		}
+	}
+	return value, fmt.Errorf("must be one of '%s'", strings.Join(in.Enum, "', '"))
+}
+
+// Typed returns the normalized value as the Go value of the type of the
+// replacement, int64 or bool, and the value itself for strings or values not
+// parsing as the type
+func (in *Replacement) Typed(value string) interface{} {
+	switch in.Type {
+	case ReplacementTypeInt:
+		if parsed, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil {
+			return parsed
+		}
+	case ReplacementTypeBool:
+		if parsed, err := strconv.ParseBool(strings.TrimSpace(value)); err == nil {
+			return parsed
+		}
+	}
+	return value
+}
+
+// Applies reports whether the placeholder is replaced in the data key
+func (in *Replacement) Applies(dataKey string) bool {
+	if len(in.AppliesTo) == 0 {
+		return true
+	}
+	for _, key := range in.AppliesTo {
+		if key == dataKey {
+			return true
+		}
+	}
+	return false
+}
+
+// TemplateEngine decides how the template data is rendered
+// +kubebuilder:validation:Enum=Replace;GoTemplate
+type TemplateEngine string
+
+const (
+	// TemplateEngineReplace replaces the placeholders of AnnotationReplace
+	TemplateEngineReplace TemplateEngine = "Replace"
+	// TemplateEngineGoTemplate executes the data as Go text/templates with
+	// .Annotations, .Labels, .Params, .Fields, .Namespace, .PodName and
+	// .Computed, a missing key fails it
+	TemplateEngineGoTemplate TemplateEngine = "GoTemplate"
+)
+
+// Delimiters are the action delimiters of the GoTemplate engine
+type Delimiters struct {
+	Left  string `json:"left"`
+	Right string `json:"right"`
+}
+
+// DataSyntax is the syntax a rendered data key is parsed with
+// +kubebuilder:validation:Enum=json;yaml;hcl;none
+type DataSyntax string
+
+const (
+	DataSyntaxJSON DataSyntax = "json"
+	DataSyntaxYAML DataSyntax = "yaml"
+	// DataSyntaxHCL checks the structure of HCL, its strings, comments,
+	// heredocs and brackets, not what its blocks and attributes mean
+	DataSyntaxHCL DataSyntax = "hcl"
+	// DataSyntaxNone doesn't parse the value, as do keys without a syntax
+	DataSyntaxNone DataSyntax = "none"
+)
+
+// Inject defines how the generated ConfigMap is injected into pods
+type Inject struct {
+	// AnnotationKeys are the pod annotations receiving the generated ConfigMap name
+	// +optional
+	AnnotationKeys []string `json:"annotationKeys,omitempty"`
+	// Volume mounts the generated ConfigMap into the pod
+	// +optional
+	Volume *InjectVolume `json:"volume,omitempty"`
+	// EnvFrom names the containers getting an envFrom reference to the
+	// generated ConfigMap, "*" selects all containers
+	// +optional
+	EnvFrom []string `json:"envFrom,omitempty"`
+	// ContainerSelector narrows the containers receiving the volume mount
+	// and envFrom down further, so sidecars of others are left alone
+	// +optional
+	ContainerSelector *ContainerSelector `json:"containerSelector,omitempty"`
+	// InitContainers are appended to the init containers of the pod, unless it
+	// has one of the same name. The ConfigMapName template variable in any of
+	// their fields is replaced by the generated ConfigMap name.
+	// +optional
+	InitContainers []corev1.Container `json:"initContainers,omitempty"`
+	// PodAnnotations are added to the pod, leaving values already set on the
+	// pod alone. The ConfigMapName template variable in a value is replaced by
+	// the generated ConfigMap name.
+	// +optional
+	PodAnnotations map[string]string `json:"podAnnotations,omitempty"`
+	// OverridePodAnnotations are the keys of PodAnnotations replacing the value
+	// already set on the pod
+	// +optional
+	OverridePodAnnotations []string `json:"overridePodAnnotations,omitempty"`
+}
+
+// InjectVolume defines the ConfigMap volume added to pods
+type InjectVolume struct {
+	// Name of the pod volume, defaults to the generated ConfigMap name
+	// +optional
+	Name string `json:"name,omitempty"`
+	// MountPath is the absolute path the ConfigMap is mounted at
+	MountPath string `json:"mountPath"`
+	// Containers receiving the volumeMount, all containers when empty
+	// +optional
+	Containers []string `json:"containers,omitempty"`
+	// ReadOnly mounts the volume read-only
+	// +optional
+	ReadOnly bool `json:"readOnly,omitempty"`
+}
+
+// ContainerSelector selects the containers of a pod by name
+type ContainerSelector struct {
+	// Names are the containers selected, "*" or none selects all of them
+	// +kubebuilder:validation:MaxItems=64
+	// +optional
+	Names []string `json:"names,omitempty"`
+	// Exclude are the containers never selected, even when Names does
+	// +kubebuilder:validation:MaxItems=64
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Selects reports whether the container is selected, a nil selector selects
+// every container
+func (in *ContainerSelector) Selects(name string) bool {
+	if in == nil {
+		return true
+	}
+	for _, excluded := range in.Exclude {
+		if excluded == name {
+			return false
+		}
+	}
+	if len(in.Names) == 0 {
+		return true
+	}
+	for _, selected := range in.Names {
+		if selected == name || selected == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// AudienceTracking decides what the audience of a CMState is made of
+// +kubebuilder:validation:Enum=Owner;Pod
+type AudienceTracking string
+
+const (
+	// AudienceTrackingPod records every pod in the audience
+	AudienceTrackingPod AudienceTracking = "Pod"
+	// AudienceTrackingOwner records the workload owning the pods once, with a
+	// count of its pods. Pods without an owner are recorded themselves.
+	AudienceTrackingOwner AudienceTracking = "Owner"
+)
+
+// StateScope decides which pods of a template share a CMState, and with it a
+// rendered ConfigMap
+// +kubebuilder:validation:Enum=Template;Owner;Pod
+type StateScope string
+
+const (
+	// StateScopeTemplate shares one CMState between all pods of the template
+	// in a namespace
+	StateScopeTemplate StateScope = "Template"
+	// StateScopeOwner renders a CMState per owning workload, the pods of a
+	// Deployment share one. Pods without an owner get one of their own.
+	StateScopeOwner StateScope = "Owner"
+	// StateScopePod renders a CMState per pod, deleted along with the pod
+	StateScopePod StateScope = "Pod"
+)
+
+// Versioning decides how a change of the template reaches the ConfigMaps it
+// rendered
+// +kubebuilder:validation:Enum=inPlace;hashSuffix
+type Versioning string
+
+const (
+	// VersioningInPlace updates the ConfigMap under the pods using it
+	VersioningInPlace Versioning = "inPlace"
+	// VersioningHashSuffix renders a new ConfigMap named after the hash of
+	// its content, new pods get it while running pods keep the previous one
+	VersioningHashSuffix Versioning = "hashSuffix"
+)
+
+// UpdateStrategy decides whether a change of the template renders the
+// ConfigMaps of its CMStates anew
+// +kubebuilder:validation:Enum=OnCreate;Always
+type UpdateStrategy string
+
+const (
+	// UpdateStrategyAlways renders the ConfigMaps anew whenever the template
+	// changes
+	UpdateStrategyAlways UpdateStrategy = "Always"
+	// UpdateStrategyOnCreate renders the ConfigMap of a CMState once, when
+	// it is created, and ignores later changes of the template
+	UpdateStrategyOnCreate UpdateStrategy = "OnCreate"
+)
+
+// CleanupPolicy decides what deleting a template does to the CMStates still
+// rendered from it
+// +kubebuilder:validation:Enum=Block;Cascade
+type CleanupPolicy string
+
+const (
+	// CleanupPolicyBlock keeps the template until its CMStates are gone
+	CleanupPolicyBlock CleanupPolicy = "Block"
+	// CleanupPolicyCascade deletes the CMStates, and with them their
+	// ConfigMaps, before the template
+	CleanupPolicyCascade CleanupPolicy = "Cascade"
+)
+
+// CMTemplateSpec defines the desired state of CMTemplate
+type CMTemplateSpec struct {
+	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
+	// Important: Run "make" to regenerate code after modifying this file
+
+	Template Template `json:"template,omitempty"`
+	// +optional
+	Inject *Inject `json:"inject,omitempty"`
+	// BaseTemplate names a CMTemplate whose data, annotationReplace and
+	// inject settings this one inherits, its own keys and settings win. The
+	// base may have a base of its own.
+	// +optional
+	BaseTemplate string `json:"baseTemplate,omitempty"`
+	// PodSelector selects the pods to inject without a cmtemplate annotation,
+	// the annotation takes precedence
+	// +optional
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+	// AudienceTracking records pods in the audience per Pod (the default) or
+	// per owning workload
+	// +optional
+	AudienceTracking AudienceTracking `json:"audienceTracking,omitempty"`
+	// StateScope is Template (the default) to share a CMState between all
+	// pods of the template in a namespace, Owner to render one per owning
+	// workload or Pod to render one per pod. The CMState is named after the
+	// owner or the pod.
+	// +optional
+	StateScope StateScope `json:"stateScope,omitempty"`
+	// Disabled stops the template from being injected into new pods, the pods
+	// and CMStates using it already keep working
+	// +optional
+	Disabled bool `json:"disabled,omitempty"`
+	// AllowedServiceAccounts are the service accounts pods have to run as to
+	// get the template, as namespace/name where both parts may be glob
+	// patterns like team-*/vault-*. Pods running as any service account get it
+	// when empty.
+	// +optional
+	AllowedServiceAccounts []string `json:"allowedServiceAccounts,omitempty"`
+	// TargetNamespaces are the namespaces pods have to be in to get the
+	// template, and CMStates to be in to be rendered. Pods in any namespace
+	// get it when empty.
+	// +optional
+	TargetNamespaces *TargetNamespaces `json:"targetNamespaces,omitempty"`
+	// Computed are values computed by CEL expressions from the values the
+	// CMState is rendered with, replaced like them. An expression failing to
+	// evaluate fails the rendering of the CMState.
+	// +listType=map
+	// +listMapKey=key
+	// +optional
+	Computed []ComputedValue `json:"computed,omitempty"`
+	// Outputs are further ConfigMaps rendered for every CMState of the
+	// template, besides the one of template.data. They share its
+	// replacements, engine and audience.
+	// +optional
+	Outputs []Output `json:"outputs,omitempty"`
+	// Target is the kind of object the template and its outputs render
+	// into, a ConfigMap unless set
+	// +optional
+	Target *Target `json:"target,omitempty"`
+	// Immutable renders into immutable ConfigMaps named after the hash of
+	// what they are rendered from, a change renders a new one new pods are
+	// injected with. The ones no pod uses anymore are deleted.
+	// +optional
+	Immutable bool `json:"immutable,omitempty"`
+	// Versioning is inPlace to update the ConfigMap when the template
+	// changes, or hashSuffix to render a new ConfigMap suffixed with the hash
+	// of its content instead. The previous one is kept until no pod of the
+	// audience uses it anymore. Unset, immutable templates are versioned by
+	// hashSuffix and the others in place.
+	// +optional
+	Versioning Versioning `json:"versioning,omitempty"`
+	// UpdateStrategy is Always (the default) to render the ConfigMaps of the
+	// CMStates anew when the template changes, or OnCreate to keep them as
+	// they were rendered when the CMState was created
+	// +optional
+	UpdateStrategy UpdateStrategy `json:"updateStrategy,omitempty"`
+	// ReloadTargets restarts the Deployments and StatefulSets of the audience
+	// once their ConfigMap was rendered anew, for consumers that only read it
+	// at startup. The same workload is restarted at most once per the
+	// operator's --reload-interval.
+	// +optional
+	ReloadTargets bool `json:"reloadTargets,omitempty"`
+	// TTLSecondsAfterEmpty is how long a CMState of the template is kept once
+	// its audience is empty before it is deleted along with its ConfigMap,
+	// instead of the operator's --empty-audience-grace-period. A pod joining
+	// in the meantime keeps it.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	TTLSecondsAfterEmpty *int32 `json:"ttlSecondsAfterEmpty,omitempty"`
+	// CleanupPolicy is Block (the default) to keep a deleted template until
+	// no CMState is rendered from it anymore, or Cascade to delete its
+	// CMStates and their ConfigMaps first
+	// +optional
+	CleanupPolicy CleanupPolicy `json:"cleanupPolicy,omitempty"`
+	// MaxRenderedBytes is the most data and binary data a ConfigMap of the
+	// template may hold once rendered, below the 1MiB a ConfigMap can hold.
+	// A CMState rendering more keeps its previous ConfigMap.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=1048576
+	// +optional
+	MaxRenderedBytes *int32 `json:"maxRenderedBytes,omitempty"`
+	// ConfigMapName is the name of the generated ConfigMap, instead of the
+	// cmstate-<template> the CMState is named. Pods overriding values get the
+	// hash of their overrides appended to it.
+	// +kubebuilder:validation:MaxLength=244
+	// +optional
+	ConfigMapName string `json:"configMapName,omitempty"`
+	// ConfigMapNamePrefix replaces the cmstate- prefix of the generated
+	// ConfigMap name
+	// +kubebuilder:validation:MaxLength=63
+	// +optional
+	ConfigMapNamePrefix string `json:"configMapNamePrefix,omitempty"`
+	// Metadata are labels and annotations added to the CMStates and
+	// ConfigMaps generated for the template, the ones the operator sets
+	// itself win over them
+	// +optional
+	Metadata *Metadata `json:"metadata,omitempty"`
+	// DataFrom adds data maintained elsewhere to template.data when
+	// rendering, so it doesn't have to be copied into the template. A change
+	// to it renders the ConfigMaps anew.
+	// +optional
+	DataFrom []DataFromSource `json:"dataFrom,omitempty"`
+	// AllowSecretToConfigMap lets the data of the Secrets dataFrom references
+	// be rendered into a ConfigMap, readable by anyone reading ConfigMaps.
+	// Without it templates referencing Secrets have to render into Secrets.
+	// Only CMTemplates can set it.
+	// +optional
+	AllowSecretToConfigMap bool `json:"allowSecretToConfigMap,omitempty"`
+	// Aliases are other names pods can ask for the template under, so it can
+	// be renamed without changing every pod. They are unique across the
+	// names and aliases of all CMTemplates, CMStates are named after the
+	// name itself.
+	// +kubebuilder:validation:MaxItems=16
+	// +optional
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// TargetNamespaces are namespaces listed by name, selected by their labels,
+// or both. A namespace either lists or selects is a target.
+type TargetNamespaces struct {
+	// Names of the namespaces
+	// +optional
+	Names []string `json:"names,omitempty"`
+	// Selector selects the namespaces by their labels
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// TargetKind is the kind of object a template renders into
+// +kubebuilder:validation:Enum=ConfigMap;Secret
+type TargetKind string
+
+const (
+	// TargetKindConfigMap renders into a ConfigMap
+	TargetKindConfigMap TargetKind = "ConfigMap"
+	// TargetKindSecret renders into a Secret, for values too sensitive for a
+	// ConfigMap
+	TargetKindSecret TargetKind = "Secret"
+)
+
+// DefaultSecretTargetAnnotation receives the name of the generated Secret
+// when the template sets neither targetAnnotation nor inject.annotationKeys
+const DefaultSecretTargetAnnotation = "vault.hashicorp.com/agent-extra-secret"
+
+// Target is the object the template renders into
+type Target struct {
+	// Kind of the object, ConfigMap (the default) or Secret
+	// +optional
+	Kind TargetKind `json:"kind,omitempty"`
+	// Type of the Secret, Opaque unless set. Only used with kind Secret.
+	// +optional
+	Type corev1.SecretType `json:"type,omitempty"`
+}
+
+// Output is a further ConfigMap rendered from the template
+type Output struct {
+	// Name of the output, its ConfigMap is named after the CMState with the
+	// name appended
+	// +kubebuilder:validation:MaxLength=63
+	Name string `json:"name"`
+	// CMTemplate is the data of the ConfigMap, rendered like
+	// template.data
+	CMTemplate map[string]string `json:"cmtemplate"`
+	// BinaryData is copied to the binaryData of the ConfigMap as is
+	// +optional
+	BinaryData map[string][]byte `json:"binaryData,omitempty"`
+	// TargetAnnotation is the pod annotation receiving the ConfigMap name
+	TargetAnnotation string `json:"targetAnnotation"`
+}
+
+// OutputName is the name of the ConfigMap of the output for the ConfigMap
+// of the CMState
+func OutputName(configMapName, output string) string {
+	return configMapName + "-" + output
+}
+
+// ConfigMapName is the name of the ConfigMap rendered for the CMState of the
+// template. Changing it renders the ConfigMap anew under the new name, the
+// one pods were injected with before is kept until none of them uses it.
+func (in *CMTemplate) ConfigMapName(cmStateName string) string {
+	switch {
+	case in.Spec.ConfigMapName != "":
+		base := in.CMStateName("", "")
+		if cmStateName == base || cmStateName == LegacyCMStateName(in.Name) {
+			return in.Spec.ConfigMapName
+		}
+		// CMStates of an owner or pod, or of pods overriding values, are the
+		// template's followed by a qualifier
+		if qualifier := strings.TrimPrefix(cmStateName, base+"-"); qualifier != cmStateName {
+			return truncateName(in.Spec.ConfigMapName + "-" + qualifier)
+		}
+		// hashed names end in the hash of the qualified name
+		return in.Spec.ConfigMapName + "-" + cmStateName[len(cmStateName)-nameHashLength:]
+	case in.Spec.ConfigMapNamePrefix != "":
+		return truncateName(in.Spec.ConfigMapNamePrefix + strings.TrimPrefix(cmStateName, "cmstate-"))
+	}
+	return cmStateName
+}
+
+// truncateName cuts the name down to the length of an object name
+func truncateName(name string) string {
+	if len(name) > validation.DNS1123SubdomainMaxLength {
+		name = strings.TrimRight(name[:validation.DNS1123SubdomainMaxLength], "-.")
+	}
+	return name
+}
+
+// contentHashLength is the length of the hash immutable and hash versioned
+// ConfigMaps are suffixed with
+const contentHashLength = 10
+
+// TemplateHash hashes everything the template renders from, the data,
+// binary data, outputs, target and computed values, canonically: encoding as
+// JSON sorts the map keys, the data is hashed with LF line endings and
+// defaults filled in don't change it. Every hash of the template's content
+// derives from it.
+func (in *CMTemplateSpec) TemplateHash() string {
+	tmpl, target := in.undefaulted()
+	tmpl.Data = normalizedNewlines(tmpl.Data)
+	outputs := make([]Output, len(in.Outputs))
+	for i, output := range in.Outputs {
+		outputs[i] = output
+		outputs[i].CMTemplate = normalizedNewlines(output.CMTemplate)
+	}
+	hashed := []interface{}{newHashedTemplate(&tmpl), outputs, target}
+	if len(in.Computed) > 0 {
+		hashed = append(hashed, in.Computed)
+	}
+	raw, _ := json.Marshal(hashed)
+	hash := sha256.Sum256(raw)
+	return hex.EncodeToString(hash[:])
+}
+
+// normalizedNewlines returns the data with CRLF line endings replaced by LF
+func normalizedNewlines(data map[string]string) map[string]string {
+	if data == nil {
+		return nil
+	}
+	normalized := make(map[string]string, len(data))
+	for key, value := range data {
+		normalized[key] = strings.ReplaceAll(value, "\r\n", "\n")
+	}
+	return normalized
+}
+
+// hashedTemplate is the template the way v1alpha1 wrote it, so the hashes
+// of templates stored before v1alpha2 don't change with the storage version
+// +kubebuilder:object:generate=false
+type hashedTemplate struct {
+	AnnotationReplace   map[string]hashedReplacement `json:"annotationreplace"`
+	LabelReplace        map[string]hashedReplacement `json:"labelReplace,omitempty"`
+	FieldReplace        map[string]FieldReplacement  `json:"fieldReplace,omitempty"`
+	CMTemplate          map[string]string            `json:"cmtemplate"`
+	BinaryData          map[string][]byte            `json:"binaryData,omitempty"`
+	Engine              TemplateEngine               `json:"engine,omitempty"`
+	Delimiters          *Delimiters                  `json:"delimiters,omitempty"`
+	Syntax              map[string]DataSyntax        `json:"syntax,omitempty"`
+	OptionalAnnotations []string                     `json:"optionalAnnotations,omitempty"`
+	TargetAnnotation    string                       `json:"targetAnnotation,omitempty"`
+}
+
+// hashedReplacement is a replacement the way v1alpha1 wrote it, the
+// placeholder alone when it sets nothing else
+type hashedReplacement Replacement
+
+func (in hashedReplacement) MarshalJSON() ([]byte, error) {
+	if in.Default == nil && in.Required == nil && in.Pattern == "" && in.Type == "" && in.Enum == nil && in.AppliesTo == nil {
+		return json.Marshal(in.Placeholder)
+	}
+	return json.Marshal(Replacement(in))
+}
+
+func newHashedTemplate(tmpl *Template) hashedTemplate {
+	hashedReplacements := func(replacements []KeyedReplacement) map[string]hashedReplacement {
+		if replacements == nil {
+			return nil
+		}
+		hashed := make(map[string]hashedReplacement, len(replacements))
+		for _, replacement := range replacements {
+			hashed[replacement.Key] = hashedReplacement(replacement.Replacement)
+		}
+		return hashed
+	}
+	return hashedTemplate{
+		AnnotationReplace:   hashedReplacements(tmpl.AnnotationReplace),
+		LabelReplace:        hashedReplacements(tmpl.LabelReplace),
+		FieldReplace:        tmpl.FieldReplace,
+		CMTemplate:          tmpl.Data,
+		BinaryData:          tmpl.BinaryData,
+		Engine:              tmpl.Engine,
+		Delimiters:          tmpl.Delimiters,
+		Syntax:              tmpl.Syntax,
+		OptionalAnnotations: tmpl.OptionalAnnotations,
+		TargetAnnotation:    tmpl.TargetAnnotation,
+	}
+}
+
+// ContentHash hashes the TemplateHash of the template with the values of the
+// CMState. It is the same whether computed by the webhook or the controller,
+// the values are encoded as JSON, which sorts map keys.
+func (in *CMTemplateSpec) ContentHash(values map[string]string) string {
+	raw, _ := json.Marshal([]interface{}{in.TemplateHash(), values})
+	hash := sha256.Sum256(raw)
+	return hex.EncodeToString(hash[:])[:contentHashLength]
+}
+
+// ImmutableName is the name of the immutable or hash versioned ConfigMap of
+// the CMState for the content hash, the CMState name is cut short to fit it
+func ImmutableName(cmStateName, hash string) string {
+	if limit := validation.DNS1123SubdomainMaxLength - len(hash) - 1; len(cmStateName) > limit {
+		cmStateName = strings.TrimRight(cmStateName[:limit], "-.")
+	}
+	return cmStateName + "-" + hash
+}
+
+// Output returns the template rendering the data of the output
+func (in *Template) Output(output *Output) *Template {
+	tmpl := in.DeepCopy()
+	tmpl.Data = output.CMTemplate
+	tmpl.BinaryData = output.BinaryData
+	return tmpl
+}
+
+// TargetAnnotations returns the pod annotations the generated ConfigMap name is
+// written to, inject.annotationKeys takes precedence over template.targetAnnotation.
+// Templates rendering into a Secret fall back to DefaultSecretTargetAnnotation.
+func (in *CMTemplateSpec) TargetAnnotations() []string {
+	if in.Inject != nil && len(in.Inject.AnnotationKeys) > 0 {
+		return in.Inject.AnnotationKeys
+	}
+	if in.Template.TargetAnnotation != "" {
+		return []string{in.Template.TargetAnnotation}
+	}
+	if in.TargetKind() == TargetKindSecret {
+		return []string{DefaultSecretTargetAnnotation}
+	}
+	return nil
+}
+
+// DataKeys returns the keys of the data the template and its outputs render
+func (in *CMTemplateSpec) DataKeys() map[string]bool {
+	keys := make(map[string]bool, len(in.Template.Data))
+	for key := range in.Template.Data {
+		keys[key] = true
+	}
+	for _, output := range in.Outputs {
+		for key := range output.CMTemplate {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// MaxRenderedSize returns the most data and binary data a rendered ConfigMap
+// of the template may hold
+func (in *CMTemplateSpec) MaxRenderedSize() int {
+	if in.MaxRenderedBytes != nil && int(*in.MaxRenderedBytes) < MaxConfigMapSize {
+		return int(*in.MaxRenderedBytes)
+	}
+	return MaxConfigMapSize
+}
+
+// RenderedSize returns the size of the data and binary data of the
+// ConfigMap, counted the way templates are validated, by key and value
+func RenderedSize(cm *corev1.ConfigMap) int {
+	size := 0
+	for key, data := range cm.Data {
+		size += len(key) + len(data)
+	}
+	for key, data := range cm.BinaryData {
+		size += len(key) + len(data)
+	}
+	return size
+}
+
+// HashVersioned reports whether the template renders into ConfigMaps named
+// after the hash of their content, as immutable templates do
+func (in *CMTemplateSpec) HashVersioned() bool {
+	return in.Immutable || in.Versioning == VersioningHashSuffix
+}
+
+// TargetKind returns the kind of object the template renders into
+func (in *CMTemplateSpec) TargetKind() TargetKind {
+	if in.Target == nil || in.Target.Kind == "" {
+		return TargetKindConfigMap
+	}
+	return in.Target.Kind
+}
+
+// SecretType returns the type of the Secrets the template renders into
+func (in *CMTemplateSpec) SecretType() corev1.SecretType {
+	if in.Target == nil || in.Target.Type == "" {
+		return corev1.SecretTypeOpaque
+	}
+	return in.Target.Type
+}
+
+// ServiceAccountAllowed reports whether pods running as the service account may
+// get the template. Malformed entries never match, Validate reports them.
+func (in *CMTemplateSpec) ServiceAccountAllowed(namespace, name string) bool {
+	if len(in.AllowedServiceAccounts) == 0 {
+		return true
+	}
+	for _, allowed := range in.AllowedServiceAccounts {
+		namespacePattern, namePattern, ok := strings.Cut(allowed, "/")
+		if !ok {
+			continue
+		}
+		namespaceMatch, _ := path.Match(namespacePattern, namespace)
+		nameMatch, _ := path.Match(namePattern, name)
+		if namespaceMatch && nameMatch {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectsNamespaces reports whether the template selects its target
+// namespaces by label, so the labels of the namespace are needed to tell
+func (in *CMTemplateSpec) SelectsNamespaces() bool {
+	return in.TargetNamespaces != nil && in.TargetNamespaces.Selector != nil
+}
+
+// NamespaceAllowed reports whether the namespace with the labels is one the
+// template may be used in. A malformed selector never matches, Validate
+// reports it.
+func (in *CMTemplateSpec) NamespaceAllowed(namespace string, namespaceLabels map[string]string) bool {
+	if in.TargetNamespaces == nil || len(in.TargetNamespaces.Names) == 0 && in.TargetNamespaces.Selector == nil {
+		return true
+	}
+	for _, name := range in.TargetNamespaces.Names {
+		if name == namespace {
+			return true
+		}
+	}
+	if in.TargetNamespaces.Selector == nil {
+		return false
+	}
+	selector, err := metav1.LabelSelectorAsSelector(in.TargetNamespaces.Selector)
+	return err == nil && selector.Matches(labels.Set(namespaceLabels))
+}
+
+// GoTemplate reports whether the data is rendered by the GoTemplate engine
+func (in *Template) GoTemplate() bool {
+	return in.Engine == TemplateEngineGoTemplate
+}
+
+// Parse parses the data as Go text/templates with the delimiters of the
+// template, failing on a missing key when executed. Only the functions of
+// TemplateFuncNames can be called.
+func (in *Template) Parse(key string) (*template.Template, error) {
+	parsed := template.New(key).Option("missingkey=error").Funcs(templateFuncs)
+	if in.Delimiters != nil {
+		parsed = parsed.Delims(in.Delimiters.Left, in.Delimiters.Right)
+	}
+	return parsed.Parse(in.Data[key])
+}
+
+// Replacements merges the entries of LabelReplace and AnnotationReplace by
+// key, the AnnotationReplace entry of a key in both wins
+func (in *Template) Replacements() map[string]Replacement {
+	replacements := make(map[string]Replacement, len(in.AnnotationReplace)+len(in.LabelReplace))
+	for _, replacement := range in.LabelReplace {
+		replacements[replacement.Key] = replacement.Replacement
+	}
+	for _, replacement := range in.AnnotationReplace {
+		replacements[replacement.Key] = replacement.Replacement
+	}
+	return replacements
+}
+
+// Replacement returns the entry of the key, the AnnotationReplace entry of a
+// key in both
+func (in *Template) Replacement(key string) (Replacement, bool) {
+	if replacement, ok := FindReplacement(in.AnnotationReplace, key); ok {
+		return replacement, true
+	}
+	return FindReplacement(in.LabelReplace, key)
+}
+
+// FindReplacement returns the entry of the key in the replacements
+func FindReplacement(replacements []KeyedReplacement, key string) (Replacement, bool) {
+	for _, replacement := range replacements {
+		if replacement.Key == key {
+			return replacement.Replacement, true
+		}
+	}
+	return Replacement{}, false
+}
+
+// SetReplacement sets the entry of the key in the replacements, appending it
+// when they don't have one yet
+func SetReplacement(replacements *[]KeyedReplacement, key string, replacement Replacement) {
+	for i := range *replacements {
+		if (*replacements)[i].Key == key {
+			(*replacements)[i].Replacement = replacement
+			return
+		}
+	}
+	*replacements = append(*replacements, KeyedReplacement{Key: key, Replacement: replacement})
+}
+
+// DefaultValue returns the default of the annotation or label, if it has one
+func (in *Template) DefaultValue(key string) (string, bool) {
+	replacement, ok := in.Replacement(key)
+	if !ok || replacement.Default == nil {
+		return "", false
+	}
+	// validation keeps defaults not normalizing out
+	value, _ := replacement.Normalize(*replacement.Default)
+	return value, true
+}
+
+// Optional reports whether pods may leave out the annotation or label, its
+// required field takes precedence over OptionalAnnotations
+func (in *Template) Optional(key string) bool {
+	if replacement, ok := in.Replacement(key); ok && replacement.Required != nil {
+		return !*replacement.Required
+	}
+	for _, optional := range in.OptionalAnnotations {
+		if optional == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Render returns the ConfigMap data of the template, with every placeholder
+// replaced by the value of the pod annotation, label or field it stands for
+func (in *Template) Render(value func(annotation string) string) map[string]string {
+	data := make(map[string]string, len(in.Data))
+	for dataKey, template := range in.Data {
+		for key, replacement := range in.Replacements() {
+			if replacement.Applies(dataKey) {
+				template = strings.ReplaceAll(template, replacement.Placeholder, value(key))
+			}
+		}
+		for key, replacement := range in.FieldReplace {
+			template = strings.ReplaceAll(template, replacement.Placeholder, value(key))
+		}
+		data[dataKey] = template
+	}
+	return data
+}
+
+// CMTemplateStatus defines the observed state of CMTemplate
+type CMTemplateStatus struct {
+	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
+	// Important: Run "make" to regenerate code after modifying this file
+
+	// Conditions tell whether the template is valid, the Valid condition
+	// holds what is wrong with it otherwise. InUse tells whether any CMState
+	// is rendered from it, RenderErrors which of them fail to render.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+	// TargetKind is the kind of object the template renders into
+	// +optional
+	TargetKind TargetKind `json:"targetKind,omitempty"`
+	// CMStates is the number of CMStates rendered from the template
+	// +optional
+	CMStates int32 `json:"cmStates"`
+	// Audience is the number of pods and owners in the audiences of its
+	// CMStates
+	// +optional
+	Audience int32 `json:"audience"`
+	// LastRenderTime is when a ConfigMap of the template was last rendered
+	// +optional
+	LastRenderTime *metav1.Time `json:"lastRenderTime,omitempty"`
+	// ContentHash is the TemplateHash of what the template renders from,
+	// with what it inherits from its base templates. The config checksum of
+	// injected pods and the hash of hash versioned ConfigMaps derive from it.
+	// +optional
+	ContentHash string `json:"contentHash,omitempty"`
+	// LastChangedTime is when the content hash last changed
+	// +optional
+	LastChangedTime *metav1.Time `json:"lastChangedTime,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:storageversion
+//+kubebuilder:printcolumn:name="Target-Kind",type=string,JSONPath=`.status.targetKind`
+//+kubebuilder:printcolumn:name="States",type=integer,JSONPath=`.status.cmStates`
+//+kubebuilder:printcolumn:name="Audience",type=integer,JSONPath=`.status.audience`
+//+kubebuilder:printcolumn:name="Valid",type=string,JSONPath=`.status.conditions[?(@.type=="Valid")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// CMTemplate is the Schema for the cmtemplates API
+type CMTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CMTemplateSpec   `json:"spec,omitempty"`
+	Status CMTemplateStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// CMTemplateList contains a list of CMTemplate
+type CMTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CMTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CMTemplate{}, &CMTemplateList{})
+}
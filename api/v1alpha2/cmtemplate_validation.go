@@ -0,0 +1,525 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Validate checks the parts of the CMTemplate the CRD schema can't express.
+func (in *CMTemplate) Validate() field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if len(in.Spec.TargetAnnotations()) == 0 {
+		allErrs = append(allErrs, field.Required(specPath.Child("template", "targetAnnotation"),
+			"either template.targetAnnotation or inject.annotationKeys must be set"))
+	}
+	if in.Spec.Template.TargetAnnotation != "" {
+		allErrs = append(allErrs, validateAnnotationKey(in.Spec.Template.TargetAnnotation, specPath.Child("template", "targetAnnotation"))...)
+	}
+	allErrs = append(allErrs, validateConfigMapName(&in.Spec, specPath)...)
+	if in.Spec.Metadata != nil {
+		allErrs = append(allErrs, validateMetadata(in.Spec.Metadata, specPath.Child("metadata"))...)
+	}
+	if in.Spec.AllowSecretToConfigMap && in.Scope() == TemplateScopeNamespaced {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("allowSecretToConfigMap"), "only CMTemplates can copy Secrets into ConfigMaps"))
+	}
+	allErrs = append(allErrs, validateAliases(in, specPath.Child("aliases"))...)
+	if in.Spec.BaseTemplate != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(in.Spec.BaseTemplate) {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("baseTemplate"), in.Spec.BaseTemplate, msg))
+		}
+	}
+	if in.Spec.Immutable && in.Spec.Versioning == VersioningInPlace {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("versioning"), in.Spec.Versioning, "immutable templates can't be updated in place"))
+	}
+	if in.Spec.Target != nil && in.Spec.Target.Type != "" && in.Spec.TargetKind() != TargetKindSecret {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("target", "type"), in.Spec.Target.Type, "only Secrets have a type"))
+	}
+	for i, key := range in.Spec.Template.OptionalAnnotations {
+		replacement, ok := FindReplacement(in.Spec.Template.AnnotationReplace, key)
+		if !ok {
+			allErrs = append(allErrs, field.NotFound(specPath.Child("template", "optionalAnnotations").Index(i), key))
+		} else if replacement.Required != nil && *replacement.Required {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("template", "optionalAnnotations").Index(i), key, "the annotation is required"))
+		}
+	}
+	dataKeys := in.Spec.DataKeys()
+	allErrs = append(allErrs, validateReplacements(in.Spec.Template.AnnotationReplace, dataKeys, specPath.Child("template", "annotationReplace"))...)
+	allErrs = append(allErrs, validateReplacements(in.Spec.Template.LabelReplace, dataKeys, specPath.Child("template", "labelReplace"))...)
+	// the CRD only checks the keys against a pattern
+	for i, replacement := range in.Spec.Template.AnnotationReplace {
+		allErrs = append(allErrs, validateAnnotationKey(replacement.Key, specPath.Child("template", "annotationReplace").Index(i).Child("key"))...)
+	}
+	for i, replacement := range in.Spec.Template.LabelReplace {
+		for _, msg := range validation.IsQualifiedName(replacement.Key) {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("template", "labelReplace").Index(i).Child("key"), replacement.Key, msg))
+		}
+	}
+	for key, replacement := range in.Spec.Template.FieldReplace {
+		fldPath := specPath.Child("template", "fieldReplace").Key(key)
+		// the values are kept on the CMState under their key
+		for _, msg := range validation.IsQualifiedName(key) {
+			allErrs = append(allErrs, field.Invalid(fldPath, key, msg))
+		}
+		if _, ok := in.Spec.Template.Replacement(key); ok {
+			allErrs = append(allErrs, field.Duplicate(fldPath, key))
+		}
+		supported := false
+		for _, fieldPath := range FieldPaths {
+			supported = supported || fieldPath == replacement.FieldPath
+		}
+		if !supported {
+			allErrs = append(allErrs, field.NotSupported(fldPath.Child("fieldPath"), replacement.FieldPath, FieldPaths))
+		}
+	}
+	allErrs = append(allErrs, validateComputed(in, specPath.Child("computed"))...)
+	allErrs = append(allErrs, validateTemplateEngine(&in.Spec.Template, specPath.Child("template"))...)
+	allErrs = append(allErrs, validateTemplateData(&in.Spec.Template, specPath.Child("template"))...)
+	allErrs = append(allErrs, validateOutputs(in, specPath.Child("outputs"))...)
+	allErrs = append(allErrs, validateSyntax(in, specPath.Child("template", "syntax"))...)
+	for i := range in.Spec.DataFrom {
+		allErrs = append(allErrs, validateDataFrom(&in.Spec, &in.Spec.DataFrom[i], specPath.Child("dataFrom").Index(i))...)
+	}
+	if in.Spec.Inject != nil {
+		for i, key := range in.Spec.Inject.AnnotationKeys {
+			allErrs = append(allErrs, validateAnnotationKey(key, specPath.Child("inject", "annotationKeys").Index(i))...)
+		}
+		if in.Spec.Inject.Volume != nil {
+			allErrs = append(allErrs, validateInjectVolume(in.Spec.Inject.Volume, specPath.Child("inject", "volume"))...)
+		}
+		for i, name := range in.Spec.Inject.EnvFrom {
+			allErrs = append(allErrs, validateContainerName(name, specPath.Child("inject", "envFrom").Index(i))...)
+		}
+		if selector := in.Spec.Inject.ContainerSelector; selector != nil {
+			// whether it matches any container is only known per pod
+			for i, name := range selector.Names {
+				allErrs = append(allErrs, validateContainerName(name, specPath.Child("inject", "containerSelector", "names").Index(i))...)
+			}
+			for i, name := range selector.Exclude {
+				fldPath := specPath.Child("inject", "containerSelector", "exclude").Index(i)
+				if name == "*" {
+					allErrs = append(allErrs, field.Invalid(fldPath, name, "excluding every container injects into none"))
+					continue
+				}
+				allErrs = append(allErrs, validateContainerName(name, fldPath)...)
+			}
+		}
+		for key := range in.Spec.Inject.PodAnnotations {
+			allErrs = append(allErrs, validateAnnotationKey(key, specPath.Child("inject", "podAnnotations").Key(key))...)
+		}
+		for i, key := range in.Spec.Inject.OverridePodAnnotations {
+			if _, ok := in.Spec.Inject.PodAnnotations[key]; !ok {
+				allErrs = append(allErrs, field.NotFound(specPath.Child("inject", "overridePodAnnotations").Index(i), key))
+			}
+		}
+		names := make(map[string]bool, len(in.Spec.Inject.InitContainers))
+		for i, container := range in.Spec.Inject.InitContainers {
+			fldPath := specPath.Child("inject", "initContainers").Index(i).Child("name")
+			for _, msg := range validation.IsDNS1123Label(container.Name) {
+				allErrs = append(allErrs, field.Invalid(fldPath, container.Name, msg))
+			}
+			if names[container.Name] {
+				allErrs = append(allErrs, field.Duplicate(fldPath, container.Name))
+			}
+			names[container.Name] = true
+		}
+	}
+	for i, allowed := range in.Spec.AllowedServiceAccounts {
+		allErrs = append(allErrs, validateServiceAccountPattern(allowed, specPath.Child("allowedServiceAccounts").Index(i))...)
+	}
+	if in.Spec.TargetNamespaces != nil {
+		for i, name := range in.Spec.TargetNamespaces.Names {
+			for _, msg := range validation.IsDNS1123Label(name) {
+				allErrs = append(allErrs, field.Invalid(specPath.Child("targetNamespaces", "names").Index(i), name, msg))
+			}
+		}
+		if in.Spec.TargetNamespaces.Selector != nil {
+			if _, err := metav1.LabelSelectorAsSelector(in.Spec.TargetNamespaces.Selector); err != nil {
+				allErrs = append(allErrs, field.Invalid(specPath.Child("targetNamespaces", "selector"), in.Spec.TargetNamespaces.Selector, err.Error()))
+			}
+		}
+	}
+	if in.Spec.PodSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(in.Spec.PodSelector); err != nil {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("podSelector"), in.Spec.PodSelector, err.Error()))
+		}
+	}
+	return allErrs
+}
+
+// validateAliases checks the aliases of the template on their own, whether
+// another template has the same name or alias is checked when it is applied
+func validateAliases(in *CMTemplate, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if len(in.Spec.Aliases) > 0 && in.Scope() == TemplateScopeNamespaced {
+		return append(allErrs, field.Forbidden(fldPath, "only CMTemplates can have aliases"))
+	}
+	seen := make(map[string]bool, len(in.Spec.Aliases))
+	for i, alias := range in.Spec.Aliases {
+		switch {
+		case alias == in.Name:
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i), alias, "is the name of the template"))
+		case seen[alias]:
+			allErrs = append(allErrs, field.Duplicate(fldPath.Index(i), alias))
+		}
+		seen[alias] = true
+		for _, msg := range validation.IsDNS1123Subdomain(alias) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i), alias, msg))
+		}
+	}
+	return allErrs
+}
+
+func validateReplacements(replacements []KeyedReplacement, dataKeys map[string]bool, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for i, replacement := range replacements {
+		keyPath := fldPath.Index(i)
+		for i, dataKey := range replacement.AppliesTo {
+			if !dataKeys[dataKey] {
+				allErrs = append(allErrs, field.NotFound(keyPath.Child("appliesTo").Index(i), dataKey))
+			}
+		}
+		if replacement.Required != nil && *replacement.Required && replacement.Default != nil {
+			allErrs = append(allErrs, field.Invalid(keyPath.Child("required"), true,
+				"a required replacement can't have a default"))
+		}
+		for i, value := range replacement.Enum {
+			if normalized, err := replacement.Normalize(value); err != nil || normalized != value {
+				allErrs = append(allErrs, field.Invalid(keyPath.Child("enum").Index(i), value,
+					fmt.Sprintf("isn't a %s as it is rendered", replacement.Type)))
+			}
+		}
+		if replacement.Default != nil {
+			if _, err := replacement.Normalize(*replacement.Default); err != nil {
+				allErrs = append(allErrs, field.Invalid(keyPath.Child("default"), *replacement.Default, err.Error()))
+			}
+		}
+		if replacement.Pattern == "" {
+			continue
+		}
+		if _, err := replacement.Regexp(); err != nil {
+			allErrs = append(allErrs, field.Invalid(keyPath.Child("pattern"), replacement.Pattern, err.Error()))
+		} else if replacement.Default != nil && !replacement.Matches(*replacement.Default) {
+			allErrs = append(allErrs, field.Invalid(keyPath.Child("default"), *replacement.Default, "doesn't match the pattern"))
+		}
+	}
+	return allErrs
+}
+
+func validateOutputs(in *CMTemplate, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	names := make(map[string]bool, len(in.Spec.Outputs))
+	targets := make(map[string]bool)
+	for _, key := range in.Spec.TargetAnnotations() {
+		targets[key] = true
+	}
+	for i := range in.Spec.Outputs {
+		output := &in.Spec.Outputs[i]
+		outputPath := fldPath.Index(i)
+		for _, msg := range validation.IsDNS1123Label(output.Name) {
+			allErrs = append(allErrs, field.Invalid(outputPath.Child("name"), output.Name, msg))
+		}
+		if names[output.Name] {
+			allErrs = append(allErrs, field.Duplicate(outputPath.Child("name"), output.Name))
+		}
+		names[output.Name] = true
+
+		if output.TargetAnnotation == "" {
+			allErrs = append(allErrs, field.Required(outputPath.Child("targetAnnotation"), ""))
+		} else {
+			allErrs = append(allErrs, validateAnnotationKey(output.TargetAnnotation, outputPath.Child("targetAnnotation"))...)
+		}
+		if targets[output.TargetAnnotation] {
+			allErrs = append(allErrs, field.Duplicate(outputPath.Child("targetAnnotation"), output.TargetAnnotation))
+		}
+		targets[output.TargetAnnotation] = true
+
+		tmpl := in.Spec.Template.Output(output)
+		allErrs = append(allErrs, validateTemplateData(tmpl, outputPath)...)
+		if tmpl.GoTemplate() && (tmpl.Delimiters == nil || tmpl.Delimiters.Left != "" && tmpl.Delimiters.Right != "") {
+			allErrs = append(allErrs, parseTemplateData(tmpl, outputPath)...)
+		}
+	}
+	return allErrs
+}
+
+// validateSyntax checks the keys declaring a syntax are data keys of the
+// template, one of its outputs or the ConfigMaps it adds the data of
+func validateSyntax(in *CMTemplate, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for key := range in.Spec.Template.Syntax {
+		_, found := in.Spec.Template.Data[key]
+		for _, source := range in.Spec.DataFrom {
+			// all of the data of a ConfigMap or Secret may have any key
+			for _, ref := range []*DataRef{source.ConfigMapRef, source.SecretRef} {
+				found = found || ref != nil && (ref.Key == "" || ref.Key == key)
+			}
+		}
+		for _, output := range in.Spec.Outputs {
+			_, ok := output.CMTemplate[key]
+			found = found || ok
+		}
+		if !found {
+			allErrs = append(allErrs, field.NotFound(fldPath.Key(key), key))
+		}
+	}
+	return allErrs
+}
+
+// validateDataFrom checks the source references either a ConfigMap or a
+// Secret by valid names, and only copies Secrets into ConfigMaps when the
+// template allows it
+func validateDataFrom(spec *CMTemplateSpec, source *DataFromSource, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	ref, refPath := source.ConfigMapRef, fldPath.Child("configMapRef")
+	switch {
+	case source.ConfigMapRef == nil && source.SecretRef == nil:
+		return append(allErrs, field.Required(fldPath, "either configMapRef or secretRef must be set"))
+	case source.ConfigMapRef != nil && source.SecretRef != nil:
+		return append(allErrs, field.Forbidden(fldPath.Child("secretRef"), "configMapRef and secretRef are mutually exclusive"))
+	case source.SecretRef != nil:
+		ref, refPath = source.SecretRef, fldPath.Child("secretRef")
+		if spec.TargetKind() != TargetKindSecret && !spec.AllowSecretToConfigMap {
+			allErrs = append(allErrs, field.Forbidden(refPath,
+				"templates rendering into a ConfigMap need allowSecretToConfigMap to add the data of a Secret"))
+		}
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(ref.Name) {
+		allErrs = append(allErrs, field.Invalid(refPath.Child("name"), ref.Name, msg))
+	}
+	if ref.Namespace != "" {
+		for _, msg := range validation.IsDNS1123Label(ref.Namespace) {
+			allErrs = append(allErrs, field.Invalid(refPath.Child("namespace"), ref.Namespace, msg))
+		}
+	}
+	if ref.Key != "" {
+		for _, msg := range validation.IsConfigMapKey(ref.Key) {
+			allErrs = append(allErrs, field.Invalid(refPath.Child("key"), ref.Key, msg))
+		}
+	}
+	return allErrs
+}
+
+// MaxConfigMapSize is the most data and binary data a ConfigMap can hold
+const MaxConfigMapSize = 1024 * 1024
+
+// validateTemplateData checks the keys of the data and binary data the way
+// the API server checks them on the ConfigMap, and that they fit into one.
+// The rendered data can still outgrow the limit with long values.
+func validateTemplateData(tmpl *Template, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	size := 0
+	for key, data := range tmpl.Data {
+		for _, msg := range validation.IsConfigMapKey(key) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("data").Key(key), key, msg))
+		}
+		size += len(key) + len(data)
+	}
+	for key, data := range tmpl.BinaryData {
+		keyPath := fldPath.Child("binaryData").Key(key)
+		for _, msg := range validation.IsConfigMapKey(key) {
+			allErrs = append(allErrs, field.Invalid(keyPath, key, msg))
+		}
+		if _, ok := tmpl.Data[key]; ok {
+			allErrs = append(allErrs, field.Duplicate(keyPath, key))
+		}
+		size += len(key) + len(data)
+	}
+	if size > MaxConfigMapSize {
+		allErrs = append(allErrs, field.TooLong(fldPath, fmt.Sprintf("%d bytes of data and binary data", size), MaxConfigMapSize))
+	}
+	return allErrs
+}
+
+// validateComputed compiles the expressions of the computed values, so one
+// failing to type check or costing too much is reported when the template is
+// applied rather than when a CMState renders it
+func validateComputed(in *CMTemplate, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	keys := make(map[string]bool, len(in.Spec.Computed))
+	for i := range in.Spec.Computed {
+		computed := &in.Spec.Computed[i]
+		idxPath := fldPath.Index(i)
+		if computed.Key == "" {
+			allErrs = append(allErrs, field.Required(idxPath.Child("key"), ""))
+		}
+		// computed values join the values replaced in the template
+		_, replaced := in.Spec.Template.Replacement(computed.Key)
+		_, fieldReplaced := in.Spec.Template.FieldReplace[computed.Key]
+		if keys[computed.Key] || replaced || fieldReplaced {
+			allErrs = append(allErrs, field.Duplicate(idxPath.Child("key"), computed.Key))
+		}
+		keys[computed.Key] = true
+		if computed.Placeholder == "" && !in.Spec.Template.GoTemplate() {
+			allErrs = append(allErrs, field.Required(idxPath.Child("placeholder"), "the Replace engine replaces computed values by their placeholder"))
+		}
+		if _, err := computed.Compile(); err != nil {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("expression"), computed.Expression, err.Error()))
+		}
+	}
+	return allErrs
+}
+
+// validateTemplateEngine parses the data of GoTemplate templates, so a syntax
+// error is reported when the template is applied rather than when a CMState
+// renders it
+func validateTemplateEngine(tmpl *Template, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if tmpl.Delimiters != nil {
+		if !tmpl.GoTemplate() {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("delimiters"), "only used by the GoTemplate engine"))
+		}
+		if tmpl.Delimiters.Left == "" {
+			allErrs = append(allErrs, field.Required(fldPath.Child("delimiters", "left"), ""))
+		}
+		if tmpl.Delimiters.Right == "" {
+			allErrs = append(allErrs, field.Required(fldPath.Child("delimiters", "right"), ""))
+		}
+	}
+	if !tmpl.GoTemplate() || len(allErrs) > 0 {
+		return allErrs
+	}
+	return parseTemplateData(tmpl, fldPath)
+}
+
+// parseTemplateData parses the data of a GoTemplate template
+func parseTemplateData(tmpl *Template, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	keys := make([]string, 0, len(tmpl.Data))
+	for key := range tmpl.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, err := tmpl.Parse(key); err != nil {
+			// the data itself is left out of the message, it may be long
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("data").Key(key), field.OmitValueType{}, parseErrorMessage(key, err)))
+		}
+	}
+	return allErrs
+}
+
+// parseErrorMessage turns the "template: <key>:<line>: <error>" of a parse
+// error into "line <line>: <error>", the field path already names the key
+func parseErrorMessage(key string, err error) string {
+	msg := strings.TrimPrefix(err.Error(), "template: "+key+":")
+	if line, rest, ok := strings.Cut(msg, ": "); ok && msg != err.Error() {
+		return fmt.Sprintf("line %s: %s", line, rest)
+	}
+	return err.Error()
+}
+
+func validateInjectVolume(volume *InjectVolume, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if volume.Name != "" {
+		for _, msg := range validation.IsDNS1123Label(volume.Name) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("name"), volume.Name, msg))
+		}
+	}
+	if volume.MountPath == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("mountPath"), ""))
+	} else if !path.IsAbs(volume.MountPath) {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("mountPath"), volume.MountPath, "must be an absolute path"))
+	}
+	for i, name := range volume.Containers {
+		allErrs = append(allErrs, validateContainerName(name, fldPath.Child("containers").Index(i))...)
+	}
+	return allErrs
+}
+
+// validateServiceAccountPattern accepts namespace/name, both parts a glob pattern
+func validateServiceAccountPattern(allowed string, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	namespace, name, ok := strings.Cut(allowed, "/")
+	if !ok || namespace == "" || name == "" {
+		return append(allErrs, field.Invalid(fldPath, allowed, "must be namespace/name"))
+	}
+	for _, pattern := range []string{namespace, name} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath, allowed, err.Error()))
+		}
+	}
+	return allErrs
+}
+
+// validateContainerName accepts a container name or "*" for all containers
+func validateContainerName(name string, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if name == "*" {
+		return allErrs
+	}
+	for _, msg := range validation.IsDNS1123Label(name) {
+		allErrs = append(allErrs, field.Invalid(fldPath, name, msg))
+	}
+	return allErrs
+}
+
+func validateAnnotationKey(key string, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for _, msg := range validation.IsQualifiedName(key) {
+		allErrs = append(allErrs, field.Invalid(fldPath, key, msg))
+	}
+	return allErrs
+}
+
+// validateConfigMapName checks the name and prefix of the generated ConfigMap
+// are valid names, and that only one of them is set
+func validateConfigMapName(spec *CMTemplateSpec, specPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if spec.ConfigMapName != "" && spec.ConfigMapNamePrefix != "" {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("configMapNamePrefix"), "configMapName and configMapNamePrefix are mutually exclusive"))
+	}
+	if spec.ConfigMapName != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(spec.ConfigMapName) {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("configMapName"), spec.ConfigMapName, msg))
+		}
+	}
+	if spec.ConfigMapNamePrefix != "" {
+		// the template name follows the prefix
+		for _, msg := range validation.IsDNS1123Subdomain(spec.ConfigMapNamePrefix + "a") {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("configMapNamePrefix"), spec.ConfigMapNamePrefix, msg))
+		}
+	}
+	return allErrs
+}
+
+// validateMetadata checks the labels and annotations propagated to the
+// generated objects are valid
+func validateMetadata(metadata *Metadata, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for key, value := range metadata.Labels {
+		for _, msg := range validation.IsQualifiedName(key) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("labels").Key(key), key, msg))
+		}
+		for _, msg := range validation.IsValidLabelValue(value) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("labels").Key(key), value, msg))
+		}
+	}
+	for key := range metadata.Annotations {
+		allErrs = append(allErrs, validateAnnotationKey(key, fldPath.Child("annotations").Key(key))...)
+	}
+	return allErrs
+}
@@ -0,0 +1,29 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+// v1alpha2 is the hub the other versions convert through, and the version
+// the operator works with and stores
+
+// Hub marks CMTemplate as the conversion hub
+func (*CMTemplate) Hub() {}
+
+// Hub marks CMState as the conversion hub
+func (*CMState) Hub() {}
+
+// Hub marks NamespacedCMTemplate as the conversion hub
+func (*NamespacedCMTemplate) Hub() {}
@@ -0,0 +1,116 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TemplateScope is where the template of a CMState is looked up
+// +kubebuilder:validation:Enum=Cluster;Namespaced
+type TemplateScope string
+
+const (
+	// TemplateScopeCluster renders the CMState from the CMTemplate of its name
+	TemplateScopeCluster TemplateScope = "Cluster"
+	// TemplateScopeNamespaced renders the CMState from the
+	// NamespacedCMTemplate of its name in the namespace of the CMState
+	TemplateScopeNamespaced TemplateScope = "Namespaced"
+)
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Namespaced,shortName=nscmtemplate
+//+kubebuilder:storageversion
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// NamespacedCMTemplate is a CMTemplate for the pods of its namespace. It
+// takes precedence over the CMTemplate of the same name for them, letting a
+// team override a cluster template without touching it.
+type NamespacedCMTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec CMTemplateSpec `json:"spec,omitempty"`
+}
+
+// CMTemplate returns the template as a CMTemplate keeping its namespace, which
+// is how the webhook and the controllers handle it
+func (in *NamespacedCMTemplate) CMTemplate() *CMTemplate {
+	return &CMTemplate{
+		ObjectMeta: *in.ObjectMeta.DeepCopy(),
+		Spec:       *in.Spec.DeepCopy(),
+	}
+}
+
+//+kubebuilder:object:root=true
+
+// NamespacedCMTemplateList contains a list of NamespacedCMTemplate
+type NamespacedCMTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NamespacedCMTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NamespacedCMTemplate{}, &NamespacedCMTemplateList{})
+}
+
+// Scope returns where the template was looked up, a CMTemplate converted
+// from a NamespacedCMTemplate keeps its namespace
+func (in *CMTemplate) Scope() TemplateScope {
+	if in.Namespace != "" {
+		return TemplateScopeNamespaced
+	}
+	return TemplateScopeCluster
+}
+
+// CMStateName returns the name of the CMState of the template. The owner or
+// pod of the state scope is joined with a slash, which no name contains, so
+// the name is hashed and can't collide with that of another template or
+// scope. Pods overriding values get the hash of their overrides appended.
+// CMStates of namespaced templates are named apart from those of the cluster
+// template they override.
+func (in *CMTemplate) CMStateName(scope, overrides string) string {
+	name := in.Name
+	separator := "-"
+	if scope != "" {
+		name += "/" + scope
+		separator = "/"
+	}
+	if overrides != "" {
+		name += separator + overrides
+	}
+	if in.Scope() == TemplateScopeNamespaced {
+		return NamespacedCMStateName(name)
+	}
+	return CMStateName(name)
+}
+
+// NamespacedCMStateName returns the name of the CMState for the namespaced
+// template. The slash can't be part of a template name, so the name is
+// always hashed and can't collide with one of a cluster template.
+func NamespacedCMStateName(cmTemplateName string) string {
+	return CMStateName("local/" + cmTemplateName)
+}
+
+// Scope returns where the template of the CMState is looked up
+func (in *CMStateSpec) Scope() TemplateScope {
+	if in.TemplateRef.Scope == "" {
+		return TemplateScopeCluster
+	}
+	return in.TemplateRef.Scope
+}
@@ -0,0 +1,278 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// templateFuncs are the functions GoTemplate templates can call, a subset of
+// the sprig library with the same names and argument order. Only functions
+// without side effects are in, nothing reads the environment, files or the
+// network, so a template can't leak what the operator has access to.
+// Templates calling any other function don't parse.
+var templateFuncs = template.FuncMap{
+	// defaults
+	"default":  defaultValue,
+	"empty":    empty,
+	"coalesce": coalesce,
+	"ternary":  ternary,
+	"required": required,
+
+	// strings
+	"trim":       strings.TrimSpace,
+	"trimAll":    func(cutset, s string) string { return strings.Trim(s, cutset) },
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"repeat":     repeat,
+	"trunc":      trunc,
+	"quote":      quote,
+	"squote":     squote,
+	"toString":   toString,
+	"sha256sum":  sha256sum,
+	"b64enc":     func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"indent":     indent,
+	"toJson":     toJSON,
+
+	// lists and dicts
+	"list":      func(items ...interface{}) []interface{} { return items },
+	"join":      join,
+	"splitList": func(sep, s string) []string { return strings.Split(s, sep) },
+	"sortAlpha": sortAlpha,
+	"dict":      dict,
+	"hasKey":    func(d map[string]interface{}, key string) bool { _, ok := d[key]; return ok },
+	"keys":      keys,
+}
+
+// TemplateFuncNames lists the functions GoTemplate templates can call, sorted
+func TemplateFuncNames() []string {
+	names := make([]string, 0, len(templateFuncs))
+	for name := range templateFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// empty reports whether the value is the zero value of its type, or an empty
+// string, slice or map
+func empty(given interface{}) bool {
+	value := reflect.ValueOf(given)
+	if !value.IsValid() {
+		return true
+	}
+	switch value.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return value.Len() == 0
+	case reflect.Struct:
+		return false
+	default:
+		return value.IsZero()
+	}
+}
+
+// defaultValue returns the given value, or the default when it is empty.
+// Piping a missing value in passes no given value at all.
+func defaultValue(d interface{}, given ...interface{}) interface{} {
+	if len(given) == 0 || empty(given[0]) {
+		return d
+	}
+	return given[0]
+}
+
+func coalesce(values ...interface{}) interface{} {
+	for _, value := range values {
+		if !empty(value) {
+			return value
+		}
+	}
+	return nil
+}
+
+func ternary(whenTrue, whenFalse interface{}, condition bool) interface{} {
+	if condition {
+		return whenTrue
+	}
+	return whenFalse
+}
+
+// required fails the rendering with the message when the value is missing
+func required(msg string, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, errors.New(msg)
+	}
+	if s, ok := value.(string); ok && s == "" {
+		return nil, errors.New(msg)
+	}
+	return value, nil
+}
+
+// trunc keeps the first count characters of the string, or the last ones
+// when count is negative
+func trunc(count int, s string) string {
+	switch {
+	case count < 0 && len(s)+count > 0:
+		return s[len(s)+count:]
+	case count >= 0 && len(s) > count:
+		return s[:count]
+	}
+	return s
+}
+
+func quote(values ...interface{}) string {
+	quoted := make([]string, 0, len(values))
+	for _, value := range values {
+		if value != nil {
+			quoted = append(quoted, strconv.Quote(toString(value)))
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+func squote(values ...interface{}) string {
+	quoted := make([]string, 0, len(values))
+	for _, value := range values {
+		if value != nil {
+			quoted = append(quoted, "'"+toString(value)+"'")
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case fmt.Stringer:
+		return v.String()
+	case error:
+		return v.Error()
+	}
+	return fmt.Sprint(value)
+}
+
+// repeat repeats the string count times. A result that can't fit into a
+// ConfigMap fails the rendering before it is built, strings.Repeat would
+// allocate whatever the count asks for or panic on a negative one.
+func repeat(count int, s string) (string, error) {
+	if count < 0 {
+		return "", fmt.Errorf("repeat count %d is negative", count)
+	}
+	if len(s) > 0 && count > MaxConfigMapSize/len(s) {
+		return "", fmt.Errorf("repeating %d bytes %d times exceeds the %d bytes of a ConfigMap", len(s), count, MaxConfigMapSize)
+	}
+	return strings.Repeat(s, count), nil
+}
+
+// indent prefixes every line of the string with the number of spaces, the
+// ones after a trailing newline as well, like sprig does
+func indent(spaces int, s string) string {
+	if spaces < 0 {
+		spaces = 0
+	}
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+// toJSON encodes the value as JSON, failing the rendering where sprig would
+// render an empty string
+func toJSON(value interface{}) (string, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+func sha256sum(s string) string {
+	hash := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(hash[:])
+}
+
+// toStrings turns a list of any type into its strings
+func toStrings(list interface{}) []string {
+	if strs, ok := list.([]string); ok {
+		return strs
+	}
+	value := reflect.ValueOf(list)
+	if value.Kind() != reflect.Array && value.Kind() != reflect.Slice {
+		return []string{toString(list)}
+	}
+	strs := make([]string, 0, value.Len())
+	for i := 0; i < value.Len(); i++ {
+		if item := value.Index(i).Interface(); item != nil {
+			strs = append(strs, toString(item))
+		}
+	}
+	return strs
+}
+
+func join(sep string, list interface{}) string {
+	return strings.Join(toStrings(list), sep)
+}
+
+func sortAlpha(list interface{}) []string {
+	strs := append([]string(nil), toStrings(list)...)
+	sort.Strings(strs)
+	return strs
+}
+
+// dict builds a map of alternating keys and values, a key without a value
+// maps to an empty string
+func dict(pairs ...interface{}) map[string]interface{} {
+	d := make(map[string]interface{}, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		key := toString(pairs[i])
+		if i+1 < len(pairs) {
+			d[key] = pairs[i+1]
+		} else {
+			d[key] = ""
+		}
+	}
+	return d
+}
+
+// keys returns the keys of the dicts sorted, unlike sprig, so ranging over
+// them renders the same data every time
+func keys(dicts ...map[string]interface{}) []string {
+	var names []string
+	for _, d := range dicts {
+		for key := range d {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
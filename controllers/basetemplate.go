@@ -0,0 +1,105 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+)
+
+// resolveBase merges the base templates of the template under it, a chain of
+// base templates that can't be resolved fails rendering like its data would
+func (r *CMStateReconciler) resolveBase(ctx context.Context, cmTemplate *cachev1alpha2.CMTemplate) error {
+	err := cmTemplate.ResolveBase(r.MaxBaseTemplateDepth, templateGetter(ctx, r))
+	var baseErr *cachev1alpha2.BaseTemplateError
+	if errors.As(err, &baseErr) {
+		return &renderError{key: "spec.baseTemplate", err: baseErr}
+	}
+	return err
+}
+
+// templateGetter reads the base templates of a chain through the reader
+func templateGetter(ctx context.Context, reader client.Reader) cachev1alpha2.TemplateGetter {
+	return func(name string) (*cachev1alpha2.CMTemplate, error) {
+		cmTemplate := &cachev1alpha2.CMTemplate{}
+		return cmTemplate, reader.Get(ctx, types.NamespacedName{Name: name}, cmTemplate)
+	}
+}
+
+// inheritingTemplates lists the templates inheriting from the named one,
+// directly or through the bases in between. Templates whose chain breaks
+// further up still count, their base may be what is being created.
+func inheritingTemplates(ctx context.Context, reader client.Reader, name string) ([]string, error) {
+	cmTemplates := &cachev1alpha2.CMTemplateList{}
+	if err := reader.List(ctx, cmTemplates); err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*cachev1alpha2.CMTemplate, len(cmTemplates.Items))
+	for i := range cmTemplates.Items {
+		byName[cmTemplates.Items[i].Name] = &cmTemplates.Items[i]
+	}
+	get := func(base string) (*cachev1alpha2.CMTemplate, error) {
+		if cmTemplate, ok := byName[base]; ok {
+			return cmTemplate, nil
+		}
+		return nil, apierrors.NewNotFound(cachev1alpha2.GroupVersion.WithResource("cmtemplates").GroupResource(), base)
+	}
+
+	var names []string
+	for _, cmTemplate := range cmTemplates.Items {
+		if cmTemplate.Spec.BaseTemplate == "" || cmTemplate.Name == name {
+			continue
+		}
+		chain, _ := cmTemplate.BaseChain(0, get)
+		inherits := cmTemplate.Spec.BaseTemplate == name
+		for _, base := range chain {
+			inherits = inherits || base.Spec.BaseTemplate == name
+		}
+		if inherits {
+			names = append(names, cmTemplate.Name)
+		}
+	}
+	return names, nil
+}
+
+// inheritsFrom reports whether any template inherits from the named one, so
+// creating or deleting it changes what they render
+func inheritsFrom(reader client.Reader, name string) bool {
+	names, err := inheritingTemplates(context.Background(), reader, name)
+	return err == nil && len(names) > 0
+}
+
+// cmTemplatesForBase maps a CMTemplate to the templates inheriting from it, so
+// changing it validates them anew
+func (r *CMTemplateReconciler) cmTemplatesForBase(obj client.Object) []reconcile.Request {
+	names, err := inheritingTemplates(context.Background(), r, obj.GetName())
+	if err != nil {
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(names))
+	for _, name := range names {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: name}})
+	}
+	return requests
+}
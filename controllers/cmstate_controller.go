@@ -19,30 +19,49 @@ package controllers
 import (
 	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"github.com/go-logr/logr"
-	cachev1alpha1 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha1"
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
 )
 
 // Definitions to manage status conditions
 const (
 	// typeAvailableCMState represents the status of the ConfigMap reconciliation
 	typeAvailableCMState = "Available"
+	// typeDisabledCMState tells whether the CMTemplate of the CMState is disabled
+	typeDisabledCMState = "Disabled"
+	// typeDegradedCMState tells whether the ConfigMap is rendered without data
+	// the dataFrom of its CMTemplate references
+	typeDegradedCMState = "Degraded"
+	// typePinnedCMState tells whether the ConfigMap is kept as it was first
+	// rendered, ignoring changes of the CMTemplate
+	typePinnedCMState = "Pinned"
 )
 
 // CMStateReconciler reconciles a CMState object
@@ -50,12 +69,37 @@ type CMStateReconciler struct {
 	client.Client
 	Scheme   *runtime.Scheme
 	Recorder record.EventRecorder
+	// EmptyAudienceGracePeriod is how long a CMState with an empty audience is
+	// kept around before it is deleted, so a rolling restart can reuse it.
+	EmptyAudienceGracePeriod time.Duration
+	// ImmutableHistory is how many of the previous immutable ConfigMaps of a
+	// CMState are kept even when no pod uses them anymore
+	ImmutableHistory int
+	// AllowCrossNamespaceDataFrom lets the dataFrom of templates read
+	// ConfigMaps in other namespaces than the one of the CMState
+	AllowCrossNamespaceDataFrom bool
+	// MaxBaseTemplateDepth is how many base templates a template may inherit
+	// from through spec.baseTemplate, 0 doesn't limit it
+	MaxBaseTemplateDepth int
+	// ReloadInterval is the least time between two restarts of the same
+	// workload by templates reloading their targets
+	ReloadInterval time.Duration
+	// ReloadDryRun only logs the workloads templates reloading their targets
+	// would restart
+	ReloadDryRun bool
 }
 
 //+kubebuilder:rbac:groups=cache.spicedelver.me,resources=cmstates,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=cache.spicedelver.me,resources=cmstates/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=cache.spicedelver.me,resources=cmstates/finalizers,verbs=update
+//+kubebuilder:rbac:groups=cache.spicedelver.me,resources=namespacedcmtemplates,verbs=get;list;watch
 //+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=replicationcontrollers,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -65,12 +109,13 @@ type CMStateReconciler struct {
 func (r *CMStateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := log.FromContext(ctx)
 
-	cmState := &cachev1alpha1.CMState{}
+	cmState := &cachev1alpha2.CMState{}
 	err := r.Get(ctx, req.NamespacedName, cmState)
 	if err != nil {
 		// If this is not nil we are already tracking one. So in this case we need to add to the audience
 		if apierrors.IsNotFound(err) {
 			log.Info("cmstate resource was not found. Ignoring, as the object must be deleted")
+			forgetAudienceSize(req.NamespacedName)
 			return ctrl.Result{}, nil
 		}
 		// Error reading the object - requeue the request.
@@ -82,23 +127,41 @@ func (r *CMStateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	// indicated by the deletion timestamp being set.
 	isCmStateMarkedToBeDeleted := cmState.GetDeletionTimestamp() != nil
 	if isCmStateMarkedToBeDeleted {
-		cm := &corev1.ConfigMap{
-			TypeMeta: metav1.TypeMeta{
-				APIVersion: "v1",
-				Kind:       "ConfigMap",
-			},
-			ObjectMeta: metav1.ObjectMeta{
-				Name: cmState.Spec.Target,
-			},
-		}
-		r.Delete(ctx, cm)
+		forgetAudienceSize(req.NamespacedName)
+		r.deleteAllRendered(ctx, cmState, log)
 		return ctrl.Result{}, nil
 	}
 
-	found := &corev1.ConfigMap{}
+	recordAudienceSize(cmState)
+
+	disabled, err := r.reconcileDisabled(ctx, cmState)
+	if err != nil {
+		log.Error(err, "Failed to update CMState status")
+		return ctrl.Result{}, err
+	}
+	pinned, err := r.reconcilePinned(ctx, cmState)
+	if err != nil {
+		log.Error(err, "Failed to update CMState status")
+		return ctrl.Result{}, err
+	}
+	if err := r.reconcileDegraded(ctx, cmState); err != nil {
+		log.Error(err, "Failed to resolve the dataFrom of the cmtemplate")
+		return ctrl.Result{}, err
+	}
+
+	found, err := r.renderedObject(ctx, cmState)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
 	err = r.Get(ctx, types.NamespacedName{Name: cmState.Spec.Target, Namespace: cmState.Namespace}, found)
-	if cmState.Spec.Target == "" {
-		cm, err := r.configMapForCMState(cmState, ctx, log)
+	if cmState.Spec.Target == "" && disabled {
+		log.Info("Not rendering the ConfigMap of a disabled cmtemplate", "cmtemplate", cmState.Spec.TemplateRef.Name)
+	} else if cmState.Spec.Target == "" {
+		objects, err := r.objectsForCMState(cmState, ctx, log)
+		var renderErr *renderError
+		if errors.As(err, &renderErr) {
+			return r.reconcileRenderFailed(ctx, cmState, renderErr, log)
+		}
 		if err != nil {
 			log.Error(err, "Failed to define new Configmap resource for CMState")
 
@@ -114,9 +177,16 @@ func (r *CMStateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 
 			return ctrl.Result{}, err
 		}
-		log.Info("Creating a new ConfigMap", "ConfigMap.Namespace", cm.Namespace, "ConfigMap.Name", cm.Name)
-		if err = r.Create(ctx, cm); err != nil {
-			log.Error(err, "Failed to create new ConfigMap", "ConfigMap.Namespace", cm.Namespace, "ConfigMap.Name", cm.Name)
+		// the outputs go first, the CMState only gets its target once all
+		// ConfigMaps are there
+		if err := r.createOutputs(ctx, objects[1:], log); err != nil {
+			return ctrl.Result{}, err
+		}
+		cm := objects[0]
+		log.Info("Creating a new ConfigMap", "ConfigMap.Namespace", cm.GetNamespace(), "ConfigMap.Name", cm.GetName(), "kind", kindOf(cm))
+		// a hash versioned ConfigMap of the same name has the same content
+		if err = r.Create(ctx, cm); err != nil && !(apierrors.IsAlreadyExists(err) && hashVersioned(cm)) {
+			log.Error(err, "Failed to create new ConfigMap", "ConfigMap.Namespace", cm.GetNamespace(), "ConfigMap.Name", cm.GetName(), "kind", kindOf(cm))
 			return ctrl.Result{}, err
 		}
 		cmState.Spec.Target = cm.GetName()
@@ -125,84 +195,1095 @@ func (r *CMStateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 			log.Error(err, "Failed to update CMState Audience")
 			return ctrl.Result{}, err
 		}
+		cmState.Status.RenderedKind = kindOf(cm)
+		cmState.Status.ConfigMap = cm.GetName()
+		cmState.Status.Audience = int32(cmState.Spec.AudienceSize())
+		cmState.Status.RenderedFromGeneration = r.templateGeneration(ctx, cmState)
+		meta.SetStatusCondition(&cmState.Status.Conditions, renderedCondition(cm.GetName()))
+		cmState.Status.LastRenderTime = &metav1.Time{Time: time.Now()}
+		if err := r.Status().Update(ctx, cmState); err != nil {
+			log.Error(err, "Failed to update CMState status")
+			return ctrl.Result{}, err
+		}
 		return ctrl.Result{}, nil
 	} else if err != nil {
 		log.Error(err, "Failed to get ConfigMap")
 		return ctrl.Result{}, err
+	} else {
+		if err := r.adoptRendered(ctx, cmState, found); err != nil {
+			log.Error(err, "Failed to adopt the ConfigMap rendered before")
+			return ctrl.Result{}, err
+		}
+		// pinned CMStates keep what they rendered when they were created
+		if !disabled && !pinned {
+			if result, err := r.reconcileRollover(ctx, cmState, log); err != nil || !result.IsZero() {
+				return result, err
+			}
+			if result, err := r.reconcileOutputs(ctx, cmState, log); err != nil || !result.IsZero() {
+				return result, err
+			}
+			if result, err := r.reconcileData(ctx, cmState, log); err != nil || !result.IsZero() {
+				return result, err
+			}
+		}
+		if err := r.reconcileMetadata(ctx, cmState); err != nil {
+			log.Error(err, "Failed to propagate the metadata of the cmtemplate")
+			return ctrl.Result{}, err
+		}
+		if result, err := r.reconcileReload(ctx, cmState, log); err != nil || !result.IsZero() {
+			return result, err
+		}
 	}
 
-	if len(cmState.Spec.Audience) == 0 {
-		cm := &corev1.ConfigMap{
-			TypeMeta: metav1.TypeMeta{
-				APIVersion: "v1",
-				Kind:       "ConfigMap",
-			},
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      cmState.Spec.Target,
-				Namespace: cmState.GetNamespace(),
-			},
+	if err := r.pruneDeletedOwners(ctx, cmState); err != nil {
+		log.Error(err, "Failed to prune the audience of deleted workloads")
+		return ctrl.Result{}, err
+	}
+	if err := r.pruneEvicted(ctx, cmState); err != nil {
+		log.Error(err, "Failed to prune the evicted pods that are gone")
+		return ctrl.Result{}, err
+	}
+	admitting, err := r.pruneDeletedPod(ctx, cmState)
+	if err != nil {
+		log.Error(err, "Failed to prune the audience of a deleted pod")
+		return ctrl.Result{}, err
+	}
+
+	if err := r.reconcileSummary(ctx, cmState); err != nil {
+		log.Error(err, "Failed to update CMState status")
+		return ctrl.Result{}, err
+	}
+
+	if len(cmState.Spec.Audience) == 0 && len(cmState.Spec.Evicted) == 0 {
+		return r.reconcileEmptyAudience(ctx, cmState, log)
+	}
+
+	if cmState.Status.EmptySince != nil {
+		// a pod joined again within the grace period
+		cmState.Status.EmptySince = nil
+		if err := r.Status().Update(ctx, cmState); err != nil {
+			log.Error(err, "Failed to update CMState status")
+			return ctrl.Result{}, err
+		}
+	}
+
+	return ctrl.Result{RequeueAfter: admitting}, nil
+}
+
+// reconcileDisabled reports whether the CMTemplate of the CMState is disabled,
+// recording it as the Disabled condition. A missing template doesn't count as
+// disabled.
+func (r *CMStateReconciler) reconcileDisabled(ctx context.Context, cmState *cachev1alpha2.CMState) (bool, error) {
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	err := r.getCMTemplate(ctx, cmState, cmTemplate)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return false, err
+	}
+	disabled := err == nil && cmTemplate.Spec.Disabled
+
+	condition := metav1.Condition{Type: typeDisabledCMState, Status: metav1.ConditionFalse, Reason: "TemplateEnabled",
+		Message: fmt.Sprintf("CMTemplate %s is injected into new pods", cmState.Spec.TemplateRef.Name)}
+	if disabled {
+		condition.Status, condition.Reason = metav1.ConditionTrue, "TemplateDisabled"
+		condition.Message = fmt.Sprintf("CMTemplate %s is disabled, new pods don't get it and the ConfigMap isn't rendered", cmState.Spec.TemplateRef.Name)
+	}
+	current := meta.FindStatusCondition(cmState.Status.Conditions, typeDisabledCMState)
+	if current == nil && !disabled {
+		// only CMStates that were ever disabled carry the condition
+		return false, nil
+	}
+	if current != nil && current.Status == condition.Status {
+		return disabled, nil
+	}
+	meta.SetStatusCondition(&cmState.Status.Conditions, condition)
+	return disabled, r.Status().Update(ctx, cmState)
+}
+
+// renderedCondition is the Available condition of a CMState whose ConfigMap
+// is rendered
+func renderedCondition(name string) metav1.Condition {
+	return metav1.Condition{Type: typeAvailableCMState, Status: metav1.ConditionTrue, Reason: "Rendered",
+		Message: fmt.Sprintf("Rendered ConfigMap %s", name)}
+}
+
+// reconcilePinned reports whether the CMTemplate of the CMState is only
+// rendered on create, recording it as the Pinned condition. Switching the
+// template to Always renders the current template on the next reconcile,
+// switching it to OnCreate keeps what was rendered last.
+func (r *CMStateReconciler) reconcilePinned(ctx context.Context, cmState *cachev1alpha2.CMState) (bool, error) {
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	err := r.getCMTemplate(ctx, cmState, cmTemplate)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return false, err
+	}
+	pinned := err == nil && cmTemplate.Spec.UpdateStrategy == cachev1alpha2.UpdateStrategyOnCreate
+
+	condition := metav1.Condition{Type: typePinnedCMState, Status: metav1.ConditionFalse, Reason: "UpdateStrategyAlways",
+		Message: fmt.Sprintf("Changes of CMTemplate %s are rendered into the ConfigMap", cmState.Spec.TemplateRef.Name)}
+	if pinned {
+		condition.Status, condition.Reason = metav1.ConditionTrue, "UpdateStrategyOnCreate"
+		condition.Message = fmt.Sprintf("Changes of CMTemplate %s after the ConfigMap was rendered are ignored, status.renderedFromGeneration is the generation it was rendered from", cmState.Spec.TemplateRef.Name)
+	}
+	current := meta.FindStatusCondition(cmState.Status.Conditions, typePinnedCMState)
+	if current == nil && !pinned {
+		// only CMStates that were ever pinned carry the condition
+		return false, nil
+	}
+	if current != nil && current.Status == condition.Status {
+		return pinned, nil
+	}
+	meta.SetStatusCondition(&cmState.Status.Conditions, condition)
+	return pinned, r.Status().Update(ctx, cmState)
+}
+
+// getCMTemplate fetches the template of the CMState, the NamespacedCMTemplate
+// of its namespace for CMStates of the namespaced scope
+func (r *CMStateReconciler) getCMTemplate(ctx context.Context, cmState *cachev1alpha2.CMState, cmTemplate *cachev1alpha2.CMTemplate) error {
+	if cmState.Spec.Scope() != cachev1alpha2.TemplateScopeNamespaced {
+		return r.Get(ctx, types.NamespacedName{Name: cmState.Spec.TemplateRef.Name}, cmTemplate)
+	}
+	namespaced := &cachev1alpha2.NamespacedCMTemplate{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: cmState.Namespace, Name: cmState.Spec.TemplateRef.Name}, namespaced); err != nil {
+		return err
+	}
+	*cmTemplate = *namespaced.CMTemplate()
+	return nil
+}
+
+// templateObject is the object events about the template are recorded on
+func templateObject(cmTemplate *cachev1alpha2.CMTemplate) client.Object {
+	if cmTemplate.Scope() == cachev1alpha2.TemplateScopeNamespaced {
+		return &cachev1alpha2.NamespacedCMTemplate{ObjectMeta: cmTemplate.ObjectMeta}
+	}
+	return cmTemplate
+}
+
+// templateGeneration is the generation of the CMTemplate of the CMState, 0
+// when it is gone
+func (r *CMStateReconciler) templateGeneration(ctx context.Context, cmState *cachev1alpha2.CMState) int64 {
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	if err := r.getCMTemplate(ctx, cmState, cmTemplate); err != nil {
+		return 0
+	}
+	return cmTemplate.Generation
+}
+
+// checkNamespace refuses to render the template in a namespace outside its
+// targetNamespaces, the webhook denies the pods there but CMStates can still
+// be created by hand
+func (r *CMStateReconciler) checkNamespace(ctx context.Context, cmTemplate *cachev1alpha2.CMTemplate, name string) error {
+	namespace := &corev1.Namespace{}
+	if cmTemplate.Spec.SelectsNamespaces() {
+		if err := r.Get(ctx, types.NamespacedName{Name: name}, namespace); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	if !cmTemplate.Spec.NamespaceAllowed(name, namespace.Labels) {
+		return &renderError{key: "spec.targetNamespaces", err: fmt.Errorf("namespace %s is not allowed to use the template", name)}
+	}
+	return nil
+}
+
+// reconcileSummary keeps the status fields kubectl lists the CMState with in
+// step: the size of its audience, the ConfigMap it renders into and whether
+// that is available. CMStates rendered before these were kept get them here.
+func (r *CMStateReconciler) reconcileSummary(ctx context.Context, cmState *cachev1alpha2.CMState) error {
+	status := cmState.Status.DeepCopy()
+	status.Audience = int32(cmState.Spec.AudienceSize())
+	status.ConfigMap = cmState.Spec.Target
+	if cmState.Spec.Target != "" && meta.FindStatusCondition(status.Conditions, typeAvailableCMState) == nil {
+		meta.SetStatusCondition(&status.Conditions, renderedCondition(cmState.Spec.Target))
+	}
+	if equality.Semantic.DeepEqual(status, &cmState.Status) {
+		return nil
+	}
+	cmState.Status = *status
+	return r.Status().Update(ctx, cmState)
+}
+
+// reconcileRenderFailed records the template failing to render as the
+// Available condition. It isn't retried, the CMState is reconciled again once
+// its template or values change. Rendering too much data is reported on the
+// template as well, it has to be fixed there.
+func (r *CMStateReconciler) reconcileRenderFailed(ctx context.Context, cmState *cachev1alpha2.CMState, renderErr *renderError, log logr.Logger) (ctrl.Result, error) {
+	log.Info("Failed to render the ConfigMap of the cmtemplate", "cmtemplate", cmState.Spec.TemplateRef.Name, "reason", renderErr.Reason(), "error", renderErr.Error())
+	condition := metav1.Condition{Type: typeAvailableCMState, Status: metav1.ConditionFalse, Reason: renderErr.Reason(),
+		Message: fmt.Sprintf("Failed to render CMTemplate %s: %s", cmState.Spec.TemplateRef.Name, renderErr)}
+	if current := meta.FindStatusCondition(cmState.Status.Conditions, typeAvailableCMState); current != nil &&
+		current.Reason == condition.Reason && current.Message == condition.Message {
+		return ctrl.Result{}, nil
+	}
+	if r.Recorder != nil {
+		r.Recorder.Event(cmState, corev1.EventTypeWarning, condition.Reason, condition.Message)
+		cmTemplate := &cachev1alpha2.CMTemplate{}
+		if renderErr.Reason() == reasonRenderTooLarge && r.getCMTemplate(ctx, cmState, cmTemplate) == nil {
+			r.Recorder.Eventf(templateObject(cmTemplate), corev1.EventTypeWarning, condition.Reason, "Failed to render the CMState %s/%s: %s", cmState.Namespace, cmState.Name, renderErr)
+		}
+	}
+	meta.SetStatusCondition(&cmState.Status.Conditions, condition)
+	if err := r.Status().Update(ctx, cmState); err != nil {
+		log.Error(err, "Failed to update CMState status")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// cmStatesForTemplate maps a CMTemplate to the CMStates rendered from it or
+// from templates inheriting from it, so disabling or enabling it updates their
+// condition and changing it renders the ConfigMaps it failed to render
+func (r *CMStateReconciler) cmStatesForTemplate(obj client.Object) []reconcile.Request {
+	names := map[string]bool{obj.GetName(): true}
+	inheriting, err := inheritingTemplates(context.Background(), r, obj.GetName())
+	if err != nil {
+		return nil
+	}
+	for _, name := range inheriting {
+		names[name] = true
+	}
+	// namespaced templates inherit from cluster templates too
+	namespacedTemplates := &cachev1alpha2.NamespacedCMTemplateList{}
+	if err := r.List(context.Background(), namespacedTemplates); err != nil {
+		return nil
+	}
+	namespaced := make(map[types.NamespacedName]bool)
+	for _, cmTemplate := range namespacedTemplates.Items {
+		if base := cmTemplate.Spec.BaseTemplate; base != "" && names[base] {
+			namespaced[client.ObjectKeyFromObject(&cmTemplate)] = true
+		}
+	}
+
+	cmStates := &cachev1alpha2.CMStateList{}
+	if err := r.List(context.Background(), cmStates); err != nil {
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, cmState := range cmStates.Items {
+		matches := names[cmState.Spec.TemplateRef.Name]
+		if cmState.Spec.Scope() == cachev1alpha2.TemplateScopeNamespaced {
+			matches = namespaced[types.NamespacedName{Namespace: cmState.Namespace, Name: cmState.Spec.TemplateRef.Name}]
+		}
+		if matches {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&cmState)})
+		}
+	}
+	return requests
+}
+
+// cmStatesForNamespacedTemplate maps a NamespacedCMTemplate to the CMStates of
+// its namespace rendered from it
+func (r *CMStateReconciler) cmStatesForNamespacedTemplate(obj client.Object) []reconcile.Request {
+	cmStates := &cachev1alpha2.CMStateList{}
+	if err := r.List(context.Background(), cmStates, client.InNamespace(obj.GetNamespace())); err != nil {
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, cmState := range cmStates.Items {
+		if cmState.Spec.Scope() == cachev1alpha2.TemplateScopeNamespaced && cmState.Spec.TemplateRef.Name == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&cmState)})
+		}
+	}
+	return requests
+}
+
+// reconcileEmptyAudience deletes the CMState and its ConfigMap once the audience
+// has been empty for longer than the grace period. The time it became empty
+// is kept in the status, so the grace period outlasts restarts of the operator.
+// The CMState is only deleted as it was read, a pod joining it in the meantime
+// has it checked again.
+func (r *CMStateReconciler) reconcileEmptyAudience(ctx context.Context, cmState *cachev1alpha2.CMState, log logr.Logger) (ctrl.Result, error) {
+	gracePeriod, err := r.emptyAudienceGracePeriod(ctx, cmState)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if gracePeriod > 0 {
+		if cmState.Status.EmptySince == nil {
+			now := metav1.Now()
+			cmState.Status.EmptySince = &now
+			if err := r.Status().Update(ctx, cmState); err != nil {
+				log.Error(err, "Failed to update CMState status")
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{RequeueAfter: gracePeriod}, nil
+		}
+
+		remaining := time.Until(cmState.Status.EmptySince.Add(gracePeriod))
+		if remaining > 0 {
+			return ctrl.Result{RequeueAfter: remaining}, nil
+		}
+	}
+
+	// a pod the webhook admitted since the CMState was read joined its
+	// audience, deleting it anyway would leave the pod without its ConfigMap
+	err = r.Delete(ctx, cmState, client.Preconditions{UID: &cmState.UID, ResourceVersion: &cmState.ResourceVersion})
+	if apierrors.IsConflict(err) {
+		log.Info("CMState changed before it was deleted, checking its audience again")
+		return ctrl.Result{Requeue: true}, nil
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Error(err, "Failed to delete CMState")
+		return ctrl.Result{}, err
+	}
+
+	r.deleteAllRendered(ctx, cmState, log)
+	return ctrl.Result{}, nil
+}
+
+// emptyAudienceGracePeriod is how long the CMState is kept with an empty
+// audience, the ttlSecondsAfterEmpty of its template or the operator's default.
+// CMStates of a pod die with it, no other pod ever joins them.
+func (r *CMStateReconciler) emptyAudienceGracePeriod(ctx context.Context, cmState *cachev1alpha2.CMState) (time.Duration, error) {
+	if cmState.Spec.StateScope == cachev1alpha2.StateScopePod {
+		return 0, nil
+	}
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	err := r.getCMTemplate(ctx, cmState, cmTemplate)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return 0, err
+	}
+	if err == nil && cmTemplate.Spec.TTLSecondsAfterEmpty != nil {
+		return time.Duration(*cmTemplate.Spec.TTLSecondsAfterEmpty) * time.Second, nil
+	}
+	return r.EmptyAudienceGracePeriod, nil
+}
+
+// pruneDeletedOwners drops the audience entries of Jobs, and of the workloads
+// audiences tracked per owner record, that are gone. Their pods are deleted in
+// bursts along with them, entries those deletions missed would otherwise keep
+// the CMState around forever.
+func (r *CMStateReconciler) pruneDeletedOwners(ctx context.Context, cmState *cachev1alpha2.CMState) error {
+	audience := make([]cachev1alpha2.CMAudience, 0, len(cmState.Spec.Audience))
+	for _, entry := range cmState.Spec.Audience {
+		owner := ownerObject(entry.Kind)
+		if owner == nil {
+			audience = append(audience, entry)
+			continue
+		}
+		namespace := entry.Namespace
+		if namespace == "" {
+			namespace = cmState.Namespace
+		}
+		err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: entry.Name}, owner)
+		if apierrors.IsNotFound(err) || (err == nil && entry.UID != "" && owner.GetUID() != entry.UID) {
+			// gone, or replaced by a Job of the same name
+			continue
 		}
-		err = r.Delete(ctx, cm)
 		if err != nil {
-			log.Error(err, "Failed to delete tracked ConfigMap")
+			return err
+		}
+		audience = append(audience, entry)
+	}
+	if len(audience) == len(cmState.Spec.Audience) {
+		return nil
+	}
+	cmState.Spec.Audience = audience
+	return r.Update(ctx, cmState)
+}
+
+// pruneEvicted forgets the evicted pods that are gone. Until then the CMState
+// is kept, a pod whose eviction was refused after the webhook removed it from
+// the audience still uses the ConfigMap.
+func (r *CMStateReconciler) pruneEvicted(ctx context.Context, cmState *cachev1alpha2.CMState) error {
+	evicted := make([]cachev1alpha2.EvictedPod, 0, len(cmState.Spec.Evicted))
+	for _, entry := range cmState.Spec.Evicted {
+		pod := &corev1.Pod{}
+		err := r.Get(ctx, types.NamespacedName{Namespace: cmState.Namespace, Name: entry.Name}, pod)
+		if apierrors.IsNotFound(err) || (err == nil && pod.UID != entry.UID) {
+			// gone, or replaced by a pod of the same name
+			continue
 		}
-		err = r.Delete(ctx, cmState)
 		if err != nil {
-			log.Error(err, "Failed to delete CMState")
-			return ctrl.Result{}, err
+			return err
+		}
+		evicted = append(evicted, entry)
+	}
+	if len(evicted) == len(cmState.Spec.Evicted) {
+		return nil
+	}
+	cmState.Spec.Evicted = evicted
+	return r.Update(ctx, cmState)
+}
+
+// cmStateAnnotation is the annotation the webhook records the CMStates a pod
+// joined in, comma separated
+const cmStateAnnotation = "cache.spicedelver.me/cmstate"
+
+// cmStatesForPod maps a deleted pod to the CMStates it recorded joining, the
+// ones it was evicted from included
+func (r *CMStateReconciler) cmStatesForPod(obj client.Object) []reconcile.Request {
+	var requests []reconcile.Request
+	if names := obj.GetAnnotations()[cmStateAnnotation]; names != "" {
+		for _, name := range strings.Split(names, ",") {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}})
 		}
 	}
+	return requests
+}
 
-	return ctrl.Result{}, nil
+// podAdmissionGrace is how long the pod of a pod scoped CMState has to be
+// created after the webhook admitted it before the CMState counts it gone
+const podAdmissionGrace = time.Minute
+
+// pruneDeletedPod drops the audience of a pod scoped CMState once no pod in
+// its namespace records joining it. The webhook removes the pod when it is
+// deleted, a deletion it missed would keep the CMState and its ConfigMap
+// forever since no other pod ever joins it. A pod admitted within the grace
+// period may not be created yet, it returns how long to wait for it.
+func (r *CMStateReconciler) pruneDeletedPod(ctx context.Context, cmState *cachev1alpha2.CMState) (time.Duration, error) {
+	if cmState.Spec.StateScope != cachev1alpha2.StateScopePod || len(cmState.Spec.Audience) == 0 {
+		return 0, nil
+	}
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(cmState.Namespace)); err != nil {
+		return 0, err
+	}
+	for i := range pods.Items {
+		if joined(&pods.Items[i], cmState.Name) {
+			return 0, nil
+		}
+	}
+	var admitting time.Duration
+	for _, entry := range cmState.Spec.Audience {
+		if entry.AddedAt == nil {
+			continue
+		}
+		if remaining := time.Until(entry.AddedAt.Add(podAdmissionGrace)); remaining > admitting {
+			admitting = remaining
+		}
+	}
+	if admitting > 0 {
+		return admitting, nil
+	}
+	cmState.Spec.Audience = nil
+	return 0, r.Update(ctx, cmState)
+}
+
+// joined reports whether the pod recorded joining the CMState
+func joined(pod *corev1.Pod, cmStateName string) bool {
+	for _, name := range strings.Split(pod.Annotations[cmStateAnnotation], ",") {
+		if name == cmStateName {
+			return true
+		}
+	}
+	return false
+}
+
+// ownerObject returns an empty object of the workload kind an audience entry
+// records, nil for pods
+func ownerObject(kind string) client.Object {
+	switch kind {
+	case "Job":
+		return &batchv1.Job{}
+	case "Deployment":
+		return &appsv1.Deployment{}
+	case "StatefulSet":
+		return &appsv1.StatefulSet{}
+	case "DaemonSet":
+		return &appsv1.DaemonSet{}
+	case "ReplicaSet":
+		return &appsv1.ReplicaSet{}
+	case "ReplicationController":
+		return &corev1.ReplicationController{}
+	}
+	return nil
+}
+
+// cmStatesForJob maps a deleted Job to the CMStates in its namespace that
+// have it in their audience
+func (r *CMStateReconciler) cmStatesForJob(obj client.Object) []reconcile.Request {
+	cmStates := &cachev1alpha2.CMStateList{}
+	if err := r.List(context.Background(), cmStates, client.InNamespace(obj.GetNamespace())); err != nil {
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, cmState := range cmStates.Items {
+		for _, entry := range cmState.Spec.Audience {
+			if entry.Kind == "Job" && entry.Name == obj.GetName() {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&cmState)})
+				break
+			}
+		}
+	}
+	return requests
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *CMStateReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&cachev1alpha1.CMState{}).
+		For(&cachev1alpha2.CMState{}).
 		Named("CMStateController").
 		Owns(&corev1.ConfigMap{}).
+		Owns(&corev1.Secret{}).
+		Watches(&source.Kind{Type: &batchv1.Job{}},
+			handler.EnqueueRequestsFromMapFunc(r.cmStatesForJob),
+			builder.WithPredicates(predicate.Funcs{
+				CreateFunc:  func(event.CreateEvent) bool { return false },
+				UpdateFunc:  func(event.UpdateEvent) bool { return false },
+				GenericFunc: func(event.GenericEvent) bool { return false },
+			})).
+		Watches(&source.Kind{Type: &corev1.Pod{}},
+			handler.EnqueueRequestsFromMapFunc(r.cmStatesForPod),
+			builder.WithPredicates(predicate.Funcs{
+				CreateFunc:  func(event.CreateEvent) bool { return false },
+				UpdateFunc:  func(event.UpdateEvent) bool { return false },
+				GenericFunc: func(event.GenericEvent) bool { return false },
+			})).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}},
+			handler.EnqueueRequestsFromMapFunc(r.cmStatesForDataFrom("ConfigMap"))).
+		Watches(&source.Kind{Type: &corev1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.cmStatesForDataFrom("Secret"))).
+		Watches(&source.Kind{Type: &cachev1alpha2.CMTemplate{}},
+			handler.EnqueueRequestsFromMapFunc(r.cmStatesForTemplate),
+			builder.WithPredicates(predicate.Funcs{
+				UpdateFunc: func(e event.UpdateEvent) bool {
+					return renderedSpecChanged(&e.ObjectOld.(*cachev1alpha2.CMTemplate).Spec, &e.ObjectNew.(*cachev1alpha2.CMTemplate).Spec)
+				},
+				// only the templates inheriting from a created or deleted one
+				// render differently
+				CreateFunc:  func(e event.CreateEvent) bool { return inheritsFrom(r, e.Object.GetName()) },
+				DeleteFunc:  func(e event.DeleteEvent) bool { return inheritsFrom(r, e.Object.GetName()) },
+				GenericFunc: func(event.GenericEvent) bool { return false },
+			})).
+		Watches(&source.Kind{Type: &cachev1alpha2.NamespacedCMTemplate{}},
+			handler.EnqueueRequestsFromMapFunc(r.cmStatesForNamespacedTemplate),
+			builder.WithPredicates(predicate.Funcs{
+				UpdateFunc: func(e event.UpdateEvent) bool {
+					return renderedSpecChanged(&e.ObjectOld.(*cachev1alpha2.NamespacedCMTemplate).Spec, &e.ObjectNew.(*cachev1alpha2.NamespacedCMTemplate).Spec)
+				},
+				GenericFunc: func(event.GenericEvent) bool { return false },
+			})).
 		Complete(r)
 }
 
-// configMapForCMState returns a CMState Deployment object
-func (r *CMStateReconciler) configMapForCMState(
-	cmstate *cachev1alpha1.CMState, ctx context.Context, log logr.Logger) (*corev1.ConfigMap, error) {
-	cmTemplate := &cachev1alpha1.CMTemplate{}
-	err := r.Get(ctx, types.NamespacedName{
-		Name: cmstate.Spec.CMTemplate,
-	}, cmTemplate)
+// renderedSpecChanged reports whether the template changed in a way the
+// CMStates rendered from it have to follow. A changed template may render the
+// CMStates it failed to, or render them under another name.
+func renderedSpecChanged(oldSpec, newSpec *cachev1alpha2.CMTemplateSpec) bool {
+	return oldSpec.Disabled != newSpec.Disabled || !equality.Semantic.DeepEqual(oldSpec.Template, newSpec.Template) ||
+		!equality.Semantic.DeepEqual(oldSpec.Outputs, newSpec.Outputs) || oldSpec.Immutable != newSpec.Immutable || oldSpec.Versioning != newSpec.Versioning ||
+		oldSpec.UpdateStrategy != newSpec.UpdateStrategy || !equality.Semantic.DeepEqual(oldSpec.Computed, newSpec.Computed) ||
+		!equality.Semantic.DeepEqual(oldSpec.MaxRenderedBytes, newSpec.MaxRenderedBytes) ||
+		!equality.Semantic.DeepEqual(oldSpec.TTLSecondsAfterEmpty, newSpec.TTLSecondsAfterEmpty) ||
+		oldSpec.ConfigMapName != newSpec.ConfigMapName || oldSpec.ConfigMapNamePrefix != newSpec.ConfigMapNamePrefix ||
+		!equality.Semantic.DeepEqual(oldSpec.Target, newSpec.Target) ||
+		!equality.Semantic.DeepEqual(oldSpec.Metadata, newSpec.Metadata) ||
+		!equality.Semantic.DeepEqual(oldSpec.DataFrom, newSpec.DataFrom) ||
+		oldSpec.AllowSecretToConfigMap != newSpec.AllowSecretToConfigMap ||
+		oldSpec.BaseTemplate != newSpec.BaseTemplate ||
+		!equality.Semantic.DeepEqual(oldSpec.TargetNamespaces, newSpec.TargetNamespaces)
+}
+
+// replacementValue is the pod annotation value copied to the cmstate. Its
+// annotations hold the value verbatim, cmstates created before that only
+// have it as a label, and cmstates created before the template had a default
+// for it have neither.
+func replacementValue(cmstate *cachev1alpha2.CMState, tmpl *cachev1alpha2.Template, annotation string) (string, bool) {
+	if value, ok := cmstate.GetAnnotations()[annotation]; ok {
+		return value, true
+	}
+	if value, ok := cmstate.GetLabels()[annotation]; ok {
+		return value, true
+	}
+	return tmpl.DefaultValue(annotation)
+}
+
+// objectsForCMState returns the ConfigMap of the CMState followed by the
+// ConfigMaps of the outputs of its template, as Secrets when the template
+// renders into Secrets
+func (r *CMStateReconciler) objectsForCMState(
+	cmstate *cachev1alpha2.CMState, ctx context.Context, log logr.Logger) ([]client.Object, error) {
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	err := r.getCMTemplate(ctx, cmstate, cmTemplate)
 	if err != nil {
 		log.Error(err, "Error fetching cmTemplate")
 		return nil, err
 	}
+	if err := r.resolveBase(ctx, cmTemplate); err != nil {
+		return nil, err
+	}
+	if err := r.checkNamespace(ctx, cmTemplate, cmstate.Namespace); err != nil {
+		return nil, err
+	}
+	// references that can't be resolved are reported by reconcileDegraded
+	if _, err := r.resolveDataFrom(ctx, cmTemplate, cmstate.Namespace); err != nil {
+		return nil, err
+	}
 
-	labels := cmstate.GetLabels()
-
-	data := make(map[string]string)
-
-	for key, template := range cmTemplate.Spec.Template.CMTemplate {
-		for annotation, templateKey := range cmTemplate.Spec.Template.AnnotationReplace {
-			template = strings.ReplaceAll(template, templateKey, labels[annotation])
-		}
-		data[key] = template
+	computed, err := computeValues(&cmTemplate.Spec, cmstate)
+	if err != nil {
+		return nil, err
+	}
+	data, err := renderData(&cmTemplate.Spec.Template, cmstate, computed)
+	if err != nil {
+		return nil, err
+	}
+	name := renderedName(cmTemplate, cmstate)
+	labels := map[string]string{}
+	if cmTemplate.Spec.HashVersioned() {
+		labels[cachev1alpha2.ContentHashLabel] = cmTemplate.Spec.ContentHash(cmstate.ReplacementValues(&cmTemplate.Spec.Template))
+	}
+	var immutable *bool
+	if cmTemplate.Spec.Immutable {
+		immutable = &cmTemplate.Spec.Immutable
 	}
 	// configReplace := strings.NewReplacer("${exit_after_auth}", "false", "${internal_role_name}", labels["internal-role"], "${aws_role_name}", labels["aws-role"])
 	// configInitReplace := strings.NewReplacer("${exit_after_auth}", "true", "${internal_role_name}", labels["internal-role"], "${aws_role_name}", labels["aws-role"])
 
-	return &corev1.ConfigMap{
+	configMaps := []*corev1.ConfigMap{{
 		TypeMeta: metav1.TypeMeta{
 			APIVersion: "v1",
 			Kind:       "ConfigMap",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      cmstate.Name,
+			Name:      name,
 			Namespace: cmstate.GetNamespace(),
+			Labels:    labels,
 		},
-		Data: data,
+		Data:       data,
+		BinaryData: cmTemplate.Spec.Template.BinaryData,
+		Immutable:  immutable,
 		// Data: map[string]string{
 		// 	"config.hcl":      configReplace.Replace(agentTemplate),
 		// 	"config-init.hcl": configInitReplace.Replace(agentTemplate),
 		// },
-	}, nil
+	}}
+	for i := range cmTemplate.Spec.Outputs {
+		output := &cmTemplate.Spec.Outputs[i]
+		data, err := renderData(cmTemplate.Spec.Template.Output(output), cmstate, computed)
+		var renderErr *renderError
+		if errors.As(err, &renderErr) {
+			renderErr.key = output.Name + "/" + renderErr.key
+		}
+		if err != nil {
+			return nil, err
+		}
+		cm := &corev1.ConfigMap{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: "v1",
+				Kind:       "ConfigMap",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      cachev1alpha2.OutputName(name, output.Name),
+				Namespace: cmstate.GetNamespace(),
+				Labels:    copyLabels(labels),
+			},
+			Data:       data,
+			BinaryData: output.BinaryData,
+			Immutable:  immutable,
+		}
+		configMaps = append(configMaps, cm)
+	}
+
+	objects := make([]client.Object, 0, len(configMaps))
+	for _, cm := range configMaps {
+		// only what the CMState controls is ever deleted with it, an object
+		// of the same name may be someone else's
+		if err := ctrl.SetControllerReference(cmstate, cm, r.Scheme); err != nil {
+			return nil, err
+		}
+		if err := checkSize(&cmTemplate.Spec, cm); err != nil {
+			return nil, err
+		}
+		cmTemplate.ApplyMetadata(cm)
+		objects = append(objects, targetObject(&cmTemplate.Spec, cm))
+	}
+	return objects, nil
+}
+
+// targetObject returns the ConfigMap as the kind of object the template
+// renders into. A Secret holds the data and binary data of the ConfigMap
+// together, the keys never overlap.
+func targetObject(spec *cachev1alpha2.CMTemplateSpec, cm *corev1.ConfigMap) client.Object {
+	if spec.TargetKind() != cachev1alpha2.TargetKindSecret {
+		return cm
+	}
+	secret := &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: cm.ObjectMeta,
+		Type:       spec.SecretType(),
+		Immutable:  cm.Immutable,
+		Data:       make(map[string][]byte, len(cm.Data)+len(cm.BinaryData)),
+	}
+	for key, value := range cm.Data {
+		secret.Data[key] = []byte(value)
+	}
+	for key, value := range cm.BinaryData {
+		secret.Data[key] = value
+	}
+	return secret
+}
+
+// emptyObject returns an empty object of the kind to read rendered objects into
+func emptyObject(kind cachev1alpha2.TargetKind) client.Object {
+	if kind == cachev1alpha2.TargetKindSecret {
+		return &corev1.Secret{}
+	}
+	return &corev1.ConfigMap{}
+}
+
+// renderedName is the name of the ConfigMap the CMState renders into, that
+// of immutable and hash versioned templates changes with what it is rendered
+// from
+func renderedName(cmTemplate *cachev1alpha2.CMTemplate, cmState *cachev1alpha2.CMState) string {
+	name := cmTemplate.ConfigMapName(cmState.Name)
+	if !cmTemplate.Spec.HashVersioned() {
+		return name
+	}
+	return cachev1alpha2.ImmutableName(name, cmTemplate.Spec.ContentHash(cmState.ReplacementValues(&cmTemplate.Spec.Template)))
+}
+
+// hashVersioned reports whether the rendered object is named after the hash
+// of its content
+func hashVersioned(obj client.Object) bool {
+	return obj.GetLabels()[cachev1alpha2.ContentHashLabel] != ""
+}
+
+// copyLabels returns a copy of the labels, each rendered object gets its own
+func copyLabels(labels map[string]string) map[string]string {
+	copied := make(map[string]string, len(labels))
+	for key, value := range labels {
+		copied[key] = value
+	}
+	return copied
+}
+
+// kindOf names the kind of a rendered object for the logs
+func kindOf(obj client.Object) cachev1alpha2.TargetKind {
+	if _, ok := obj.(*corev1.Secret); ok {
+		return cachev1alpha2.TargetKindSecret
+	}
+	return cachev1alpha2.TargetKindConfigMap
+}
+
+// renderedObject returns an empty object of the kind the template of the
+// CMState renders into, a ConfigMap when the template is gone
+func (r *CMStateReconciler) renderedObject(ctx context.Context, cmState *cachev1alpha2.CMState) (client.Object, error) {
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	err := r.getCMTemplate(ctx, cmState, cmTemplate)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	return emptyObject(cmTemplate.Spec.TargetKind()), nil
+}
+
+// deleteRendered deletes the ConfigMap or Secret the CMState rendered under
+// the name, as the kind it last rendered. Objects it doesn't control are left
+// alone, the name may be taken by an object of the user.
+func (r *CMStateReconciler) deleteRendered(ctx context.Context, cmState *cachev1alpha2.CMState, name string, log logr.Logger) {
+	if name == "" {
+		return
+	}
+	obj, err := r.renderedKindObject(ctx, cmState)
+	if err != nil {
+		log.Error(err, "Failed to get the kind of the tracked ConfigMap", "ConfigMap.Name", name)
+		return
+	}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: cmState.Namespace, Name: name}, obj); err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Error(err, "Failed to get tracked ConfigMap", "ConfigMap.Name", name, "kind", kindOf(obj))
+		}
+		return
+	}
+	if !metav1.IsControlledBy(obj, cmState) {
+		log.Info("Leaving alone a ConfigMap the cmstate doesn't control", "ConfigMap.Name", name, "kind", kindOf(obj))
+		return
+	}
+	uid := obj.GetUID()
+	if err := r.Delete(ctx, obj, client.Preconditions{UID: &uid}); client.IgnoreNotFound(err) != nil {
+		log.Error(err, "Failed to delete tracked ConfigMap", "ConfigMap.Name", name, "kind", kindOf(obj))
+	}
+}
+
+// renderedKindObject returns an empty object of the kind the CMState last
+// rendered, for CMStates rendered before it was recorded the kind its template
+// renders into
+func (r *CMStateReconciler) renderedKindObject(ctx context.Context, cmState *cachev1alpha2.CMState) (client.Object, error) {
+	if cmState.Status.RenderedKind != "" {
+		return emptyObject(cmState.Status.RenderedKind), nil
+	}
+	return r.renderedObject(ctx, cmState)
+}
+
+// adoptRendered makes the CMState the controller of the object it rendered
+// before it recorded its kind, when it didn't set itself as such yet, so it
+// is deleted along with the CMState
+func (r *CMStateReconciler) adoptRendered(ctx context.Context, cmState *cachev1alpha2.CMState, obj client.Object) error {
+	if cmState.Status.RenderedKind != "" {
+		return nil
+	}
+	if metav1.GetControllerOf(obj) == nil {
+		if err := ctrl.SetControllerReference(cmState, obj, r.Scheme); err != nil {
+			return err
+		}
+		if err := r.Update(ctx, obj); err != nil {
+			return err
+		}
+	}
+	cmState.Status.RenderedKind = kindOf(obj)
+	return r.Status().Update(ctx, cmState)
+}
+
+// createOutputs creates the ConfigMaps of the outputs that don't exist yet
+func (r *CMStateReconciler) createOutputs(ctx context.Context, outputs []client.Object, log logr.Logger) error {
+	for _, cm := range outputs {
+		err := r.Create(ctx, cm)
+		if apierrors.IsAlreadyExists(err) {
+			continue
+		}
+		if err != nil {
+			log.Error(err, "Failed to create new ConfigMap", "ConfigMap.Namespace", cm.GetNamespace(), "ConfigMap.Name", cm.GetName(), "kind", kindOf(cm))
+			return err
+		}
+		log.Info("Created the ConfigMap of an output", "ConfigMap.Namespace", cm.GetNamespace(), "ConfigMap.Name", cm.GetName(), "kind", kindOf(cm))
+	}
+	return nil
+}
+
+// reconcileOutputs creates the ConfigMaps of outputs added to the template
+// after the CMState rendered its ConfigMap
+func (r *CMStateReconciler) reconcileOutputs(ctx context.Context, cmState *cachev1alpha2.CMState, log logr.Logger) (ctrl.Result, error) {
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	if err := r.getCMTemplate(ctx, cmState, cmTemplate); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	missing := false
+	for _, output := range cmTemplate.Spec.Outputs {
+		err := r.Get(ctx, types.NamespacedName{Namespace: cmState.Namespace, Name: cachev1alpha2.OutputName(cmState.Spec.Target, output.Name)},
+			emptyObject(cmTemplate.Spec.TargetKind()))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		missing = missing || err != nil
+	}
+	if !missing {
+		return ctrl.Result{}, nil
+	}
+
+	objects, err := r.objectsForCMState(cmState, ctx, log)
+	var renderErr *renderError
+	if errors.As(err, &renderErr) {
+		return r.reconcileRenderFailed(ctx, cmState, renderErr, log)
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, r.createOutputs(ctx, objects[1:], log)
+}
+
+// reconcileRollover renders the ConfigMap the CMState renders into anew when
+// its name changed, which for immutable templates is whenever what it is
+// rendered from changed. New pods are injected with the new one, the previous
+// ones are deleted once no pod uses them anymore.
+func (r *CMStateReconciler) reconcileRollover(ctx context.Context, cmState *cachev1alpha2.CMState, log logr.Logger) (ctrl.Result, error) {
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	if err := r.getCMTemplate(ctx, cmState, cmTemplate); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	// the inherited and referenced data is part of the content hash of
+	// immutable templates
+	var renderErr *renderError
+	if err := r.resolveBase(ctx, cmTemplate); errors.As(err, &renderErr) {
+		return r.reconcileRenderFailed(ctx, cmState, renderErr, log)
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+	if _, err := r.resolveDataFrom(ctx, cmTemplate, cmState.Namespace); err != nil {
+		return ctrl.Result{}, err
+	}
+	if renderedName(cmTemplate, cmState) == cmState.Spec.Target {
+		return ctrl.Result{}, r.prunePrevious(ctx, cmState, cmTemplate, log)
+	}
+
+	objects, err := r.objectsForCMState(cmState, ctx, log)
+	if errors.As(err, &renderErr) {
+		return r.reconcileRenderFailed(ctx, cmState, renderErr, log)
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	// createOutputs leaves alone what exists, an immutable ConfigMap of the
+	// same name has the same content
+	if err := r.createOutputs(ctx, objects, log); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	previous := cmState.Spec.Target
+	cmState.Spec.Target = objects[0].GetName()
+	if err := r.Patch(ctx, cmState, client.Merge); err != nil {
+		log.Error(err, "Failed to update CMState target")
+		return ctrl.Result{}, err
+	}
+	cmState.Status.ConfigMap = cmState.Spec.Target
+	cmState.Status.RenderedKind = kindOf(objects[0])
+	cmState.Status.RenderedFromGeneration = cmTemplate.Generation
+	requestReload(cmState, cmTemplate)
+	cmState.Status.PreviousConfigMaps = append([]string{previous}, cmState.Status.PreviousConfigMaps...)
+	meta.SetStatusCondition(&cmState.Status.Conditions, renderedCondition(cmState.Spec.Target))
+	cmState.Status.LastRenderTime = &metav1.Time{Time: time.Now()}
+	if err := r.Status().Update(ctx, cmState); err != nil {
+		log.Error(err, "Failed to update CMState status")
+		return ctrl.Result{}, err
+	}
+	log.Info("Rolled over to a new ConfigMap", "ConfigMap.Name", cmState.Spec.Target, "previous", previous)
+	if r.Recorder != nil {
+		r.Recorder.Eventf(cmState, corev1.EventTypeNormal, "RolledOver", "Rolled over from ConfigMap %s to %s", previous, cmState.Spec.Target)
+	}
+	return ctrl.Result{}, r.prunePrevious(ctx, cmState, cmTemplate, log)
+}
+
+// reconcileMetadata propagates the labels and annotations of the template to
+// the CMState and the ConfigMaps it renders into, the template may have
+// changed them since they were created
+func (r *CMStateReconciler) reconcileMetadata(ctx context.Context, cmState *cachev1alpha2.CMState) error {
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	if err := r.getCMTemplate(ctx, cmState, cmTemplate); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if cmTemplate.ApplyMetadata(cmState) {
+		if err := r.Update(ctx, cmState); err != nil {
+			return err
+		}
+	}
+
+	names := []string{cmState.Spec.Target}
+	for _, output := range cmTemplate.Spec.Outputs {
+		names = append(names, cachev1alpha2.OutputName(cmState.Spec.Target, output.Name))
+	}
+	for _, name := range names {
+		obj := emptyObject(cmTemplate.Spec.TargetKind())
+		err := r.Get(ctx, types.NamespacedName{Namespace: cmState.Namespace, Name: name}, obj)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if cmTemplate.ApplyMetadata(obj) {
+			if err := r.Update(ctx, obj); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prunePrevious deletes the previous ConfigMaps of the CMState no entry of its
+// audience was injected with and no pod in its namespace uses anymore, past
+// the most recent ones kept. The audience records the ConfigMap of each entry
+// as pods join, before the pods may have been created; pods use a ConfigMap
+// through their annotations, volumes or environment, which still covers the
+// older replicas of an entry.
+func (r *CMStateReconciler) prunePrevious(ctx context.Context, cmState *cachev1alpha2.CMState, cmTemplate *cachev1alpha2.CMTemplate, log logr.Logger) error {
+	previous := cmState.Status.PreviousConfigMaps
+	if len(previous) <= r.ImmutableHistory {
+		return nil
+	}
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(cmState.Namespace)); err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, entry := range cmState.Spec.Audience {
+		if entry.ConfigMap != "" {
+			used[entry.ConfigMap] = true
+		}
+	}
+	for i := range pods.Items {
+		for _, name := range podReferences(&pods.Items[i]) {
+			used[name] = true
+		}
+	}
+
+	kept := append([]string{}, previous[:r.ImmutableHistory]...)
+	for _, name := range previous[r.ImmutableHistory:] {
+		if used[name] || name == cmState.Spec.Target {
+			kept = append(kept, name)
+			continue
+		}
+		log.Info("Deleting a previous ConfigMap no pod uses anymore", "ConfigMap.Name", name)
+		r.deleteRendered(ctx, cmState, name, log)
+		for _, output := range cmTemplate.Spec.Outputs {
+			r.deleteRendered(ctx, cmState, cachev1alpha2.OutputName(name, output.Name), log)
+		}
+	}
+	if len(kept) == len(previous) {
+		return nil
+	}
+	cmState.Status.PreviousConfigMaps = kept
+	return r.Status().Update(ctx, cmState)
+}
+
+// podReferences returns the names of the ConfigMaps and Secrets the pod may
+// use: the values of its annotations, which agents read the name from, and
+// the objects its volumes and containers reference
+func podReferences(pod *corev1.Pod) []string {
+	var names []string
+	for _, value := range pod.Annotations {
+		names = append(names, value)
+	}
+	for _, volume := range pod.Spec.Volumes {
+		switch {
+		case volume.ConfigMap != nil:
+			names = append(names, volume.ConfigMap.Name)
+		case volume.Secret != nil:
+			names = append(names, volume.Secret.SecretName)
+		case volume.Projected != nil:
+			for _, source := range volume.Projected.Sources {
+				if source.ConfigMap != nil {
+					names = append(names, source.ConfigMap.Name)
+				}
+				if source.Secret != nil {
+					names = append(names, source.Secret.Name)
+				}
+			}
+		}
+	}
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, ephemeral := range pod.Spec.EphemeralContainers {
+		containers = append(containers, corev1.Container(ephemeral.EphemeralContainerCommon))
+	}
+	for _, container := range containers {
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.ConfigMapRef != nil {
+				names = append(names, envFrom.ConfigMapRef.Name)
+			}
+			if envFrom.SecretRef != nil {
+				names = append(names, envFrom.SecretRef.Name)
+			}
+		}
+		for _, env := range container.Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if env.ValueFrom.ConfigMapKeyRef != nil {
+				names = append(names, env.ValueFrom.ConfigMapKeyRef.Name)
+			}
+			if env.ValueFrom.SecretKeyRef != nil {
+				names = append(names, env.ValueFrom.SecretKeyRef.Name)
+			}
+		}
+	}
+	return names
+}
+
+// deleteAllRendered deletes the ConfigMap of the CMState and those of the
+// outputs of its template, along with the previous ones it rolled over from
+func (r *CMStateReconciler) deleteAllRendered(ctx context.Context, cmState *cachev1alpha2.CMState, log logr.Logger) {
+	outputs := []cachev1alpha2.Output{}
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	if err := r.getCMTemplate(ctx, cmState, cmTemplate); err == nil {
+		// the outputs are owned by the CMState should the template be gone
+		outputs = cmTemplate.Spec.Outputs
+	}
+	for _, name := range append([]string{cmState.Spec.Target}, cmState.Status.PreviousConfigMaps...) {
+		r.deleteRendered(ctx, cmState, name, log)
+		if name == "" {
+			continue
+		}
+		for _, output := range outputs {
+			r.deleteRendered(ctx, cmState, cachev1alpha2.OutputName(name, output.Name), log)
+		}
+	}
 }
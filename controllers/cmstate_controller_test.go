@@ -0,0 +1,1982 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+)
+
+func newTestCMState(audience ...string) *cachev1alpha2.CMState {
+	cmState := &cachev1alpha2.CMState{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "cmstate-vault-agent",
+			Namespace: "default",
+		},
+		Spec: cachev1alpha2.CMStateSpec{
+			Audience:    []cachev1alpha2.CMAudience{},
+			TemplateRef: cachev1alpha2.TemplateRef{Name: "vault-agent"},
+			Target:      "cmstate-vault-agent",
+		},
+	}
+	for _, name := range audience {
+		cmState.Spec.Audience = append(cmState.Spec.Audience, cachev1alpha2.CMAudience{Kind: "Pod", Name: name})
+	}
+	return cmState
+}
+
+func newTestCMTemplate() *cachev1alpha2.CMTemplate {
+	return &cachev1alpha2.CMTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "vault-agent"},
+		Spec: cachev1alpha2.CMTemplateSpec{
+			Template: cachev1alpha2.Template{
+				AnnotationReplace: []cachev1alpha2.KeyedReplacement{{Key: "vault.hashicorp.com/role", Replacement: cachev1alpha2.Replacement{Placeholder: "{role}"}}},
+				Data:              map[string]string{"config.hcl": "role = \"{role}\""},
+			},
+		},
+	}
+}
+
+func newTestConfigMap() *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "cmstate-vault-agent",
+			Namespace:       "default",
+			OwnerReferences: renderedByTestCMState(),
+		},
+	}
+}
+
+// renderedByTestCMState is the controller reference the CMState of
+// newTestCMState sets on the objects it renders
+func renderedByTestCMState() []metav1.OwnerReference {
+	return []metav1.OwnerReference{{
+		APIVersion: cachev1alpha2.GroupVersion.String(),
+		Kind:       "CMState",
+		Name:       "cmstate-vault-agent",
+		Controller: pointer.Bool(true),
+	}}
+}
+
+func newTestCMStateReconciler(objs ...client.Object) *CMStateReconciler {
+	return &CMStateReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(objs...).Build(),
+		Scheme: scheme.Scheme,
+	}
+}
+
+// joiningClient lets the webhook add a pod to the audience of the CMState
+// right before it is deleted
+type joiningClient struct {
+	client.Client
+}
+
+func (c *joiningClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	if _, ok := obj.(*cachev1alpha2.CMState); ok {
+		joined := &cachev1alpha2.CMState{}
+		if err := c.Client.Get(ctx, client.ObjectKeyFromObject(obj), joined); err != nil {
+			return err
+		}
+		joined.Spec.Audience = append(joined.Spec.Audience, cachev1alpha2.CMAudience{Kind: "Pod", Name: "app-1"})
+		if err := c.Client.Update(ctx, joined); err != nil {
+			return err
+		}
+	}
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+var _ = Describe("CMStateReconciler", func() {
+	ctx := context.Background()
+
+	Context("when the last audience member is gone", func() {
+		It("deletes the cmstate and its configmap without a grace period", func() {
+			cmState := newTestCMState()
+			r := newTestCMStateReconciler(cmState, newTestConfigMap())
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &cachev1alpha2.CMState{}))).To(BeTrue())
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &corev1.ConfigMap{}))).To(BeTrue())
+		})
+
+		It("keeps the cmstate for reuse by pods arriving within the grace period", func() {
+			cmState := newTestCMState()
+			r := newTestCMStateReconciler(cmState, newTestConfigMap())
+			r.EmptyAudienceGracePeriod = time.Hour
+
+			result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(time.Hour))
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Status.EmptySince).NotTo(BeNil())
+
+			// the webhook admits a new pod before the grace period ran out
+			cmState.Spec.Audience = append(cmState.Spec.Audience, cachev1alpha2.CMAudience{Kind: "Pod", Name: "app-1"})
+			Expect(r.Update(ctx, cmState)).To(Succeed())
+
+			_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Status.EmptySince).To(BeNil())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), &corev1.ConfigMap{})).To(Succeed())
+		})
+
+		It("deletes the cmstate once the grace period expired", func() {
+			cmState := newTestCMState()
+			emptySince := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+			cmState.Status.EmptySince = &emptySince
+			r := newTestCMStateReconciler(cmState, newTestConfigMap())
+			r.EmptyAudienceGracePeriod = time.Hour
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &cachev1alpha2.CMState{}))).To(BeTrue())
+		})
+
+		It("keeps the cmstate and its configmap a pod joined while deleting it", func() {
+			cmState := newTestCMState()
+			r := newTestCMStateReconciler(cmState, newTestConfigMap())
+			r.Client = &joiningClient{Client: r.Client}
+
+			result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Requeue).To(BeTrue())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(HaveLen(1))
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), &corev1.ConfigMap{})).To(Succeed())
+		})
+	})
+
+	Context("when a pod was evicted", func() {
+		newEvictedCMState := func() *cachev1alpha2.CMState {
+			cmState := newTestCMState()
+			cmState.Spec.Evicted = []cachev1alpha2.EvictedPod{{Name: "app-1", UID: "app-1-uid", EvictedAt: metav1.Now()}}
+			return cmState
+		}
+
+		It("keeps the cmstate and its configmap while the evicted pod still runs", func() {
+			cmState := newEvictedCMState()
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-1", Namespace: "default", UID: "app-1-uid"}}
+			r := newTestCMStateReconciler(cmState, newTestConfigMap(), pod)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Evicted).To(HaveLen(1))
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), &corev1.ConfigMap{})).To(Succeed())
+		})
+
+		It("deletes the cmstate once the evicted pod is gone or replaced", func() {
+			cmState := newEvictedCMState()
+			replaced := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-1", Namespace: "default", UID: "app-1-new-uid"}}
+			r := newTestCMStateReconciler(cmState, newTestConfigMap(), replaced)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &cachev1alpha2.CMState{}))).To(BeTrue())
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &corev1.ConfigMap{}))).To(BeTrue())
+		})
+
+		It("keeps the cmstate for the ttl of its template over the grace period", func() {
+			cmState := newTestCMState()
+			emptySince := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+			cmState.Status.EmptySince = &emptySince
+			cmTemplate := newTestCMTemplate()
+			ttl := int32(3 * 60 * 60)
+			cmTemplate.Spec.TTLSecondsAfterEmpty = &ttl
+			r := newTestCMStateReconciler(cmState, cmTemplate, newTestConfigMap())
+			r.EmptyAudienceGracePeriod = time.Hour
+
+			result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeNumerically("~", time.Hour, time.Minute))
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), &corev1.ConfigMap{})).To(Succeed())
+		})
+
+		It("deletes the cmstate once the ttl of its template expired", func() {
+			cmState := newTestCMState()
+			emptySince := metav1.NewTime(time.Now().Add(-2 * time.Minute))
+			cmState.Status.EmptySince = &emptySince
+			cmTemplate := newTestCMTemplate()
+			ttl := int32(60)
+			cmTemplate.Spec.TTLSecondsAfterEmpty = &ttl
+			r := newTestCMStateReconciler(cmState, cmTemplate, newTestConfigMap())
+			r.EmptyAudienceGracePeriod = time.Hour
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &cachev1alpha2.CMState{}))).To(BeTrue())
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &corev1.ConfigMap{}))).To(BeTrue())
+		})
+
+		It("deletes the cmstate of a pod right away", func() {
+			cmState := newTestCMState()
+			cmState.Spec.StateScope = cachev1alpha2.StateScopePod
+			cmTemplate := newTestCMTemplate()
+			ttl := int32(60)
+			cmTemplate.Spec.TTLSecondsAfterEmpty = &ttl
+			r := newTestCMStateReconciler(cmState, cmTemplate, newTestConfigMap())
+			r.EmptyAudienceGracePeriod = time.Hour
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &cachev1alpha2.CMState{}))).To(BeTrue())
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &corev1.ConfigMap{}))).To(BeTrue())
+		})
+	})
+
+	Context("when the pod of a pod scoped cmstate is gone", func() {
+		newPodCMState := func(addedAt time.Time) *cachev1alpha2.CMState {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.StateScope = cachev1alpha2.StateScopePod
+			cmState.Spec.Audience[0].AddedAt = &metav1.Time{Time: addedAt}
+			return cmState
+		}
+
+		It("deletes the cmstate and its configmap the webhook missed the deletion of", func() {
+			cmState := newPodCMState(time.Now().Add(-time.Hour))
+			r := newTestCMStateReconciler(cmState, newTestCMTemplate(), newTestConfigMap())
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &cachev1alpha2.CMState{}))).To(BeTrue())
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &corev1.ConfigMap{}))).To(BeTrue())
+		})
+
+		It("keeps the cmstate while its pod is there", func() {
+			cmState := newPodCMState(time.Now().Add(-time.Hour))
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:        "app-1",
+				Namespace:   "default",
+				Annotations: map[string]string{"cache.spicedelver.me/cmstate": "cmstate-other," + cmState.Name},
+			}}
+			r := newTestCMStateReconciler(cmState, newTestCMTemplate(), newTestConfigMap(), pod)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(HaveLen(1))
+			Expect(r.cmStatesForPod(pod)).To(ContainElement(reconcile.Request{NamespacedName: client.ObjectKeyFromObject(cmState)}))
+		})
+
+		It("waits for a pod just admitted to be created", func() {
+			cmState := newPodCMState(time.Now())
+			r := newTestCMStateReconciler(cmState, newTestCMTemplate(), newTestConfigMap())
+
+			result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeNumerically("~", podAdmissionGrace, time.Second))
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(HaveLen(1))
+		})
+	})
+
+	Context("when the cmtemplate is disabled", func() {
+		newDisabledTemplate := func(disabled bool) *cachev1alpha2.CMTemplate {
+			return &cachev1alpha2.CMTemplate{
+				ObjectMeta: metav1.ObjectMeta{Name: "vault-agent"},
+				Spec:       cachev1alpha2.CMTemplateSpec{Disabled: disabled},
+			}
+		}
+
+		It("marks the cmstate disabled and keeps its configmap", func() {
+			cmState := newTestCMState("app-1")
+			r := newTestCMStateReconciler(cmState, newTestConfigMap(), newDisabledTemplate(true))
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(meta.IsStatusConditionTrue(cmState.Status.Conditions, typeDisabledCMState)).To(BeTrue())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), &corev1.ConfigMap{})).To(Succeed())
+		})
+
+		It("doesn't render the configmap", func() {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			r := newTestCMStateReconciler(cmState, newDisabledTemplate(true))
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &corev1.ConfigMap{}))).To(BeTrue())
+		})
+
+		It("clears the condition once the template is enabled again", func() {
+			cmState := newTestCMState("app-1")
+			meta.SetStatusCondition(&cmState.Status.Conditions, metav1.Condition{Type: typeDisabledCMState, Status: metav1.ConditionTrue, Reason: "TemplateDisabled"})
+			r := newTestCMStateReconciler(cmState, newTestConfigMap(), newDisabledTemplate(false))
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(meta.IsStatusConditionFalse(cmState.Status.Conditions, typeDisabledCMState)).To(BeTrue())
+		})
+
+		It("leaves cmstates of enabled templates without the condition", func() {
+			cmState := newTestCMState("app-1")
+			r := newTestCMStateReconciler(cmState, newTestConfigMap(), newDisabledTemplate(false))
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(meta.FindStatusCondition(cmState.Status.Conditions, typeDisabledCMState)).To(BeNil())
+		})
+	})
+
+	Context("when exporting the audience size", func() {
+		It("counts the pods and owners of the audience", func() {
+			cmState := newTestCMState("app-1", "app-2")
+			cmState.Spec.Audience = append(cmState.Spec.Audience, cachev1alpha2.CMAudience{
+				Kind: "ReplicaSet", Name: "app", Count: 5, Members: []types.UID{"a", "b", "c"},
+			})
+			r := newTestCMStateReconciler(cmState, newTestConfigMap())
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(promtestutil.ToFloat64(audienceSize.WithLabelValues("default", cmState.Name))).To(Equal(5.0))
+		})
+
+		It("drops deleted cmstates", func() {
+			cmState := newTestCMState("app-1")
+			audienceSize.WithLabelValues("default", cmState.Name).Set(1)
+			r := newTestCMStateReconciler()
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(audienceSize.DeleteLabelValues("default", cmState.Name)).To(BeFalse())
+		})
+	})
+
+	Context("when rendering the configmap", func() {
+		newRenderTemplate := func() *cachev1alpha2.CMTemplate {
+			return &cachev1alpha2.CMTemplate{
+				ObjectMeta: metav1.ObjectMeta{Name: "vault-agent"},
+				Spec: cachev1alpha2.CMTemplateSpec{
+					Template: cachev1alpha2.Template{
+						AnnotationReplace: []cachev1alpha2.KeyedReplacement{{Key: "vault.hashicorp.com/address", Replacement: cachev1alpha2.Replacement{Placeholder: "{address}"}}},
+						Data:              map[string]string{"config.hcl": "address = \"{address}\""},
+					},
+				},
+			}
+		}
+		render := func(cmState *cachev1alpha2.CMState) string {
+			cmState.Spec.Target = ""
+			r := newTestCMStateReconciler(newRenderTemplate(), cmState)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			return cm.Data["config.hcl"]
+		}
+
+		It("uses the verbatim value from the cmstate annotations", func() {
+			cmState := newTestCMState("app-1")
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/address": "https://vault.example.com:8200"}
+			cmState.Labels = map[string]string{"vault.hashicorp.com/address": "https---vault.example.com-8200-1a2b3c4d"}
+
+			Expect(render(cmState)).To(Equal(`address = "https://vault.example.com:8200"`))
+		})
+
+		It("falls back to the labels of cmstates created before", func() {
+			cmState := newTestCMState("app-1")
+			cmState.Labels = map[string]string{"vault.hashicorp.com/address": "vault.example.com"}
+
+			Expect(render(cmState)).To(Equal(`address = "vault.example.com"`))
+		})
+
+		It("replaces the labels of the template", func() {
+			cmTemplate := newRenderTemplate()
+			cmTemplate.Spec.Template.LabelReplace = []cachev1alpha2.KeyedReplacement{{Key: "team", Replacement: cachev1alpha2.Replacement{Placeholder: "{team}"}}}
+			cmTemplate.Spec.Template.Data["config.hcl"] = `address = "{address}" team = "{team}"`
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/address": "vault.example.com", "team": "payments"}
+			r := newTestCMStateReconciler(cmTemplate, cmState)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data["config.hcl"]).To(Equal(`address = "vault.example.com" team = "payments"`))
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Status.LastRenderTime).NotTo(BeNil())
+		})
+
+		It("copies the binary data without replacing in it", func() {
+			cmTemplate := newRenderTemplate()
+			cmTemplate.Spec.Template.BinaryData = map[string][]byte{"truststore.jks": []byte("\xfe\xed{address}")}
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/address": "vault.example.com"}
+			r := newTestCMStateReconciler(cmTemplate, cmState)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.BinaryData).To(HaveKeyWithValue("truststore.jks", []byte("\xfe\xed{address}")))
+		})
+
+		It("replaces the placeholders only in the data keys they apply to", func() {
+			cmTemplate := newRenderTemplate()
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/address", cachev1alpha2.Replacement{Placeholder: "{address}", AppliesTo: []string{"config.hcl"}})
+			cmTemplate.Spec.Template.Data["app.json"] = `{"pattern": "{address}"}`
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/address": "vault.example.com"}
+			r := newTestCMStateReconciler(cmTemplate, cmState)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data).To(Equal(map[string]string{
+				"config.hcl": `address = "vault.example.com"`,
+				"app.json":   `{"pattern": "{address}"}`,
+			}))
+		})
+
+		It("falls back to the default of the template", func() {
+			address := "https://vault.default:8200"
+			cmTemplate := newRenderTemplate()
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/address", cachev1alpha2.Replacement{Placeholder: "{address}", Default: &address})
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			r := newTestCMStateReconciler(cmTemplate, cmState)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data["config.hcl"]).To(Equal(`address = "https://vault.default:8200"`))
+		})
+	})
+
+	Context("when rendering the configmap with the GoTemplate engine", func() {
+		newGoTemplate := func(data string) *cachev1alpha2.CMTemplate {
+			return &cachev1alpha2.CMTemplate{
+				ObjectMeta: metav1.ObjectMeta{Name: "vault-agent"},
+				Spec: cachev1alpha2.CMTemplateSpec{
+					Template: cachev1alpha2.Template{
+						AnnotationReplace: []cachev1alpha2.KeyedReplacement{{Key: "vault.hashicorp.com/role", Replacement: cachev1alpha2.Replacement{Placeholder: ""}}},
+						Data:              map[string]string{"config.hcl": data},
+						Engine:            cachev1alpha2.TemplateEngineGoTemplate,
+					},
+				},
+			}
+		}
+		newRenderCMState := func() *cachev1alpha2.CMState {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/role": "app"}
+			cmState.Labels = map[string]string{"team": "payments"}
+			return cmState
+		}
+
+		It("executes the data against the cmstate", func() {
+			cmState := newRenderCMState()
+			r := newTestCMStateReconciler(cmState, newGoTemplate(
+				`{{ if eq (index .Annotations "vault.hashicorp.com/role") "app" }}role = "{{ .Labels.team }}-{{ .PodName }}.{{ .Namespace }}"{{ end }}`))
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data["config.hcl"]).To(Equal(`role = "payments-app-1.default"`))
+		})
+
+		It("calls the sprig functions", func() {
+			cmState := newRenderCMState()
+			r := newTestCMStateReconciler(cmState, newGoTemplate(
+				`{{ range keys (dict "b" 1 "a" 2) }}{{ . }}{{ end }} {{ .Labels.team | upper | quote }} {{ index .Labels "owner" | default "ops" }} {{ sha256sum "app" | trunc 8 }}`))
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data["config.hcl"]).To(Equal(`ab "PAYMENTS" ops a172cedc`))
+		})
+
+		DescribeTable("renders the encoding and layout helpers",
+			func(data, expected string) {
+				cmState := newRenderCMState()
+				r := newTestCMStateReconciler(cmState, newGoTemplate(data))
+
+				_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+				Expect(err).NotTo(HaveOccurred())
+
+				cm := &corev1.ConfigMap{}
+				Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+				Expect(cm.Data["config.hcl"]).To(Equal(expected))
+			},
+			Entry("b64enc of ascii", `{{ .Labels.team | b64enc }}`, "cGF5bWVudHM="),
+			Entry("b64enc of UTF-8", `{{ "héllo ✓" | b64enc }}`, "aMOpbGxvIOKckw=="),
+			Entry("b64enc of a CA bundle keeping its newlines",
+				`{{ "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n" | b64enc }}`,
+				"LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCk1JSUIKLS0tLS1FTkQgQ0VSVElGSUNBVEUtLS0tLQo="),
+			Entry("b64enc of nothing", `{{ "" | b64enc }}`, ""),
+			Entry("indent of a single line", `{{ .Labels.team | indent 2 }}`, "  payments"),
+			Entry("indent of every line", `{{ "a\nb\nc" | indent 2 }}`, "  a\n  b\n  c"),
+			Entry("indent after a trailing newline", `{{ "a\n" | indent 2 }}`, "  a\n  "),
+			Entry("indent of empty lines", `{{ "a\n\nb" | indent 2 }}`, "  a\n  \n  b"),
+			Entry("indent keeping carriage returns", `{{ "a\r\nb" | indent 2 }}`, "  a\r\n  b"),
+			Entry("indent of UTF-8", `{{ "ü\n✓" | indent 4 }}`, "    ü\n    ✓"),
+			Entry("indent of nothing", `{{ "" | indent 2 }}`, "  "),
+			Entry("indent by a negative number", `{{ "a\nb" | indent -2 }}`, "a\nb"),
+			Entry("indent of a nested template",
+				"agent {\n{{ `template {\n  source = \"/vault/role.tpl\"\n}` | indent 2 }}\n}",
+				"agent {\n  template {\n    source = \"/vault/role.tpl\"\n  }\n}"),
+			Entry("toJson of a dict with sorted keys", `{{ dict "ttl" 60 "role" .Labels.team | toJson }}`, `{"role":"payments","ttl":60}`),
+			Entry("toJson of a list", `{{ list "a" 1 true | toJson }}`, `["a",1,true]`),
+			Entry("toJson escaping newlines and quotes", `{{ "a\n\"b\"" | toJson }}`, `"a\n\"b\""`),
+			Entry("toJson of UTF-8", `{{ "héllo ✓" | toJson }}`, `"héllo ✓"`),
+			Entry("toJson escaping HTML like sprig", `{{ "<a&b>" | toJson }}`, `"\u003ca\u0026b\u003e"`),
+			Entry("quote escaping newlines", `{{ "a\nb" | quote }}`, `"a\nb"`),
+			Entry("quote of UTF-8", `{{ "héllo ✓" | quote }}`, `"héllo ✓"`),
+			Entry("repeat", `{{ .Labels.team | repeat 2 }}`, "paymentspayments"),
+			Entry("repeat of nothing", `{{ "" | repeat 1000000000 }}`, ""),
+			Entry("chained helpers", `{{ dict "team" .Labels.team | toJson | b64enc }}`, "eyJ0ZWFtIjoicGF5bWVudHMifQ=="),
+		)
+
+		It("renders optional annotations the pod left out empty", func() {
+			cmState := newRenderCMState()
+			optional := false
+			cmTemplate := newGoTemplate(`{{ if .Annotations.sink }}sink = "{{ .Annotations.sink }}"{{ end }}`)
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "sink", cachev1alpha2.Replacement{Required: &optional})
+			r := newTestCMStateReconciler(cmState, cmTemplate)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data["config.hcl"]).To(BeEmpty())
+		})
+
+		It("exposes the values of typed parameters as their types", func() {
+			cmState := newRenderCMState()
+			cmState.Annotations["skip"] = "true"
+			cmState.Annotations["ttl"] = "300"
+			cmTemplate := newGoTemplate(`{{ if .Params.skip }}tls_skip_verify = true{{ end }}{{ if gt .Params.ttl 60 }} ttl = "{{ .Params.ttl }}s"{{ end }} role = "{{ index .Params "vault.hashicorp.com/role" }}"`)
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "skip", cachev1alpha2.Replacement{Type: cachev1alpha2.ReplacementTypeBool})
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "ttl", cachev1alpha2.Replacement{Type: cachev1alpha2.ReplacementTypeInt})
+			r := newTestCMStateReconciler(cmState, cmTemplate)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data["config.hcl"]).To(Equal(`tls_skip_verify = true ttl = "300s" role = "app"`))
+		})
+
+		It("exposes the pod fields carried by the cmstate", func() {
+			cmState := newRenderCMState()
+			cmState.Annotations["serviceaccount"] = "vault-auth"
+			cmTemplate := newGoTemplate(`role = "{{ .Fields.serviceaccount }}" node = "{{ .Fields.node }}"`)
+			cmTemplate.Spec.Template.FieldReplace = map[string]cachev1alpha2.FieldReplacement{
+				"serviceaccount": {FieldPath: "spec.serviceAccountName"},
+				"node":           {FieldPath: "spec.nodeName"},
+			}
+			r := newTestCMStateReconciler(cmState, cmTemplate)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data["config.hcl"]).To(Equal(`role = "vault-auth" node = ""`))
+		})
+
+		It("leaves the default delimiters to the data with custom ones", func() {
+			cmState := newRenderCMState()
+			cmTemplate := newGoTemplate(`{{ with secret "<< index .Annotations "vault.hashicorp.com/role" >>" }}{{ end }}`)
+			cmTemplate.Spec.Template.Delimiters = &cachev1alpha2.Delimiters{Left: "<<", Right: ">>"}
+			r := newTestCMStateReconciler(cmState, cmTemplate)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data["config.hcl"]).To(Equal(`{{ with secret "app" }}{{ end }}`))
+		})
+
+		It("surfaces a missing key as a condition instead of rendering", func() {
+			cmState := newRenderCMState()
+			r := newTestCMStateReconciler(cmState, newGoTemplate(`role = "{{ .Labels.owner }}"`))
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &corev1.ConfigMap{}))).To(BeTrue())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			condition := meta.FindStatusCondition(cmState.Status.Conditions, typeAvailableCMState)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal("RenderFailed"))
+			Expect(condition.Message).To(ContainSubstring(`map has no entry for key "owner"`))
+		})
+
+		It("fails repeating past the size of a ConfigMap before building the string", func() {
+			cmState := newRenderCMState()
+			r := newTestCMStateReconciler(cmState, newGoTemplate(`{{ .Labels.team | repeat 1000000000000 }}`))
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			condition := meta.FindStatusCondition(cmState.Status.Conditions, typeAvailableCMState)
+			Expect(condition).To(HaveField("Reason", "RenderFailed"))
+			Expect(condition.Message).To(ContainSubstring("exceeds the 1048576 bytes of a ConfigMap"))
+		})
+
+		It("marks the cmstate available once it renders", func() {
+			cmState := newRenderCMState()
+			meta.SetStatusCondition(&cmState.Status.Conditions, metav1.Condition{Type: typeAvailableCMState, Status: metav1.ConditionFalse, Reason: "RenderFailed"})
+			r := newTestCMStateReconciler(cmState, newGoTemplate(`role = "{{ .Labels.team }}"`))
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(meta.IsStatusConditionTrue(cmState.Status.Conditions, typeAvailableCMState)).To(BeTrue())
+		})
+	})
+
+	Context("when the template has computed values", func() {
+		newComputedTemplate := func(engine cachev1alpha2.TemplateEngine, data string) *cachev1alpha2.CMTemplate {
+			return &cachev1alpha2.CMTemplate{
+				ObjectMeta: metav1.ObjectMeta{Name: "vault-agent"},
+				Spec: cachev1alpha2.CMTemplateSpec{
+					Template: cachev1alpha2.Template{
+						LabelReplace: []cachev1alpha2.KeyedReplacement{{Key: "tier", Replacement: cachev1alpha2.Replacement{Placeholder: "{tier}"}}},
+						Data:         map[string]string{"config.hcl": data},
+						Engine:       engine,
+					},
+					Computed: []cachev1alpha2.ComputedValue{{
+						Key:         "role",
+						Expression:  `labels["tier"] == "frontend" ? "web-" + podNamespace : "backend"`,
+						Placeholder: "{role}",
+					}},
+				},
+			}
+		}
+		render := func(cmTemplate *cachev1alpha2.CMTemplate, tier string) (*cachev1alpha2.CMState, *CMStateReconciler) {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			cmState.Annotations = map[string]string{"tier": tier}
+			r := newTestCMStateReconciler(cmState, cmTemplate)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			return cmState, r
+		}
+
+		It("replaces the placeholder with the computed value", func() {
+			cmState, r := render(newComputedTemplate(cachev1alpha2.TemplateEngineReplace, `role = "{role}" tier = "{tier}"`), "frontend")
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data["config.hcl"]).To(Equal(`role = "web-default" tier = "frontend"`))
+		})
+
+		It("exposes the computed values to the GoTemplate engine", func() {
+			cmState, r := render(newComputedTemplate(cachev1alpha2.TemplateEngineGoTemplate, `role = "{{ .Computed.role }}"`), "batch")
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data["config.hcl"]).To(Equal(`role = "backend"`))
+		})
+
+		It("surfaces an expression failing to evaluate as a condition instead of rendering", func() {
+			cmTemplate := newComputedTemplate(cachev1alpha2.TemplateEngineReplace, `role = "{role}"`)
+			cmTemplate.Spec.Computed[0].Expression = `annotations["vault.hashicorp.com/role"]`
+			cmState, r := render(cmTemplate, "frontend")
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &corev1.ConfigMap{}))).To(BeTrue())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			condition := meta.FindStatusCondition(cmState.Status.Conditions, typeAvailableCMState)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal("RenderFailed"))
+			Expect(condition.Message).To(ContainSubstring("computed value role"))
+		})
+	})
+
+	Context("when the template has outputs", func() {
+		newOutputTemplate := func() *cachev1alpha2.CMTemplate {
+			return &cachev1alpha2.CMTemplate{
+				ObjectMeta: metav1.ObjectMeta{Name: "vault-agent"},
+				Spec: cachev1alpha2.CMTemplateSpec{
+					Template: cachev1alpha2.Template{
+						AnnotationReplace: []cachev1alpha2.KeyedReplacement{{Key: "vault.hashicorp.com/role", Replacement: cachev1alpha2.Replacement{Placeholder: "{role}"}}},
+						Data:              map[string]string{"config.hcl": "role = \"{role}\""},
+					},
+					Outputs: []cachev1alpha2.Output{{
+						Name:             "init",
+						CMTemplate:       map[string]string{"config-init.hcl": "role = \"{role}\" exit_after_auth = true"},
+						TargetAnnotation: "example.com/init-configmap",
+					}},
+				},
+			}
+		}
+		outputKey := types.NamespacedName{Namespace: "default", Name: "cmstate-vault-agent-init"}
+
+		It("renders and owns a ConfigMap per output", func() {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/role": "reader"}
+			r := newTestCMStateReconciler(newOutputTemplate(), cmState)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, outputKey, cm)).To(Succeed())
+			Expect(cm.Data).To(Equal(map[string]string{"config-init.hcl": `role = "reader" exit_after_auth = true`}))
+			Expect(metav1.GetControllerOf(cm)).NotTo(BeNil())
+			Expect(metav1.GetControllerOf(cm).Name).To(Equal(cmState.Name))
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data).To(HaveKeyWithValue("config.hcl", `role = "reader"`))
+		})
+
+		It("creates the ConfigMaps of outputs added later", func() {
+			cmState := newTestCMState("app-1")
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/role": "reader"}
+			r := newTestCMStateReconciler(newOutputTemplate(), cmState, newTestConfigMap())
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Get(ctx, outputKey, &corev1.ConfigMap{})).To(Succeed())
+		})
+
+		It("deletes the ConfigMaps of the outputs with the cmstate", func() {
+			cmState := newTestCMState()
+			output := newTestConfigMap()
+			output.Name = outputKey.Name
+			r := newTestCMStateReconciler(newOutputTemplate(), cmState, newTestConfigMap(), output)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apierrors.IsNotFound(r.Get(ctx, outputKey, &corev1.ConfigMap{}))).To(BeTrue())
+		})
+	})
+
+	Context("when the template renders into a Secret", func() {
+		newSecretTemplate := func() *cachev1alpha2.CMTemplate {
+			return &cachev1alpha2.CMTemplate{
+				ObjectMeta: metav1.ObjectMeta{Name: "vault-agent"},
+				Spec: cachev1alpha2.CMTemplateSpec{
+					Template: cachev1alpha2.Template{
+						AnnotationReplace: []cachev1alpha2.KeyedReplacement{{Key: "vault.hashicorp.com/role", Replacement: cachev1alpha2.Replacement{Placeholder: "{role}"}}},
+						Data:              map[string]string{"config.hcl": "role = \"{role}\""},
+						BinaryData:        map[string][]byte{"truststore.jks": {0xfe, 0xed}},
+					},
+					Target: &cachev1alpha2.Target{Kind: cachev1alpha2.TargetKindSecret},
+				},
+			}
+		}
+
+		It("renders the data and binary data into an Opaque Secret", func() {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/role": "reader"}
+			r := newTestCMStateReconciler(newSecretTemplate(), cmState)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			secret := &corev1.Secret{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), secret)).To(Succeed())
+			Expect(secret.Type).To(Equal(corev1.SecretTypeOpaque))
+			Expect(secret.Data).To(Equal(map[string][]byte{"config.hcl": []byte(`role = "reader"`), "truststore.jks": {0xfe, 0xed}}))
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &corev1.ConfigMap{}))).To(BeTrue())
+		})
+
+		It("uses the type of the target", func() {
+			cmTemplate := newSecretTemplate()
+			cmTemplate.Spec.Target.Type = "example.com/vault-agent"
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/role": "reader"}
+			r := newTestCMStateReconciler(cmTemplate, cmState)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			secret := &corev1.Secret{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), secret)).To(Succeed())
+			Expect(secret.Type).To(Equal(corev1.SecretType("example.com/vault-agent")))
+		})
+
+		It("deletes the Secret with the cmstate", func() {
+			cmState := newTestCMState()
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: cmState.Spec.Target, Namespace: cmState.Namespace, OwnerReferences: renderedByTestCMState()}}
+			r := newTestCMStateReconciler(newSecretTemplate(), cmState, secret)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(secret), &corev1.Secret{}))).To(BeTrue())
+		})
+
+		It("only deletes the kind it rendered and what it controls", func() {
+			cmState := newTestCMState()
+			cmState.Status.RenderedKind = cachev1alpha2.TargetKindSecret
+			// objects of the user that happen to share the name
+			configMap := newTestConfigMap()
+			configMap.OwnerReferences = nil
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: cmState.Spec.Target, Namespace: cmState.Namespace}}
+			r := newTestCMStateReconciler(cmState, configMap, secret)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &cachev1alpha2.CMState{}))).To(BeTrue())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(configMap), &corev1.ConfigMap{})).To(Succeed())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(secret), &corev1.Secret{})).To(Succeed())
+		})
+
+		It("adopts the Secret it rendered before recording its kind", func() {
+			cmState := newTestCMState("app-1")
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: cmState.Spec.Target, Namespace: cmState.Namespace}}
+			r := newTestCMStateReconciler(newSecretTemplate(), cmState, secret)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(secret), secret)).To(Succeed())
+			Expect(metav1.GetControllerOf(secret)).To(HaveField("Name", cmState.Name))
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Status.RenderedKind).To(Equal(cachev1alpha2.TargetKindSecret))
+		})
+	})
+
+	Context("when the template is immutable", func() {
+		newImmutableTemplate := func() *cachev1alpha2.CMTemplate {
+			return &cachev1alpha2.CMTemplate{
+				ObjectMeta: metav1.ObjectMeta{Name: "vault-agent"},
+				Spec: cachev1alpha2.CMTemplateSpec{
+					Template: cachev1alpha2.Template{
+						AnnotationReplace: []cachev1alpha2.KeyedReplacement{{Key: "vault.hashicorp.com/role", Replacement: cachev1alpha2.Replacement{Placeholder: "{role}"}}},
+						Data:              map[string]string{"config.hcl": "role = \"{role}\""},
+					},
+					Immutable: true,
+				},
+			}
+		}
+		newImmutableCMState := func() *cachev1alpha2.CMState {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/role": "reader"}
+			return cmState
+		}
+		hashedName := func(cmTemplate *cachev1alpha2.CMTemplate) string {
+			return cachev1alpha2.ImmutableName("cmstate-vault-agent", cmTemplate.Spec.ContentHash(map[string]string{"vault.hashicorp.com/role": "reader"}))
+		}
+		reconcile := func(r *CMStateReconciler, cmState *cachev1alpha2.CMState) {
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+		}
+
+		It("renders an immutable ConfigMap named after the content hash", func() {
+			cmTemplate := newImmutableTemplate()
+			cmState := newImmutableCMState()
+			r := newTestCMStateReconciler(cmTemplate, cmState)
+			reconcile(r, cmState)
+
+			Expect(cmState.Spec.Target).To(Equal(hashedName(cmTemplate)))
+			Expect(cmState.Status.ConfigMap).To(Equal(hashedName(cmTemplate)))
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: hashedName(cmTemplate)}, cm)).To(Succeed())
+			Expect(cm.Immutable).NotTo(BeNil())
+			Expect(*cm.Immutable).To(BeTrue())
+			Expect(cm.Data).To(HaveKeyWithValue("config.hcl", `role = "reader"`))
+		})
+
+		It("rolls over to a new ConfigMap once the template changed", func() {
+			cmTemplate := newImmutableTemplate()
+			cmState := newImmutableCMState()
+			r := newTestCMStateReconciler(cmTemplate, cmState)
+			r.ImmutableHistory = 1
+			reconcile(r, cmState)
+			previous := cmState.Spec.Target
+
+			cmTemplate.Spec.Template.Data["config.hcl"] = "role = \"{role}\" exit_after_auth = true"
+			Expect(r.Update(ctx, cmTemplate)).To(Succeed())
+			reconcile(r, cmState)
+
+			Expect(cmState.Status.ConfigMap).To(Equal(hashedName(cmTemplate)))
+			Expect(cmState.Status.PreviousConfigMaps).To(Equal([]string{previous}))
+			Expect(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: hashedName(cmTemplate)}, &corev1.ConfigMap{})).To(Succeed())
+			Expect(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: previous}, &corev1.ConfigMap{})).To(Succeed())
+		})
+
+		It("deletes the previous ConfigMaps no pod uses past the kept ones", func() {
+			cmTemplate := newImmutableTemplate()
+			cmState := newImmutableCMState()
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-1", Namespace: "default"}}
+			r := newTestCMStateReconciler(cmTemplate, cmState, pod)
+			reconcile(r, cmState)
+			used := cmState.Spec.Target
+			pod.Annotations = map[string]string{"vault.hashicorp.com/agent-configmap": used}
+			Expect(r.Update(ctx, pod)).To(Succeed())
+
+			cmTemplate.Spec.Template.Data["config.hcl"] = "role = \"{role}\" exit_after_auth = true"
+			Expect(r.Update(ctx, cmTemplate)).To(Succeed())
+			reconcile(r, cmState)
+			unused := cmState.Spec.Target
+
+			cmTemplate.Spec.Template.Data["config.hcl"] = "role = \"{role}\" exit_after_auth = false"
+			Expect(r.Update(ctx, cmTemplate)).To(Succeed())
+			reconcile(r, cmState)
+
+			Expect(cmState.Status.PreviousConfigMaps).To(Equal([]string{used}))
+			Expect(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: used}, &corev1.ConfigMap{})).To(Succeed())
+			Expect(apierrors.IsNotFound(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: unused}, &corev1.ConfigMap{}))).To(BeTrue())
+		})
+
+		It("keeps the previous ConfigMaps the audience was injected with", func() {
+			cmTemplate := newImmutableTemplate()
+			cmState := newImmutableCMState()
+			r := newTestCMStateReconciler(cmTemplate, cmState)
+			reconcile(r, cmState)
+			previous := cmState.Spec.Target
+			// the pod isn't created yet, only its admission was recorded
+			cmState.Spec.Audience[0].ConfigMap = previous
+			Expect(r.Update(ctx, cmState)).To(Succeed())
+
+			cmTemplate.Spec.Template.Data["config.hcl"] = "role = \"{role}\" exit_after_auth = true"
+			Expect(r.Update(ctx, cmTemplate)).To(Succeed())
+			reconcile(r, cmState)
+			Expect(cmState.Status.PreviousConfigMaps).To(Equal([]string{previous}))
+			Expect(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: previous}, &corev1.ConfigMap{})).To(Succeed())
+
+			// the entry moved on to the current ConfigMap
+			cmState.Spec.Audience[0].ConfigMap = cmState.Spec.Target
+			Expect(r.Update(ctx, cmState)).To(Succeed())
+			reconcile(r, cmState)
+			Expect(cmState.Status.PreviousConfigMaps).To(BeEmpty())
+			Expect(apierrors.IsNotFound(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: previous}, &corev1.ConfigMap{}))).To(BeTrue())
+		})
+
+		It("keeps the previous ConfigMaps pods mount or read their environment from", func() {
+			cmTemplate := newImmutableTemplate()
+			cmState := newImmutableCMState()
+			versions := []string{`role = "{role}" exit_after_auth = true`, `role = "{role}" exit_after_auth = false`, `role = "{role}" pid_file = "/tmp/pid"`}
+			var names []string
+			for _, data := range versions {
+				cmTemplate.Spec.Template.Data["config.hcl"] = data
+				names = append(names, hashedName(cmTemplate))
+			}
+			mounted := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-1", Namespace: "default"}, Spec: corev1.PodSpec{
+				Volumes: []corev1.Volume{{Name: "config", VolumeSource: corev1.VolumeSource{
+					ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: names[0]}},
+				}}},
+			}}
+			projected := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-2", Namespace: "default"}, Spec: corev1.PodSpec{
+				Volumes: []corev1.Volume{{Name: "config", VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{
+					Sources: []corev1.VolumeProjection{{ConfigMap: &corev1.ConfigMapProjection{LocalObjectReference: corev1.LocalObjectReference{Name: names[1]}}}},
+				}}}},
+			}}
+			environment := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-3", Namespace: "default"}, Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", EnvFrom: []corev1.EnvFromSource{
+					{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: names[2]}}},
+				}}},
+			}}
+			r := newTestCMStateReconciler(newImmutableTemplate(), cmState, mounted, projected, environment)
+			// the pods use every version but the first and the last
+			for _, data := range append(versions, `role = "{role}" pid_file = "/run/pid"`) {
+				Expect(r.Get(ctx, client.ObjectKeyFromObject(cmTemplate), cmTemplate)).To(Succeed())
+				cmTemplate.Spec.Template.Data["config.hcl"] = data
+				Expect(r.Update(ctx, cmTemplate)).To(Succeed())
+				reconcile(r, cmState)
+			}
+
+			Expect(cmState.Status.PreviousConfigMaps).To(ConsistOf(names))
+			for _, name := range names {
+				Expect(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: name}, &corev1.ConfigMap{})).To(Succeed())
+			}
+		})
+	})
+
+	Context("when the template is versioned by hashSuffix", func() {
+		newVersionedTemplate := func() *cachev1alpha2.CMTemplate {
+			cmTemplate := newTestCMTemplate()
+			cmTemplate.Spec.Versioning = cachev1alpha2.VersioningHashSuffix
+			return cmTemplate
+		}
+		newVersionedCMState := func() *cachev1alpha2.CMState {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/role": "reader"}
+			return cmState
+		}
+		hash := func(cmTemplate *cachev1alpha2.CMTemplate) string {
+			return cmTemplate.Spec.ContentHash(map[string]string{"vault.hashicorp.com/role": "reader"})
+		}
+		render := func(r *CMStateReconciler, cmState *cachev1alpha2.CMState) {
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+		}
+
+		It("renders a mutable ConfigMap suffixed with the content hash", func() {
+			cmTemplate := newVersionedTemplate()
+			cmState := newVersionedCMState()
+			r := newTestCMStateReconciler(cmTemplate, cmState)
+			render(r, cmState)
+
+			name := cachev1alpha2.ImmutableName("cmstate-vault-agent", hash(cmTemplate))
+			Expect(cmState.Spec.Target).To(Equal(name))
+			Expect(cmState.Status.ConfigMap).To(Equal(name))
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: name}, cm)).To(Succeed())
+			Expect(cm.Immutable).To(BeNil())
+			Expect(cm.Labels).To(HaveKeyWithValue(cachev1alpha2.ContentHashLabel, hash(cmTemplate)))
+		})
+
+		It("keeps the previous version until its last pod is gone", func() {
+			cmTemplate := newVersionedTemplate()
+			cmState := newVersionedCMState()
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-1", Namespace: "default"}}
+			r := newTestCMStateReconciler(cmTemplate, cmState, pod)
+			render(r, cmState)
+			previous := cmState.Spec.Target
+			pod.Annotations = map[string]string{"vault.hashicorp.com/agent-configmap": previous}
+			Expect(r.Update(ctx, pod)).To(Succeed())
+
+			cmTemplate.Spec.Template.Data["config.hcl"] = "role = \"{role}\" exit_after_auth = true"
+			Expect(r.Update(ctx, cmTemplate)).To(Succeed())
+			render(r, cmState)
+
+			Expect(cmState.Status.ConfigMap).To(Equal(cachev1alpha2.ImmutableName("cmstate-vault-agent", hash(cmTemplate))))
+			Expect(cmState.Status.PreviousConfigMaps).To(Equal([]string{previous}))
+			Expect(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: previous}, &corev1.ConfigMap{})).To(Succeed())
+
+			// the pod leaving the audience lets the previous version go
+			Expect(r.Delete(ctx, pod)).To(Succeed())
+			cmState.Spec.Audience = append(cmState.Spec.Audience, cachev1alpha2.CMAudience{Kind: "Pod", Name: "app-2"})[1:]
+			Expect(r.Update(ctx, cmState)).To(Succeed())
+			render(r, cmState)
+
+			Expect(cmState.Status.PreviousConfigMaps).To(BeEmpty())
+			Expect(apierrors.IsNotFound(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: previous}, &corev1.ConfigMap{}))).To(BeTrue())
+		})
+	})
+
+	Context("when the template changes", func() {
+		newRenderedCMState := func() *cachev1alpha2.CMState {
+			cmState := newTestCMState("app-1")
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/role": "reader"}
+			return cmState
+		}
+		newRenderedConfigMap := func() *corev1.ConfigMap {
+			cm := newTestConfigMap()
+			cm.Data = map[string]string{"config.hcl": `role = "reader"`}
+			return cm
+		}
+		change := func(r *CMStateReconciler, cmTemplate *cachev1alpha2.CMTemplate) {
+			cmTemplate.Generation++
+			cmTemplate.Spec.Template.Data["config.hcl"] = `role = "{role}" exit_after_auth = true`
+			Expect(r.Update(ctx, cmTemplate)).To(Succeed())
+		}
+		render := func(r *CMStateReconciler, cmState *cachev1alpha2.CMState) *corev1.ConfigMap {
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			return cm
+		}
+
+		It("renders the ConfigMap anew in place", func() {
+			cmTemplate := newTestCMTemplate()
+			cmTemplate.Generation = 1
+			cmState := newRenderedCMState()
+			r := newTestCMStateReconciler(cmTemplate, cmState, newRenderedConfigMap())
+			change(r, cmTemplate)
+
+			cm := render(r, cmState)
+			Expect(cm.Data).To(HaveKeyWithValue("config.hcl", `role = "reader" exit_after_auth = true`))
+			Expect(cmState.Status.RenderedFromGeneration).To(Equal(int64(2)))
+			Expect(meta.FindStatusCondition(cmState.Status.Conditions, typePinnedCMState)).To(BeNil())
+		})
+
+		It("keeps the ConfigMap of templates only rendered on create", func() {
+			cmTemplate := newTestCMTemplate()
+			cmTemplate.Generation = 1
+			cmTemplate.Spec.UpdateStrategy = cachev1alpha2.UpdateStrategyOnCreate
+			cmState := newRenderedCMState()
+			cmState.Spec.Target = ""
+			r := newTestCMStateReconciler(cmTemplate, cmState)
+			render(r, cmState)
+			Expect(cmState.Status.RenderedFromGeneration).To(Equal(int64(1)))
+
+			change(r, cmTemplate)
+			cm := render(r, cmState)
+			Expect(cm.Data).To(HaveKeyWithValue("config.hcl", `role = "reader"`))
+			Expect(cmState.Status.RenderedFromGeneration).To(Equal(int64(1)))
+			Expect(meta.IsStatusConditionTrue(cmState.Status.Conditions, typePinnedCMState)).To(BeTrue())
+		})
+
+		It("renders the current template once switched to Always", func() {
+			cmTemplate := newTestCMTemplate()
+			cmTemplate.Generation = 1
+			cmTemplate.Spec.UpdateStrategy = cachev1alpha2.UpdateStrategyOnCreate
+			cmState := newRenderedCMState()
+			cmState.Status.RenderedFromGeneration = 1
+			r := newTestCMStateReconciler(cmTemplate, cmState, newRenderedConfigMap())
+			change(r, cmTemplate)
+			render(r, cmState)
+
+			cmTemplate.Generation++
+			cmTemplate.Spec.UpdateStrategy = cachev1alpha2.UpdateStrategyAlways
+			Expect(r.Update(ctx, cmTemplate)).To(Succeed())
+			cm := render(r, cmState)
+			Expect(cm.Data).To(HaveKeyWithValue("config.hcl", `role = "reader" exit_after_auth = true`))
+			Expect(cmState.Status.RenderedFromGeneration).To(Equal(int64(3)))
+			condition := meta.FindStatusCondition(cmState.Status.Conditions, typePinnedCMState)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal("UpdateStrategyAlways"))
+		})
+	})
+
+	Context("when the template reloads its targets", func() {
+		newReloadingTemplate := func() *cachev1alpha2.CMTemplate {
+			cmTemplate := newTestCMTemplate()
+			cmTemplate.Spec.ReloadTargets = true
+			return cmTemplate
+		}
+		newDeployment := func(restartedAt string) *appsv1.Deployment {
+			deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"}}
+			if restartedAt != "" {
+				deployment.Spec.Template.Annotations = map[string]string{RestartedAtAnnotation: restartedAt}
+			}
+			return deployment
+		}
+		// the pods of the Deployment are tracked under the generateName of
+		// its ReplicaSet, those of the StatefulSet by name
+		newWorkloadObjects := func(deployment *appsv1.Deployment) []client.Object {
+			controller := true
+			replicaSet := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "web-5d8f7", Namespace: "default",
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", Controller: &controller}}}}
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "db-0", Namespace: "default",
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "db", Controller: &controller}}}}
+			statefulSet := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"}}
+			return []client.Object{deployment, replicaSet, pod, statefulSet}
+		}
+		newStaleState := func() (*cachev1alpha2.CMState, *corev1.ConfigMap) {
+			cmState := newTestCMState("web-5d8f7-", "db-0", "web-5d8f7-")
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/role": "reader"}
+			cm := newTestConfigMap()
+			cm.Data = map[string]string{"config.hcl": `role = "writer"`}
+			return cmState, cm
+		}
+		render := func(r *CMStateReconciler, cmState *cachev1alpha2.CMState) ctrl.Result {
+			result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			return result
+		}
+		restartedAt := func(r *CMStateReconciler, workload client.Object) string {
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(workload), workload)).To(Succeed())
+			return podTemplateOf(workload).Annotations[RestartedAtAnnotation]
+		}
+
+		It("restarts the workloads of the audience once after rendering anew", func() {
+			cmState, cm := newStaleState()
+			objs := newWorkloadObjects(newDeployment(""))
+			r := newTestCMStateReconciler(append(objs, newReloadingTemplate(), cmState, cm)...)
+			r.ReloadInterval = DefaultReloadInterval
+
+			Expect(render(r, cmState)).To(Equal(ctrl.Result{}))
+			Expect(restartedAt(r, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"}})).NotTo(BeEmpty())
+			Expect(restartedAt(r, &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"}})).NotTo(BeEmpty())
+			Expect(cmState.Status.ReloadRequestedAt).To(BeNil())
+		})
+
+		It("leaves the workloads alone when nothing was rendered anew", func() {
+			cmState, cm := newStaleState()
+			cm.Data = map[string]string{"config.hcl": `role = "reader"`}
+			deployment := newDeployment("")
+			r := newTestCMStateReconciler(append(newWorkloadObjects(deployment), newReloadingTemplate(), cmState, cm)...)
+
+			render(r, cmState)
+			Expect(restartedAt(r, deployment)).To(BeEmpty())
+		})
+
+		It("defers restarting a workload restarted within the reload interval", func() {
+			cmState, cm := newStaleState()
+			recently := time.Now().Add(-time.Minute).Format(time.RFC3339)
+			deployment := newDeployment(recently)
+			r := newTestCMStateReconciler(append(newWorkloadObjects(deployment), newReloadingTemplate(), cmState, cm)...)
+			r.ReloadInterval = 5 * time.Minute
+
+			result := render(r, cmState)
+			Expect(result.RequeueAfter).To(BeNumerically("~", 4*time.Minute, 5*time.Second))
+			Expect(restartedAt(r, deployment)).To(Equal(recently))
+			Expect(cmState.Status.ReloadRequestedAt).NotTo(BeNil())
+		})
+
+		It("only restarts workloads in the namespace of the cmstate", func() {
+			cmState, cm := newStaleState()
+			cmState.Spec.Audience = append(cmState.Spec.Audience, cachev1alpha2.CMAudience{Kind: "Deployment", Name: "web", Namespace: "kube-system"})
+			deployment := newDeployment("")
+			other := newDeployment("")
+			other.Namespace = "kube-system"
+			r := newTestCMStateReconciler(append(newWorkloadObjects(deployment), other, newReloadingTemplate(), cmState, cm)...)
+
+			render(r, cmState)
+			Expect(restartedAt(r, deployment)).NotTo(BeEmpty())
+			Expect(restartedAt(r, other)).To(BeEmpty())
+		})
+
+		It("only logs the restarts in dry run", func() {
+			cmState, cm := newStaleState()
+			deployment := newDeployment("")
+			r := newTestCMStateReconciler(append(newWorkloadObjects(deployment), newReloadingTemplate(), cmState, cm)...)
+			r.ReloadDryRun = true
+
+			render(r, cmState)
+			Expect(restartedAt(r, deployment)).To(BeEmpty())
+			Expect(cmState.Status.ReloadRequestedAt).To(BeNil())
+		})
+	})
+
+	Context("when the template names the ConfigMap", func() {
+		It("renders the ConfigMap under the name of the template", func() {
+			cmTemplate := newTestCMTemplate()
+			cmTemplate.Spec.ConfigMapName = "vault-agent-config"
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			r := newTestCMStateReconciler(cmTemplate, cmState)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Target).To(Equal("vault-agent-config"))
+			Expect(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "vault-agent-config"}, &corev1.ConfigMap{})).To(Succeed())
+		})
+
+		It("renders it anew under a changed name and keeps the previous one while pods use it", func() {
+			cmTemplate := newTestCMTemplate()
+			cmTemplate.Spec.ConfigMapNamePrefix = "team-a-"
+			cmState := newTestCMState("app-1")
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-1", Namespace: "default",
+				Annotations: map[string]string{"vault.hashicorp.com/agent-configmap": "cmstate-vault-agent"}}}
+			r := newTestCMStateReconciler(cmTemplate, cmState, newTestConfigMap(), pod)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Target).To(Equal("team-a-vault-agent"))
+			Expect(cmState.Status.PreviousConfigMaps).To(Equal([]string{"cmstate-vault-agent"}))
+			Expect(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "team-a-vault-agent"}, &corev1.ConfigMap{})).To(Succeed())
+			Expect(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "cmstate-vault-agent"}, &corev1.ConfigMap{})).To(Succeed())
+		})
+	})
+
+	Context("when the template is namespaced", func() {
+		newNamespacedCMState := func() *cachev1alpha2.CMState {
+			cmState := newTestCMState("app-1")
+			cmState.Name = cachev1alpha2.NamespacedCMStateName("vault-agent")
+			cmState.Spec.Target, cmState.Spec.TemplateRef.Scope = "", cachev1alpha2.TemplateScopeNamespaced
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/role": "app"}
+			return cmState
+		}
+		newNamespacedTemplate := func() *cachev1alpha2.NamespacedCMTemplate {
+			cmTemplate := newTestCMTemplate()
+			cmTemplate.Spec.Template.Data["config.hcl"] = `team = "{role}"`
+			return &cachev1alpha2.NamespacedCMTemplate{
+				ObjectMeta: metav1.ObjectMeta{Name: "vault-agent", Namespace: "default"},
+				Spec:       cmTemplate.Spec,
+			}
+		}
+
+		It("renders from the template of its namespace over the cluster one", func() {
+			cmState := newNamespacedCMState()
+			r := newTestCMStateReconciler(newTestCMTemplate(), newNamespacedTemplate(), cmState)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data["config.hcl"]).To(Equal(`team = "app"`))
+		})
+
+		It("only reads dataFrom of its own namespace whatever the operator allows", func() {
+			cmState := newNamespacedCMState()
+			cmTemplate := newNamespacedTemplate()
+			cmTemplate.Spec.AllowSecretToConfigMap = true
+			cmTemplate.Spec.DataFrom = []cachev1alpha2.DataFromSource{
+				{ConfigMapRef: &cachev1alpha2.DataRef{Name: "agent-base", Namespace: "platform"}},
+				{SecretRef: &cachev1alpha2.DataRef{Name: "vault-ca"}},
+			}
+			r := newTestCMStateReconciler(cmTemplate, cmState,
+				&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "agent-base", Namespace: "platform"}, Data: map[string]string{"base.hcl": "platform"}},
+				&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "vault-ca", Namespace: "default"}, Data: map[string][]byte{"ca.crt": []byte("ca")}},
+			)
+			r.AllowCrossNamespaceDataFrom = true
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data).NotTo(HaveKey("base.hcl"))
+			Expect(cm.Data).NotTo(HaveKey("ca.crt"))
+		})
+
+		It("maps the template only to the cmstates of its namespace rendered from it", func() {
+			namespaced := newNamespacedCMState()
+			cluster := newTestCMState("app-2")
+			other := newNamespacedCMState()
+			other.Namespace = "team-b"
+			r := newTestCMStateReconciler(namespaced, cluster, other)
+
+			Expect(r.cmStatesForNamespacedTemplate(newNamespacedTemplate())).To(ConsistOf(
+				ctrl.Request{NamespacedName: client.ObjectKeyFromObject(namespaced)},
+			))
+			Expect(r.cmStatesForTemplate(newTestCMTemplate())).To(ConsistOf(
+				ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cluster)},
+			))
+		})
+	})
+
+	Context("when the template has metadata", func() {
+		newMetadataTemplate := func() *cachev1alpha2.CMTemplate {
+			cmTemplate := newTestCMTemplate()
+			cmTemplate.Spec.Metadata = &cachev1alpha2.Metadata{
+				Labels:      map[string]string{"team": "payments"},
+				Annotations: map[string]string{"example.com/cost-center": "1234"},
+			}
+			return cmTemplate
+		}
+
+		It("labels the ConfigMap with it", func() {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			r := newTestCMStateReconciler(newMetadataTemplate(), cmState)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Labels).To(HaveKeyWithValue("team", "payments"))
+			Expect(cm.Labels).To(HaveKeyWithValue(cachev1alpha2.TemplateLabel, "vault-agent"))
+			Expect(cm.Annotations).To(HaveKeyWithValue("example.com/cost-center", "1234"))
+		})
+
+		It("updates existing objects once the template changed it", func() {
+			cmTemplate := newMetadataTemplate()
+			cmState := newTestCMState("app-1")
+			cm := newTestConfigMap()
+			cm.Labels = map[string]string{"team": "set-by-hand"}
+			r := newTestCMStateReconciler(cmTemplate, cmState, cm)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Labels).To(HaveKeyWithValue("team", "payments"))
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cm), cm)).To(Succeed())
+			Expect(cm.Labels).To(HaveKeyWithValue("team", "set-by-hand"))
+			Expect(cm.Annotations).To(HaveKeyWithValue("example.com/cost-center", "1234"))
+
+			cmTemplate.Spec.Metadata.Annotations = map[string]string{"example.com/owner": "payments"}
+			Expect(r.Update(ctx, cmTemplate)).To(Succeed())
+			_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cm), cm)).To(Succeed())
+			Expect(cm.Annotations).NotTo(HaveKey("example.com/cost-center"))
+			Expect(cm.Annotations).To(HaveKeyWithValue("example.com/owner", "payments"))
+		})
+	})
+
+	Context("when the rendered data is too large", func() {
+		newLargeCMState := func(role string) *cachev1alpha2.CMState {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/role": role}
+			return cmState
+		}
+
+		It("keeps the previous ConfigMap and reports the sizes on the cmstate and template", func() {
+			cmTemplate := newTestCMTemplate()
+			maxBytes := int32(64)
+			cmTemplate.Spec.MaxRenderedBytes = &maxBytes
+			cmState := newLargeCMState("reader")
+			recorder := record.NewFakeRecorder(10)
+			r := newTestCMStateReconciler(cmTemplate, cmState)
+			r.Recorder = recorder
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			// the template loops over the value now
+			cmTemplate.Spec.Template.Data["config.hcl"] = strings.Repeat(`role = "{role}"\n`, 4)
+			Expect(r.Update(ctx, cmTemplate)).To(Succeed())
+			_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			condition := meta.FindStatusCondition(cmState.Status.Conditions, typeAvailableCMState)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal("RenderTooLarge"))
+			Expect(condition.Message).To(ContainSubstring("rendering cmstate-vault-agent: 78 bytes of data exceed the limit of 64 bytes"))
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data).To(Equal(map[string]string{"config.hcl": `role = "reader"`}))
+
+			Expect(recorder.Events).To(Receive(HavePrefix("Warning RenderTooLarge Failed to render CMTemplate vault-agent")))
+			Expect(recorder.Events).To(Receive(HavePrefix("Warning RenderTooLarge Failed to render the CMState default/cmstate-vault-agent")))
+		})
+
+		It("fails values outgrowing a ConfigMap before the API server rejects them", func() {
+			cmState := newLargeCMState(strings.Repeat("r", cachev1alpha2.MaxConfigMapSize))
+			r := newTestCMStateReconciler(newTestCMTemplate(), cmState)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &corev1.ConfigMap{}))).To(BeTrue())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			condition := meta.FindStatusCondition(cmState.Status.Conditions, typeAvailableCMState)
+			Expect(condition.Reason).To(Equal("RenderTooLarge"))
+			Expect(condition.Message).To(ContainSubstring("exceed the limit of 1048576 bytes"))
+		})
+	})
+
+	Context("when the template declares a syntax", func() {
+		newSyntaxTemplate := func(data string, syntax cachev1alpha2.DataSyntax) *cachev1alpha2.CMTemplate {
+			cmTemplate := newTestCMTemplate()
+			cmTemplate.Spec.Template.Data = map[string]string{"config": data}
+			cmTemplate.Spec.Template.Syntax = map[string]cachev1alpha2.DataSyntax{"config": syntax}
+			return cmTemplate
+		}
+		newSyntaxCMState := func() *cachev1alpha2.CMState {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/role": "reader"}
+			return cmState
+		}
+
+		It("renders data that parses", func() {
+			cmState := newSyntaxCMState()
+			r := newTestCMStateReconciler(cmState, newSyntaxTemplate(`{"role": "{role}"}`, cachev1alpha2.DataSyntaxJSON))
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data).To(HaveKeyWithValue("config", `{"role": "reader"}`))
+		})
+
+		It("surfaces data failing to parse as a condition instead of rendering", func() {
+			cmState := newSyntaxCMState()
+			r := newTestCMStateReconciler(cmState, newSyntaxTemplate("role: [{role}", cachev1alpha2.DataSyntaxYAML))
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), &corev1.ConfigMap{}))).To(BeTrue())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			condition := meta.FindStatusCondition(cmState.Status.Conditions, typeAvailableCMState)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Reason).To(Equal("RenderFailed"))
+			Expect(condition.Message).To(ContainSubstring("rendering config: invalid yaml"))
+		})
+
+		It("keeps the previous ConfigMap when the new data fails to parse", func() {
+			cmTemplate := newSyntaxTemplate(`role = "{role}"`, cachev1alpha2.DataSyntaxHCL)
+			cmTemplate.Spec.Immutable = true
+			cmState := newSyntaxCMState()
+			r := newTestCMStateReconciler(cmTemplate, cmState)
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			previous := cmState.Spec.Target
+
+			cmTemplate.Spec.Template.Data["config"] = `template { contents = "{role}" `
+			Expect(r.Update(ctx, cmTemplate)).To(Succeed())
+			_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Target).To(Equal(previous))
+			Expect(meta.FindStatusCondition(cmState.Status.Conditions, typeAvailableCMState).Reason).To(Equal("RenderFailed"))
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, types.NamespacedName{Namespace: "default", Name: previous}, cm)).To(Succeed())
+			Expect(cm.Data).To(HaveKeyWithValue("config", `role = "reader"`))
+		})
+	})
+
+	Describe("parseHCL", func() {
+		It("accepts a vault agent config", func() {
+			Expect(parseHCL(`# agent
+auto_auth {
+  method "kubernetes" {
+    config = { role = "reader" } // the role
+  }
+}
+/* templates */
+template {
+  contents = <<-EOT
+    {{ with secret "kv/app" }}{{ .Data.password }}{{ end }}
+  EOT
+  destination = "/vault/secrets/${var.name}-%{ if true }a{ end }"
+  args = ["a", "$${escaped"]
+}`)).To(Succeed())
+		})
+
+		It("reports what doesn't parse", func() {
+			Expect(parseHCL(`auto_auth {`)).To(MatchError(`missing '}'`))
+			Expect(parseHCL("role = \"reader\nnext = 1")).To(MatchError("unterminated string on line 1"))
+			Expect(parseHCL("a = [1, 2}")).To(MatchError(`unexpected '}' on line 1, expected ']'`))
+			Expect(parseHCL("a = \"${b")).To(MatchError("unterminated interpolation"))
+			Expect(parseHCL("a = <<EOT\nb\n")).To(MatchError("unterminated heredoc EOT on line 1"))
+			Expect(parseHCL("/* a")).To(MatchError("unterminated comment on line 1"))
+		})
+	})
+
+	Context("when the template adds data from a ConfigMap", func() {
+		newDataFromTemplate := func(ref cachev1alpha2.DataRef) *cachev1alpha2.CMTemplate {
+			cmTemplate := newTestCMTemplate()
+			cmTemplate.Spec.DataFrom = []cachev1alpha2.DataFromSource{{ConfigMapRef: &ref}}
+			return cmTemplate
+		}
+		newBaseConfigMap := func(namespace string) *corev1.ConfigMap {
+			return &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "agent-base", Namespace: namespace},
+				Data:       map[string]string{"base.hcl": `vault { address = "https://vault" }`, "other.hcl": "exit_after_auth = true"},
+			}
+		}
+		newDataFromCMState := func() *cachev1alpha2.CMState {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/role": "reader"}
+			return cmState
+		}
+		render := func(r *CMStateReconciler, cmState *cachev1alpha2.CMState) {
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+		}
+
+		It("renders the referenced key along with the template data", func() {
+			cmState := newDataFromCMState()
+			r := newTestCMStateReconciler(cmState, newDataFromTemplate(cachev1alpha2.DataRef{Name: "agent-base", Key: "base.hcl"}), newBaseConfigMap("default"))
+			render(r, cmState)
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data).To(Equal(map[string]string{"config.hcl": `role = "reader"`, "base.hcl": `vault { address = "https://vault" }`}))
+			Expect(meta.FindStatusCondition(cmState.Status.Conditions, typeDegradedCMState)).To(BeNil())
+		})
+
+		It("renders without a missing reference and marks the cmstate degraded until it is there", func() {
+			cmState := newDataFromCMState()
+			r := newTestCMStateReconciler(cmState, newDataFromTemplate(cachev1alpha2.DataRef{Name: "agent-base"}))
+			render(r, cmState)
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data).To(Equal(map[string]string{"config.hcl": `role = "reader"`}))
+			condition := meta.FindStatusCondition(cmState.Status.Conditions, typeDegradedCMState)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+			Expect(condition.Message).To(ContainSubstring("ConfigMap default/agent-base not found"))
+
+			Expect(r.Create(ctx, newBaseConfigMap("default"))).To(Succeed())
+			render(r, cmState)
+
+			Expect(meta.IsStatusConditionFalse(cmState.Status.Conditions, typeDegradedCMState)).To(BeTrue())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data).To(HaveKey("base.hcl"))
+			Expect(cm.Data).To(HaveKey("other.hcl"))
+		})
+
+		It("only reads other namespaces when allowed", func() {
+			cmState := newDataFromCMState()
+			r := newTestCMStateReconciler(cmState, newDataFromTemplate(cachev1alpha2.DataRef{Name: "agent-base", Namespace: "platform", Key: "base.hcl"}),
+				newBaseConfigMap("platform"))
+			render(r, cmState)
+
+			Expect(meta.FindStatusCondition(cmState.Status.Conditions, typeDegradedCMState).Message).To(ContainSubstring("ConfigMap platform/agent-base is in another namespace"))
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data).NotTo(HaveKey("base.hcl"))
+
+			r.AllowCrossNamespaceDataFrom = true
+			render(r, cmState)
+			Expect(meta.IsStatusConditionFalse(cmState.Status.Conditions, typeDegradedCMState)).To(BeTrue())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data).To(HaveKey("base.hcl"))
+		})
+
+		It("marks the rendered cmstate available again once it renders", func() {
+			cmState := newDataFromCMState()
+			cmState.Spec.Target = "cmstate-vault-agent"
+			meta.SetStatusCondition(&cmState.Status.Conditions, metav1.Condition{Type: typeAvailableCMState, Status: metav1.ConditionFalse, Reason: "RenderFailed"})
+			cm := newTestConfigMap()
+			cm.Data = map[string]string{"config.hcl": `role = "reader"`, "base.hcl": `vault { address = "https://vault" }`}
+			r := newTestCMStateReconciler(cmState, cm, newDataFromTemplate(cachev1alpha2.DataRef{Name: "agent-base", Key: "base.hcl"}), newBaseConfigMap("default"))
+			// rendering what the ConfigMap already holds changes nothing but the condition
+			render(r, cmState)
+
+			condition := meta.FindStatusCondition(cmState.Status.Conditions, typeAvailableCMState)
+			Expect(condition).To(And(HaveField("Status", metav1.ConditionTrue), HaveField("Reason", "Rendered")))
+		})
+
+		It("renders the ConfigMap anew once the referenced data changed", func() {
+			cmState := newDataFromCMState()
+			base := newBaseConfigMap("default")
+			r := newTestCMStateReconciler(cmState, newDataFromTemplate(cachev1alpha2.DataRef{Name: "agent-base", Key: "base.hcl"}), base)
+			render(r, cmState)
+
+			base.Data["base.hcl"] = `vault { address = "https://vault.internal" }`
+			Expect(r.Update(ctx, base)).To(Succeed())
+			Expect(r.cmStatesForDataFrom("ConfigMap")(base)).To(ConsistOf(reconcile.Request{NamespacedName: client.ObjectKeyFromObject(cmState)}))
+			Expect(r.cmStatesForDataFrom("ConfigMap")(newBaseConfigMap("other"))).To(BeEmpty())
+			render(r, cmState)
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data).To(HaveKeyWithValue("base.hcl", `vault { address = "https://vault.internal" }`))
+		})
+
+		It("renders the data of a Secret into a Secret and re-renders it on change", func() {
+			cmState := newDataFromCMState()
+			cmTemplate := newTestCMTemplate()
+			cmTemplate.Spec.Target = &cachev1alpha2.Target{Kind: cachev1alpha2.TargetKindSecret}
+			cmTemplate.Spec.DataFrom = []cachev1alpha2.DataFromSource{{SecretRef: &cachev1alpha2.DataRef{Name: "vault-ca", Key: "ca.crt"}}}
+			ca := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "vault-ca", Namespace: "default"},
+				Data:       map[string][]byte{"ca.crt": []byte("-----BEGIN CERTIFICATE-----")},
+			}
+			r := newTestCMStateReconciler(cmState, cmTemplate, ca)
+			render(r, cmState)
+
+			secret := &corev1.Secret{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), secret)).To(Succeed())
+			Expect(secret.Data).To(HaveKeyWithValue("ca.crt", []byte("-----BEGIN CERTIFICATE-----")))
+
+			ca.Data["ca.crt"] = []byte("-----BEGIN CERTIFICATE-----\nrotated")
+			Expect(r.Update(ctx, ca)).To(Succeed())
+			Expect(r.cmStatesForDataFrom("Secret")(ca)).To(ConsistOf(reconcile.Request{NamespacedName: client.ObjectKeyFromObject(cmState)}))
+			Expect(r.cmStatesForDataFrom("ConfigMap")(ca)).To(BeEmpty())
+			render(r, cmState)
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), secret)).To(Succeed())
+			Expect(secret.Data).To(HaveKeyWithValue("ca.crt", []byte("-----BEGIN CERTIFICATE-----\nrotated")))
+		})
+
+		It("doesn't copy a Secret into a ConfigMap unless the template allows it", func() {
+			cmState := newDataFromCMState()
+			cmTemplate := newTestCMTemplate()
+			cmTemplate.Spec.DataFrom = []cachev1alpha2.DataFromSource{{SecretRef: &cachev1alpha2.DataRef{Name: "vault-ca"}}}
+			ca := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "vault-ca", Namespace: "default"},
+				Data:       map[string][]byte{"ca.crt": []byte("-----BEGIN CERTIFICATE-----")},
+			}
+			r := newTestCMStateReconciler(cmState, cmTemplate, ca)
+			render(r, cmState)
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data).NotTo(HaveKey("ca.crt"))
+			Expect(meta.FindStatusCondition(cmState.Status.Conditions, typeDegradedCMState).Message).To(ContainSubstring("Secret default/vault-ca isn't copied into a ConfigMap"))
+
+			cmTemplate.Spec.AllowSecretToConfigMap = true
+			Expect(r.Update(ctx, cmTemplate)).To(Succeed())
+			render(r, cmState)
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data).To(HaveKey("ca.crt"))
+		})
+	})
+
+	Context("when the template has a base template", func() {
+		newBaseTemplate := func() *cachev1alpha2.CMTemplate {
+			return &cachev1alpha2.CMTemplate{
+				ObjectMeta: metav1.ObjectMeta{Name: "vault-agent-base"},
+				Spec: cachev1alpha2.CMTemplateSpec{
+					Template: cachev1alpha2.Template{
+						AnnotationReplace: []cachev1alpha2.KeyedReplacement{{Key: "vault.hashicorp.com/role", Replacement: cachev1alpha2.Replacement{Placeholder: "{role}"}}},
+						Data:              map[string]string{"config.hcl": "role = \"base\"", "base.hcl": "exit_after_auth = {role}"},
+					},
+				},
+			}
+		}
+		newChildTemplate := func() *cachev1alpha2.CMTemplate {
+			cmTemplate := newTestCMTemplate()
+			cmTemplate.Spec.Template.AnnotationReplace = nil
+			cmTemplate.Spec.BaseTemplate = "vault-agent-base"
+			return cmTemplate
+		}
+		newChildCMState := func() *cachev1alpha2.CMState {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/role": "reader"}
+			return cmState
+		}
+		render := func(r *CMStateReconciler, cmState *cachev1alpha2.CMState) {
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+		}
+
+		It("renders the data of the base under its own", func() {
+			cmState := newChildCMState()
+			r := newTestCMStateReconciler(cmState, newChildTemplate(), newBaseTemplate())
+			render(r, cmState)
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data).To(Equal(map[string]string{"config.hcl": `role = "reader"`, "base.hcl": "exit_after_auth = reader"}))
+		})
+
+		It("fails to render while the base is missing", func() {
+			cmState := newChildCMState()
+			r := newTestCMStateReconciler(cmState, newChildTemplate())
+			render(r, cmState)
+
+			condition := meta.FindStatusCondition(cmState.Status.Conditions, typeAvailableCMState)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Reason).To(Equal("RenderFailed"))
+			Expect(condition.Message).To(ContainSubstring("base template 'vault-agent-base' not found"))
+
+			Expect(r.Create(ctx, newBaseTemplate())).To(Succeed())
+			render(r, cmState)
+			Expect(meta.IsStatusConditionTrue(cmState.Status.Conditions, typeAvailableCMState)).To(BeTrue())
+		})
+
+		It("fails to render base templates forming a cycle", func() {
+			cmState := newChildCMState()
+			base := newBaseTemplate()
+			base.Spec.BaseTemplate = "vault-agent"
+			r := newTestCMStateReconciler(cmState, newChildTemplate(), base)
+			render(r, cmState)
+
+			condition := meta.FindStatusCondition(cmState.Status.Conditions, typeAvailableCMState)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Message).To(ContainSubstring("base templates form a cycle: vault-agent -> vault-agent-base -> vault-agent"))
+		})
+
+		It("renders the ConfigMap anew once the base changed", func() {
+			cmState := newChildCMState()
+			base := newBaseTemplate()
+			r := newTestCMStateReconciler(cmState, newChildTemplate(), base)
+			render(r, cmState)
+
+			base.Spec.Template.Data["base.hcl"] = "exit_after_auth = false"
+			Expect(r.Update(ctx, base)).To(Succeed())
+			Expect(r.cmStatesForTemplate(base)).To(ConsistOf(reconcile.Request{NamespacedName: client.ObjectKeyFromObject(cmState)}))
+			render(r, cmState)
+
+			cm := &corev1.ConfigMap{}
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cm)).To(Succeed())
+			Expect(cm.Data).To(HaveKeyWithValue("base.hcl", "exit_after_auth = false"))
+		})
+	})
+
+	Context("when the template restricts its namespaces", func() {
+		It("refuses to render CMStates of other namespaces", func() {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Target = ""
+			cmState.Annotations = map[string]string{"vault.hashicorp.com/role": "reader"}
+			cmTemplate := newTestCMTemplate()
+			cmTemplate.Spec.TargetNamespaces = &cachev1alpha2.TargetNamespaces{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"vault-access": "true"}},
+			}
+			namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+			r := newTestCMStateReconciler(cmState, cmTemplate, namespace)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Target).To(BeEmpty())
+			condition := meta.FindStatusCondition(cmState.Status.Conditions, typeAvailableCMState)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Message).To(ContainSubstring("namespace default is not allowed to use the template"))
+
+			namespace.Labels = map[string]string{"vault-access": "true"}
+			Expect(r.Update(ctx, namespace)).To(Succeed())
+			_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Target).To(Equal("cmstate-vault-agent"))
+		})
+	})
+
+	Context("when the cmstate is listed", func() {
+		It("keeps the audience, configmap and readiness in its status", func() {
+			cmState := newTestCMState("app-1", "app-2")
+			r := newTestCMStateReconciler(cmState, newTestConfigMap(), newTestCMTemplate())
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Status.Audience).To(Equal(int32(2)))
+			Expect(cmState.Status.ConfigMap).To(Equal("cmstate-vault-agent"))
+			Expect(meta.IsStatusConditionTrue(cmState.Status.Conditions, typeAvailableCMState)).To(BeTrue())
+		})
+
+		It("follows the audience as pods leave", func() {
+			cmState := newTestCMState("app-1", "app-2")
+			cmState.Status.Audience = 2
+			r := newTestCMStateReconciler(cmState, newTestConfigMap(), newTestCMTemplate())
+
+			cmState.Spec.Audience = cmState.Spec.Audience[:1]
+			Expect(r.Update(ctx, cmState)).To(Succeed())
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Status.Audience).To(Equal(int32(1)))
+		})
+	})
+
+	Context("when a Job in the audience is deleted", func() {
+		newJobCMState := func() *cachev1alpha2.CMState {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Audience = append(cmState.Spec.Audience, cachev1alpha2.CMAudience{
+				Kind:      "Job",
+				Name:      "backup",
+				Namespace: "default",
+				UID:       "backup-uid",
+				Count:     2,
+				Members:   []types.UID{"member-1", "member-2"},
+			})
+			return cmState
+		}
+		newJob := func(uid types.UID) *batchv1.Job {
+			return &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "backup", Namespace: "default", UID: uid}}
+		}
+		reconcileAudience := func(objs ...client.Object) []cachev1alpha2.CMAudience {
+			cmState := newJobCMState()
+			r := newTestCMStateReconciler(append(objs, cmState, newTestConfigMap())...)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			return cmState.Spec.Audience
+		}
+
+		It("purges the entry of the Job", func() {
+			Expect(reconcileAudience()).To(ConsistOf(HaveField("Name", "app-1")))
+		})
+
+		It("purges the entry when a new Job took over the name", func() {
+			Expect(reconcileAudience(newJob("other-uid"))).To(ConsistOf(HaveField("Name", "app-1")))
+		})
+
+		It("keeps the entry while the Job exists", func() {
+			Expect(reconcileAudience(newJob("backup-uid"))).To(HaveLen(2))
+		})
+
+		It("reconciles the cmstates the Job is in", func() {
+			cmState := newJobCMState()
+			other := newTestCMState("app-2")
+			other.Name = "cmstate-other"
+			r := newTestCMStateReconciler(cmState, other)
+
+			Expect(r.cmStatesForJob(newJob("backup-uid"))).To(ConsistOf(
+				reconcile.Request{NamespacedName: client.ObjectKeyFromObject(cmState)},
+			))
+		})
+	})
+
+	Context("when the audience is tracked per owner", func() {
+		reconcileAudience := func(objs ...client.Object) []cachev1alpha2.CMAudience {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.AudienceTracking = cachev1alpha2.AudienceTrackingOwner
+			cmState.Spec.Audience = append(cmState.Spec.Audience, cachev1alpha2.CMAudience{
+				Kind: "Deployment", Name: "web", Namespace: "default", UID: "web-uid", Count: 3,
+			})
+			r := newTestCMStateReconciler(append(objs, cmState, newTestConfigMap())...)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			return cmState.Spec.Audience
+		}
+
+		It("keeps the entry of a workload that exists", func() {
+			deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "web-uid"}}
+			Expect(reconcileAudience(deployment)).To(HaveLen(2))
+		})
+
+		It("purges the entry of a workload that is gone", func() {
+			Expect(reconcileAudience()).To(ConsistOf(HaveField("Name", "app-1")))
+		})
+	})
+})
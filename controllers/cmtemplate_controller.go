@@ -18,27 +18,54 @@ package controllers
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
-	cachev1alpha1 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha1"
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 var (
-	cmTemplates map[string]cachev1alpha1.CMTemplateSpec
+	cmTemplates map[string]cachev1alpha2.CMTemplateSpec
 )
 
+// typeValidCMTemplate tells whether the CMTemplate passes validation, GoTemplate
+// data that doesn't parse or calls an unknown function fails it
+const typeValidCMTemplate = "Valid"
+
 // CMTemplateReconciler reconciles a CMTemplate object
 type CMTemplateReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// MaxBaseTemplateDepth is how many base templates a template may inherit
+	// from through spec.baseTemplate, 0 doesn't limit it
+	MaxBaseTemplateDepth int
+	// StatusInterval is the least time between two updates of the usage the
+	// status of a template reports, so a busy template isn't written on every
+	// pod event of its CMStates. A change of its validity is written at once.
+	StatusInterval time.Duration
+	// Recorder records the progress of deleting a template as events on it
+	Recorder record.EventRecorder
+
+	statusMu      sync.Mutex
+	statusUpdated map[string]time.Time
 }
 
 func init() {
-	cmTemplates = make(map[string]cachev1alpha1.CMTemplateSpec)
+	cmTemplates = make(map[string]cachev1alpha2.CMTemplateSpec)
 }
 
 //+kubebuilder:rbac:groups=cache.spicedelver.me,resources=cmtemplates,verbs=get;list;watch;create;update;patch;delete
@@ -56,20 +83,77 @@ func init() {
 func (r *CMTemplateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := log.FromContext(ctx)
 
-	cmTemplate := &cachev1alpha1.CMTemplate{}
+	cmTemplate := &cachev1alpha2.CMTemplate{}
 	err := r.Get(ctx, req.NamespacedName, cmTemplate)
 	if err != nil {
 		// If this is not nil we are already tracking one. So in this case we need to add to the audience
 		if apierrors.IsNotFound(err) {
 			log.Info("cmtemplate resource was not found. Ignoring, as the object must be deleted")
 			delete(cmTemplates, req.NamespacedName.Name)
+			r.recordStatusUpdate(req.NamespacedName.Name, true)
 			return ctrl.Result{}, nil
 		}
 		// Error reading the object - requeue the request.
 		log.Error(err, "Failed to get cmtemplate")
 		return ctrl.Result{}, err
 	}
+	if !cmTemplate.DeletionTimestamp.IsZero() {
+		return r.reconcileDeletion(ctx, cmTemplate)
+	}
+	if err := r.ensureFinalizer(ctx, cmTemplate); err != nil {
+		log.Error(err, "Failed to add the finalizer to the cmtemplate")
+		return ctrl.Result{}, err
+	}
+	condition := metav1.Condition{Type: typeValidCMTemplate, Status: metav1.ConditionTrue, Reason: "Valid",
+		Message: "CMTemplate is valid", ObservedGeneration: cmTemplate.Generation}
+	// the template is validated with what it inherits from its base templates
+	resolved := cmTemplate.DeepCopy()
+	err = resolved.ResolveBase(r.MaxBaseTemplateDepth, templateGetter(ctx, r))
+	var baseErr *cachev1alpha2.BaseTemplateError
+	if errors.As(err, &baseErr) {
+		log.Info("cmtemplate base templates can't be resolved, pods using it will be denied", "error", baseErr.Error())
+		condition.Status, condition.Reason = metav1.ConditionFalse, baseErr.Reason
+		condition.Message = fmt.Sprintf("Pods using the CMTemplate are denied: %s", baseErr)
+	} else if err != nil {
+		log.Error(err, "Failed to get the base templates of the cmtemplate")
+		return ctrl.Result{}, err
+	} else if errs := resolved.Validate(); len(errs) > 0 {
+		log.Info("cmtemplate is invalid, pods using it will be denied", "errors", errs.ToAggregate().Error())
+		condition.Status, condition.Reason = metav1.ConditionFalse, "Invalid"
+		condition.Message = fmt.Sprintf("Pods using the CMTemplate are denied: %s", errs.ToAggregate())
+	}
 	cmTemplates[req.NamespacedName.Name] = cmTemplate.Spec
+
+	status := cmTemplate.Status.DeepCopy()
+	status.TargetKind = cmTemplate.Spec.TargetKind()
+	meta.SetStatusCondition(&status.Conditions, condition)
+	// the content is what pods render, with what the template inherits
+	if baseErr == nil {
+		if hash := resolved.Spec.TemplateHash(); hash != status.ContentHash {
+			now := metav1.Now()
+			status.ContentHash, status.LastChangedTime = hash, &now
+		}
+	}
+	// what the template itself says is written at once
+	specChanged := !equality.Semantic.DeepEqual(status, &cmTemplate.Status)
+	if err := r.observeUsage(ctx, cmTemplate.Name, status); err != nil {
+		log.Error(err, "Failed to list the CMStates of the cmtemplate")
+		return ctrl.Result{}, err
+	}
+	if equality.Semantic.DeepEqual(status, &cmTemplate.Status) {
+		return ctrl.Result{}, nil
+	}
+	// only the usage changed, it's written at most once per interval
+	if wait := r.untilStatusUpdate(cmTemplate.Name); !specChanged && wait > 0 {
+		return ctrl.Result{RequeueAfter: wait}, nil
+	}
+
+	cmTemplate.Status = *status
+	if err := r.Status().Update(ctx, cmTemplate); err != nil {
+		log.Error(err, "Failed to update CMTemplate status")
+		return ctrl.Result{}, err
+	}
+	r.recordStatusUpdate(cmTemplate.Name, false)
 	return ctrl.Result{}, nil
 }
 
@@ -77,7 +161,14 @@ func (r *CMTemplateReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 func (r *CMTemplateReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		Named("CMTemplateController").
-		For(&cachev1alpha1.CMTemplate{}).
+		For(&cachev1alpha2.CMTemplate{}).
+		// templates inheriting from a changed one are validated anew
+		Watches(&source.Kind{Type: &cachev1alpha2.CMTemplate{}},
+			handler.EnqueueRequestsFromMapFunc(r.cmTemplatesForBase)).
+		// the usage of a template follows the CMStates rendered from it
+		Watches(&source.Kind{Type: &cachev1alpha2.CMState{}},
+			handler.EnqueueRequestsFromMapFunc(r.cmTemplateForCMState),
+			builder.WithPredicates(cmStateUsageChanged)).
 		// Uncomment the following line adding a pointer to an instance of the controlled resource as an argument
 		// For().
 		Complete(r)
@@ -0,0 +1,372 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+)
+
+var _ = Describe("CMTemplateReconciler", func() {
+	ctx := context.Background()
+
+	newGoTemplate := func(data string) *cachev1alpha2.CMTemplate {
+		return &cachev1alpha2.CMTemplate{
+			ObjectMeta: metav1.ObjectMeta{Name: "vault-agent"},
+			Spec: cachev1alpha2.CMTemplateSpec{
+				Template: cachev1alpha2.Template{
+					AnnotationReplace: []cachev1alpha2.KeyedReplacement{{Key: "vault.hashicorp.com/role", Replacement: cachev1alpha2.Replacement{Placeholder: ""}}},
+					Data:              map[string]string{"config.hcl": data},
+					Engine:            cachev1alpha2.TemplateEngineGoTemplate,
+					TargetAnnotation:  "vault.hashicorp.com/agent-configmap",
+				},
+			},
+		}
+	}
+	reconcileTemplate := func(cmTemplate *cachev1alpha2.CMTemplate, objs ...client.Object) *metav1.Condition {
+		r := &CMTemplateReconciler{
+			Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(append(objs, cmTemplate)...).Build(),
+			Scheme: scheme.Scheme,
+
+			MaxBaseTemplateDepth: cachev1alpha2.DefaultMaxBaseTemplateDepth,
+		}
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmTemplate)})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(r.Get(ctx, client.ObjectKeyFromObject(cmTemplate), cmTemplate)).To(Succeed())
+		return meta.FindStatusCondition(cmTemplate.Status.Conditions, typeValidCMTemplate)
+	}
+
+	It("marks templates calling the allowed functions valid", func() {
+		condition := reconcileTemplate(newGoTemplate(`role = {{ index .Annotations "vault.hashicorp.com/role" | default "app" | trim | quote }}`))
+		Expect(condition).NotTo(BeNil())
+		Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+	})
+
+	It("reports data too large for a ConfigMap", func() {
+		cmTemplate := newGoTemplate("role = {{ .Labels.team }}")
+		cmTemplate.Spec.Template.BinaryData = map[string][]byte{"truststore.jks": make([]byte, 1024*1024)}
+
+		condition := reconcileTemplate(cmTemplate)
+		Expect(condition).NotTo(BeNil())
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(condition.Message).To(ContainSubstring("spec.template: Too long"))
+	})
+
+	It("reports the functions templates can't call", func() {
+		condition := reconcileTemplate(newGoTemplate("role = {{ .Labels.team | b64enc }}\ntoken = {{ env \"VAULT_TOKEN\" }}"))
+		Expect(condition).NotTo(BeNil())
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(condition.Reason).To(Equal("Invalid"))
+		Expect(condition.Message).To(ContainSubstring(`spec.template.data[config.hcl]: Invalid value: line 2: function "env" not defined`))
+	})
+
+	It("reports computed values failing to compile or type check", func() {
+		cmTemplate := newGoTemplate("role = {{ .Computed.role }}")
+		cmTemplate.Spec.Computed = []cachev1alpha2.ComputedValue{
+			{Key: "role", Expression: `labels["tier"] == "frontend" ? "web" : "backend"`},
+			{Key: "port", Expression: `size(annotations) + 8200`},
+			{Key: "team", Expression: `labels.team ==`},
+		}
+
+		condition := reconcileTemplate(cmTemplate)
+		Expect(condition).NotTo(BeNil())
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(condition.Message).NotTo(ContainSubstring("spec.computed[0]"))
+		Expect(condition.Message).To(ContainSubstring("spec.computed[1].expression"))
+		Expect(condition.Message).To(ContainSubstring("evaluates to int rather than a string"))
+		Expect(condition.Message).To(ContainSubstring("spec.computed[2].expression"))
+	})
+
+	It("reports computed values costing too much", func() {
+		cmTemplate := newGoTemplate("role = {{ .Computed.role }}")
+		cmTemplate.Spec.Computed = []cachev1alpha2.ComputedValue{{Key: "role",
+			Expression: `annotations.all(a, annotations.all(b, labels.all(c, a + b + c != podNamespace))) ? "a" : "b"`}}
+
+		condition := reconcileTemplate(cmTemplate)
+		Expect(condition).NotTo(BeNil())
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(condition.Message).To(ContainSubstring("exceeds the limit"))
+	})
+
+	It("publishes the content hash and when it last changed", func() {
+		cmTemplate := newGoTemplate("role = app\nexit_after_auth = true")
+		r := &CMTemplateReconciler{
+			Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(cmTemplate).Build(),
+			Scheme: scheme.Scheme,
+		}
+		reconcile := func() {
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmTemplate)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmTemplate), cmTemplate)).To(Succeed())
+		}
+
+		reconcile()
+		hash, changed := cmTemplate.Status.ContentHash, cmTemplate.Status.LastChangedTime
+		Expect(hash).To(Equal(cmTemplate.Spec.TemplateHash()))
+		Expect(changed).NotTo(BeNil())
+
+		// line endings aren't content
+		cmTemplate.Spec.Template.Data["config.hcl"] = "role = app\r\nexit_after_auth = true"
+		Expect(r.Update(ctx, cmTemplate)).To(Succeed())
+		reconcile()
+		Expect(cmTemplate.Status.ContentHash).To(Equal(hash))
+		Expect(cmTemplate.Status.LastChangedTime).To(Equal(changed))
+
+		cmTemplate.Spec.Template.Data["config.hcl"] = "role = app"
+		Expect(r.Update(ctx, cmTemplate)).To(Succeed())
+		reconcile()
+		Expect(cmTemplate.Status.ContentHash).NotTo(Equal(hash))
+		Expect(cmTemplate.Status.ContentHash).To(Equal(cmTemplate.Spec.TemplateHash()))
+	})
+
+	Context("when the template has a base template", func() {
+		newChild := func(base string) *cachev1alpha2.CMTemplate {
+			return &cachev1alpha2.CMTemplate{
+				ObjectMeta: metav1.ObjectMeta{Name: "vault-agent-team"},
+				Spec: cachev1alpha2.CMTemplateSpec{
+					BaseTemplate: base,
+					Template: cachev1alpha2.Template{
+						Data:   map[string]string{"team.hcl": "role = {{ .Labels.team }}"},
+						Engine: cachev1alpha2.TemplateEngineGoTemplate,
+					},
+				},
+			}
+		}
+
+		It("validates the template with what it inherits", func() {
+			base := newGoTemplate("role = app")
+			base.Spec.Template.TargetAnnotation = ""
+			base.Spec.Inject = &cachev1alpha2.Inject{AnnotationKeys: []string{"vault.hashicorp.com/agent-configmap"}}
+
+			condition := reconcileTemplate(newChild("vault-agent"), base)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+		})
+
+		It("reports a missing base template", func() {
+			condition := reconcileTemplate(newChild("vault-agent"))
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal(cachev1alpha2.ReasonBaseTemplateNotFound))
+			Expect(condition.Message).To(ContainSubstring("base template 'vault-agent' not found"))
+		})
+
+		It("reports base templates forming a cycle", func() {
+			base := newGoTemplate("role = app")
+			base.Spec.BaseTemplate = "vault-agent-team"
+
+			condition := reconcileTemplate(newChild("vault-agent"), base)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal(cachev1alpha2.ReasonBaseTemplateCycle))
+			Expect(condition.Message).To(ContainSubstring("vault-agent-team -> vault-agent -> vault-agent-team"))
+		})
+
+		It("validates the templates inheriting from a changed one anew", func() {
+			grandchild := newChild("vault-agent-team")
+			grandchild.Name = "vault-agent-team-a"
+			r := &CMTemplateReconciler{
+				Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).
+					WithObjects(newGoTemplate("role = app"), newChild("vault-agent"), grandchild).Build(),
+				Scheme: scheme.Scheme,
+			}
+
+			requests := r.cmTemplatesForBase(newGoTemplate("role = app"))
+			Expect(requests).To(ConsistOf(
+				HaveField("NamespacedName.Name", "vault-agent-team"),
+				HaveField("NamespacedName.Name", "vault-agent-team-a"),
+			))
+		})
+	})
+
+	Context("when CMStates are rendered from the template", func() {
+		newRenderedCMState := func(name string, audience ...string) *cachev1alpha2.CMState {
+			cmState := newTestCMState(audience...)
+			cmState.Name = name
+			return cmState
+		}
+
+		It("reports the CMStates, their audience and the last render", func() {
+			rendered := metav1.NewTime(time.Now().Add(-time.Minute).Truncate(time.Second))
+			first, second := newRenderedCMState("cmstate-a", "app-1", "app-2"), newRenderedCMState("cmstate-b", "app-3")
+			first.Status.LastRenderTime = &rendered
+			other := newRenderedCMState("cmstate-c", "app-4")
+			other.Spec.TemplateRef.Name = "other"
+
+			cmTemplate := newGoTemplate("role = app")
+			condition := reconcileTemplate(cmTemplate, first, second, other)
+			Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+			Expect(cmTemplate.Status.TargetKind).To(Equal(cachev1alpha2.TargetKindConfigMap))
+			Expect(cmTemplate.Status.CMStates).To(Equal(int32(2)))
+			Expect(cmTemplate.Status.Audience).To(Equal(int32(3)))
+			Expect(cmTemplate.Status.LastRenderTime.Equal(&rendered)).To(BeTrue())
+			Expect(meta.IsStatusConditionTrue(cmTemplate.Status.Conditions, typeInUseCMTemplate)).To(BeTrue())
+			Expect(meta.IsStatusConditionFalse(cmTemplate.Status.Conditions, typeRenderErrorsCMTemplate)).To(BeTrue())
+		})
+
+		It("reports an unused template", func() {
+			cmTemplate := newGoTemplate("role = app")
+			reconcileTemplate(cmTemplate)
+			Expect(cmTemplate.Status.CMStates).To(BeZero())
+			Expect(meta.FindStatusCondition(cmTemplate.Status.Conditions, typeInUseCMTemplate).Reason).To(Equal("Unused"))
+		})
+
+		It("aggregates the CMStates failing to render", func() {
+			var objs []client.Object
+			for _, name := range []string{"cmstate-a", "cmstate-b", "cmstate-c", "cmstate-d", "cmstate-e", "cmstate-f", "cmstate-g"} {
+				cmState := newRenderedCMState(name, "app")
+				meta.SetStatusCondition(&cmState.Status.Conditions, metav1.Condition{Type: typeAvailableCMState, Status: metav1.ConditionFalse,
+					Reason: "RenderFailed", Message: "data key 'config.hcl' failed to render"})
+				objs = append(objs, cmState)
+			}
+
+			cmTemplate := newGoTemplate("role = app")
+			reconcileTemplate(cmTemplate, objs...)
+			condition := meta.FindStatusCondition(cmTemplate.Status.Conditions, typeRenderErrorsCMTemplate)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+			Expect(condition.Message).To(HavePrefix("default/cmstate-a: data key 'config.hcl' failed to render; default/cmstate-b:"))
+			Expect(condition.Message).NotTo(ContainSubstring("cmstate-f"))
+			Expect(condition.Message).To(HaveSuffix("; and 2 more"))
+		})
+
+		It("updates the usage at most once per interval", func() {
+			cmTemplate := newGoTemplate("role = app")
+			r := &CMTemplateReconciler{
+				Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).
+					WithObjects(cmTemplate, newRenderedCMState("cmstate-a", "app-1")).Build(),
+				Scheme: scheme.Scheme,
+
+				StatusInterval: time.Hour,
+			}
+			req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmTemplate)}
+			_, err := r.Reconcile(ctx, req)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Create(ctx, newRenderedCMState("cmstate-b", "app-2"))).To(Succeed())
+			result, err := r.Reconcile(ctx, req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeNumerically(">", 59*time.Minute))
+			Expect(r.Get(ctx, req.NamespacedName, cmTemplate)).To(Succeed())
+			Expect(cmTemplate.Status.CMStates).To(Equal(int32(1)))
+
+			// a change of validity isn't held back
+			cmTemplate.Spec.Template.Data = map[string]string{"config.hcl": `token = {{ env "VAULT_TOKEN" }}`}
+			Expect(r.Update(ctx, cmTemplate)).To(Succeed())
+			_, err = r.Reconcile(ctx, req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Get(ctx, req.NamespacedName, cmTemplate)).To(Succeed())
+			Expect(meta.IsStatusConditionFalse(cmTemplate.Status.Conditions, typeValidCMTemplate)).To(BeTrue())
+			Expect(cmTemplate.Status.CMStates).To(Equal(int32(2)))
+		})
+
+		It("only follows the CMState updates changing the usage", func() {
+			oldState, newState := newTestCMState("app-1"), newTestCMState("app-2")
+			Expect(cmStateUsageChanged.Update(event.UpdateEvent{ObjectOld: oldState, ObjectNew: newState})).To(BeFalse())
+
+			newState.Spec.Audience = append(newState.Spec.Audience, cachev1alpha2.CMAudience{Kind: "Pod", Name: "app-3"})
+			Expect(cmStateUsageChanged.Update(event.UpdateEvent{ObjectOld: oldState, ObjectNew: newState})).To(BeTrue())
+		})
+	})
+
+	Context("when the template is deleted", func() {
+		// deleteTemplate reconciles the template into having its finalizer and
+		// deletes it along with CMStates rendered from it
+		deleteTemplate := func(policy cachev1alpha2.CleanupPolicy, objs ...client.Object) (*CMTemplateReconciler, *record.FakeRecorder, ctrl.Request) {
+			cmTemplate := newGoTemplate("role = {{ .Labels.team }}")
+			cmTemplate.Spec.CleanupPolicy = policy
+			recorder := record.NewFakeRecorder(10)
+			r := &CMTemplateReconciler{
+				Client:   fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(append(objs, cmTemplate)...).Build(),
+				Scheme:   scheme.Scheme,
+				Recorder: recorder,
+			}
+			req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmTemplate)}
+			_, err := r.Reconcile(ctx, req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Get(ctx, req.NamespacedName, cmTemplate)).To(Succeed())
+			Expect(cmTemplate.Finalizers).To(ContainElement(CMTemplateFinalizer))
+
+			Expect(r.Delete(ctx, cmTemplate)).To(Succeed())
+			_, err = r.Reconcile(ctx, req)
+			Expect(err).NotTo(HaveOccurred())
+			return r, recorder, req
+		}
+
+		It("waits for the CMStates rendered from it", func() {
+			cmState := newTestCMState("app-1")
+			r, recorder, req := deleteTemplate("", cmState)
+
+			cmTemplate := &cachev1alpha2.CMTemplate{}
+			Expect(r.Get(ctx, req.NamespacedName, cmTemplate)).To(Succeed())
+			condition := meta.FindStatusCondition(cmTemplate.Status.Conditions, typeTerminatingCMTemplate)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Reason).To(Equal("WaitingForCMStates"))
+			Expect(condition.Message).To(ContainSubstring("default/cmstate-vault-agent"))
+			Expect(recorder.Events).To(Receive(HavePrefix("Normal WaitingForCMStates Deletion waits for the 1 CMStates")))
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+
+			Expect(r.Delete(ctx, cmState)).To(Succeed())
+			_, err := r.Reconcile(ctx, req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apierrors.IsNotFound(r.Get(ctx, req.NamespacedName, cmTemplate))).To(BeTrue())
+		})
+
+		It("deletes the CMStates rendered from it first with the Cascade policy", func() {
+			cmState, other := newTestCMState("app-1"), newTestCMState("app-2")
+			other.Name, other.Spec.TemplateRef.Name = "cmstate-other", "other"
+			managed := map[string]string{cachev1alpha2.ManagedByLabel: cachev1alpha2.ManagedByValue}
+			cm, previous, unowned := newTestConfigMap(), newTestConfigMap(), newTestConfigMap()
+			cm.Labels, previous.Labels, unowned.Labels = managed, managed, managed
+			previous.Name = "cmstate-vault-agent-previous"
+			unowned.Name, unowned.OwnerReferences = "cmstate-vault-agent-user", nil
+			r, recorder, req := deleteTemplate(cachev1alpha2.CleanupPolicyCascade, cmState, other, cm, previous, unowned)
+
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cmState), cmState))).To(BeTrue())
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(cm), cm))).To(BeTrue())
+			Expect(apierrors.IsNotFound(r.Get(ctx, client.ObjectKeyFromObject(previous), previous))).To(BeTrue())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(unowned), unowned)).To(Succeed())
+			Expect(r.Get(ctx, client.ObjectKeyFromObject(other), other)).To(Succeed())
+			Expect(recorder.Events).To(Receive(HavePrefix("Normal DeletingCMStates Deleting the 1 CMStates")))
+
+			_, err := r.Reconcile(ctx, req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apierrors.IsNotFound(r.Get(ctx, req.NamespacedName, &cachev1alpha2.CMTemplate{}))).To(BeTrue())
+		})
+
+		It("is released right away without CMStates", func() {
+			r, _, req := deleteTemplate("")
+			Expect(apierrors.IsNotFound(r.Get(ctx, req.NamespacedName, &cachev1alpha2.CMTemplate{}))).To(BeTrue())
+		})
+	})
+})
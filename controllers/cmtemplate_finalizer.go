@@ -0,0 +1,163 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+)
+
+// CMTemplateFinalizer keeps a deleted CMTemplate until no CMState is rendered
+// from it anymore
+const CMTemplateFinalizer = "cache.spicedelver.me/cmstates"
+
+// typeTerminatingCMTemplate tells what a deleted CMTemplate is waiting for
+const typeTerminatingCMTemplate = "Terminating"
+
+// maxListedCMStates is how many CMStates the Terminating condition names
+const maxListedCMStates = 10
+
+// ensureFinalizer adds the finalizer to a template that doesn't have it yet
+func (r *CMTemplateReconciler) ensureFinalizer(ctx context.Context, cmTemplate *cachev1alpha2.CMTemplate) error {
+	if controllerutil.ContainsFinalizer(cmTemplate, CMTemplateFinalizer) {
+		return nil
+	}
+	controllerutil.AddFinalizer(cmTemplate, CMTemplateFinalizer)
+	return r.Update(ctx, cmTemplate)
+}
+
+// reconcileDeletion releases a deleted template once no CMState is rendered
+// from it anymore. Until then the Terminating condition names the CMStates
+// it waits for, which templates cleaned up by Cascade delete first.
+func (r *CMTemplateReconciler) reconcileDeletion(ctx context.Context, cmTemplate *cachev1alpha2.CMTemplate) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+	if !controllerutil.ContainsFinalizer(cmTemplate, CMTemplateFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	cmStates, err := r.cmStatesOf(ctx, cmTemplate.Name)
+	if err != nil {
+		log.Error(err, "Failed to list the CMStates of the cmtemplate")
+		return ctrl.Result{}, err
+	}
+	if len(cmStates) == 0 {
+		log.Info("Releasing the deleted cmtemplate, no CMState is rendered from it anymore")
+		controllerutil.RemoveFinalizer(cmTemplate, CMTemplateFinalizer)
+		return ctrl.Result{}, r.Update(ctx, cmTemplate)
+	}
+
+	condition := metav1.Condition{Type: typeTerminatingCMTemplate, Status: metav1.ConditionTrue, Reason: "WaitingForCMStates",
+		Message: fmt.Sprintf("Deletion waits for the %d CMStates rendered from the CMTemplate: %s", len(cmStates), listCMStates(cmStates)), ObservedGeneration: cmTemplate.Generation}
+	if cmTemplate.Spec.CleanupPolicy == cachev1alpha2.CleanupPolicyCascade {
+		condition.Reason = "DeletingCMStates"
+		condition.Message = fmt.Sprintf("Deleting the %d CMStates rendered from the CMTemplate: %s", len(cmStates), listCMStates(cmStates))
+		for i := range cmStates {
+			if cmStates[i].DeletionTimestamp != nil {
+				continue
+			}
+			log.Info("Deleting a CMState of the deleted cmtemplate", "namespace", cmStates[i].Namespace, "cmstate", cmStates[i].Name)
+			// ConfigMaps rendered before the CMState controlled them aren't
+			// collected along with it, so they are deleted first
+			if err := r.deleteRenderedBy(ctx, &cmStates[i]); err != nil {
+				log.Error(err, "Failed to delete the ConfigMaps of a CMState of the deleted cmtemplate", "namespace", cmStates[i].Namespace, "cmstate", cmStates[i].Name)
+				return ctrl.Result{}, err
+			}
+			if err := r.Delete(ctx, &cmStates[i]); client.IgnoreNotFound(err) != nil {
+				log.Error(err, "Failed to delete a CMState of the deleted cmtemplate", "namespace", cmStates[i].Namespace, "cmstate", cmStates[i].Name)
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	current := meta.FindStatusCondition(cmTemplate.Status.Conditions, typeTerminatingCMTemplate)
+	if current != nil && current.Reason == condition.Reason && current.Message == condition.Message {
+		return ctrl.Result{}, nil
+	}
+	if r.Recorder != nil {
+		r.Recorder.Event(cmTemplate, corev1.EventTypeNormal, condition.Reason, condition.Message)
+	}
+	meta.SetStatusCondition(&cmTemplate.Status.Conditions, condition)
+	if err := r.Status().Update(ctx, cmTemplate); err != nil {
+		log.Error(err, "Failed to update CMTemplate status")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// deleteRenderedBy deletes the ConfigMaps and Secrets the operator rendered
+// that the CMState controls
+func (r *CMTemplateReconciler) deleteRenderedBy(ctx context.Context, cmState *cachev1alpha2.CMState) error {
+	for _, list := range []client.ObjectList{&corev1.ConfigMapList{}, &corev1.SecretList{}} {
+		if err := r.List(ctx, list, client.InNamespace(cmState.Namespace),
+			client.MatchingLabels{cachev1alpha2.ManagedByLabel: cachev1alpha2.ManagedByValue}); err != nil {
+			return err
+		}
+		err := meta.EachListItem(list, func(item runtime.Object) error {
+			obj := item.(client.Object)
+			if !metav1.IsControlledBy(obj, cmState) {
+				return nil
+			}
+			uid := obj.GetUID()
+			return client.IgnoreNotFound(r.Delete(ctx, obj, client.Preconditions{UID: &uid}))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cmStatesOf lists the CMStates rendered from the cluster template
+func (r *CMTemplateReconciler) cmStatesOf(ctx context.Context, name string) ([]cachev1alpha2.CMState, error) {
+	cmStates := &cachev1alpha2.CMStateList{}
+	if err := r.List(ctx, cmStates); err != nil {
+		return nil, err
+	}
+	var found []cachev1alpha2.CMState
+	for _, cmState := range cmStates.Items {
+		if cmState.Spec.TemplateRef.Name == name && cmState.Spec.Scope() == cachev1alpha2.TemplateScopeCluster {
+			found = append(found, cmState)
+		}
+	}
+	return found, nil
+}
+
+// listCMStates names the CMStates sorted, the first maxListedCMStates of them
+func listCMStates(cmStates []cachev1alpha2.CMState) string {
+	names := make([]string, 0, len(cmStates))
+	for _, cmState := range cmStates {
+		names = append(names, cmState.Namespace+"/"+cmState.Name)
+	}
+	sort.Strings(names)
+	if len(names) > maxListedCMStates {
+		return fmt.Sprintf("%s and %d more", strings.Join(names[:maxListedCMStates], ", "), len(names)-maxListedCMStates)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+)
+
+const (
+	// typeInUseCMTemplate tells whether any CMState is rendered from the CMTemplate
+	typeInUseCMTemplate = "InUse"
+	// typeRenderErrorsCMTemplate tells whether CMStates of the CMTemplate fail to render
+	typeRenderErrorsCMTemplate = "RenderErrors"
+)
+
+// DefaultTemplateStatusInterval is the least time between two updates of the
+// usage a CMTemplate reports unless the operator is configured otherwise
+const DefaultTemplateStatusInterval = 10 * time.Second
+
+// maxRenderErrors is how many failing CMStates the RenderErrors condition
+// names before it only counts the rest
+const maxRenderErrors = 5
+
+// observeUsage records how many CMStates are rendered from the template, the
+// size of their audience and how their rendering went into the status
+func (r *CMTemplateReconciler) observeUsage(ctx context.Context, name string, status *cachev1alpha2.CMTemplateStatus) error {
+	cmStates := &cachev1alpha2.CMStateList{}
+	if err := r.List(ctx, cmStates); err != nil {
+		return err
+	}
+
+	status.CMStates, status.Audience = 0, 0
+	var failures []string
+	for _, cmState := range cmStates.Items {
+		if cmState.Spec.TemplateRef.Name != name || cmState.Spec.Scope() != cachev1alpha2.TemplateScopeCluster {
+			continue
+		}
+		status.CMStates++
+		status.Audience += int32(cmState.Spec.AudienceSize())
+		if rendered := cmState.Status.LastRenderTime; rendered != nil && (status.LastRenderTime == nil || status.LastRenderTime.Before(rendered)) {
+			status.LastRenderTime = rendered.DeepCopy()
+		}
+		if condition := meta.FindStatusCondition(cmState.Status.Conditions, typeAvailableCMState); condition != nil &&
+			condition.Status == metav1.ConditionFalse && (condition.Reason == reasonRenderFailed || condition.Reason == reasonRenderTooLarge) {
+			failures = append(failures, fmt.Sprintf("%s/%s: %s", cmState.Namespace, cmState.Name, condition.Message))
+		}
+	}
+
+	inUse := metav1.Condition{Type: typeInUseCMTemplate, Status: metav1.ConditionTrue, Reason: "InUse",
+		Message: "CMStates are rendered from the CMTemplate"}
+	if status.CMStates == 0 {
+		inUse.Status, inUse.Reason, inUse.Message = metav1.ConditionFalse, "Unused", "No CMState is rendered from the CMTemplate"
+	}
+	meta.SetStatusCondition(&status.Conditions, inUse)
+
+	renderErrors := metav1.Condition{Type: typeRenderErrorsCMTemplate, Status: metav1.ConditionFalse, Reason: "Rendered",
+		Message: "The CMStates of the CMTemplate render"}
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		message := strings.Join(failures, "; ")
+		if len(failures) > maxRenderErrors {
+			message = strings.Join(failures[:maxRenderErrors], "; ") + fmt.Sprintf("; and %d more", len(failures)-maxRenderErrors)
+		}
+		renderErrors.Status, renderErrors.Reason, renderErrors.Message = metav1.ConditionTrue, reasonRenderFailed, message
+	}
+	meta.SetStatusCondition(&status.Conditions, renderErrors)
+	return nil
+}
+
+// untilStatusUpdate returns how long the usage of the template has to wait
+// before its status is updated again, 0 when it may be updated now
+func (r *CMTemplateReconciler) untilStatusUpdate(name string) time.Duration {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	updated, ok := r.statusUpdated[name]
+	if !ok {
+		return 0
+	}
+	if wait := time.Until(updated.Add(r.StatusInterval)); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// recordStatusUpdate remembers when the status of the template was updated,
+// forgetting it once the template is gone
+func (r *CMTemplateReconciler) recordStatusUpdate(name string, deleted bool) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	if deleted {
+		delete(r.statusUpdated, name)
+		return
+	}
+	if r.statusUpdated == nil {
+		r.statusUpdated = make(map[string]time.Time)
+	}
+	r.statusUpdated[name] = time.Now()
+}
+
+// cmTemplateForCMState maps a CMState to the template it's rendered from, so
+// its usage is reported anew
+func (r *CMTemplateReconciler) cmTemplateForCMState(obj client.Object) []reconcile.Request {
+	cmState, ok := obj.(*cachev1alpha2.CMState)
+	if !ok || cmState.Spec.Scope() != cachev1alpha2.TemplateScopeCluster {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: cmState.Spec.TemplateRef.Name}}}
+}
+
+// cmStateUsageChanged only passes the CMState updates that change the usage
+// its template reports, not every pod joining an audience that's counted
+// the same
+var cmStateUsageChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldState, newState := e.ObjectOld.(*cachev1alpha2.CMState), e.ObjectNew.(*cachev1alpha2.CMState)
+		return oldState.Spec.TemplateRef.Name != newState.Spec.TemplateRef.Name ||
+			oldState.Spec.AudienceSize() != newState.Spec.AudienceSize() ||
+			!equality.Semantic.DeepEqual(oldState.Status.LastRenderTime, newState.Status.LastRenderTime) ||
+			!equality.Semantic.DeepEqual(meta.FindStatusCondition(oldState.Status.Conditions, typeAvailableCMState),
+				meta.FindStatusCondition(newState.Status.Conditions, typeAvailableCMState))
+	},
+}
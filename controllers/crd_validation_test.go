@@ -0,0 +1,124 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+)
+
+var _ = Describe("CRD validation", func() {
+	ctx := context.Background()
+
+	// expectInvalid creates the object and expects the API server to reject
+	// it naming the field
+	expectInvalid := func(obj client.Object, field string) {
+		err := k8sClient.Create(ctx, obj)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue(), "expected an invalid error, got %v", err)
+		Expect(err.Error()).To(ContainSubstring(field))
+	}
+
+	BeforeEach(func() {
+		if cfg == nil {
+			Skip("the CRDs are validated by the API server, KUBEBUILDER_ASSETS isn't set")
+		}
+	})
+
+	It("rejects CMStates without a template name", func() {
+		cmState := newTestCMState("app-1")
+		cmState.Spec.TemplateRef.Name = ""
+		expectInvalid(cmState, "spec.templateRef.name")
+	})
+
+	It("rejects audience entries of other kinds or without a name", func() {
+		cmState := newTestCMState("app-1")
+		cmState.Spec.Audience[0].Kind = "CronJob"
+		expectInvalid(cmState, "spec.audience[0].kind")
+
+		cmState = newTestCMState("")
+		expectInvalid(cmState, "spec.audience[0].name")
+	})
+
+	It("rejects workloads in audiences tracked per Pod", func() {
+		cmState := newTestCMState("app-1")
+		cmState.Spec.AudienceTracking = cachev1alpha2.AudienceTrackingPod
+		cmState.Spec.Audience = append(cmState.Spec.Audience, cachev1alpha2.CMAudience{Kind: "Deployment", Name: "app", Count: 2})
+		expectInvalid(cmState, "audiences tracked per Pod only list pods and Jobs")
+	})
+
+	It("keeps the audience tracking of a CMState", func() {
+		cmState := newTestCMState("app-1")
+		cmState.Name = "cmstate-vault-agent-tracking"
+		cmState.Spec.AudienceTracking = cachev1alpha2.AudienceTrackingPod
+		Expect(k8sClient.Create(ctx, cmState)).To(Succeed())
+		DeferCleanup(k8sClient.Delete, ctx, cmState)
+
+		cmState.Spec.AudienceTracking = cachev1alpha2.AudienceTrackingOwner
+		err := k8sClient.Update(ctx, cmState)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue(), "expected an invalid error, got %v", err)
+		Expect(err.Error()).To(ContainSubstring("audienceTracking is immutable"))
+	})
+
+	It("rejects template data keys that aren't ConfigMap keys", func() {
+		cmTemplate := newTestCMTemplate()
+		cmTemplate.Spec.Template.Data["conf/config.hcl"] = "role = \"{role}\""
+		expectInvalid(cmTemplate, "spec.template.data")
+	})
+
+	It("rejects field replacements keyed by something else than a qualified name", func() {
+		cmTemplate := newTestCMTemplate()
+		cmTemplate.Spec.Template.FieldReplace = map[string]cachev1alpha2.FieldReplacement{
+			"node name": {FieldPath: "spec.nodeName", Placeholder: "{node}"},
+		}
+		expectInvalid(cmTemplate, "spec.template.fieldReplace")
+	})
+
+	It("rejects target annotations that aren't qualified names", func() {
+		cmTemplate := newTestCMTemplate()
+		cmTemplate.Spec.Template.TargetAnnotation = "vault agent configmap"
+		expectInvalid(cmTemplate, "spec.template.targetAnnotation")
+	})
+
+	It("limits the annotations a template replaces", func() {
+		cmTemplate := newTestCMTemplate()
+		for i := 0; i < 64; i++ {
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, fmt.Sprintf("example.com/value-%d", i), cachev1alpha2.Replacement{Placeholder: fmt.Sprintf("{value-%d}", i)})
+		}
+		expectInvalid(cmTemplate, "spec.template.annotationReplace")
+	})
+
+	It("accepts valid CMStates and templates", func() {
+		cmTemplate := newTestCMTemplate()
+		cmTemplate.Name = "vault-agent-valid"
+		Expect(k8sClient.Create(ctx, cmTemplate)).To(Succeed())
+		DeferCleanup(k8sClient.Delete, ctx, cmTemplate)
+
+		cmState := newTestCMState("app-1")
+		cmState.Name = "cmstate-vault-agent-valid"
+		cmState.Spec.Audience = append(cmState.Spec.Audience, cachev1alpha2.CMAudience{Kind: "Deployment", Name: "app", Count: 2})
+		Expect(k8sClient.Create(ctx, cmState)).To(Succeed())
+		DeferCleanup(k8sClient.Delete, ctx, cmState)
+	})
+})
@@ -0,0 +1,228 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+)
+
+// resolveDataFrom adds the data the template references through dataFrom to
+// its template data for the CMStates of the namespace, returning the
+// references it couldn't resolve
+func (r *CMStateReconciler) resolveDataFrom(ctx context.Context, cmTemplate *cachev1alpha2.CMTemplate, namespace string) ([]string, error) {
+	return cmTemplate.ResolveDataFrom(namespace, r.AllowCrossNamespaceDataFrom, func(key types.NamespacedName, obj client.Object) error {
+		return r.Get(ctx, key, obj)
+	})
+}
+
+// reconcileDegraded records the dataFrom references of the template that
+// can't be resolved as the Degraded condition, the ConfigMap is rendered
+// without their data meanwhile
+func (r *CMStateReconciler) reconcileDegraded(ctx context.Context, cmState *cachev1alpha2.CMState) error {
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	if err := r.getCMTemplate(ctx, cmState, cmTemplate); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	missing, err := r.resolveDataFrom(ctx, cmTemplate, cmState.Namespace)
+	if err != nil {
+		return err
+	}
+
+	condition := metav1.Condition{Type: typeDegradedCMState, Status: metav1.ConditionFalse, Reason: "DataFromResolved",
+		Message: fmt.Sprintf("Resolved the dataFrom of CMTemplate %s", cmState.Spec.TemplateRef.Name)}
+	if len(missing) > 0 {
+		condition.Status, condition.Reason = metav1.ConditionTrue, "DataFromMissing"
+		condition.Message = fmt.Sprintf("Rendering CMTemplate %s without the data of: %s", cmState.Spec.TemplateRef.Name, strings.Join(missing, "; "))
+	}
+	current := meta.FindStatusCondition(cmState.Status.Conditions, typeDegradedCMState)
+	if current == nil && len(missing) == 0 {
+		// only CMStates that were ever missing data carry the condition
+		return nil
+	}
+	if current != nil && current.Status == condition.Status && current.Message == condition.Message {
+		return nil
+	}
+	if len(missing) > 0 && r.Recorder != nil {
+		r.Recorder.Event(cmState, corev1.EventTypeWarning, "DataFromMissing", condition.Message)
+	}
+	meta.SetStatusCondition(&cmState.Status.Conditions, condition)
+	return r.Status().Update(ctx, cmState)
+}
+
+// reconcileData renders the ConfigMaps of the CMState anew, updating them in
+// place when the template, or the data it references or inherits, changed.
+// Immutable and hash versioned templates roll over to a new ConfigMap
+// instead, they are only rendered here while the last render failed. A
+// successful render makes the CMState available again.
+func (r *CMStateReconciler) reconcileData(ctx context.Context, cmState *cachev1alpha2.CMState, log logr.Logger) (ctrl.Result, error) {
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	if err := r.getCMTemplate(ctx, cmState, cmTemplate); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	available := meta.IsStatusConditionTrue(cmState.Status.Conditions, typeAvailableCMState)
+	if cmTemplate.Spec.HashVersioned() && available {
+		return ctrl.Result{}, nil
+	}
+
+	objects, err := r.objectsForCMState(cmState, ctx, log)
+	var renderErr *renderError
+	if errors.As(err, &renderErr) {
+		return r.reconcileRenderFailed(ctx, cmState, renderErr, log)
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	updated := false
+	if !cmTemplate.Spec.HashVersioned() {
+		if updated, err = r.updateRendered(ctx, cmTemplate, objects, log); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if !updated && available && cmState.Status.RenderedFromGeneration == cmTemplate.Generation {
+		return ctrl.Result{}, nil
+	}
+
+	if updated {
+		cmState.Status.LastRenderTime = &metav1.Time{Time: time.Now()}
+		requestReload(cmState, cmTemplate)
+	}
+	if !cmTemplate.Spec.HashVersioned() {
+		cmState.Status.RenderedFromGeneration = cmTemplate.Generation
+	}
+	meta.SetStatusCondition(&cmState.Status.Conditions, renderedCondition(cmState.Spec.Target))
+	if err := r.Status().Update(ctx, cmState); err != nil {
+		log.Error(err, "Failed to update CMState status")
+		return ctrl.Result{}, err
+	}
+	if updated && r.Recorder != nil {
+		r.Recorder.Eventf(cmState, corev1.EventTypeNormal, "Rerendered", "Rendered %s %s anew with the changed template", kindOf(objects[0]), cmState.Spec.Target)
+	}
+	return ctrl.Result{}, nil
+}
+
+// updateRendered updates the data of the ConfigMaps that exist to the rendered
+// objects, reporting whether any of them changed
+func (r *CMStateReconciler) updateRendered(ctx context.Context, cmTemplate *cachev1alpha2.CMTemplate, objects []client.Object, log logr.Logger) (bool, error) {
+	updated := false
+	for _, rendered := range objects {
+		found := emptyObject(cmTemplate.Spec.TargetKind())
+		if err := r.Get(ctx, client.ObjectKeyFromObject(rendered), found); err != nil {
+			// missing outputs are created by reconcileOutputs
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return false, err
+		}
+		if !updateData(found, rendered) {
+			continue
+		}
+		log.Info("Updating the ConfigMap with the changed template", "ConfigMap.Name", found.GetName(), "kind", kindOf(found))
+		if err := r.Update(ctx, found); err != nil {
+			log.Error(err, "Failed to update ConfigMap", "ConfigMap.Name", found.GetName(), "kind", kindOf(found))
+			return false, err
+		}
+		updated = true
+	}
+	return updated, nil
+}
+
+// updateData copies the data of the rendered object to the one found,
+// reporting whether that changed it
+func updateData(found, rendered client.Object) bool {
+	switch found := found.(type) {
+	case *corev1.ConfigMap:
+		rendered := rendered.(*corev1.ConfigMap)
+		if equality.Semantic.DeepEqual(found.Data, rendered.Data) && equality.Semantic.DeepEqual(found.BinaryData, rendered.BinaryData) {
+			return false
+		}
+		found.Data, found.BinaryData = rendered.Data, rendered.BinaryData
+	case *corev1.Secret:
+		rendered := rendered.(*corev1.Secret)
+		if equality.Semantic.DeepEqual(found.Data, rendered.Data) {
+			return false
+		}
+		found.Data = rendered.Data
+	}
+	return true
+}
+
+// cmStatesForDataFrom maps a ConfigMap or Secret to the CMStates whose
+// template adds its data through dataFrom, so changing it renders them anew
+func (r *CMStateReconciler) cmStatesForDataFrom(kind string) handler.MapFunc {
+	return func(obj client.Object) []reconcile.Request {
+		cmTemplates := &cachev1alpha2.CMTemplateList{}
+		if err := r.List(context.Background(), cmTemplates); err != nil {
+			return nil
+		}
+		namespacedTemplates := &cachev1alpha2.NamespacedCMTemplateList{}
+		if err := r.List(context.Background(), namespacedTemplates); err != nil {
+			return nil
+		}
+		// keyed by namespace and name, cluster templates have no namespace
+		sources := make(map[types.NamespacedName][]cachev1alpha2.DataFromSource)
+		for _, cmTemplate := range cmTemplates.Items {
+			if len(cmTemplate.Spec.DataFrom) > 0 {
+				sources[client.ObjectKeyFromObject(&cmTemplate)] = cmTemplate.Spec.DataFrom
+			}
+		}
+		for _, cmTemplate := range namespacedTemplates.Items {
+			if len(cmTemplate.Spec.DataFrom) > 0 {
+				sources[client.ObjectKeyFromObject(&cmTemplate)] = cmTemplate.Spec.DataFrom
+			}
+		}
+		if len(sources) == 0 {
+			return nil
+		}
+
+		cmStates := &cachev1alpha2.CMStateList{}
+		if err := r.List(context.Background(), cmStates); err != nil {
+			return nil
+		}
+		var requests []reconcile.Request
+		for _, cmState := range cmStates.Items {
+			key := types.NamespacedName{Name: cmState.Spec.TemplateRef.Name}
+			if cmState.Spec.Scope() == cachev1alpha2.TemplateScopeNamespaced {
+				key.Namespace = cmState.Namespace
+			}
+			for _, source := range sources[key] {
+				if source.References(kind, client.ObjectKeyFromObject(obj), cmState.Namespace) {
+					requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&cmState)})
+					break
+				}
+			}
+		}
+		return requests
+	}
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var audienceSize = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cmstate_audience_size",
+		Help: "Number of pods and owners the audience of a CMState lists, by namespace and CMState.",
+	},
+	[]string{"namespace", "cmstate"},
+)
+
+func init() {
+	metrics.Registry.MustRegister(audienceSize)
+}
+
+// recordAudienceSize exports the audience size of the cmstate
+func recordAudienceSize(cmState *cachev1alpha2.CMState) {
+	audienceSize.WithLabelValues(cmState.Namespace, cmState.Name).Set(float64(cmState.Spec.AudienceSize()))
+}
+
+// forgetAudienceSize drops a deleted cmstate from the metric
+func forgetAudienceSize(key types.NamespacedName) {
+	audienceSize.DeleteLabelValues(key.Namespace, key.Name)
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("printer columns", func() {
+	ctx := context.Background()
+
+	// table lists the resource the way kubectl get does, by its printer columns
+	table := func(path string) map[string][]interface{} {
+		clientset, err := kubernetes.NewForConfig(cfg)
+		Expect(err).NotTo(HaveOccurred())
+		raw, err := clientset.CoreV1().RESTClient().Get().AbsPath(path).
+			SetHeader("Accept", "application/json;as=Table;v=v1;g=meta.k8s.io").Do(ctx).Raw()
+		Expect(err).NotTo(HaveOccurred())
+
+		list := &metav1.Table{}
+		Expect(json.Unmarshal(raw, list)).To(Succeed())
+		rows := make(map[string][]interface{}, len(list.Rows))
+		for _, row := range list.Rows {
+			// the first column is the name
+			rows[row.Cells[0].(string)] = row.Cells[1:]
+		}
+		return rows
+	}
+
+	BeforeEach(func() {
+		if cfg == nil {
+			Skip("the printer columns are served by the API server, KUBEBUILDER_ASSETS isn't set")
+		}
+	})
+
+	It("shows the live status of templates and cmstates", func() {
+		cmTemplate := newTestCMTemplate()
+		cmTemplate.Name = "vault-agent-columns"
+		cmTemplate.Spec.Template.TargetAnnotation = "vault.hashicorp.com/agent-configmap"
+		Expect(k8sClient.Create(ctx, cmTemplate)).To(Succeed())
+		DeferCleanup(k8sClient.Delete, ctx, cmTemplate)
+
+		cmState := newTestCMState("app-1", "app-2")
+		cmState.Name, cmState.Spec.TemplateRef.Name, cmState.Spec.Target = "cmstate-vault-agent-columns", cmTemplate.Name, ""
+		Expect(k8sClient.Create(ctx, cmState)).To(Succeed())
+		DeferCleanup(k8sClient.Delete, ctx, cmState)
+
+		DeferCleanup(k8sClient.Delete, ctx, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: cmState.Name, Namespace: cmState.Namespace}})
+
+		stateReconciler := &CMStateReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+		_, err := stateReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmState)})
+		Expect(err).NotTo(HaveOccurred())
+		templateReconciler := &CMTemplateReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+		_, err = templateReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cmTemplate)})
+		Expect(err).NotTo(HaveOccurred())
+
+		// TARGET-KIND, STATES, AUDIENCE, VALID, AGE
+		templates := table("/apis/cache.spicedelver.me/v1alpha2/cmtemplates")
+		Expect(templates).To(HaveKey(cmTemplate.Name))
+		Expect(templates[cmTemplate.Name][:4]).To(Equal([]interface{}{"ConfigMap", float64(1), float64(2), "True"}))
+		// TEMPLATE, AUDIENCE, READY, CONFIGMAP, AGE
+		cmStates := table("/apis/cache.spicedelver.me/v1alpha2/namespaces/default/cmstates")
+		Expect(cmStates).To(HaveKey(cmState.Name))
+		Expect(cmStates[cmState.Name][:4]).To(Equal([]interface{}{cmTemplate.Name, float64(2), "True", "cmstate-vault-agent-columns"}))
+	})
+})
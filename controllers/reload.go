@@ -0,0 +1,209 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+)
+
+//+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets,verbs=get;list;watch;patch
+//+kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch
+
+// RestartedAtAnnotation is set on the pod template of the workloads of the
+// audience to roll them over once their ConfigMap was rendered anew
+const RestartedAtAnnotation = "cache.spicedelver.me/restartedAt"
+
+// DefaultReloadInterval is the least time between two restarts of the same
+// workload unless the operator is configured otherwise
+const DefaultReloadInterval = 5 * time.Minute
+
+// requestReload records that the workloads of the audience are to be
+// restarted, for templates reloading their targets. Renders in quick
+// succession share a single restart.
+func requestReload(cmState *cachev1alpha2.CMState, cmTemplate *cachev1alpha2.CMTemplate) {
+	if cmTemplate.Spec.ReloadTargets {
+		cmState.Status.ReloadRequestedAt = &metav1.Time{Time: time.Now()}
+	}
+}
+
+// reconcileReload restarts the Deployments and StatefulSets of the audience
+// once the ConfigMap was rendered anew. A workload restarted less than the
+// reload interval ago is restarted once that passed, so flapping renders
+// can't keep it restarting, and one restarted since the render is left alone.
+func (r *CMStateReconciler) reconcileReload(ctx context.Context, cmState *cachev1alpha2.CMState, log logr.Logger) (ctrl.Result, error) {
+	requested := cmState.Status.ReloadRequestedAt
+	if requested == nil {
+		return ctrl.Result{}, nil
+	}
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	err := r.getCMTemplate(ctx, cmState, cmTemplate)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+
+	var wait time.Duration
+	if err == nil && cmTemplate.Spec.ReloadTargets {
+		workloads, err := r.audienceWorkloads(ctx, cmState)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		for _, workload := range workloads {
+			template := podTemplateOf(workload)
+			restarted, _ := time.Parse(time.RFC3339, template.Annotations[RestartedAtAnnotation])
+			if !restarted.Before(requested.Time.Truncate(time.Second)) {
+				continue
+			}
+			if remaining := time.Until(restarted.Add(r.ReloadInterval)); remaining > 0 {
+				if wait == 0 || remaining < wait {
+					wait = remaining
+				}
+				continue
+			}
+			if err := r.restart(ctx, cmState, workload, log); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+	if wait > 0 {
+		log.Info("Deferring the restart of workloads restarted within the reload interval", "after", wait)
+		return ctrl.Result{RequeueAfter: wait}, nil
+	}
+
+	cmState.Status.ReloadRequestedAt = nil
+	if err := r.Status().Update(ctx, cmState); err != nil {
+		log.Error(err, "Failed to update CMState status")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// restart rolls the workload over by stamping its pod template, only logging
+// it in dry run
+func (r *CMStateReconciler) restart(ctx context.Context, cmState *cachev1alpha2.CMState, workload client.Object, log logr.Logger) error {
+	kind := workload.GetObjectKind().GroupVersionKind().Kind
+	if r.ReloadDryRun {
+		log.Info("Would restart a workload of the audience (dry run)", "kind", kind, "namespace", workload.GetNamespace(), "name", workload.GetName())
+		if r.Recorder != nil {
+			r.Recorder.Eventf(cmState, corev1.EventTypeNormal, "WouldRestart", "Would restart %s %s/%s for the ConfigMap rendered anew (dry run)", kind, workload.GetNamespace(), workload.GetName())
+		}
+		return nil
+	}
+
+	patch := client.MergeFrom(workload.DeepCopyObject().(client.Object))
+	template := podTemplateOf(workload)
+	if template.Annotations == nil {
+		template.Annotations = make(map[string]string)
+	}
+	template.Annotations[RestartedAtAnnotation] = time.Now().Format(time.RFC3339)
+	if err := r.Patch(ctx, workload, patch); err != nil {
+		log.Error(err, "Failed to restart a workload of the audience", "kind", kind, "namespace", workload.GetNamespace(), "name", workload.GetName())
+		return err
+	}
+	log.Info("Restarted a workload of the audience", "kind", kind, "namespace", workload.GetNamespace(), "name", workload.GetName())
+	if r.Recorder != nil {
+		r.Recorder.Eventf(cmState, corev1.EventTypeNormal, "Restarted", "Restarted %s %s/%s for the ConfigMap rendered anew", kind, workload.GetNamespace(), workload.GetName())
+	}
+	return nil
+}
+
+// audienceWorkloads returns the Deployments and StatefulSets the audience of
+// the CMState belongs to, each once. Pods are followed to their owner, pods
+// tracked under the generateName of their ReplicaSet through that. Entries
+// naming another namespace are ignored.
+func (r *CMStateReconciler) audienceWorkloads(ctx context.Context, cmState *cachev1alpha2.CMState) ([]client.Object, error) {
+	seen := make(map[string]bool)
+	var workloads []client.Object
+	namespace := cmState.Namespace
+	for _, entry := range cmState.Spec.Audience {
+		if entry.Namespace != "" && entry.Namespace != namespace {
+			// the audience is editable, an entry can't restart workloads
+			// outside the namespace of the CMState
+			continue
+		}
+		kind, name := entry.Kind, entry.Name
+		if kind == "Pod" {
+			pod := &corev1.Pod{}
+			err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, pod)
+			switch {
+			case err == nil && metav1.GetControllerOf(pod) != nil:
+				kind, name = metav1.GetControllerOf(pod).Kind, metav1.GetControllerOf(pod).Name
+			case apierrors.IsNotFound(err) && strings.HasSuffix(name, "-"):
+				kind, name = "ReplicaSet", strings.TrimSuffix(name, "-")
+			case err != nil && !apierrors.IsNotFound(err):
+				return nil, err
+			}
+		}
+		if kind == "ReplicaSet" {
+			replicaSet := &appsv1.ReplicaSet{}
+			err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, replicaSet)
+			if client.IgnoreNotFound(err) != nil {
+				return nil, err
+			}
+			if ref := metav1.GetControllerOf(replicaSet); err == nil && ref != nil {
+				kind, name = ref.Kind, ref.Name
+			}
+		}
+
+		var workload client.Object
+		switch kind {
+		case "Deployment":
+			workload = &appsv1.Deployment{}
+		case "StatefulSet":
+			workload = &appsv1.StatefulSet{}
+		default:
+			continue
+		}
+		key := kind + "/" + namespace + "/" + name
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, workload); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		workload.GetObjectKind().SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind(kind))
+		workloads = append(workloads, workload)
+	}
+	return workloads, nil
+}
+
+// podTemplateOf returns the pod template of the workload
+func podTemplateOf(workload client.Object) *corev1.PodTemplateSpec {
+	switch workload := workload.(type) {
+	case *appsv1.Deployment:
+		return &workload.Spec.Template
+	case *appsv1.StatefulSet:
+		return &workload.Spec.Template
+	}
+	return &corev1.PodTemplateSpec{}
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+)
+
+// renderContext is what the data of GoTemplate templates is executed against
+type renderContext struct {
+	// Annotations are the values of the annotations the template replaces,
+	// as copied from the pod to the CMState
+	Annotations map[string]string
+	// Labels are the labels of the CMState, with the values of the labels the
+	// template replaces
+	Labels map[string]string
+	// Params are the values of the annotations and labels the template
+	// replaces parsed as the types of their replacements, int64 for int,
+	// bool for bool and string otherwise, so conditionals can use them
+	Params map[string]interface{}
+	// Fields are the values of the pod fields the template replaces, as read
+	// from the pod creating the CMState
+	Fields map[string]string
+	// Namespace is the namespace of the CMState and its pods
+	Namespace string
+	// PodName is the first member of the audience, the pod or the workload
+	// it is tracked under
+	PodName string
+	// Computed are the values computed by the expressions of the template
+	Computed map[string]string
+}
+
+const (
+	// reasonRenderFailed is a template failing to execute or its data failing
+	// to parse
+	reasonRenderFailed = "RenderFailed"
+	// reasonRenderTooLarge is a template rendering more data than a ConfigMap
+	// of it may hold
+	reasonRenderTooLarge = "RenderTooLarge"
+)
+
+// renderError is a template failing to render, retrying doesn't fix it until
+// the template or the values change
+type renderError struct {
+	key string
+	err error
+	// reason is why it failed, reasonRenderFailed unless set
+	reason string
+}
+
+// Reason returns why the template failed to render
+func (e *renderError) Reason() string {
+	if e.reason == "" {
+		return reasonRenderFailed
+	}
+	return e.reason
+}
+
+func (e *renderError) Error() string {
+	return fmt.Sprintf("rendering %s: %s", e.key, e.err)
+}
+
+func (e *renderError) Unwrap() error {
+	return e.err
+}
+
+// checkSize fails ConfigMaps holding more data than the template allows,
+// before they are written, so the API server doesn't reject them
+func checkSize(spec *cachev1alpha2.CMTemplateSpec, cm *corev1.ConfigMap) error {
+	size, limit := cachev1alpha2.RenderedSize(cm), spec.MaxRenderedSize()
+	if size <= limit {
+		return nil
+	}
+	return &renderError{key: cm.Name, reason: reasonRenderTooLarge,
+		err: fmt.Errorf("%d bytes of data exceed the limit of %d bytes", size, limit)}
+}
+
+// computedValues are the values computed for a cmstate, by their key and by
+// the placeholder the Replace engine replaces
+type computedValues struct {
+	byKey         map[string]string
+	byPlaceholder map[string]string
+}
+
+// renderData renders the ConfigMap data of the cmstate with the engine of
+// its template and the computed values, and parses the keys declaring a
+// syntax
+func renderData(tmpl *cachev1alpha2.Template, cmstate *cachev1alpha2.CMState, computed computedValues) (map[string]string, error) {
+	data, err := executeData(tmpl, cmstate, computed)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSyntax(tmpl, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// newRenderContext returns the values the cmstate renders the template with
+func newRenderContext(tmpl *cachev1alpha2.Template, cmstate *cachev1alpha2.CMState) renderContext {
+	context := renderContext{
+		Annotations: make(map[string]string, len(tmpl.AnnotationReplace)),
+		Labels:      make(map[string]string, len(cmstate.GetLabels())+len(tmpl.LabelReplace)),
+		Fields:      make(map[string]string, len(tmpl.FieldReplace)),
+		Namespace:   cmstate.GetNamespace(),
+	}
+	for key, value := range cmstate.GetLabels() {
+		context.Labels[key] = value
+	}
+	// left out optional annotations and labels are empty, required ones stay
+	// missing keys instead of empty values
+	for _, replacement := range tmpl.AnnotationReplace {
+		annotation := replacement.Key
+		if value, ok := replacementValue(cmstate, tmpl, annotation); ok {
+			context.Annotations[annotation] = value
+		} else if tmpl.Optional(annotation) {
+			context.Annotations[annotation] = ""
+		}
+	}
+	for key := range tmpl.FieldReplace {
+		// fields the pod didn't have yet are empty, like the Replace engine
+		// renders them
+		context.Fields[key], _ = replacementValue(cmstate, tmpl, key)
+	}
+	for _, replacement := range tmpl.LabelReplace {
+		label := replacement.Key
+		if value, ok := replacementValue(cmstate, tmpl, label); ok {
+			context.Labels[label] = value
+		} else if tmpl.Optional(label) {
+			context.Labels[label] = ""
+		}
+	}
+	replacements := tmpl.Replacements()
+	context.Params = make(map[string]interface{}, len(replacements))
+	for key, replacement := range replacements {
+		value, ok := context.Annotations[key]
+		if _, annotation := cachev1alpha2.FindReplacement(tmpl.AnnotationReplace, key); !annotation {
+			value, ok = context.Labels[key]
+		}
+		if ok {
+			context.Params[key] = replacement.Typed(value)
+		}
+	}
+	if len(cmstate.Spec.Audience) > 0 {
+		context.PodName = cmstate.Spec.Audience[0].Name
+	}
+	return context
+}
+
+// computeValues evaluates the computed values of the template for the
+// cmstate, an expression failing to evaluate fails the rendering like a
+// template failing to execute
+func computeValues(spec *cachev1alpha2.CMTemplateSpec, cmstate *cachev1alpha2.CMState) (computedValues, error) {
+	var computed computedValues
+	if len(spec.Computed) == 0 {
+		return computed, nil
+	}
+	context := newRenderContext(&spec.Template, cmstate)
+	input := &cachev1alpha2.ComputedInput{
+		Annotations: context.Annotations,
+		Labels:      context.Labels,
+		Fields:      context.Fields,
+		Namespace:   context.Namespace,
+		PodName:     context.PodName,
+	}
+	computed.byKey = make(map[string]string, len(spec.Computed))
+	computed.byPlaceholder = make(map[string]string, len(spec.Computed))
+	for i := range spec.Computed {
+		value, err := spec.Computed[i].Evaluate(input)
+		if err != nil {
+			return computedValues{}, &renderError{key: "computed value " + spec.Computed[i].Key, err: err}
+		}
+		computed.byKey[spec.Computed[i].Key] = value
+		if spec.Computed[i].Placeholder != "" {
+			computed.byPlaceholder[spec.Computed[i].Placeholder] = value
+		}
+	}
+	return computed, nil
+}
+
+// executeData renders the ConfigMap data of the cmstate with the engine of
+// its template
+func executeData(tmpl *cachev1alpha2.Template, cmstate *cachev1alpha2.CMState, computed computedValues) (map[string]string, error) {
+	if !tmpl.GoTemplate() {
+		data := tmpl.Render(func(annotation string) string {
+			value, _ := replacementValue(cmstate, tmpl, annotation)
+			return value
+		})
+		for key, value := range data {
+			for placeholder, computed := range computed.byPlaceholder {
+				value = strings.ReplaceAll(value, placeholder, computed)
+			}
+			data[key] = value
+		}
+		return data, nil
+	}
+
+	context := newRenderContext(tmpl, cmstate)
+	context.Computed = computed.byKey
+
+	// the keys are rendered in order, so the same key fails every time
+	keys := make([]string, 0, len(tmpl.Data))
+	for key := range tmpl.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	data := make(map[string]string, len(keys))
+	for _, key := range keys {
+		parsed, err := tmpl.Parse(key)
+		if err != nil {
+			return nil, &renderError{key: key, err: err}
+		}
+		var out strings.Builder
+		if err := parsed.Execute(&out, context); err != nil {
+			return nil, &renderError{key: key, err: err}
+		}
+		data[key] = out.String()
+	}
+	return data, nil
+}
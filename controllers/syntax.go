@@ -0,0 +1,191 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	"sigs.k8s.io/yaml"
+)
+
+// checkSyntax parses the rendered data keys declaring a syntax, in order of
+// the keys so the same key fails every time
+func checkSyntax(tmpl *cachev1alpha2.Template, data map[string]string) error {
+	keys := make([]string, 0, len(tmpl.Syntax))
+	for key := range tmpl.Syntax {
+		if _, ok := data[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := parseSyntax(tmpl.Syntax[key], data[key]); err != nil {
+			return &renderError{key: key, err: err}
+		}
+	}
+	return nil
+}
+
+// parseSyntax parses the value with the syntax, keys without one aren't parsed
+func parseSyntax(syntax cachev1alpha2.DataSyntax, value string) error {
+	var parsed interface{}
+	switch syntax {
+	case cachev1alpha2.DataSyntaxJSON:
+		if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+			return fmt.Errorf("invalid json: %w", err)
+		}
+	case cachev1alpha2.DataSyntaxYAML:
+		if err := yaml.Unmarshal([]byte(value), &parsed); err != nil {
+			return fmt.Errorf("invalid yaml: %w", err)
+		}
+	case cachev1alpha2.DataSyntaxHCL:
+		if err := parseHCL(value); err != nil {
+			return fmt.Errorf("invalid hcl: %w", err)
+		}
+	}
+	return nil
+}
+
+// parseHCL checks the structure of HCL without interpreting it: strings,
+// their ${ } and %{ } interpolations, comments and heredocs are terminated
+// and brackets are balanced
+func parseHCL(value string) error {
+	// the closers expected, '"' inside a string and 'i' closing the
+	// interpolation of a string with }
+	var stack []byte
+	line := 1
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == '\n' {
+			line++
+		}
+		if len(stack) > 0 && stack[len(stack)-1] == '"' {
+			switch {
+			case c == '\\':
+				i++
+			case c == '\n':
+				return fmt.Errorf("unterminated string on line %d", line-1)
+			case c == '"':
+				stack = stack[:len(stack)-1]
+			case (c == '$' || c == '%') && strings.HasPrefix(value[i+1:], string(c)+"{"):
+				// $${ and %%{ are escaped
+				i += 2
+			case (c == '$' || c == '%') && strings.HasPrefix(value[i+1:], "{"):
+				stack = append(stack, 'i')
+				i++
+			}
+			continue
+		}
+
+		switch c {
+		case '#':
+			i = endOfLine(value, i) - 1
+		case '/':
+			switch {
+			case strings.HasPrefix(value[i+1:], "/"):
+				i = endOfLine(value, i) - 1
+			case strings.HasPrefix(value[i+1:], "*"):
+				end := strings.Index(value[i+2:], "*/")
+				if end == -1 {
+					return fmt.Errorf("unterminated comment on line %d", line)
+				}
+				line += strings.Count(value[i:i+2+end], "\n")
+				i += end + 3
+			}
+		case '<':
+			end, err := skipHeredoc(value, i, &line)
+			if err != nil {
+				return err
+			}
+			i = end
+		case '"':
+			stack = append(stack, '"')
+		case '{':
+			stack = append(stack, '}')
+		case '[':
+			stack = append(stack, ']')
+		case '(':
+			stack = append(stack, ')')
+		case '}', ']', ')':
+			if len(stack) == 0 {
+				return fmt.Errorf("unexpected %q on line %d", c, line)
+			}
+			closer := stack[len(stack)-1]
+			if closer == 'i' {
+				closer = '}'
+			}
+			if closer != c {
+				return fmt.Errorf("unexpected %q on line %d, expected %q", c, line, closer)
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if len(stack) > 0 {
+		switch closer := stack[len(stack)-1]; closer {
+		case '"':
+			return fmt.Errorf("unterminated string")
+		case 'i':
+			return fmt.Errorf("unterminated interpolation")
+		default:
+			return fmt.Errorf("missing %q", closer)
+		}
+	}
+	return nil
+}
+
+// endOfLine is the index of the newline ending the line of i, or the end of
+// the value
+func endOfLine(value string, i int) int {
+	if end := strings.IndexByte(value[i:], '\n'); end != -1 {
+		return i + end
+	}
+	return len(value)
+}
+
+// skipHeredoc returns the index of the last character of the heredoc starting
+// at i, up to the line closing it. A < not starting one is left alone.
+func skipHeredoc(value string, i int, line *int) (int, error) {
+	start := i
+	if !strings.HasPrefix(value[i:], "<<") {
+		return start, nil
+	}
+	i += 2
+	if strings.HasPrefix(value[i:], "-") {
+		i++
+	}
+	eol := endOfLine(value, i)
+	marker := strings.TrimSpace(value[i:eol])
+	if marker == "" || strings.ContainsAny(marker, " \t\"'{}[]()") {
+		return start, nil
+	}
+
+	opened := *line
+	for eol < len(value) {
+		*line++
+		next := endOfLine(value, eol+1)
+		if strings.TrimSpace(value[eol+1:next]) == marker {
+			return next - 1, nil
+		}
+		eol = next
+	}
+	return 0, fmt.Errorf("unterminated heredoc %s on line %d", marker, opened)
+}
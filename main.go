@@ -17,8 +17,11 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -32,6 +35,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	cachev1alpha1 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha1"
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
 	"github.com/stollenaar/cmstate-injector-operator/controllers"
 	"github.com/stollenaar/cmstate-injector-operator/webhook"
 	//+kubebuilder:scaffold:imports
@@ -40,12 +44,15 @@ import (
 var (
 	scheme   = runtime.NewScheme()
 	setupLog = ctrl.Log.WithName("setup")
+	// version is set at build time through -ldflags "-X main.version=..."
+	version = "dev"
 )
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(cachev1alpha1.AddToScheme(scheme))
+	utilruntime.Must(cachev1alpha2.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -53,23 +60,113 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var emptyAudienceGracePeriod time.Duration
+	var immutableHistory int
+	var allowCrossNamespaceDataFrom bool
+	var maxBaseTemplateDepth int
+	var templateStatusInterval time.Duration
+	var reloadInterval time.Duration
+	var reloadDryRun bool
+	var webhookOptions webhook.Options
+	var workloadOptions webhook.WorkloadOptions
+	var templateOptions webhook.TemplateOptions
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.DurationVar(&emptyAudienceGracePeriod, "empty-audience-grace-period", 30*time.Second,
+		"How long a CMState with an empty audience is kept before it is deleted, for templates without spec.ttlSecondsAfterEmpty.")
+	flag.IntVar(&immutableHistory, "immutable-history", 2,
+		"How many previous immutable ConfigMaps of a CMState are kept even when no pod uses them anymore.")
+	flag.BoolVar(&allowCrossNamespaceDataFrom, "allow-cross-namespace-data-from", false,
+		"Let the dataFrom of CMTemplates read ConfigMaps in other namespaces than the one of the CMState.")
+	flag.IntVar(&maxBaseTemplateDepth, "max-base-template-depth", cachev1alpha2.DefaultMaxBaseTemplateDepth,
+		"How many base templates a CMTemplate may inherit from through spec.baseTemplate, 0 doesn't limit it.")
+	flag.DurationVar(&templateStatusInterval, "template-status-interval", controllers.DefaultTemplateStatusInterval,
+		"The least time between two updates of the CMStates and audience a CMTemplate status reports.")
+	flag.DurationVar(&reloadInterval, "reload-interval", controllers.DefaultReloadInterval,
+		"The least time between two restarts of the same workload by CMTemplates reloading their targets.")
+	flag.BoolVar(&reloadDryRun, "reload-dry-run", false,
+		"Only log and record events for the workloads CMTemplates reloading their targets would restart.")
+	flag.StringVar(&webhookOptions.TriggerAnnotation, "trigger-annotation", webhook.DefaultTriggerAnnotation,
+		"The pod annotation naming the CMTemplates to inject.")
+	flag.Func("inject-namespaces", "Comma-separated glob patterns of the namespaces to inject pods in, defaults to all namespaces.",
+		func(value string) error {
+			webhookOptions.InjectNamespaces = splitList(value)
+			return nil
+		})
+	flag.Func("exclude-namespaces", "Comma-separated glob patterns of the namespaces never to inject pods in.",
+		func(value string) error {
+			webhookOptions.ExcludeNamespaces = splitList(value)
+			return nil
+		})
+	flag.StringVar(&webhookOptions.NamespaceSelector, "namespace-selector", "",
+		"A label selector the namespace of a pod has to match for it to be injected.")
+	flag.BoolVar(&webhookOptions.AllowSystemNamespaces, "allow-system-namespaces", false,
+		"Inject pods in kube-system, kube-node-lease and the operator's own namespace.")
+	flag.StringVar((*string)(&webhookOptions.MissingTemplatePolicy), "missing-template-policy", string(webhook.MissingTemplateWarn),
+		"What to do with pods referencing a CMTemplate that doesn't exist: Warn admits them without injection, Deny rejects them.")
+	flag.StringVar((*string)(&workloadOptions.Policy), "workload-template-policy", string(webhook.MissingTemplateWarn),
+		"What to do with Deployments, StatefulSets and DaemonSets whose pod template references a missing or disabled CMTemplate: Warn admits them with a warning, Deny rejects them.")
+	flag.StringVar((*string)(&templateOptions.ValidationPolicy), "validate-templates", string(webhook.TemplateValidationEnforce),
+		"What to do with CMTemplates failing validation when they are applied: enforce rejects them, warn admits them with a warning.")
+	flag.BoolVar(&webhookOptions.NamespaceDefaultTemplate, "namespace-default-template", false,
+		"Inject pods without a trigger annotation with the templates named by their namespace's "+webhook.NamespaceDefaultTemplateAnnotation+" annotation.")
+	flag.DurationVar(&webhookOptions.Timeout, "webhook-timeout", webhook.DefaultTimeout,
+		"How long a single pod admission may take, keep it below the timeoutSeconds of the webhook configuration.")
+	flag.StringVar((*string)(&webhookOptions.TimeoutPolicy), "timeout-policy", string(webhook.TimeoutWarn),
+		"What to do with pods whose admission timed out: Warn admits them with a warning, Error fails the admission.")
+	flag.StringVar((*string)(&webhookOptions.MutationMode), "mutation-mode", string(webhook.MutationEnforce),
+		"Whether the webhook mutates pods: enforce injects them, log-only logs the writes and patch it would make and admits pods unmodified.")
+	flag.StringVar((*string)(&webhookOptions.CMStateWrites), "cmstate-writes", string(webhook.CMStateWritesAdmission),
+		"Where the CMStates of admitted pods are written: admission creates or joins them while admitting the pod, controller leaves that to a controller watching pods.")
+	flag.IntVar(&webhookOptions.MaxAudienceSize, "max-audience-size", webhook.DefaultMaxAudienceSize,
+		"The number of pods a CMState lists before new pods joining it are denied, 0 disables the limit.")
+	flag.IntVar(&webhookOptions.AudienceSizeWarning, "audience-size-warning", 0,
+		"The number of pods a CMState lists before admissions warn about its size, defaults to 80% of --max-audience-size.")
+	flag.StringVar(&webhookOptions.Path, "webhook-path", webhook.DefaultWebhookPath,
+		"The path the webhook is served on, it has to match the path in the MutatingWebhookConfiguration.")
+	flag.IntVar(&webhookOptions.Port, "webhook-port", webhook.DefaultWebhookPort,
+		"The port the webhook server listens on.")
+	flag.StringVar(&webhookOptions.CertDir, "webhook-cert-dir", "",
+		"The directory holding the webhook's tls.crt and tls.key, defaults to /tmp/k8s-webhook-server/serving-certs.")
+	flag.StringVar(&webhookOptions.TLSMinVersion, "webhook-tls-min-version", webhook.DefaultTLSMinVersion,
+		"The lowest TLS version the webhook server accepts: 1.0, 1.1, 1.2 or 1.3.")
+	flag.Func("webhook-tls-cipher-suites", "Comma-separated IANA names of the cipher suites the webhook server accepts below TLS 1.3, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Defaults to Go's secure suites.",
+		func(value string) error {
+			webhookOptions.TLSCipherSuites = splitList(value)
+			return nil
+		})
+	flag.IntVar(&webhookOptions.BreakerThreshold, "cmstate-write-breaker-threshold", 5,
+		"The number of consecutive failed CMState writes after which pods are admitted without injection for the cooldown, 0 disables it.")
+	flag.DurationVar(&webhookOptions.BreakerWindow, "cmstate-write-breaker-window", webhook.DefaultBreakerWindow,
+		"The window the failed CMState writes opening the breaker have to happen in.")
+	flag.DurationVar(&webhookOptions.BreakerCooldown, "cmstate-write-breaker-cooldown", webhook.DefaultBreakerCooldown,
+		"How long CMState writes are skipped once the breaker opened.")
 	opts := zap.Options{
 		Development: true,
 	}
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
+	webhookOptions.AllowCrossNamespaceDataFrom = allowCrossNamespaceDataFrom
+	webhookOptions.MaxBaseTemplateDepth = maxBaseTemplateDepth
+	// workloads are checked where the pod webhook injects their pods
+	workloadOptions.TriggerAnnotation = webhookOptions.TriggerAnnotation
+	workloadOptions.InjectNamespaces = webhookOptions.InjectNamespaces
+	workloadOptions.ExcludeNamespaces = webhookOptions.ExcludeNamespaces
+	workloadOptions.NamespaceSelector = webhookOptions.NamespaceSelector
+	workloadOptions.AllowSystemNamespaces = webhookOptions.AllowSystemNamespaces
+	workloadOptions.MaxBaseTemplateDepth = maxBaseTemplateDepth
+	workloadOptions.Timeout = webhookOptions.Timeout
+	templateOptions.MaxBaseTemplateDepth = maxBaseTemplateDepth
+	templateOptions.Timeout = webhookOptions.Timeout
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "c377543a.spicedelver.me",
@@ -94,21 +191,54 @@ func main() {
 		Client:   mgr.GetClient(),
 		Scheme:   mgr.GetScheme(),
 		Recorder: mgr.GetEventRecorderFor("cm-injector"),
+
+		EmptyAudienceGracePeriod: emptyAudienceGracePeriod,
+		ImmutableHistory:         immutableHistory,
+
+		AllowCrossNamespaceDataFrom: allowCrossNamespaceDataFrom,
+		MaxBaseTemplateDepth:        maxBaseTemplateDepth,
+		ReloadInterval:              reloadInterval,
+		ReloadDryRun:                reloadDryRun,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "CMState")
 		os.Exit(1)
 	}
 
 	if err = (&controllers.CMTemplateReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("cm-injector"),
+
+		MaxBaseTemplateDepth: maxBaseTemplateDepth,
+		StatusInterval:       templateStatusInterval,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "CMTemplate")
 		os.Exit(1)
 	}
 
-	if err = webhook.CMStateCreator(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "CMTemplate")
+	if err = webhook.IndexAliases(context.Background(), mgr.GetFieldIndexer()); err != nil {
+		setupLog.Error(err, "unable to index cmtemplate aliases")
+		os.Exit(1)
+	}
+	webhookOptions.Version = version
+	if err = webhook.CMStateCreator(mgr, webhookOptions); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "CMStateCreator")
+		os.Exit(1)
+	}
+	if err = webhook.WorkloadValidator(mgr, workloadOptions); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "WorkloadValidator")
+		os.Exit(1)
+	}
+	if err = webhook.TemplateDefaulter(mgr); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "TemplateDefaulter")
+		os.Exit(1)
+	}
+	if err = webhook.TemplateValidator(mgr, templateOptions); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "TemplateValidator")
+		os.Exit(1)
+	}
+	if err = webhook.ConversionWebhook(mgr); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "Conversion")
 		os.Exit(1)
 	}
 	//+kubebuilder:scaffold:builder
@@ -121,6 +251,11 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	// keep admission traffic away until template reads are served from the cache
+	if err := mgr.AddReadyzCheck("cmtemplate-cache", webhook.CacheSyncedCheck(mgr.GetCache())); err != nil {
+		setupLog.Error(err, "unable to set up ready check")
+		os.Exit(1)
+	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
@@ -128,3 +263,14 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
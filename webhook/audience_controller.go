@@ -0,0 +1,154 @@
+package webhook
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+
+// audienceReconciler creates or joins the cmstates of the pods the webhook
+// deferred them for. It shares the webhook's client and audience bookkeeping,
+// so an entry looks the same whichever of the two wrote it.
+type audienceReconciler struct {
+	hook *cmStateCreator
+}
+
+func setupAudienceController(mgr ctrl.Manager, hook *cmStateCreator) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("pod-audience").
+		For(&corev1.Pod{}, builder.WithPredicates(pendingAudience())).
+		Complete(&audienceReconciler{hook: hook})
+}
+
+// pendingAudience only lets through deferred pods being created or getting
+// deferred, pod status updates don't change the audience
+func pendingAudience() predicate.Predicate {
+	marked := func(obj client.Object) bool {
+		_, ok := obj.GetAnnotations()[AudienceDeferredAnnotation]
+		return ok
+	}
+	pending := func(obj client.Object) bool {
+		return marked(obj) && obj.GetDeletionTimestamp() == nil
+	}
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return pending(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return !marked(e.ObjectOld) && pending(e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return false
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return false
+		},
+	}
+}
+
+// Reconcile joins the pod to the cmstate of every template it was injected
+// with, creating the cmstate when it is the first. Pods deleted before the
+// controller caught up are left alone, their deletion found nothing to remove.
+func (r *audienceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	pod := &corev1.Pod{}
+	if err := r.hook.Client.Get(ctx, req.NamespacedName, pod); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if pod.DeletionTimestamp != nil {
+		return ctrl.Result{}, nil
+	}
+	if _, ok := pod.Annotations[AudienceDeferredAnnotation]; !ok {
+		return ctrl.Result{}, nil
+	}
+	return ctrl.Result{}, r.joinAll(ctx, req, pod)
+}
+
+// joinAll joins the pod to the cmstates of the templates recorded on it
+func (r *audienceReconciler) joinAll(ctx context.Context, req ctrl.Request, pod *corev1.Pod) error {
+	log := ctrl.LoggerFrom(ctx)
+	hook := r.hook
+
+	checked := false
+	templates, cmStates := recordedInjections(pod)
+	for i, name := range templates {
+		cmTemplate := &cachev1alpha2.CMTemplate{}
+		if err := hook.getCMTemplate(ctx, pod.Namespace, name, cmTemplate); err != nil {
+			if apierrors.IsNotFound(err) {
+				log.Info("Skipping deleted cmtemplate", "cmtemplate", name)
+				continue
+			}
+			return err
+		}
+		var baseErr *cachev1alpha2.BaseTemplateError
+		if err := hook.resolveBase(ctx, cmTemplate); errors.As(err, &baseErr) {
+			log.Info("Skipping cmtemplate whose base templates can't be resolved", "cmtemplate", name, "error", baseErr.Error())
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := hook.resolveDataFrom(ctx, cmTemplate, pod.Namespace); err != nil {
+			return err
+		}
+		cmState, err := hook.fetchCMState(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: cmStates[i]})
+		if err != nil {
+			return err
+		}
+		if alreadyInjected(cmState, cmTemplate, pod) {
+			continue
+		}
+
+		if !checked {
+			// the cache may not have seen the deletion yet, joining a pod
+			// whose deletion already went through admission leaves a stale entry
+			live, err := hook.livePod(ctx, req.NamespacedName)
+			if err != nil || live == nil || live.DeletionTimestamp != nil {
+				return err
+			}
+			checked = true
+		}
+
+		err = r.join(ctx, cmStates[i], cmState, cmTemplate, pod)
+		if errors.Is(err, errAudienceFull) {
+			// retrying won't make room, the pod stays out of the audience
+			hook.recordPodEvent(pod, corev1.EventTypeWarning, eventAudienceJoinFailed, "Joining the audience of cmstate '%s' failed: %s", cmStates[i], err)
+			continue
+		}
+		if err != nil {
+			hook.recordPodEvent(pod, corev1.EventTypeWarning, eventAudienceJoinFailed, "Joining the audience of cmstate '%s' failed: %s", cmStates[i], err)
+			return err
+		}
+		hook.recordPodEvent(pod, corev1.EventTypeNormal, eventAudienceJoined, "Joined the audience of cmstate %s", cmStates[i])
+	}
+	return nil
+}
+
+// join adds the pod to the audience of the cmstate, creating it under the name
+// recorded at admission when missing
+func (r *audienceReconciler) join(ctx context.Context, name string, cmState *cachev1alpha2.CMState, cmTemplate *cachev1alpha2.CMTemplate, pod *corev1.Pod) error {
+	hook := r.hook
+	// the member id is read back from the pod, the owner resolves the same
+	owner := hook.audienceOwnerFor(ctx, audienceTrackingOf(cmState, cmTemplate), pod)
+	if cmState.Name != "" {
+		_, err := hook.addToAudience(ctx, cmState, pod, owner, injectedConfigMap(cmTemplate, pod))
+		return errors.Wrap(err, "error joining cmstate")
+	}
+
+	cmState = generateCMState(cmTemplate, name, pod, owner)
+	err := hook.Client.Create(ctx, cmState)
+	if apierrors.IsAlreadyExists(err) {
+		// a webhook or another pod got there first, join its audience instead
+		_, err = hook.addToAudience(ctx, cmState, pod, owner, injectedConfigMap(cmTemplate, pod))
+	}
+	return errors.Wrap(err, "error creating cmstate")
+}
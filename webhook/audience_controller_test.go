@@ -0,0 +1,199 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	"github.com/stollenaar/cmstate-injector-operator/webhook/testutil"
+)
+
+var _ = Describe("Pod audience controller", func() {
+	var (
+		ctx        = context.Background()
+		hook       *cmStateCreator
+		reconciler *audienceReconciler
+	)
+
+	newControllerHook := func(objs ...client.Object) {
+		hook = newTestHook(objs...)
+		hook.Options.CMStateWrites = CMStateWritesController
+		reconciler = &audienceReconciler{hook: hook}
+	}
+
+	// admit admits the pod and stores it the way the API server would
+	admit := func(pod *corev1.Pod) *corev1.Pod {
+		out := review(hook, testutil.NewPodCreateRequest(pod))
+		Expect(out.Response.Allowed).To(BeTrue())
+		created := applyPatch(pod, out)
+		Expect(hook.Client.Create(ctx, created)).To(Succeed())
+		return created
+	}
+
+	reconcilePod := func(pod *corev1.Pod) {
+		_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(pod)})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	cmStates := func() []cachev1alpha2.CMState {
+		list := &cachev1alpha2.CMStateList{}
+		Expect(hook.Client.List(ctx, list)).To(Succeed())
+		return list.Items
+	}
+
+	It("only stamps the pod at admission", func() {
+		newControllerHook(newTestTemplate())
+
+		pod := admit(newTestPod("app-1"))
+		Expect(pod.Annotations).To(HaveKeyWithValue(AudienceDeferredAnnotation, "true"))
+		Expect(pod.Annotations).To(HaveKeyWithValue(testTargetAnnotation, "cmstate-vault-agent"))
+		Expect(pod.Annotations).To(HaveKeyWithValue(CMStateAnnotation, "cmstate-vault-agent"))
+		Expect(cmStates()).To(BeEmpty())
+	})
+
+	It("creates the cmstate and joins it once", func() {
+		newControllerHook(newTestTemplate())
+
+		pod := admit(newTestPod("app-1"))
+		reconcilePod(pod)
+		reconcilePod(pod)
+
+		Expect(cmStates()).To(ConsistOf(And(
+			HaveField("Name", "cmstate-vault-agent"),
+			HaveField("Spec.Audience", ConsistOf(And(
+				HaveField("Name", "app-1"),
+				HaveField("UID", types.UID("app-1-uid")),
+			))),
+		)))
+	})
+
+	It("joins an existing cmstate", func() {
+		newControllerHook(newTestTemplate(), newTestCMState("app-0"))
+
+		reconcilePod(admit(newTestPod("app-1")))
+
+		Expect(cmStates()).To(ConsistOf(HaveField("Spec.Audience", ConsistOf(
+			HaveField("Name", "app-0"),
+			HaveField("Name", "app-1"),
+		))))
+	})
+
+	It("leaves pods out of a full audience without retrying", func() {
+		newControllerHook(newTestTemplate(), newTestCMState("app-0"))
+		hook.Options.MaxAudienceSize = 1
+
+		reconcilePod(admit(newTestPod("app-1")))
+
+		Expect(cmStates()).To(ConsistOf(HaveField("Spec.Audience", ConsistOf(HaveField("Name", "app-0")))))
+	})
+
+	It("counts every replica of an owner once", func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.AudienceTracking = cachev1alpha2.AudienceTrackingOwner
+		replicaSet := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Name:            "web-5d8f7",
+			Namespace:       testNamespace,
+			OwnerReferences: []metav1.OwnerReference{controllerRef("apps/v1", "Deployment", "web")},
+		}}
+		newControllerHook(cmTemplate, replicaSet)
+
+		for i := 0; i < 2; i++ {
+			pod := newTestPod(fmt.Sprintf("web-5d8f7-%d", i))
+			pod.OwnerReferences = []metav1.OwnerReference{controllerRef("apps/v1", "ReplicaSet", "web-5d8f7")}
+			pod = admit(pod)
+			Expect(pod.Annotations).To(HaveKey(AudienceMemberAnnotation))
+			reconcilePod(pod)
+			reconcilePod(pod)
+		}
+
+		Expect(cmStates()).To(ConsistOf(HaveField("Spec.Audience", ConsistOf(And(
+			HaveField("Kind", "Deployment"),
+			HaveField("Name", "web"),
+			HaveField("UID", types.UID("web-uid")),
+			HaveField("Count", BeEquivalentTo(2)),
+			HaveField("Members", HaveLen(2)),
+		)))))
+	})
+
+	It("leaves the audience once the joined pod is deleted", func() {
+		newControllerHook(newTestTemplate())
+
+		pod := admit(newTestPod("app-1"))
+		reconcilePod(pod)
+		Expect(review(hook, testutil.NewPodDeleteRequest(pod)).Response.Allowed).To(BeTrue())
+
+		Expect(cmStates()).To(ConsistOf(HaveField("Spec.Audience", BeEmpty())))
+	})
+
+	It("doesn't join pods deleted before it caught up", func() {
+		newControllerHook(newTestTemplate())
+
+		pod := admit(newTestPod("app-1"))
+		Expect(hook.Client.Delete(ctx, pod)).To(Succeed())
+		reconcilePod(pod)
+
+		Expect(cmStates()).To(BeEmpty())
+	})
+
+	It("doesn't join pods the cache still holds but the API server deleted", func() {
+		newControllerHook(newTestTemplate())
+		hook.APIReader = fake.NewClientBuilder().WithScheme(testScheme).Build()
+
+		reconcilePod(admit(newTestPod("app-1")))
+
+		Expect(cmStates()).To(BeEmpty())
+	})
+
+	It("ignores pods injected during admission", func() {
+		newControllerHook(newTestTemplate())
+		hook.Options.CMStateWrites = CMStateWritesAdmission
+
+		pod := admit(newTestPod("app-1"))
+		Expect(pod.Annotations).NotTo(HaveKey(AudienceDeferredAnnotation))
+		Expect(cmStates()).To(ConsistOf(HaveField("Spec.Audience", HaveLen(1))))
+
+		reconcilePod(pod)
+		Expect(cmStates()).To(ConsistOf(HaveField("Spec.Audience", HaveLen(1))))
+	})
+
+	It("only watches deferred pods being created", func() {
+		deferred := newTestPod("app-1")
+		deferred.Annotations[AudienceDeferredAnnotation] = "true"
+		plain := newTestPod("app-2")
+
+		p := pendingAudience()
+		Expect(p.Create(event.CreateEvent{Object: deferred})).To(BeTrue())
+		Expect(p.Create(event.CreateEvent{Object: plain})).To(BeFalse())
+		Expect(p.Update(event.UpdateEvent{ObjectOld: deferred, ObjectNew: deferred})).To(BeFalse())
+		Expect(p.Update(event.UpdateEvent{ObjectOld: plain, ObjectNew: deferred})).To(BeTrue())
+		Expect(p.Delete(event.DeleteEvent{Object: deferred})).To(BeFalse())
+	})
+})
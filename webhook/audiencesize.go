@@ -0,0 +1,49 @@
+package webhook
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// DefaultMaxAudienceSize is the number of pods a single cmstate lists before
+// new ones are denied. Every admission rewrites the whole audience, it gets
+// slow well before the object hits the size limit of etcd.
+const DefaultMaxAudienceSize = 2000
+
+// eventAudienceSize is the reason of the event recorded on a cmstate whose
+// audience grows past the warning threshold
+const eventAudienceSize = "AudienceSizeWarning"
+
+// errAudienceFull is returned when joining would grow an audience past
+// MaxAudienceSize
+var errAudienceFull = errors.New("audience is full")
+
+// audienceFull reports whether an audience grown to size is past the limit
+func (hook *cmStateCreator) audienceFull(size int) bool {
+	return hook.Options.MaxAudienceSize > 0 && size > hook.Options.MaxAudienceSize
+}
+
+// audienceFullResponse denies a pod because the cmstate it would join is full
+func (hook *cmStateCreator) audienceFullResponse(cmStateName string) *admission.Response {
+	resp := admission.Denied(fmt.Sprintf("cmstate-injector: cmstate '%s' reached its audience limit of %d pods, "+
+		"check the selector or owner tracking of its template", cmStateName, hook.Options.MaxAudienceSize))
+	return &resp
+}
+
+// checkAudienceSize warns about an audience past the warning threshold, on the
+// cmstate as an event and to the caller as an admission warning
+func (hook *cmStateCreator) checkAudienceSize(cmState *cachev1alpha2.CMState, size int) []string {
+	if hook.Options.AudienceSizeWarning <= 0 || size <= hook.Options.AudienceSizeWarning {
+		return nil
+	}
+	if hook.Recorder != nil {
+		// a constant message lets the recorder fold the repeats into one event
+		hook.Recorder.Eventf(cmState, corev1.EventTypeWarning, eventAudienceSize,
+			"Audience is above %d pods, new pods are denied above %d", hook.Options.AudienceSizeWarning, hook.Options.MaxAudienceSize)
+	}
+	return []string{warnf("cmstate '%s' lists %d pods, new pods are denied above %d", cmState.Name, size, hook.Options.MaxAudienceSize)}
+}
@@ -0,0 +1,117 @@
+package webhook
+
+import (
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// DefaultBreakerWindow is the window consecutive cmstate write failures
+	// are counted in
+	DefaultBreakerWindow = 30 * time.Second
+	// DefaultBreakerCooldown is how long cmstate writes are skipped once the
+	// breaker opened
+	DefaultBreakerCooldown = 30 * time.Second
+)
+
+// eventCMStateWritesSuspended is the reason of the event recorded in the
+// operator's namespace when the breaker opens
+const eventCMStateWritesSuspended = "CMStateWritesSuspended"
+
+// circuitBreaker stops the webhook from writing cmstates while those writes
+// keep failing, every admission waiting on a write to an overloaded API server
+// only adds to its load. After threshold consecutive failures within the
+// window it opens for the cooldown. It then goes half-open and lets a single
+// write through as a probe, a failure opens it again right away and a success
+// closes it. A probe that never reports back is replaced after the cooldown.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu           sync.Mutex
+	failures     int
+	firstFailure time.Time
+	openUntil    time.Time
+	tripped      bool
+	// probeUntil is when the write let through while half-open is given up on
+	probeUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, window: window, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports whether cmstates may be written, a nil breaker always allows.
+// Once the cooldown is over only the first caller is allowed, as the probe.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.tripped {
+		return true
+	}
+	now := b.now()
+	if now.Before(b.openUntil) || now.Before(b.probeUntil) {
+		return false
+	}
+	b.probeUntil = now.Add(b.cooldown)
+	return true
+}
+
+// success closes the breaker and forgets the failures so far
+func (b *circuitBreaker) success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probeUntil = time.Time{}
+	if b.tripped {
+		b.tripped = false
+		circuitOpen.Set(0)
+	}
+}
+
+// failure counts a failed write, reporting whether it opened the breaker
+func (b *circuitBreaker) failure() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.window {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	if b.failures < b.threshold && !b.tripped {
+		return false
+	}
+
+	b.failures = 0
+	b.openUntil = now.Add(b.cooldown)
+	b.probeUntil = time.Time{}
+	b.tripped = true
+	circuitOpen.Set(1)
+	circuitTripsTotal.Inc()
+	return true
+}
+
+// writeFailed feeds a failed cmstate write to the breaker, telling the
+// operator's namespace when that suspends the writes
+func (hook *cmStateCreator) writeFailed(err error) {
+	if !hook.breaker.failure() || hook.Recorder == nil || hook.operatorNamespace == "" {
+		return
+	}
+	ref := &corev1.ObjectReference{APIVersion: "v1", Kind: "Namespace", Name: hook.operatorNamespace, Namespace: hook.operatorNamespace}
+	hook.Recorder.Eventf(ref, corev1.EventTypeWarning, eventCMStateWritesSuspended,
+		"CMState writes keep failing, pods are admitted without injection for %s: %s", hook.breaker.cooldown, err)
+}
@@ -0,0 +1,203 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	v1admission "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// +kubebuilder:webhook:path=/mutate-cmtemplates,mutating=true,failurePolicy=ignore,sideEffects=None,groups=cache.spicedelver.me,resources=cmtemplates;namespacedcmtemplates,verbs=create;update,versions=v1alpha2,name=cmtemplate-defaulter.spicedelver.me,admissionReviewVersions=v1;v1beta1
+// +kubebuilder:webhook:path=/validate-cmtemplates,mutating=false,failurePolicy=ignore,sideEffects=None,groups=cache.spicedelver.me,resources=cmtemplates;namespacedcmtemplates,verbs=create;update,versions=v1alpha2,name=cmtemplate-validator.spicedelver.me,admissionReviewVersions=v1;v1beta1
+
+// TemplateDefaultingWebhookPath is the path the CMTemplate defaulting is
+// served on, it has to match the path of the kubebuilder marker above
+const TemplateDefaultingWebhookPath = "/mutate-cmtemplates"
+
+// TemplateWebhookPath is the path the CMTemplate validation is served on, it
+// has to match the path of the kubebuilder marker above
+const TemplateWebhookPath = "/validate-cmtemplates"
+
+// TemplateValidationPolicy decides what happens to a CMTemplate failing
+// validation when it is applied
+type TemplateValidationPolicy string
+
+const (
+	// TemplateValidationWarn admits the template with a warning per error
+	TemplateValidationWarn TemplateValidationPolicy = "warn"
+	// TemplateValidationEnforce rejects the template
+	TemplateValidationEnforce TemplateValidationPolicy = "enforce"
+)
+
+// TemplateOptions configures the CMTemplate validating webhook
+type TemplateOptions struct {
+	// ValidationPolicy decides whether CMTemplates failing validation are
+	// rejected when they are applied or admitted with a warning
+	ValidationPolicy TemplateValidationPolicy
+	// MaxBaseTemplateDepth is how many base templates a template may inherit
+	// from through spec.baseTemplate, it has to match the controller's
+	MaxBaseTemplateDepth int
+	// Timeout bounds the API calls made validating a single template
+	Timeout time.Duration
+}
+
+// TemplateDefaulter registers the webhook filling in the defaults of
+// CMTemplates when they are applied
+func TemplateDefaulter(mgr ctrl.Manager) error {
+	mgr.GetWebhookServer().Register(TemplateDefaultingWebhookPath, &webhook.Admission{Handler: &templateDefaulter{}})
+	return nil
+}
+
+// TemplateValidator registers the webhook validating CMTemplates when they
+// are applied
+func TemplateValidator(mgr ctrl.Manager, opts TemplateOptions) error {
+	switch opts.ValidationPolicy {
+	case "":
+		opts.ValidationPolicy = TemplateValidationEnforce
+	case TemplateValidationWarn, TemplateValidationEnforce:
+	default:
+		return fmt.Errorf("invalid template validation policy %q, must be %s or %s", opts.ValidationPolicy, TemplateValidationWarn, TemplateValidationEnforce)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	mgr.GetWebhookServer().Register(TemplateWebhookPath, &webhook.Admission{Handler: &templateValidator{Client: mgr.GetClient(), Options: opts}})
+	return nil
+}
+
+// templateDefaulter fills in the defaults of a CMTemplate when it is applied,
+// so the stored template is fully specified
+type templateDefaulter struct{}
+
+func (d *templateDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	if err := json.Unmarshal(req.Object.Raw, cmTemplate); err != nil {
+		recordError(errorDecode)
+		return admission.Errored(http.StatusBadRequest, errors.Wrap(err, "error decoding CMTemplate"))
+	}
+	cmTemplate.Default()
+	raw, err := json.Marshal(cmTemplate)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, errors.Wrap(err, "error encoding CMTemplate"))
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, raw)
+}
+
+// templateValidator checks a CMTemplate when it is applied, so a template
+// that doesn't parse, or a base template that isn't there, shows up then
+// instead of when pods are admitted or its CMStates rendered
+type templateValidator struct {
+	Client  client.Reader
+	Options TemplateOptions
+}
+
+func (v *templateValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != v1admission.Create && req.Operation != v1admission.Update {
+		return admission.Allowed("")
+	}
+	if v.Options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.Options.Timeout)
+		defer cancel()
+	}
+
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	if err := json.Unmarshal(req.Object.Raw, cmTemplate); err != nil {
+		recordError(errorDecode)
+		return admission.Errored(http.StatusBadRequest, errors.Wrap(err, "error decoding CMTemplate"))
+	}
+
+	errs, err := v.validate(ctx, cmTemplate)
+	if err != nil {
+		return admission.Allowed("skipping cmtemplate validation due to an error").
+			WithWarnings(warnf("validating CMTemplate '%s' failed: %s", cmTemplate.Name, err))
+	}
+	if len(errs) == 0 {
+		return admission.Allowed("")
+	}
+	if v.Options.ValidationPolicy == TemplateValidationEnforce {
+		return admission.Denied(fmt.Sprintf("cmstate-injector: CMTemplate '%s' is invalid: %s", cmTemplate.Name, errs.ToAggregate()))
+	}
+	warnings := make([]string, 0, len(errs))
+	for _, e := range errs {
+		warnings = append(warnings, warnf("CMTemplate '%s' is invalid: %s", cmTemplate.Name, e))
+	}
+	return admission.Allowed("").WithWarnings(warnings...)
+}
+
+// validate validates the template with what it inherits from its base
+// templates, the way pods using it are admitted. A chain that can't be
+// resolved is reported on spec.baseTemplate and the template validated on
+// its own.
+func (v *templateValidator) validate(ctx context.Context, cmTemplate *cachev1alpha2.CMTemplate) (field.ErrorList, error) {
+	conflicts, err := v.aliasConflicts(ctx, cmTemplate)
+	if err != nil {
+		return nil, err
+	}
+	resolved := cmTemplate.DeepCopy()
+	err = resolveBase(ctx, v.Client, v.Options.MaxBaseTemplateDepth, resolved)
+	var baseErr *cachev1alpha2.BaseTemplateError
+	if !errors.As(err, &baseErr) {
+		if err != nil {
+			return nil, err
+		}
+		return append(resolved.Validate(), conflicts...), nil
+	}
+
+	allErrs := append(cmTemplate.Validate(), conflicts...)
+	return append(allErrs, field.Invalid(field.NewPath("spec", "baseTemplate"), cmTemplate.Spec.BaseTemplate, baseErr.Message)), nil
+}
+
+// aliasConflicts reports the aliases of the template another CMTemplate
+// already goes by, as name or alias, and the name of the template when it is
+// the alias of another, pods asking for it would get either
+func (v *templateValidator) aliasConflicts(ctx context.Context, cmTemplate *cachev1alpha2.CMTemplate) (field.ErrorList, error) {
+	var allErrs field.ErrorList
+	aliased, err := aliasedBy(ctx, v.Client, cmTemplate.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range aliased {
+		if other.Name != cmTemplate.Name {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("metadata", "name"), cmTemplate.Name,
+				fmt.Sprintf("already an alias of CMTemplate '%s'", other.Name)))
+		}
+	}
+
+	for j, alias := range cmTemplate.Spec.Aliases {
+		aliased, err := aliasedBy(ctx, v.Client, alias)
+		if err != nil {
+			return nil, err
+		}
+		named := &cachev1alpha2.CMTemplate{}
+		err = v.Client.Get(ctx, types.NamespacedName{Name: alias}, named)
+		if err == nil {
+			aliased = append(aliased, *named)
+		} else if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+
+		conflicting := make(map[string]bool)
+		for _, other := range aliased {
+			if other.Name != cmTemplate.Name && !conflicting[other.Name] {
+				conflicting[other.Name] = true
+				allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "aliases").Index(j), alias,
+					fmt.Sprintf("already the name or an alias of CMTemplate '%s'", other.Name)))
+			}
+		}
+	}
+	return allErrs, nil
+}
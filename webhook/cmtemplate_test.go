@@ -0,0 +1,220 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	v1admission "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// newTemplateRequest builds the request admitting the template
+func newTemplateRequest(op v1admission.Operation, cmTemplate *cachev1alpha2.CMTemplate) admission.Request {
+	raw, err := json.Marshal(cmTemplate)
+	Expect(err).NotTo(HaveOccurred())
+	return admission.Request{AdmissionRequest: v1admission.AdmissionRequest{
+		UID:       "req-vault-agent",
+		Kind:      metav1.GroupVersionKind{Group: cachev1alpha2.GroupVersion.Group, Version: cachev1alpha2.GroupVersion.Version, Kind: "CMTemplate"},
+		Name:      cmTemplate.Name,
+		Operation: op,
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+}
+
+var _ = Describe("CMTemplate validation", func() {
+	validate := func(validator *templateValidator, req admission.Request) *v1admission.AdmissionResponse {
+		return review(validator, req).Response
+	}
+	newValidator := func(objs ...client.Object) *templateValidator {
+		return &templateValidator{Client: newTestHook(objs...).Client, Options: TemplateOptions{ValidationPolicy: TemplateValidationEnforce}}
+	}
+
+	It("admits valid templates", func() {
+		resp := validate(newValidator(), newTemplateRequest(v1admission.Create, newTestTemplate()))
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(resp.Warnings).To(BeEmpty())
+	})
+
+	It("rejects templates that don't compile with the field paths of the errors", func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Template.Engine = cachev1alpha2.TemplateEngineGoTemplate
+		cmTemplate.Spec.Template.Data["config.hcl"] = "role = \"{{ .Annotations\""
+		cmTemplate.Spec.Inject = &cachev1alpha2.Inject{PodAnnotations: map[string]string{"not a key": "value"}}
+		cmTemplate.Spec.PodSelector = &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: "Near"}}}
+
+		resp := validate(newValidator(), newTemplateRequest(v1admission.Update, cmTemplate))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(HavePrefix("cmstate-injector: CMTemplate 'vault-agent' is invalid: "))
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("spec.template.data[config.hcl]"))
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("spec.inject.podAnnotations[not a key]"))
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("spec.podSelector"))
+	})
+
+	It("rejects duplicate data keys and invalid patterns", func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Template.BinaryData = map[string][]byte{"config.hcl": []byte("role")}
+		cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/role", cachev1alpha2.Replacement{Placeholder: "{role}", Pattern: "["})
+
+		resp := validate(newValidator(), newTemplateRequest(v1admission.Create, cmTemplate))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("spec.template.binaryData[config.hcl]: Duplicate value"))
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("spec.template.annotationReplace[0].pattern"))
+	})
+
+	It("rejects replaced annotations that aren't qualified names", func() {
+		cmTemplate := newTestTemplate()
+		cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault role", cachev1alpha2.Replacement{Placeholder: "{vault-role}"})
+
+		resp := validate(newValidator(), newTemplateRequest(v1admission.Create, cmTemplate))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("spec.template.annotationReplace[1].key"))
+	})
+
+	It("validates templates with what they inherit and rejects missing bases", func() {
+		child := newTestTemplate()
+		child.Name = "vault-agent-team"
+		child.Spec.BaseTemplate = testTemplateName
+		child.Spec.Template.TargetAnnotation = ""
+		base := newTestTemplate()
+		base.Spec.Template.TargetAnnotation = ""
+		base.Spec.Inject = &cachev1alpha2.Inject{AnnotationKeys: []string{testTargetAnnotation}}
+
+		Expect(validate(newValidator(base), newTemplateRequest(v1admission.Create, child)).Allowed).To(BeTrue())
+
+		resp := validate(newValidator(), newTemplateRequest(v1admission.Create, child))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring(`spec.baseTemplate: Invalid value: "vault-agent": base template 'vault-agent' not found`))
+	})
+
+	It("rejects chains deeper than allowed", func() {
+		root := newTestTemplate()
+		root.Name = "vault-agent-root"
+		base := newTestTemplate()
+		base.Spec.BaseTemplate = root.Name
+		child := newTestTemplate()
+		child.Name = "vault-agent-team"
+		child.Spec.BaseTemplate = testTemplateName
+		validator := newValidator(root, base)
+		validator.Options.MaxBaseTemplateDepth = 1
+
+		resp := validate(validator, newTemplateRequest(v1admission.Create, child))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("base templates are nested deeper than 1"))
+	})
+
+	It("rejects namespaced templates copying Secrets into ConfigMaps", func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Namespace = testNamespace
+		cmTemplate.Spec.AllowSecretToConfigMap = true
+
+		resp := validate(newValidator(), newTemplateRequest(v1admission.Create, cmTemplate))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("spec.allowSecretToConfigMap: Forbidden: only CMTemplates can copy Secrets into ConfigMaps"))
+
+		cmTemplate.Namespace = ""
+		Expect(validate(newValidator(), newTemplateRequest(v1admission.Create, cmTemplate)).Allowed).To(BeTrue())
+	})
+
+	It("only warns when configured to", func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Template.TargetAnnotation = "not a key"
+		validator := newValidator()
+		validator.Options.ValidationPolicy = TemplateValidationWarn
+
+		resp := validate(validator, newTemplateRequest(v1admission.Create, cmTemplate))
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(resp.Warnings).To(ConsistOf(HavePrefix("cmstate-injector: CMTemplate 'vault-agent' is invalid: spec.template.targetAnnotation")))
+	})
+
+	It("fails fast on an invalid policy", func() {
+		Expect(TemplateValidator(nil, TemplateOptions{ValidationPolicy: "audit"})).To(MatchError(ContainSubstring("invalid template validation policy")))
+	})
+})
+
+var _ = Describe("CMTemplate defaulting", func() {
+	// defaulted returns the template the API server stores after applying the
+	// patch of the defaulting webhook
+	defaulted := func(cmTemplate *cachev1alpha2.CMTemplate) *cachev1alpha2.CMTemplate {
+		req := newTemplateRequest(v1admission.Create, cmTemplate)
+		resp := review(&templateDefaulter{}, req).Response
+		Expect(resp.Allowed).To(BeTrue())
+		if len(resp.Patch) == 0 {
+			return cmTemplate
+		}
+		patch, err := jsonpatch.DecodePatch(resp.Patch)
+		Expect(err).NotTo(HaveOccurred())
+		raw, err := patch.Apply(req.Object.Raw)
+		Expect(err).NotTo(HaveOccurred())
+		stored := &cachev1alpha2.CMTemplate{}
+		Expect(json.Unmarshal(raw, stored)).To(Succeed())
+		return stored
+	}
+
+	It("fills in the documented defaults", func() {
+		stored := defaulted(newTestTemplate())
+		Expect(stored.Spec.Template.Engine).To(Equal(cachev1alpha2.TemplateEngineReplace))
+		Expect(stored.Spec.AudienceTracking).To(Equal(cachev1alpha2.AudienceTrackingPod))
+		Expect(stored.Spec.StateScope).To(Equal(cachev1alpha2.StateScopeTemplate))
+		Expect(stored.Spec.UpdateStrategy).To(Equal(cachev1alpha2.UpdateStrategyAlways))
+		Expect(stored.Spec.CleanupPolicy).To(Equal(cachev1alpha2.CleanupPolicyBlock))
+		Expect(stored.Spec.Target).To(Equal(&cachev1alpha2.Target{Kind: cachev1alpha2.TargetKindConfigMap}))
+		Expect(stored.Spec.Template.Data).To(Equal(newTestTemplate().Spec.Template.Data))
+
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Target = &cachev1alpha2.Target{Kind: cachev1alpha2.TargetKindSecret}
+		Expect(defaulted(cmTemplate).Spec.Target.Type).To(Equal(corev1.SecretTypeOpaque))
+	})
+
+	It("never overrides values that are set", func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Template.Engine = cachev1alpha2.TemplateEngineGoTemplate
+		cmTemplate.Spec.AudienceTracking = cachev1alpha2.AudienceTrackingOwner
+		cmTemplate.Spec.StateScope = cachev1alpha2.StateScopePod
+		cmTemplate.Spec.UpdateStrategy = cachev1alpha2.UpdateStrategyOnCreate
+		cmTemplate.Spec.CleanupPolicy = cachev1alpha2.CleanupPolicyCascade
+		cmTemplate.Spec.Target = &cachev1alpha2.Target{Kind: cachev1alpha2.TargetKindSecret, Type: corev1.SecretTypeTLS}
+
+		resp := review(&templateDefaulter{}, newTemplateRequest(v1admission.Update, cmTemplate)).Response
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(resp.Patch).To(BeEmpty())
+	})
+
+	It("leaves a defaulted template as it is", func() {
+		stored := defaulted(newTestTemplate())
+		Expect(defaulted(stored)).To(Equal(stored))
+	})
+
+	It("keeps the content hash of immutable templates", func() {
+		cmTemplate := newTestTemplate()
+		values := map[string]string{"vault.hashicorp.com/role": "reader"}
+		Expect(defaulted(cmTemplate).Spec.ContentHash(values)).To(Equal(cmTemplate.Spec.ContentHash(values)))
+
+		cmTemplate.Spec.Target = &cachev1alpha2.Target{Kind: cachev1alpha2.TargetKindSecret}
+		Expect(defaulted(cmTemplate).Spec.ContentHash(values)).To(Equal(cmTemplate.Spec.ContentHash(values)))
+	})
+})
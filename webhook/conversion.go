@@ -0,0 +1,17 @@
+package webhook
+
+import (
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/conversion"
+)
+
+// ConversionWebhookPath is the path the CMTemplate and CMState versions are
+// converted on, the CRDs name it in spec.conversion
+const ConversionWebhookPath = "/convert"
+
+// ConversionWebhook registers the webhook converting CMTemplates and CMStates
+// between the versions the API server serves
+func ConversionWebhook(mgr ctrl.Manager) error {
+	mgr.GetWebhookServer().Register(ConversionWebhookPath, &conversion.Webhook{})
+	return nil
+}
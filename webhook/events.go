@@ -0,0 +1,74 @@
+package webhook
+
+import (
+	v1admission "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// eventSource is the component pod events are reported by
+const eventSource = "cm-injector"
+
+// Reasons of the events recorded on pods
+const (
+	eventInjected         = "Injected"
+	eventInjectionSkipped = "InjectionSkipped"
+	eventInjectionFailed  = "InjectionFailed"
+	eventRemovalFailed    = "AudienceRemovalFailed"
+	// recorded by the pod controller
+	eventAudienceJoined     = "AudienceJoined"
+	eventAudienceJoinFailed = "AudienceJoinFailed"
+)
+
+// event records an event about the injection of the pod so `kubectl describe`
+// tells what happened to it. A pod being created doesn't exist yet, an event
+// on it would have no UID and no name for pods created through generateName,
+// so its events go to the workload controlling it, like the FailedCreate
+// events of a ReplicaSet, naming the pod. The creator of a pod without one
+// reads the outcome from the admission response. Dry runs leave no trace. The
+// recorder queues the event and drops it when the queue is full, it never
+// holds up the admission.
+func (hook *cmStateCreator) event(req admission.Request, pod *corev1.Pod, eventType, reason, messageFmt string, args ...interface{}) {
+	if isDryRun(req) {
+		return
+	}
+	if req.Operation != v1admission.Create {
+		if pod.GetUID() != "" {
+			hook.recordPodEvent(pod, eventType, reason, messageFmt, args...)
+		}
+		return
+	}
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.UID == "" || hook.Recorder == nil {
+		return
+	}
+	ref := &corev1.ObjectReference{
+		APIVersion: owner.APIVersion,
+		Kind:       owner.Kind,
+		Namespace:  pod.GetNamespace(),
+		Name:       owner.Name,
+		UID:        owner.UID,
+	}
+	hook.Recorder.Eventf(ref, eventType, reason, "Pod %s: "+messageFmt, append([]interface{}{audienceName(pod)}, args...)...)
+}
+
+// recordPodEvent records an event on a pod that exists, like the ones the pod
+// controller handles
+func (hook *cmStateCreator) recordPodEvent(pod *corev1.Pod, eventType, reason, messageFmt string, args ...interface{}) {
+	if hook.Recorder == nil {
+		return
+	}
+	hook.Recorder.Eventf(pod, eventType, reason, messageFmt, args...)
+}
+
+// skipPod skips the admission, telling pods created with templates why they
+// didn't get them
+func (hook *cmStateCreator) skipPod(req admission.Request, pod *corev1.Pod, reason string) *admission.Response {
+	if req.Operation == v1admission.Create && len(hook.templateNames(pod)) > 0 {
+		hook.event(req, pod, corev1.EventTypeNormal, eventInjectionSkipped, reason)
+	}
+	return skip(req, reason)
+}
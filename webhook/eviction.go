@@ -0,0 +1,67 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	v1admission "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// evictionSubResource is the pod subresource node drains evict pods through
+const evictionSubResource = "eviction"
+
+// handleEviction removes the evicted pod from its audiences the way its
+// deletion would, the deletion following an eviction doesn't reach the webhook
+// on every API server. The Eviction only names the pod, so the pod is read to
+// find its annotations and handled as a deletion of it.
+//
+// The deletion keeps the eviction subresource, the CMState records the pods it
+// removed that way. A retried eviction and the deletion following it find the
+// record instead of counting the pod down twice.
+func (hook *cmStateCreator) handleEviction(ctx context.Context, req admission.Request) (*admission.Response, error) {
+	if req.Operation != v1admission.Create {
+		return skip(req, "skipping cmstate check due to bad operation"), nil
+	}
+
+	pod, err := hook.livePod(ctx, types.NamespacedName{Namespace: req.Namespace, Name: req.Name})
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching evicted pod")
+	}
+	if pod == nil {
+		return skip(req, "skipping cmstate check due to pod already gone"), nil
+	}
+	if len(hook.templateNames(pod)) == 0 {
+		return skip(req, "skipping cmstate check due to missing annotation"), nil
+	}
+
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		recordError(errorEncode)
+		return nil, errors.Wrap(err, "error encoding evicted pod")
+	}
+
+	deletion := req
+	deletion.Operation = v1admission.Delete
+	deletion.Object = runtime.RawExtension{}
+	deletion.OldObject = runtime.RawExtension{Raw: raw}
+	return hook.handleInner(ctx, deletion)
+}
+
+// livePod reads the pod from the API server, a deleted pod is returned nil
+func (hook *cmStateCreator) livePod(ctx context.Context, key types.NamespacedName) (*corev1.Pod, error) {
+	var reader client.Reader = hook.Client
+	if hook.APIReader != nil {
+		reader = hook.APIReader
+	}
+	pod := &corev1.Pod{}
+	if err := reader.Get(ctx, key, pod); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	return pod, nil
+}
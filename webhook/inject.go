@@ -0,0 +1,305 @@
+package webhook
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/pkg/errors"
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// configMapNameVariable matches the template variable for the generated
+// ConfigMap name, e.g. "{{ .ConfigMapName }}"
+var configMapNameVariable = regexp.MustCompile(`\{\{\s*\.ConfigMapName\s*\}\}`)
+
+// applyInjection mutates the pod to consume the ConfigMap generated for the
+// cmstate. Every step keeps or replaces what an earlier invocation injected,
+// so applying it twice yields the same pod.
+func applyInjection(cmTemplate *cachev1alpha2.CMTemplate, cmStateName string, pod *corev1.Pod) error {
+	setTargetAnnotations(cmTemplate, cmStateName, pod)
+	inject := cmTemplate.Spec.Inject
+	if inject == nil {
+		return nil
+	}
+	kind := cmTemplate.Spec.TargetKind()
+	if inject.Volume != nil {
+		injectVolume(inject.Volume, inject.ContainerSelector, cmStateName, kind, pod)
+	}
+	if len(inject.EnvFrom) > 0 {
+		injectEnvFrom(inject.EnvFrom, inject.ContainerSelector, cmStateName, kind, pod)
+	}
+	if len(inject.PodAnnotations) > 0 {
+		injectPodAnnotations(inject, cmStateName, pod)
+	}
+	if len(inject.InitContainers) > 0 {
+		return injectInitContainers(inject.InitContainers, cmStateName, pod)
+	}
+	return nil
+}
+
+// configChecksum hashes the content hashes of the templates with the
+// annotations and overrides of the pod, the same hashes hash versioned
+// ConfigMaps are named after. The hashes are encoded as JSON, which sorts map
+// keys, so the checksum doesn't depend on the order of the templates.
+func configChecksum(templates []*cachev1alpha2.CMTemplate, pod *corev1.Pod) (string, error) {
+	hashes := make(map[string]string, len(templates))
+	for _, cmTemplate := range templates {
+		hashes[cmTemplate.Name] = cmTemplate.Spec.ContentHash(replacementValues(cmTemplate, pod))
+	}
+	raw, err := json.Marshal(hashes)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(raw)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// injectVolume adds a volume for the ConfigMap, or the Secret, and mounts it
+// into the containers selected by both the volume and the container selector,
+// replacing a volume or mount of the same name.
+func injectVolume(spec *cachev1alpha2.InjectVolume, selector *cachev1alpha2.ContainerSelector, configMapName string, kind cachev1alpha2.TargetKind, pod *corev1.Pod) {
+	name := spec.Name
+	if name == "" {
+		name = configMapName
+	}
+
+	volume := corev1.Volume{
+		Name: name,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: configMapName},
+			},
+		},
+	}
+	if kind == cachev1alpha2.TargetKindSecret {
+		volume.VolumeSource = corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: configMapName},
+		}
+	}
+	pod.Spec.Volumes = upsertByName(pod.Spec.Volumes, volume, func(v corev1.Volume) string { return v.Name })
+
+	mount := corev1.VolumeMount{
+		Name:      name,
+		MountPath: spec.MountPath,
+		ReadOnly:  spec.ReadOnly,
+	}
+	for i := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[i]
+		if !containerSelected(spec.Containers, container.Name) || !selector.Selects(container.Name) {
+			continue
+		}
+		container.VolumeMounts = upsertByName(container.VolumeMounts, mount, func(m corev1.VolumeMount) string { return m.Name })
+	}
+}
+
+// injectEnvFrom adds an envFrom reference to the ConfigMap, or the Secret, to
+// the containers selected by both the list and the container selector, after
+// the entries they already have.
+func injectEnvFrom(containers []string, selector *cachev1alpha2.ContainerSelector, configMapName string, kind cachev1alpha2.TargetKind, pod *corev1.Pod) {
+	source := corev1.EnvFromSource{
+		ConfigMapRef: &corev1.ConfigMapEnvSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: configMapName},
+		},
+	}
+	if kind == cachev1alpha2.TargetKindSecret {
+		source = corev1.EnvFromSource{
+			SecretRef: &corev1.SecretEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: configMapName},
+			},
+		}
+	}
+	for i := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[i]
+		if !containerSelected(containers, container.Name) || !selector.Selects(container.Name) || hasEnvFrom(container, source) {
+			continue
+		}
+		container.EnvFrom = append(container.EnvFrom, source)
+	}
+}
+
+// injectPodAnnotations merges the template's pod annotations into the pod.
+// Values set on the pod win unless the key is listed as an override.
+func injectPodAnnotations(inject *cachev1alpha2.Inject, configMapName string, pod *corev1.Pod) {
+	overrides := make(map[string]bool, len(inject.OverridePodAnnotations))
+	for _, key := range inject.OverridePodAnnotations {
+		overrides[key] = true
+	}
+	for key, value := range inject.PodAnnotations {
+		if _, ok := pod.Annotations[key]; ok && !overrides[key] {
+			continue
+		}
+		pod.Annotations[key] = configMapNameVariable.ReplaceAllLiteralString(value, configMapName)
+	}
+}
+
+// injectInitContainers appends the init containers the pod doesn't have one
+// of the same name of yet, with the ConfigMap name filled in.
+func injectInitContainers(containers []corev1.Container, configMapName string, pod *corev1.Pod) error {
+	for _, container := range containers {
+		exists := false
+		for _, current := range pod.Spec.InitContainers {
+			if current.Name == container.Name {
+				exists = true
+				break
+			}
+		}
+		if exists {
+			continue
+		}
+
+		expanded, err := expandConfigMapName(container, configMapName)
+		if err != nil {
+			return errors.Wrapf(err, "error expanding init container '%s'", container.Name)
+		}
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, expanded)
+	}
+	return nil
+}
+
+// expandConfigMapName replaces the ConfigMap name variable in every string
+// field of the container. ConfigMap names never need escaping in JSON, so
+// the replacement is done on the encoded container.
+func expandConfigMapName(container corev1.Container, configMapName string) (corev1.Container, error) {
+	raw, err := json.Marshal(container)
+	if err != nil {
+		return container, err
+	}
+	raw = configMapNameVariable.ReplaceAllLiteral(raw, []byte(configMapName))
+
+	var expanded corev1.Container
+	err = json.Unmarshal(raw, &expanded)
+	return expanded, err
+}
+
+func hasEnvFrom(container *corev1.Container, source corev1.EnvFromSource) bool {
+	for _, current := range container.EnvFrom {
+		if source.ConfigMapRef != nil && current.ConfigMapRef != nil && current.ConfigMapRef.Name == source.ConfigMapRef.Name {
+			return true
+		}
+		if source.SecretRef != nil && current.SecretRef != nil && current.SecretRef.Name == source.SecretRef.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// injectedContainers lists the containers of the pod the templates mount
+// their volume into or add an envFrom reference to, sorted
+func injectedContainers(templates []*cachev1alpha2.CMTemplate, pod *corev1.Pod) []string {
+	var injected []string
+	for _, container := range pod.Spec.Containers {
+		for _, cmTemplate := range templates {
+			if injectsInto(cmTemplate.Spec.Inject, container.Name) {
+				injected = append(injected, container.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(injected)
+	return injected
+}
+
+// injectsInto reports whether the volume mount or envFrom reference of the
+// injection is added to the container
+func injectsInto(inject *cachev1alpha2.Inject, name string) bool {
+	if inject == nil || !inject.ContainerSelector.Selects(name) {
+		return false
+	}
+	return (inject.Volume != nil && containerSelected(inject.Volume.Containers, name)) ||
+		(len(inject.EnvFrom) > 0 && containerSelected(inject.EnvFrom, name))
+}
+
+// unselectedWarnings warns about the templates whose container selector
+// matches none of the containers of the pod, which get neither their volume
+// nor their envFrom reference
+func unselectedWarnings(templates []*cachev1alpha2.CMTemplate, pod *corev1.Pod) []string {
+	var warnings []string
+	for _, cmTemplate := range templates {
+		inject := cmTemplate.Spec.Inject
+		if inject == nil || inject.ContainerSelector == nil || (inject.Volume == nil && len(inject.EnvFrom) == 0) {
+			continue
+		}
+		matched := false
+		for _, container := range pod.Spec.Containers {
+			if injectsInto(inject, container.Name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			warnings = append(warnings, warnf("container selector of template '%s' matches none of the containers, pod admitted without its volume and envFrom", cmTemplate.Name))
+		}
+	}
+	return warnings
+}
+
+// containerSelected reports whether the container is one of the selected
+// names, no selection or "*" selects every container.
+func containerSelected(selected []string, name string) bool {
+	if len(selected) == 0 {
+		return true
+	}
+	for _, s := range selected {
+		if s == name || s == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// upsertByName replaces the item sharing the name of the new one in place, or
+// appends it when there is none.
+func upsertByName[T any](items []T, item T, name func(T) string) []T {
+	for i := range items {
+		if name(items[i]) == name(item) {
+			items[i] = item
+			return items
+		}
+	}
+	return append(items, item)
+}
+
+// podPatch builds the JSONPatch operations turning the original pod into the
+// mutated one. Only the fields the injection touches are compared.
+func podPatch(original, updated *corev1.Pod) []PatchOperation {
+	patch := annotationPatch(original.GetAnnotations(), updated.GetAnnotations())
+	patch = append(patch, listPatch("/spec/volumes", original.Spec.Volumes, updated.Spec.Volumes)...)
+	for i := range updated.Spec.Containers {
+		patch = append(patch, listPatch(fmt.Sprintf("/spec/containers/%d/volumeMounts", i),
+			original.Spec.Containers[i].VolumeMounts, updated.Spec.Containers[i].VolumeMounts)...)
+		patch = append(patch, listPatch(fmt.Sprintf("/spec/containers/%d/envFrom", i),
+			original.Spec.Containers[i].EnvFrom, updated.Spec.Containers[i].EnvFrom)...)
+	}
+	patch = append(patch, listPatch("/spec/initContainers", original.Spec.InitContainers, updated.Spec.InitContainers)...)
+	return patch
+}
+
+// listPatch builds the JSONPatch operations for a list the injection only
+// replaces items of in place or appends to.
+func listPatch[T any](path string, original, updated []T) []PatchOperation {
+	if len(updated) == 0 || equality.Semantic.DeepEqual(original, updated) {
+		return nil
+	}
+	if len(original) == 0 {
+		// the list may be absent, add it as a whole
+		return []PatchOperation{{Op: "add", Path: path, Value: updated}}
+	}
+
+	var patch []PatchOperation
+	for i := range updated {
+		if i >= len(original) {
+			patch = append(patch, PatchOperation{Op: "add", Path: path + "/-", Value: updated[i]})
+			continue
+		}
+		if !equality.Semantic.DeepEqual(original[i], updated[i]) {
+			patch = append(patch, PatchOperation{Op: "replace", Path: fmt.Sprintf("%s/%d", path, i), Value: updated[i]})
+		}
+	}
+	return patch
+}
@@ -0,0 +1,823 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	v1admission "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	"github.com/stollenaar/cmstate-injector-operator/webhook/testutil"
+)
+
+func newVolumeTemplate(volume *cachev1alpha2.InjectVolume) *cachev1alpha2.CMTemplate {
+	cmTemplate := newTestTemplate()
+	cmTemplate.Spec.Inject = &cachev1alpha2.Inject{Volume: volume}
+	return cmTemplate
+}
+
+// patchValue decodes the value of the operation on the path back into the
+// type it was encoded from
+func patchValue[T any](patch []testutil.PatchOperation, op, path string) T {
+	found, ok := testutil.FindPatch(patch, path)
+	Expect(ok).To(BeTrue(), "no operation on %s", path)
+	Expect(found.Op).To(Equal(op))
+	value, err := testutil.PatchValue[T](found)
+	Expect(err).NotTo(HaveOccurred())
+	return value
+}
+
+var _ = Describe("Volume injection", func() {
+	configMapVolume := corev1.Volume{
+		Name: "cmstate-vault-agent",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "cmstate-vault-agent"},
+			},
+		},
+	}
+
+	It("adds the ConfigMap volume and mounts it into every container", func() {
+		hook := newTestHook(newVolumeTemplate(&cachev1alpha2.InjectVolume{MountPath: "/etc/vault", ReadOnly: true}))
+		pod := newTestPod("app-1")
+
+		out := review(hook, testutil.NewPodCreateRequest(pod))
+		Expect(out.Response.Allowed).To(BeTrue())
+
+		patch := decodePatch(out)
+		Expect(patchValue[[]corev1.Volume](patch, "add", "/spec/volumes")).To(Equal([]corev1.Volume{configMapVolume}))
+		Expect(patchValue[[]corev1.VolumeMount](patch, "add", "/spec/containers/0/volumeMounts")).To(Equal([]corev1.VolumeMount{
+			{Name: "cmstate-vault-agent", MountPath: "/etc/vault", ReadOnly: true},
+		}))
+	})
+
+	It("only mounts into the selected containers", func() {
+		hook := newTestHook(newVolumeTemplate(&cachev1alpha2.InjectVolume{
+			Name:       "vault-config",
+			MountPath:  "/etc/vault",
+			Containers: []string{"sidecar"},
+		}))
+		pod := newTestPod("app-1")
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+			Name:         "sidecar",
+			Image:        "vault",
+			VolumeMounts: []corev1.VolumeMount{{Name: "tmp", MountPath: "/tmp"}},
+		})
+
+		patch := decodePatch(review(hook, testutil.NewPodCreateRequest(pod)))
+		Expect(patch).NotTo(ContainElement(HaveField("Path", HavePrefix("/spec/containers/0"))))
+		Expect(patch).To(ContainElement(And(
+			HaveField("Op", "add"),
+			HaveField("Path", "/spec/containers/1/volumeMounts/-"),
+		)))
+	})
+
+	It("replaces a volume and mount of the same name instead of duplicating them", func() {
+		hook := newTestHook(newVolumeTemplate(&cachev1alpha2.InjectVolume{Name: "config", MountPath: "/etc/vault"}))
+		pod := newTestPod("app-1")
+		pod.Spec.Volumes = []corev1.Volume{
+			{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			{Name: "config", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		}
+		pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "config", MountPath: "/config"}}
+
+		patch := decodePatch(review(hook, testutil.NewPodCreateRequest(pod)))
+		Expect(patch).To(ContainElement(And(
+			HaveField("Op", "replace"),
+			HaveField("Path", "/spec/volumes/1"),
+		)))
+		Expect(patch).To(ContainElement(And(
+			HaveField("Op", "replace"),
+			HaveField("Path", "/spec/containers/0/volumeMounts/0"),
+		)))
+		Expect(patch).NotTo(ContainElement(And(HaveField("Op", "add"), HaveField("Path", HavePrefix("/spec/")))))
+	})
+
+	It("is idempotent", func() {
+		cmTemplate := newVolumeTemplate(&cachev1alpha2.InjectVolume{MountPath: "/etc/vault"})
+		pod := newTestPod("app-1")
+		Expect(applyInjection(cmTemplate, "cmstate-vault-agent", pod)).To(Succeed())
+
+		again := pod.DeepCopy()
+		Expect(applyInjection(cmTemplate, "cmstate-vault-agent", again)).To(Succeed())
+		Expect(again.Spec.Volumes).To(HaveLen(1))
+		Expect(podPatch(pod, again)).To(BeEmpty())
+	})
+
+	It("denies pods when the mount path isn't absolute", func() {
+		hook := newTestHook(newVolumeTemplate(&cachev1alpha2.InjectVolume{MountPath: "etc/vault"}))
+
+		out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+		Expect(out.Response.Allowed).To(BeFalse())
+		Expect(string(out.Response.Result.Reason)).To(ContainSubstring("spec.inject.volume.mountPath"))
+	})
+})
+
+var _ = Describe("EnvFrom injection", func() {
+	newEnvFromTemplate := func(containers ...string) *cachev1alpha2.CMTemplate {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Inject = &cachev1alpha2.Inject{EnvFrom: containers}
+		return cmTemplate
+	}
+	configMapRef := corev1.EnvFromSource{
+		ConfigMapRef: &corev1.ConfigMapEnvSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "cmstate-vault-agent"},
+		},
+	}
+
+	It("only references the ConfigMap from the targeted container", func() {
+		hook := newTestHook(newEnvFromTemplate("sidecar"))
+		pod := newTestPod("app-1")
+		existing := corev1.EnvFromSource{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "creds"}}}
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+			Name:    "sidecar",
+			Image:   "vault",
+			EnvFrom: []corev1.EnvFromSource{existing},
+		})
+
+		out := review(hook, testutil.NewPodCreateRequest(pod))
+		Expect(out.Response.Allowed).To(BeTrue())
+
+		patch := decodePatch(out)
+		Expect(patch).NotTo(ContainElement(HaveField("Path", HavePrefix("/spec/containers/0"))))
+		Expect(patch).NotTo(ContainElement(HaveField("Op", "replace")))
+		Expect(patchValue[corev1.EnvFromSource](patch, "add", "/spec/containers/1/envFrom/-")).To(Equal(configMapRef))
+	})
+
+	It("selects every container with a wildcard", func() {
+		pod := newTestPod("app-1")
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "sidecar", Image: "vault"})
+
+		Expect(applyInjection(newEnvFromTemplate("*"), "cmstate-vault-agent", pod)).To(Succeed())
+		Expect(pod.Spec.Containers).To(HaveEach(HaveField("EnvFrom", ConsistOf(configMapRef))))
+	})
+
+	It("doesn't add the reference twice when reinvoked", func() {
+		cmTemplate := newEnvFromTemplate("app")
+		pod := newTestPod("app-1")
+		Expect(applyInjection(cmTemplate, "cmstate-vault-agent", pod)).To(Succeed())
+
+		again := pod.DeepCopy()
+		Expect(applyInjection(cmTemplate, "cmstate-vault-agent", again)).To(Succeed())
+		Expect(again.Spec.Containers[0].EnvFrom).To(HaveLen(1))
+		Expect(podPatch(pod, again)).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Container selection", func() {
+	newSelectorTemplate := func(selector *cachev1alpha2.ContainerSelector) *cachev1alpha2.CMTemplate {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Inject = &cachev1alpha2.Inject{
+			Volume:            &cachev1alpha2.InjectVolume{MountPath: "/etc/vault"},
+			EnvFrom:           []string{"*"},
+			ContainerSelector: selector,
+		}
+		return cmTemplate
+	}
+	newSidecarPod := func() *corev1.Pod {
+		pod := newTestPod("app-1")
+		pod.Spec.Containers = append(pod.Spec.Containers,
+			corev1.Container{Name: "istio-proxy", Image: "proxyv2"},
+			corev1.Container{Name: "worker", Image: "busybox"},
+		)
+		return pod
+	}
+	injected := func(pod *corev1.Pod) []string {
+		var names []string
+		for _, container := range pod.Spec.Containers {
+			if len(container.VolumeMounts) > 0 || len(container.EnvFrom) > 0 {
+				names = append(names, container.Name)
+			}
+		}
+		return names
+	}
+
+	It("leaves the excluded containers alone", func() {
+		pod := newSidecarPod()
+		Expect(applyInjection(newSelectorTemplate(&cachev1alpha2.ContainerSelector{Names: []string{"*"}, Exclude: []string{"istio-proxy"}}), "cmstate-vault-agent", pod)).To(Succeed())
+		Expect(injected(pod)).To(Equal([]string{"app", "worker"}))
+	})
+
+	It("only injects into the named containers", func() {
+		pod := newSidecarPod()
+		Expect(applyInjection(newSelectorTemplate(&cachev1alpha2.ContainerSelector{Names: []string{"worker"}}), "cmstate-vault-agent", pod)).To(Succeed())
+		Expect(injected(pod)).To(Equal([]string{"worker"}))
+	})
+
+	It("records the containers it injected into", func() {
+		hook := newTestHook(newSelectorTemplate(&cachev1alpha2.ContainerSelector{Exclude: []string{"istio-proxy"}}))
+
+		out := review(hook, testutil.NewPodCreateRequest(newSidecarPod()))
+		Expect(out.Response.Allowed).To(BeTrue())
+		Expect(out.Response.Warnings).To(BeEmpty())
+		Expect(patchValue[string](decodePatch(out), "add", annotationPath(InjectedContainersAnnotation))).To(Equal("app,worker"))
+	})
+
+	It("warns when the selector matches none of the containers", func() {
+		hook := newTestHook(newSelectorTemplate(&cachev1alpha2.ContainerSelector{Names: []string{"vault-agent"}}))
+
+		out := review(hook, testutil.NewPodCreateRequest(newSidecarPod()))
+		Expect(out.Response.Allowed).To(BeTrue())
+		Expect(out.Response.Warnings).To(ConsistOf(ContainSubstring("container selector of template 'vault-agent' matches none of the containers")))
+		_, ok := testutil.FindPatch(decodePatch(out), annotationPath(InjectedContainersAnnotation))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("rejects selectors excluding every container", func() {
+		cmTemplate := newSelectorTemplate(&cachev1alpha2.ContainerSelector{Names: []string{"Not A Name"}, Exclude: []string{"*"}})
+
+		Expect(cmTemplate.Validate()).To(ConsistOf(
+			HaveField("Field", "spec.inject.containerSelector.names[0]"),
+			HaveField("Field", "spec.inject.containerSelector.exclude[0]"),
+		))
+	})
+})
+
+var _ = Describe("Init container injection", func() {
+	newInitTemplate := func(containers ...corev1.Container) *cachev1alpha2.CMTemplate {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Inject = &cachev1alpha2.Inject{InitContainers: containers}
+		return cmTemplate
+	}
+	waitForConfig := corev1.Container{
+		Name:    "wait-for-config",
+		Image:   "bitnami/kubectl",
+		Command: []string{"kubectl", "wait", "--for=create", "configmap/{{ .ConfigMapName }}"},
+		Env:     []corev1.EnvVar{{Name: "CONFIGMAP", Value: "{{.ConfigMapName}}"}},
+	}
+
+	It("appends the init container with the ConfigMap name filled in", func() {
+		hook := newTestHook(newInitTemplate(waitForConfig))
+		pod := newTestPod("app-1")
+
+		out := review(hook, testutil.NewPodCreateRequest(pod))
+		Expect(out.Response.Allowed).To(BeTrue())
+
+		containers := patchValue[[]corev1.Container](decodePatch(out), "add", "/spec/initContainers")
+		Expect(containers).To(HaveLen(1))
+		Expect(containers[0].Command).To(Equal([]string{"kubectl", "wait", "--for=create", "configmap/cmstate-vault-agent"}))
+		Expect(containers[0].Env).To(ConsistOf(corev1.EnvVar{Name: "CONFIGMAP", Value: "cmstate-vault-agent"}))
+	})
+
+	It("runs after the pod's own init containers", func() {
+		pod := newTestPod("app-1")
+		pod.Spec.InitContainers = []corev1.Container{{Name: "migrate", Image: "app"}}
+		original := pod.DeepCopy()
+
+		Expect(applyInjection(newInitTemplate(waitForConfig), "cmstate-vault-agent", pod)).To(Succeed())
+		Expect(podPatch(original, pod)).To(ConsistOf(
+			HaveField("Path", HavePrefix("/metadata/annotations/")),
+			And(HaveField("Op", "add"), HaveField("Path", "/spec/initContainers/-")),
+		))
+	})
+
+	It("leaves an init container of the same name alone", func() {
+		pod := newTestPod("app-1")
+		pod.Spec.InitContainers = []corev1.Container{{Name: "wait-for-config", Image: "custom"}}
+
+		Expect(applyInjection(newInitTemplate(waitForConfig), "cmstate-vault-agent", pod)).To(Succeed())
+		Expect(pod.Spec.InitContainers).To(ConsistOf(HaveField("Image", "custom")))
+	})
+
+	It("doesn't touch the init containers of templates without any", func() {
+		pod := newTestPod("app-1")
+		Expect(applyInjection(newTestTemplate(), "cmstate-vault-agent", pod)).To(Succeed())
+		Expect(pod.Spec.InitContainers).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Pod annotation injection", func() {
+	newAnnotationTemplate := func(overrides ...string) *cachev1alpha2.CMTemplate {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Inject = &cachev1alpha2.Inject{
+			PodAnnotations: map[string]string{
+				"vault.hashicorp.com/agent-inject":            "true",
+				"vault.hashicorp.com/agent-configmap":         "{{ .ConfigMapName }}",
+				"vault.hashicorp.com/auth-path":               "auth/kubernetes",
+				"vault.hashicorp.com/agent-pre-populate-only": "true",
+			},
+			OverridePodAnnotations: overrides,
+		}
+		cmTemplate.Spec.Template.TargetAnnotation = "example.com/configmap"
+		return cmTemplate
+	}
+
+	It("adds the annotations with the ConfigMap name filled in", func() {
+		hook := newTestHook(newAnnotationTemplate())
+		pod := newTestPod("app-1")
+
+		patch := decodePatch(review(hook, testutil.NewPodCreateRequest(pod)))
+		Expect(patch).To(ContainElements(
+			testutil.PatchOperation{Op: "add", Path: "/metadata/annotations/vault.hashicorp.com~1agent-configmap", Value: "cmstate-vault-agent"},
+			testutil.PatchOperation{Op: "add", Path: "/metadata/annotations/vault.hashicorp.com~1agent-inject", Value: "true"},
+		))
+	})
+
+	It("keeps values set on the pod unless the key overrides them", func() {
+		pod := newTestPod("app-1")
+		pod.Annotations["vault.hashicorp.com/auth-path"] = "auth/custom"
+		pod.Annotations["vault.hashicorp.com/agent-pre-populate-only"] = "false"
+
+		Expect(applyInjection(newAnnotationTemplate("vault.hashicorp.com/agent-pre-populate-only"), "cmstate-vault-agent", pod)).To(Succeed())
+		Expect(pod.Annotations).To(HaveKeyWithValue("vault.hashicorp.com/auth-path", "auth/custom"))
+		Expect(pod.Annotations).To(HaveKeyWithValue("vault.hashicorp.com/agent-pre-populate-only", "true"))
+	})
+
+	It("denies pods when a key isn't a valid annotation key", func() {
+		cmTemplate := newAnnotationTemplate()
+		cmTemplate.Spec.Inject.PodAnnotations["not a key"] = "value"
+		hook := newTestHook(cmTemplate)
+
+		out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+		Expect(out.Response.Allowed).To(BeFalse())
+		Expect(string(out.Response.Result.Reason)).To(ContainSubstring("spec.inject.podAnnotations[not a key]"))
+	})
+
+	It("denies pods of GoTemplate templates that don't parse", func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Template.Engine = cachev1alpha2.TemplateEngineGoTemplate
+		cmTemplate.Spec.Template.Data["config.hcl"] = "role = \"{{ .Annotations\""
+		hook := newTestHook(cmTemplate)
+
+		out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+		Expect(out.Response.Allowed).To(BeFalse())
+		Expect(string(out.Response.Result.Reason)).To(ContainSubstring("spec.template.data[config.hcl]"))
+	})
+
+	It("rejects overrides of keys it doesn't set", func() {
+		Expect(newAnnotationTemplate("vault.hashicorp.com/role").Validate()).To(ConsistOf(
+			HaveField("Field", "spec.inject.overridePodAnnotations[0]"),
+		))
+	})
+})
+
+var _ = Describe("Secret injection", func() {
+	newSecretTemplate := func() *cachev1alpha2.CMTemplate {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Template.TargetAnnotation = ""
+		cmTemplate.Spec.Target = &cachev1alpha2.Target{Kind: cachev1alpha2.TargetKindSecret}
+		cmTemplate.Spec.Inject = &cachev1alpha2.Inject{
+			Volume:  &cachev1alpha2.InjectVolume{MountPath: "/etc/vault"},
+			EnvFrom: []string{"*"},
+		}
+		return cmTemplate
+	}
+
+	It("writes the Secret name into the extra secret annotation of the Vault agent", func() {
+		pod := newTestPod("app-1")
+		Expect(applyInjection(newSecretTemplate(), "cmstate-vault-agent", pod)).To(Succeed())
+		Expect(pod.Annotations).To(HaveKeyWithValue(cachev1alpha2.DefaultSecretTargetAnnotation, "cmstate-vault-agent"))
+	})
+
+	It("mounts and references the Secret instead of a ConfigMap", func() {
+		pod := newTestPod("app-1")
+		Expect(applyInjection(newSecretTemplate(), "cmstate-vault-agent", pod)).To(Succeed())
+		Expect(pod.Spec.Volumes).To(ConsistOf(HaveField("VolumeSource.Secret.SecretName", "cmstate-vault-agent")))
+		Expect(pod.Spec.Containers[0].EnvFrom).To(ConsistOf(HaveField("SecretRef.Name", "cmstate-vault-agent")))
+	})
+
+	It("rejects a type for ConfigMaps", func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Target = &cachev1alpha2.Target{Type: corev1.SecretTypeOpaque}
+		Expect(cmTemplate.Validate()).To(ConsistOf(HaveField("Field", "spec.target.type")))
+	})
+})
+
+var _ = Describe("ConfigMap naming", func() {
+	newNamedTemplate := func(name, prefix string) *cachev1alpha2.CMTemplate {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.ConfigMapName = name
+		cmTemplate.Spec.ConfigMapNamePrefix = prefix
+		return cmTemplate
+	}
+	injectedName := func(cmTemplate *cachev1alpha2.CMTemplate, pod *corev1.Pod) string {
+		out := review(newTestHook(cmTemplate), testutil.NewPodCreateRequest(pod))
+		Expect(out.Response.Allowed).To(BeTrue())
+		return applyPatch(pod, out).Annotations[testTargetAnnotation]
+	}
+
+	It("injects the ConfigMap name of the template", func() {
+		Expect(injectedName(newNamedTemplate("vault-agent-config", ""), newTestPod("app-1"))).To(Equal("vault-agent-config"))
+	})
+
+	It("appends the hash of the overrides to the name", func() {
+		pod := newTestPod("app-1")
+		pod.Annotations[ReplaceAnnotationPrefix+"vault.hashicorp.com_role"] = "canary"
+		cmStateName := newTestHook().cmStateNameFor(context.Background(), newTestTemplate(), pod)
+
+		Expect(injectedName(newNamedTemplate("vault-agent-config", ""), pod)).To(Equal("vault-agent-config-" + cmStateName[len(cmStateName)-8:]))
+	})
+
+	It("replaces the cmstate prefix with the one of the template", func() {
+		Expect(injectedName(newNamedTemplate("", "team-a-"), newTestPod("app-1"))).To(Equal("team-a-vault-agent"))
+	})
+
+	It("rejects setting both the name and the prefix", func() {
+		Expect(newNamedTemplate("vault-agent-config", "team-a-").Validate()).To(ConsistOf(
+			HaveField("Field", "spec.configMapNamePrefix"),
+		))
+	})
+
+	It("rejects names that aren't valid ConfigMap names", func() {
+		Expect(newNamedTemplate("Vault_Agent", "").Validate()).To(ConsistOf(
+			HaveField("Field", "spec.configMapName"),
+		))
+		Expect(newNamedTemplate("", "team_a-").Validate()).To(ConsistOf(
+			HaveField("Field", "spec.configMapNamePrefix"),
+		))
+	})
+})
+
+var _ = Describe("Namespaced templates", func() {
+	ctx := context.Background()
+
+	newNamespacedTemplate := func(namespace string) *cachev1alpha2.NamespacedCMTemplate {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Template.Data["config.hcl"] = "role = \"team-{role}\""
+		return &cachev1alpha2.NamespacedCMTemplate{
+			ObjectMeta: metav1.ObjectMeta{Name: testTemplateName, Namespace: namespace},
+			Spec:       cmTemplate.Spec,
+		}
+	}
+
+	It("takes the template of the pod's namespace over the cluster one", func() {
+		hook := newTestHook(newTestTemplate(), newNamespacedTemplate(testNamespace))
+		pod := newTestPod("app-1")
+		out := review(hook, testutil.NewPodCreateRequest(pod))
+		Expect(out.Response.Allowed).To(BeTrue())
+
+		cmStateName := cachev1alpha2.NamespacedCMStateName(testTemplateName)
+		injected := applyPatch(pod, out)
+		Expect(injected.Annotations).To(HaveKeyWithValue(testTargetAnnotation, cmStateName))
+		Expect(injected.Annotations).To(HaveKeyWithValue(CMStateAnnotation, cmStateName))
+		Expect(injected.Annotations).To(HaveKeyWithValue(NamespacedTemplatesAnnotation, testTemplateName))
+
+		cmState := &cachev1alpha2.CMState{}
+		Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: cmStateName}, cmState)).To(Succeed())
+		Expect(cmState.Spec.TemplateRef.Scope).To(Equal(cachev1alpha2.TemplateScopeNamespaced))
+		Expect(cmState.Spec.TemplateRef.Name).To(Equal(testTemplateName))
+		err := hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, &cachev1alpha2.CMState{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("leaves the pods of other namespaces with the cluster template", func() {
+		hook := newTestHook(newTestTemplate(), newNamespacedTemplate("team-b"))
+		pod := newTestPod("app-1")
+		out := review(hook, testutil.NewPodCreateRequest(pod))
+		Expect(out.Response.Allowed).To(BeTrue())
+
+		injected := applyPatch(pod, out)
+		Expect(injected.Annotations).To(HaveKeyWithValue(testTargetAnnotation, "cmstate-vault-agent"))
+		Expect(injected.Annotations).NotTo(HaveKey(NamespacedTemplatesAnnotation))
+
+		cmState := &cachev1alpha2.CMState{}
+		Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+		Expect(cmState.Spec.Scope()).To(Equal(cachev1alpha2.TemplateScopeCluster))
+	})
+
+	It("names the cmstates of namespaced templates apart from the cluster ones", func() {
+		name := cachev1alpha2.NamespacedCMStateName(testTemplateName)
+		Expect(name).NotTo(Equal(cachev1alpha2.CMStateName(testTemplateName)))
+		Expect(name).NotTo(Equal(cachev1alpha2.CMStateName("local-" + testTemplateName)))
+		Expect(name).To(HavePrefix("cmstate-local-vault-agent-"))
+	})
+})
+
+var _ = Describe("Template aliases", func() {
+	var (
+		ctx  = context.Background()
+		hook *cmStateCreator
+	)
+
+	BeforeEach(func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Aliases = []string{"vault-agent-v1"}
+		hook = newTestHook(cmTemplate)
+	})
+
+	aliasedPod := func(name, template string) *corev1.Pod {
+		pod := newTestPod(name)
+		pod.Annotations[DefaultTriggerAnnotation] = template
+		return pod
+	}
+
+	It("injects pods asking for an alias into the cmstate of the template", func() {
+		out := review(hook, testutil.NewPodCreateRequest(aliasedPod("app-1", "vault-agent-v1")))
+		Expect(out.Response.Allowed).To(BeTrue())
+		patched := applyPatch(aliasedPod("app-1", "vault-agent-v1"), out)
+		Expect(patched.Annotations).To(HaveKeyWithValue(TemplatesUsedAnnotation, testTemplateName))
+		Expect(patched.Annotations).To(HaveKeyWithValue(testTargetAnnotation, "cmstate-vault-agent"))
+
+		Expect(review(hook, testutil.NewPodCreateRequest(aliasedPod("app-2", testTemplateName))).Response.Allowed).To(BeTrue())
+		cmState := newTestCMState()
+		Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: cmState.Name}, cmState)).To(Succeed())
+		Expect(cmState.Spec.TemplateRef.Name).To(Equal(testTemplateName))
+		Expect(cmState.Spec.Audience).To(ConsistOf(HaveField("Name", "app-1"), HaveField("Name", "app-2")))
+	})
+
+	It("injects a pod asking for the name and an alias once", func() {
+		pod := aliasedPod("app-1", "vault-agent,vault-agent-v1")
+		patched := applyPatch(pod, review(hook, testutil.NewPodCreateRequest(pod)))
+		Expect(patched.Annotations).To(HaveKeyWithValue(TemplatesUsedAnnotation, testTemplateName))
+
+		Expect(review(hook, testutil.NewPodDeleteRequest(patched)).Response.Allowed).To(BeTrue())
+		cmState := newTestCMState()
+		Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: cmState.Name}, cmState)).To(Succeed())
+		Expect(cmState.Spec.Audience).To(BeEmpty())
+	})
+
+	It("rejects aliases another template already goes by", func() {
+		other := newTestTemplate()
+		other.Name = "vault-agent-v2"
+		other.Spec.Aliases = []string{"vault-agent-v1", testTemplateName}
+		validator := &templateValidator{Client: hook.Client, Options: TemplateOptions{ValidationPolicy: TemplateValidationEnforce}}
+
+		resp := review(validator, newTemplateRequest(v1admission.Create, other)).Response
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring(`spec.aliases[0]: Invalid value: "vault-agent-v1": already the name or an alias of CMTemplate 'vault-agent'`))
+		Expect(string(resp.Result.Reason)).To(ContainSubstring(`spec.aliases[1]: Invalid value: "vault-agent": already the name or an alias of CMTemplate 'vault-agent'`))
+
+		other.Name = "vault-agent-v1"
+		other.Spec.Aliases = nil
+		resp = review(validator, newTemplateRequest(v1admission.Create, other)).Response
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("metadata.name"))
+	})
+})
+
+var _ = Describe("Output injection", func() {
+	newOutputTemplate := func() *cachev1alpha2.CMTemplate {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Outputs = []cachev1alpha2.Output{{
+			Name:             "init",
+			CMTemplate:       map[string]string{"config-init.hcl": "role = \"{role}\" exit_after_auth = true"},
+			TargetAnnotation: "example.com/init-configmap",
+		}}
+		return cmTemplate
+	}
+
+	It("points the annotation of every output at its ConfigMap", func() {
+		hook := newTestHook(newOutputTemplate())
+
+		patch := decodePatch(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))))
+		Expect(patch).To(ContainElements(
+			testutil.PatchOperation{Op: "add", Path: "/metadata/annotations/vault.hashicorp.com~1agent-configmap", Value: "cmstate-vault-agent"},
+			testutil.PatchOperation{Op: "add", Path: "/metadata/annotations/example.com~1init-configmap", Value: "cmstate-vault-agent-init"},
+		))
+	})
+
+	It("changes the checksum with the data of an output", func() {
+		cmTemplate := newOutputTemplate()
+		before := testChecksum(newTestPod("app-1"), cmTemplate)
+		cmTemplate.Spec.Outputs[0].CMTemplate["config-init.hcl"] = "role = \"{role}\""
+		Expect(testChecksum(newTestPod("app-1"), cmTemplate)).NotTo(Equal(before))
+	})
+
+	It("rejects outputs sharing a name or annotation", func() {
+		cmTemplate := newOutputTemplate()
+		cmTemplate.Spec.Outputs = append(cmTemplate.Spec.Outputs, cachev1alpha2.Output{
+			Name:             "init",
+			CMTemplate:       map[string]string{"config.hcl": "exit_after_auth = true"},
+			TargetAnnotation: testTargetAnnotation,
+		})
+		Expect(cmTemplate.Validate()).To(ConsistOf(
+			HaveField("Field", "spec.outputs[1].name"),
+			HaveField("Field", "spec.outputs[1].targetAnnotation"),
+		))
+	})
+
+	It("rejects dataFrom without a valid reference", func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.DataFrom = []cachev1alpha2.DataFromSource{
+			{},
+			{ConfigMapRef: &cachev1alpha2.DataRef{Name: "Agent_Base", Namespace: "platform", Key: "base hcl"}},
+			{ConfigMapRef: &cachev1alpha2.DataRef{Name: "agent-base"}, SecretRef: &cachev1alpha2.DataRef{Name: "agent-base"}},
+		}
+		Expect(cmTemplate.Validate()).To(ConsistOf(
+			HaveField("Field", "spec.dataFrom[0]"),
+			HaveField("Field", "spec.dataFrom[1].configMapRef.name"),
+			HaveField("Field", "spec.dataFrom[1].configMapRef.key"),
+			HaveField("Field", "spec.dataFrom[2].secretRef"),
+		))
+	})
+
+	It("only adds the data of Secrets to ConfigMaps when allowed", func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.DataFrom = []cachev1alpha2.DataFromSource{{SecretRef: &cachev1alpha2.DataRef{Name: "vault-ca", Key: "ca.crt"}}}
+		Expect(cmTemplate.Validate()).To(ConsistOf(HaveField("Field", "spec.dataFrom[0].secretRef")))
+
+		cmTemplate.Spec.AllowSecretToConfigMap = true
+		Expect(cmTemplate.Validate()).To(BeEmpty())
+
+		cmTemplate.Spec.AllowSecretToConfigMap = false
+		cmTemplate.Spec.Target = &cachev1alpha2.Target{Kind: cachev1alpha2.TargetKindSecret}
+		Expect(cmTemplate.Validate()).To(BeEmpty())
+	})
+
+	It("accepts a syntax for the keys of outputs only", func() {
+		cmTemplate := newOutputTemplate()
+		cmTemplate.Spec.Template.Syntax = map[string]cachev1alpha2.DataSyntax{
+			"config-init.hcl": cachev1alpha2.DataSyntaxHCL,
+			"config.json":     cachev1alpha2.DataSyntaxJSON,
+		}
+		Expect(cmTemplate.Validate()).To(ConsistOf(HaveField("Field", "spec.template.syntax[config.json]")))
+	})
+})
+
+var _ = Describe("Immutable injection", func() {
+	newImmutableTemplate := func() *cachev1alpha2.CMTemplate {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Immutable = true
+		return cmTemplate
+	}
+
+	It("injects new pods with the name the controller renders the ConfigMap under", func() {
+		cmTemplate := newImmutableTemplate()
+		hook := newTestHook(cmTemplate)
+
+		patch := decodePatch(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))))
+		name := cachev1alpha2.ImmutableName("cmstate-vault-agent", cmTemplate.Spec.ContentHash(map[string]string{"vault.hashicorp.com/role": "reader"}))
+		Expect(patch).To(ContainElement(
+			testutil.PatchOperation{Op: "add", Path: "/metadata/annotations/vault.hashicorp.com~1agent-configmap", Value: name},
+		))
+	})
+
+	It("injects the hash suffixed name of templates versioned by hashSuffix", func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Versioning = cachev1alpha2.VersioningHashSuffix
+		hook := newTestHook(cmTemplate)
+
+		patch := decodePatch(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))))
+		name := cachev1alpha2.ImmutableName("cmstate-vault-agent", cmTemplate.Spec.ContentHash(map[string]string{"vault.hashicorp.com/role": "reader"}))
+		Expect(patch).To(ContainElement(
+			testutil.PatchOperation{Op: "add", Path: "/metadata/annotations/vault.hashicorp.com~1agent-configmap", Value: name},
+		))
+	})
+
+	It("rejects immutable templates updated in place", func() {
+		cmTemplate := newImmutableTemplate()
+		cmTemplate.Spec.Versioning = cachev1alpha2.VersioningInPlace
+		Expect(cmTemplate.Validate()).To(ConsistOf(HaveField("Field", "spec.versioning")))
+	})
+
+	It("hashes the data the template adds from a ConfigMap along", func() {
+		cmTemplate := newImmutableTemplate()
+		cmTemplate.Spec.DataFrom = []cachev1alpha2.DataFromSource{{ConfigMapRef: &cachev1alpha2.DataRef{Name: "agent-base"}}}
+		base := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent-base", Namespace: testNamespace},
+			Data:       map[string]string{"base.hcl": `vault { address = "https://vault" }`},
+		}
+		hook := newTestHook(cmTemplate, base)
+
+		patch := decodePatch(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))))
+		resolved := cmTemplate.DeepCopy()
+		resolved.Spec.Template.Data["base.hcl"] = base.Data["base.hcl"]
+		name := cachev1alpha2.ImmutableName("cmstate-vault-agent", resolved.Spec.ContentHash(map[string]string{"vault.hashicorp.com/role": "reader"}))
+		Expect(name).NotTo(Equal(cachev1alpha2.ImmutableName("cmstate-vault-agent", cmTemplate.Spec.ContentHash(map[string]string{"vault.hashicorp.com/role": "reader"}))))
+		Expect(patch).To(ContainElement(
+			testutil.PatchOperation{Op: "add", Path: "/metadata/annotations/vault.hashicorp.com~1agent-configmap", Value: name},
+		))
+	})
+
+	It("keeps injecting the ConfigMap of a cmstate pinned on create", func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.UpdateStrategy = cachev1alpha2.UpdateStrategyOnCreate
+		cmTemplate.Spec.ConfigMapName = "vault-agent-config"
+		cmState := newTestCMState("app-0")
+		cmState.Spec.Target = "cmstate-vault-agent"
+		hook := newTestHook(cmTemplate, cmState)
+
+		patch := decodePatch(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))))
+		Expect(patch).To(ContainElement(
+			testutil.PatchOperation{Op: "add", Path: "/metadata/annotations/vault.hashicorp.com~1agent-configmap", Value: "cmstate-vault-agent"},
+		))
+	})
+
+	It("injects the current ConfigMap of the cmstate", func() {
+		cmState := newTestCMState("app-0")
+		cmState.Spec.Target = "cmstate-vault-agent-0123456789"
+		cmState.Status.ConfigMap = "cmstate-vault-agent-0123456789"
+		hook := newTestHook(newImmutableTemplate(), cmState)
+
+		patch := decodePatch(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))))
+		Expect(patch).To(ContainElement(
+			testutil.PatchOperation{Op: "add", Path: "/metadata/annotations/vault.hashicorp.com~1agent-configmap", Value: "cmstate-vault-agent-0123456789"},
+		))
+	})
+
+	It("records the ConfigMap every pod was injected with in the audience", func() {
+		cmState := newTestCMState("app-0")
+		cmState.Spec.Audience[0].ConfigMap = "cmstate-vault-agent-0123456789"
+		cmState.Spec.Target = "cmstate-vault-agent-0123456789"
+		cmState.Status.ConfigMap = "cmstate-vault-agent-abcdef0123"
+		hook := newTestHook(newImmutableTemplate(), cmState)
+
+		Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+
+		Expect(hook.Client.Get(context.Background(), types.NamespacedName{Namespace: testNamespace, Name: cmState.Name}, cmState)).To(Succeed())
+		Expect(cmState.Spec.Audience).To(ConsistOf(
+			And(HaveField("Name", "app-0"), HaveField("ConfigMap", "cmstate-vault-agent-0123456789")),
+			And(HaveField("Name", "app-1"), HaveField("ConfigMap", "cmstate-vault-agent-abcdef0123")),
+		))
+	})
+})
+
+var _ = Describe("Config checksum", func() {
+	checksumOf := func(hook *cmStateCreator, pod *corev1.Pod) string {
+		patch := decodePatch(review(hook, testutil.NewPodCreateRequest(pod)))
+		return patchValue[string](patch, "add", annotationPath(ConfigChecksumAnnotation))
+	}
+
+	It("is the same for pods rendering the same config", func() {
+		hook := newTestHook(newTestTemplate())
+		first := checksumOf(hook, newTestPod("app-1"))
+		second := checksumOf(hook, newTestPod("app-2"))
+		Expect(first).NotTo(BeEmpty())
+		Expect(second).To(Equal(first))
+	})
+
+	It("covers the annotation values of the pod", func() {
+		pod := newTestPod("app-1")
+		other := newTestPod("app-1")
+		other.Annotations["vault.hashicorp.com/role"] = "writer"
+		Expect(testChecksum(other, newTestTemplate())).NotTo(Equal(testChecksum(pod, newTestTemplate())))
+	})
+
+	It("changes with the content of the template", func() {
+		cmTemplate := newTestTemplate()
+		before := testChecksum(newTestPod("app-1"), cmTemplate)
+		cmTemplate.Spec.Template.Data["config.hcl"] = "role = \"{role}\"\nexit_after_auth = true"
+		Expect(testChecksum(newTestPod("app-1"), cmTemplate)).NotTo(Equal(before))
+	})
+
+	It("covers the annotation values of pods of GoTemplate templates", func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Template.Engine = cachev1alpha2.TemplateEngineGoTemplate
+		other := newTestPod("app-1")
+		other.Annotations["vault.hashicorp.com/role"] = "writer"
+		Expect(testChecksum(other, cmTemplate)).NotTo(Equal(testChecksum(newTestPod("app-1"), cmTemplate)))
+	})
+
+	It("changes with the binary data of the template", func() {
+		cmTemplate := newTestTemplate()
+		before := testChecksum(newTestPod("app-1"), cmTemplate)
+		cmTemplate.Spec.Template.BinaryData = map[string][]byte{"truststore.jks": {0xfe, 0xed}}
+		Expect(testChecksum(newTestPod("app-1"), cmTemplate)).NotTo(Equal(before))
+	})
+
+	It("doesn't depend on the order of the template keys", func() {
+		keys := []string{"a.hcl", "b.hcl", "c.hcl", "d.hcl", "e.hcl"}
+		forward, backward := newTestTemplate(), newTestTemplate()
+		forward.Spec.Template.Data = map[string]string{}
+		backward.Spec.Template.Data = map[string]string{}
+		for i := range keys {
+			forward.Spec.Template.Data[keys[i]] = "role = \"{role}\""
+			backward.Spec.Template.Data[keys[len(keys)-1-i]] = "role = \"{role}\""
+		}
+		Expect(testChecksum(newTestPod("app-1"), backward)).To(Equal(testChecksum(newTestPod("app-1"), forward)))
+	})
+
+	It("ignores line endings and defaults like the content hash", func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Template.Data["config.hcl"] = "role = \"{role}\"\nexit_after_auth = true"
+		before := testChecksum(newTestPod("app-1"), cmTemplate)
+
+		cmTemplate.Spec.Template.Data["config.hcl"] = "role = \"{role}\"\r\nexit_after_auth = true"
+		Expect(testChecksum(newTestPod("app-1"), cmTemplate)).To(Equal(before))
+
+		cmTemplate.Spec.Template.Engine = cachev1alpha2.TemplateEngineReplace
+		Expect(testChecksum(newTestPod("app-1"), cmTemplate)).To(Equal(before))
+	})
+
+	It("isn't set on pods admitted without an injection", func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.Disabled = true
+		hook := newTestHook(cmTemplate)
+
+		out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+		_, ok := testutil.FindPatch(decodePatch(out), annotationPath(ConfigChecksumAnnotation))
+		Expect(ok).To(BeFalse())
+	})
+})
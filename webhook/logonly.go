@@ -0,0 +1,127 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// MutationMode decides whether the webhook mutates pods or only logs what it
+// would have done
+type MutationMode string
+
+const (
+	// MutationEnforce injects pods and keeps the cmstates up to date
+	MutationEnforce MutationMode = "enforce"
+	// MutationLogOnly evaluates every pod and logs the writes and patch it
+	// would have made, but admits pods unmodified and writes nothing
+	MutationLogOnly MutationMode = "log-only"
+)
+
+// handleLogOnly evaluates the request like an enforcing webhook would, on a
+// copy of the hook whose writes are sent as server-side dry runs and logged.
+// Whatever the outcome, the pod is admitted unmodified.
+func (hook *cmStateCreator) handleLogOnly(ctx context.Context, req admission.Request) (*admission.Response, error) {
+	log := ctrl.Log.WithName("webhooks").WithName("CMStateCreator").WithValues(logOnlyValues(req)...)
+
+	shadow := *hook
+	shadow.Options.MutationMode = MutationEnforce
+	shadow.Client = &logOnlyClient{Client: hook.Client, log: log}
+	shadow.Recorder = nil
+	shadow.breaker = hook.logOnlyBreaker
+	shadow.logOnly = true
+
+	resp, err := shadow.handleInner(ctx, req)
+	switch {
+	case resp == nil && err != nil:
+		log.Error(err, "Would fail the admission")
+	case resp == nil:
+	case !resp.Allowed:
+		log.Info("Would deny pod", "reason", resp.Result.Reason)
+	case len(resp.Patch) > 0:
+		log.Info("Would patch pod", "patch", string(resp.Patch), "warnings", resp.Warnings)
+	}
+
+	allowed := admission.Allowed("log-only mode, pod admitted unmodified")
+	return &allowed, nil
+}
+
+// logOnlyValues identifies the pod and its workload in the log lines of a
+// log-only admission, so they can be grouped into a report of the affected
+// workloads. Only the metadata is decoded, the handler decodes the pod itself.
+func logOnlyValues(req admission.Request) []interface{} {
+	raw := req.Object.Raw
+	if len(raw) == 0 {
+		raw = req.OldObject.Raw
+	}
+	metadata := &metav1.PartialObjectMetadata{}
+	_ = json.Unmarshal(raw, metadata)
+
+	values := []interface{}{
+		"mode", MutationLogOnly,
+		"operation", req.Operation,
+		"namespace", req.Namespace,
+		"name", metadata.Name,
+		"generateName", metadata.GenerateName,
+	}
+	if ref := metav1.GetControllerOf(metadata); ref != nil {
+		values = append(values, "ownerKind", ref.Kind, "ownerName", ref.Name)
+	}
+	return values
+}
+
+// logOnlyClient turns every write into a server-side dry run, logging the
+// object it would have written. Reads go straight through.
+type logOnlyClient struct {
+	client.Client
+	log logr.Logger
+}
+
+func (c *logOnlyClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	c.log.Info("Would create object", c.objectValues(obj)...)
+	return c.Client.Create(ctx, obj, append(opts, client.DryRunAll)...)
+}
+
+func (c *logOnlyClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	c.log.Info("Would update object", c.objectValues(obj)...)
+	return c.Client.Update(ctx, obj, append(opts, client.DryRunAll)...)
+}
+
+func (c *logOnlyClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	c.log.Info("Would patch object", c.objectValues(obj)...)
+	return c.Client.Patch(ctx, obj, patch, append(opts, client.DryRunAll)...)
+}
+
+func (c *logOnlyClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	c.log.Info("Would delete object", c.objectValues(obj)...)
+	return c.Client.Delete(ctx, obj, append(opts, client.DryRunAll)...)
+}
+
+func (c *logOnlyClient) objectValues(obj client.Object) []interface{} {
+	kind := obj.GetObjectKind().GroupVersionKind().Kind
+	if gvk, err := apiutil.GVKForObject(obj, c.Scheme()); err == nil {
+		kind = gvk.Kind
+	}
+	return []interface{}{"kind", kind, "objectNamespace", obj.GetNamespace(), "objectName", obj.GetName(), "object", obj}
+}
+
+// mutatingDecision counts the injections and removals of a log-only
+// admission as decisions the webhook would have made
+func (hook *cmStateCreator) mutatingDecision(decision string) string {
+	if !hook.logOnly {
+		return decision
+	}
+	switch decision {
+	case decisionInjected:
+		return decisionWouldInject
+	case decisionRemoved:
+		return decisionWouldRemove
+	}
+	return decision
+}
@@ -0,0 +1,83 @@
+package webhook
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	v1admission "k8s.io/api/admission/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Admission decisions, per template where a template is involved
+const (
+	decisionInjected = "injected"
+	decisionRemoved  = "removed"
+	decisionSkipped  = "skipped"
+	decisionDenied   = "denied"
+	decisionErrored  = "errored"
+	// log-only mode counts the mutations it would have made
+	decisionWouldInject = "would_inject"
+	decisionWouldRemove = "would_remove"
+)
+
+// Error reasons, kept to a fixed set so the label stays bounded
+const (
+	errorDecode           = "decode"
+	errorNamespaceLookup  = "namespace_lookup"
+	errorCMStateLookup    = "cmstate_lookup"
+	errorCMTemplateLookup = "cmtemplate_lookup"
+	errorCMStateCreate    = "cmstate_create"
+	errorCMStateUpdate    = "cmstate_update"
+	errorEncode           = "encode"
+	errorTimeout          = "timeout"
+)
+
+var (
+	admissionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cmstate_webhook_admissions_total",
+			Help: "Number of pod admissions handled, by operation, decision and CMTemplate.",
+		},
+		[]string{"operation", "decision", "template"},
+	)
+	admissionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "cmstate_webhook_duration_seconds",
+			Help:    "Time spent handling a pod admission, by operation.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"operation"},
+	)
+	errorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cmstate_webhook_errors_total",
+			Help: "Number of errors while handling pod admissions, by reason.",
+		},
+		[]string{"reason"},
+	)
+	circuitOpen = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cmstate_webhook_circuit_open",
+			Help: "Whether CMState writes are suspended after repeated failures, until a write succeeds again.",
+		},
+	)
+	circuitTripsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cmstate_webhook_circuit_trips_total",
+			Help: "Number of times CMState writes were suspended after repeated failures.",
+		},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(admissionsTotal, admissionDuration, errorsTotal, circuitOpen, circuitTripsTotal)
+}
+
+// recordAdmission counts a decision. The template label only ever holds the
+// name of an existing CMTemplate, names of missing ones come straight from pod
+// annotations and would make the cardinality unbounded.
+func recordAdmission(operation v1admission.Operation, decision, template string) {
+	admissionsTotal.WithLabelValues(string(operation), decision, template).Inc()
+}
+
+func recordError(reason string) {
+	errorsTotal.WithLabelValues(reason).Inc()
+}
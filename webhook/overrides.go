@@ -0,0 +1,174 @@
+package webhook
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ReplaceAnnotationPrefix prefixes the pod annotations overriding the value of
+// an annotation the template replaces, named after its full key with the '/'
+// written as '_'. cache.spicedelver.me/replace.vault.hashicorp.com_role
+// overrides vault.hashicorp.com/role, so a canary can point at another Vault
+// role than the rest of its workload.
+const ReplaceAnnotationPrefix = "cache.spicedelver.me/replace."
+
+// DefaultedAnnotation lists on a CMState the annotations and labels its
+// ConfigMap is rendered with the template's default of, the pod creating it
+// didn't set them. It is left out when no default was used.
+const DefaultedAnnotation = "cache.spicedelver.me/defaulted"
+
+// replaceKey is the name overrides of the annotation go by. An annotation name
+// can't hold a '/', a prefix can't hold a '_', so the prefix is kept apart
+// from the name by the latter and annotations of other prefixes never share it.
+func replaceKey(annotation string) string {
+	return strings.Replace(annotation, "/", "_", 1)
+}
+
+// replacementOverrides returns the values the pod overrides for the
+// annotations and labels the template replaces, by key, normalized to their
+// type
+func replacementOverrides(cmTemplate *cachev1alpha2.CMTemplate, pod *corev1.Pod) map[string]string {
+	overrides := make(map[string]string)
+	for key, replacement := range cmTemplate.Spec.Template.Replacements() {
+		if value, ok := pod.GetAnnotations()[ReplaceAnnotationPrefix+replaceKey(key)]; ok {
+			overrides[key] = normalizedValue(replacement, value)
+		}
+	}
+	return overrides
+}
+
+// normalizedValue is the value normalized to the type of its replacement. A
+// value failing to is kept as it is, mismatchedAnnotations denies the pod.
+func normalizedValue(replacement cachev1alpha2.Replacement, value string) string {
+	normalized, err := replacement.Normalize(value)
+	if err != nil {
+		return value
+	}
+	return normalized
+}
+
+// podValue returns the value the pod sets for the key. The annotation of a
+// key both replaced as annotation and label wins over the label.
+func podValue(cmTemplate *cachev1alpha2.CMTemplate, pod *corev1.Pod, key string) (string, bool) {
+	if _, ok := cachev1alpha2.FindReplacement(cmTemplate.Spec.Template.AnnotationReplace, key); ok {
+		if value, ok := pod.GetAnnotations()[key]; ok {
+			return value, true
+		}
+	}
+	if _, ok := cachev1alpha2.FindReplacement(cmTemplate.Spec.Template.LabelReplace, key); ok {
+		if value, ok := pod.GetLabels()[key]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// replacementValues returns the values the template's placeholders are
+// replaced with for the pod, its overrides win over its annotations and
+// labels and those over the defaults of the template. Only the values the pod
+// has or defaults are returned, along with the fields it has, normalized to
+// the types of their replacements.
+func replacementValues(cmTemplate *cachev1alpha2.CMTemplate, pod *corev1.Pod) map[string]string {
+	values := replacementOverrides(cmTemplate, pod)
+	for key, replacement := range cmTemplate.Spec.Template.Replacements() {
+		if _, ok := values[key]; ok {
+			continue
+		}
+		if value, ok := podValue(cmTemplate, pod, key); ok {
+			values[key] = normalizedValue(replacement, value)
+		} else if value, ok := cmTemplate.Spec.Template.DefaultValue(key); ok {
+			values[key] = value
+		}
+	}
+	for key, replacement := range cmTemplate.Spec.Template.FieldReplace {
+		if value := fieldValue(pod, replacement.FieldPath); value != "" {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// fieldValue reads the pod field of a field replacement, fields the pod
+// doesn't have yet are empty
+func fieldValue(pod *corev1.Pod, fieldPath string) string {
+	switch fieldPath {
+	case "metadata.name":
+		return pod.Name
+	case "metadata.namespace":
+		return pod.Namespace
+	case "spec.serviceAccountName":
+		return serviceAccountName(pod)
+	case "spec.nodeName":
+		return pod.Spec.NodeName
+	}
+	return ""
+}
+
+// defaultedAnnotations lists the annotations and labels the pod takes the
+// default of, neither setting nor overriding them, sorted
+func defaultedAnnotations(cmTemplate *cachev1alpha2.CMTemplate, pod *corev1.Pod) []string {
+	overrides := replacementOverrides(cmTemplate, pod)
+	var defaulted []string
+	for key := range cmTemplate.Spec.Template.Replacements() {
+		if _, ok := overrides[key]; ok {
+			continue
+		}
+		if _, ok := podValue(cmTemplate, pod, key); ok {
+			continue
+		}
+		if _, ok := cmTemplate.Spec.Template.DefaultValue(key); ok {
+			defaulted = append(defaulted, key)
+		}
+	}
+	sort.Strings(defaulted)
+	return defaulted
+}
+
+// overridesHash is the hash of the values the pod overrides, empty without
+// overrides. Pods overriding values render a ConfigMap of their own, shared
+// with the pods overriding the same values.
+func overridesHash(cmTemplate *cachev1alpha2.CMTemplate, pod *corev1.Pod) string {
+	overrides := replacementOverrides(cmTemplate, pod)
+	if len(overrides) == 0 {
+		return ""
+	}
+	// encoding sorts the keys, the hash doesn't depend on map ordering
+	raw, _ := json.Marshal(overrides)
+	hash := sha256.Sum256(raw)
+	return hex.EncodeToString(hash[:])[:labelHashLength]
+}
+
+// unknownOverrides lists the override annotations of the pod that none of its
+// templates replace, sorted. Nothing is reported when a template can't be
+// read, the injection reports that.
+func (hook *cmStateCreator) unknownOverrides(ctx context.Context, templates []string, pod *corev1.Pod) []string {
+	known := make(map[string]bool)
+	for _, name := range templates {
+		cmTemplate := &cachev1alpha2.CMTemplate{}
+		if err := hook.getCMTemplate(ctx, pod.Namespace, name, cmTemplate); err != nil {
+			return nil
+		}
+		if err := hook.resolveBase(ctx, cmTemplate); err != nil {
+			return nil
+		}
+		for key := range cmTemplate.Spec.Template.Replacements() {
+			known[ReplaceAnnotationPrefix+replaceKey(key)] = true
+		}
+	}
+
+	var unknown []string
+	for key := range pod.GetAnnotations() {
+		if strings.HasPrefix(key, ReplaceAnnotationPrefix) && !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	"github.com/stollenaar/cmstate-injector-operator/webhook/testutil"
+)
+
+var _ = Describe("Replacement overrides", func() {
+	ctx := context.Background()
+
+	canary := func(name, role string) *corev1.Pod {
+		pod := newTestPod(name)
+		pod.Annotations[ReplaceAnnotationPrefix+"vault.hashicorp.com_role"] = role
+		return pod
+	}
+
+	cmStates := func(hook *cmStateCreator) []cachev1alpha2.CMState {
+		list := &cachev1alpha2.CMStateList{}
+		Expect(hook.Client.List(ctx, list, client.InNamespace(testNamespace))).To(Succeed())
+		return list.Items
+	}
+
+	It("gives pods overriding a value a cmstate of their own", func() {
+		hook := newTestHook(newTestTemplate())
+
+		Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+		out := review(hook, testutil.NewPodCreateRequest(canary("app-2", "canary")))
+		Expect(out.Response.Allowed).To(BeTrue())
+
+		name := hook.cmStateNameFor(ctx, newTestTemplate(), canary("app-2", "canary"))
+		Expect(name).NotTo(Equal("cmstate-vault-agent"))
+		Expect(applyPatch(canary("app-2", "canary"), out).Annotations).To(HaveKeyWithValue(testTargetAnnotation, name))
+		Expect(cmStates(hook)).To(ConsistOf(
+			And(
+				HaveField("Name", "cmstate-vault-agent"),
+				HaveField("Annotations", HaveKeyWithValue("vault.hashicorp.com/role", "reader")),
+				HaveField("Spec.Audience", ConsistOf(HaveField("Name", "app-1"))),
+			),
+			And(
+				HaveField("Name", name),
+				HaveField("Annotations", HaveKeyWithValue("vault.hashicorp.com/role", "canary")),
+				HaveField("Labels", HaveKeyWithValue("vault.hashicorp.com/role", "canary")),
+				HaveField("Spec.Audience", ConsistOf(HaveField("Name", "app-2"))),
+			),
+		))
+	})
+
+	It("shares the cmstate between pods overriding the same values", func() {
+		hook := newTestHook(newTestTemplate())
+
+		Expect(review(hook, testutil.NewPodCreateRequest(canary("app-1", "canary"))).Response.Allowed).To(BeTrue())
+		Expect(review(hook, testutil.NewPodCreateRequest(canary("app-2", "canary"))).Response.Allowed).To(BeTrue())
+		Expect(review(hook, testutil.NewPodCreateRequest(canary("app-3", "preview"))).Response.Allowed).To(BeTrue())
+
+		Expect(cmStates(hook)).To(ConsistOf(
+			HaveField("Spec.Audience", HaveLen(2)),
+			HaveField("Spec.Audience", HaveLen(1)),
+		))
+	})
+
+	It("supplies a value the pod doesn't annotate", func() {
+		hook := newTestHook(newTestTemplate())
+		pod := canary("app-1", "canary")
+		delete(pod.Annotations, "vault.hashicorp.com/role")
+
+		Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Allowed).To(BeTrue())
+		Expect(cmStates(hook)).To(ConsistOf(HaveField("Annotations", HaveKeyWithValue("vault.hashicorp.com/role", "canary"))))
+	})
+
+	It("denies overrides of values the templates don't replace", func() {
+		hook := newTestHook(newTestTemplate())
+		pod := newTestPod("app-1")
+		pod.Annotations[ReplaceAnnotationPrefix+"path"] = "secret/canary"
+
+		out := review(hook, testutil.NewPodCreateRequest(pod))
+		Expect(out.Response.Allowed).To(BeFalse())
+		Expect(string(out.Response.Result.Reason)).To(ContainSubstring("cache.spicedelver.me/replace.path"))
+		Expect(cmStates(hook)).To(BeEmpty())
+	})
+
+	It("only overrides the annotation with the full key", func() {
+		cmTemplate := newTestTemplate()
+		cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "consul.hashicorp.com/role", cachev1alpha2.Replacement{Placeholder: "{consul-role}"})
+		cmTemplate.Spec.Template.OptionalAnnotations = []string{"consul.hashicorp.com/role"}
+		hook := newTestHook(cmTemplate)
+		pod := newTestPod("app-1")
+		pod.Annotations[ReplaceAnnotationPrefix+"role"] = "canary"
+
+		out := review(hook, testutil.NewPodCreateRequest(pod))
+		Expect(out.Response.Allowed).To(BeFalse())
+		Expect(string(out.Response.Result.Reason)).To(ContainSubstring("cache.spicedelver.me/replace.role"))
+
+		Expect(replacementOverrides(cmTemplate, canary("app-1", "canary"))).To(Equal(map[string]string{"vault.hashicorp.com/role": "canary"}))
+	})
+
+	It("removes the pod from its own cmstate on delete", func() {
+		hook := newTestHook(newTestTemplate())
+		pod := canary("app-1", "canary")
+
+		out := review(hook, testutil.NewPodCreateRequest(pod))
+		Expect(review(hook, testutil.NewPodDeleteRequest(applyPatch(pod, out))).Response.Allowed).To(BeTrue())
+		Expect(cmStates(hook)).To(ConsistOf(HaveField("Spec.Audience", BeEmpty())))
+	})
+})
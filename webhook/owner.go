@@ -0,0 +1,173 @@
+package webhook
+
+import (
+	"context"
+	"strings"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+// audienceOwner is the workload a pod is tracked under in the audience
+type audienceOwner struct {
+	Kind string
+	Name string
+	UID  types.UID
+	// Member is the id of the pod within the owner's entry, only set for
+	// owners whose pods are tracked individually
+	Member types.UID
+}
+
+// String formats the owner the way it is recorded in AudienceOwnerAnnotation
+func (o *audienceOwner) String() string {
+	return o.Kind + "/" + o.Name
+}
+
+// newAudience returns the audience entry for the owner, counting its first pod
+func (o *audienceOwner) newAudience(namespace string) cachev1alpha2.CMAudience {
+	now := metav1.Now()
+	audience := cachev1alpha2.CMAudience{
+		Kind:      o.Kind,
+		Name:      o.Name,
+		Namespace: namespace,
+		UID:       o.UID,
+		AddedAt:   &now,
+		Count:     1,
+	}
+	if o.Member != "" {
+		audience.Members = []types.UID{o.Member}
+	}
+	return audience
+}
+
+// join counts the pod in the existing entry of the owner, it reports false
+// when the pod is a member already
+func (o *audienceOwner) join(entry *cachev1alpha2.CMAudience) bool {
+	if o.Member != "" {
+		if hasMember(entry, o.Member) {
+			return false
+		}
+		entry.Members = append(entry.Members, o.Member)
+	}
+	entry.Count++
+	return true
+}
+
+// leave drops the pod from the members of the owner's entry, it reports false
+// when the pod isn't a member, e.g. because its deletion was retried. Entries
+// without members are left for the caller to count down.
+func (o *audienceOwner) leave(entry *cachev1alpha2.CMAudience) bool {
+	if o.Member == "" || len(entry.Members) == 0 {
+		return true
+	}
+	for i, member := range entry.Members {
+		if member == o.Member {
+			entry.Members = append(entry.Members[:i], entry.Members[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func hasMember(entry *cachev1alpha2.CMAudience, member types.UID) bool {
+	for _, m := range entry.Members {
+		if m == member {
+			return true
+		}
+	}
+	return false
+}
+
+// audienceTrackingOf returns how the audience of the cmstate is tracked, the
+// way it was when the cmstate was created or, for new and older cmstates, the
+// way the template asks for. A template switching never mixes pods and owners
+// in the audience of an existing cmstate.
+func audienceTrackingOf(cmState *cachev1alpha2.CMState, cmTemplate *cachev1alpha2.CMTemplate) cachev1alpha2.AudienceTracking {
+	if cmState.Spec.AudienceTracking != "" {
+		return cmState.Spec.AudienceTracking
+	}
+	return templateAudienceTracking(cmTemplate)
+}
+
+// templateAudienceTracking returns how the template tracks the audiences of
+// new cmstates, per Pod unless set
+func templateAudienceTracking(cmTemplate *cachev1alpha2.CMTemplate) cachev1alpha2.AudienceTracking {
+	if cmTemplate.Spec.AudienceTracking == "" {
+		return cachev1alpha2.AudienceTrackingPod
+	}
+	return cmTemplate.Spec.AudienceTracking
+}
+
+// audienceOwnerFor returns the owner the pod is tracked under, if any. Job
+// pods are always tracked under their Job, each by a member id of its own, so
+// the completion of one pod doesn't drop the entry its siblings still depend
+// on. Pods joined by the pod controller get a member id whatever their owner,
+// the controller may see a pod more than once.
+func (hook *cmStateCreator) audienceOwnerFor(ctx context.Context, tracking cachev1alpha2.AudienceTracking, pod *corev1.Pod) *audienceOwner {
+	var owner *audienceOwner
+	if tracking == cachev1alpha2.AudienceTrackingOwner {
+		owner = hook.resolveOwner(ctx, pod)
+	} else if ref := metav1.GetControllerOf(pod); ref != nil && ref.Kind == "Job" {
+		owner = &audienceOwner{Kind: ref.Kind, Name: ref.Name, UID: ref.UID}
+	}
+	if owner != nil && (owner.Kind == "Job" || hook.Options.CMStateWrites == CMStateWritesController) {
+		owner.Member = podMember(pod)
+	}
+	return owner
+}
+
+// podMember returns the member id of the pod, reusing the one an earlier
+// template or invocation stamped on it
+func podMember(pod *corev1.Pod) types.UID {
+	if member := pod.GetAnnotations()[AudienceMemberAnnotation]; member != "" {
+		return types.UID(member)
+	}
+	return uuid.NewUUID()
+}
+
+// resolveOwner returns the workload controlling the pod, following a
+// ReplicaSet up to its Deployment. Pods without a controller, or controlled by
+// a kind an audience can't record, return nil and are tracked themselves.
+func (hook *cmStateCreator) resolveOwner(ctx context.Context, pod *corev1.Pod) *audienceOwner {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil || !cachev1alpha2.IsAudienceKind(ref.Kind) {
+		return nil
+	}
+	owner := &audienceOwner{Kind: ref.Kind, Name: ref.Name, UID: ref.UID}
+	if ref.Kind != "ReplicaSet" {
+		return owner
+	}
+
+	replicaSet := &appsv1.ReplicaSet{}
+	if err := hook.Client.Get(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: ref.Name}, replicaSet); err != nil {
+		// a standalone view of the ReplicaSet is still a stable owner
+		return owner
+	}
+	if rsRef := metav1.GetControllerOf(replicaSet); rsRef != nil && rsRef.Kind == "Deployment" {
+		owner = &audienceOwner{Kind: rsRef.Kind, Name: rsRef.Name, UID: rsRef.UID}
+	}
+	return owner
+}
+
+// parseAudienceOwner reads the owner recorded on the pod at admission
+func parseAudienceOwner(pod *corev1.Pod) *audienceOwner {
+	kind, name, found := strings.Cut(pod.GetAnnotations()[AudienceOwnerAnnotation], "/")
+	if !found || kind == "" || name == "" {
+		return nil
+	}
+	return &audienceOwner{Kind: kind, Name: name, Member: types.UID(pod.GetAnnotations()[AudienceMemberAnnotation])}
+}
+
+// findOwnerIndex looks up the audience entry of an owner
+func findOwnerIndex(slice []cachev1alpha2.CMAudience, kind, name string) int {
+	for i, aud := range slice {
+		if aud.Kind == kind && aud.Name == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,266 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	"github.com/stollenaar/cmstate-injector-operator/webhook/testutil"
+)
+
+func controllerRef(apiVersion, kind, name string) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Name:       name,
+		UID:        types.UID(name + "-uid"),
+		Controller: pointer.Bool(true),
+	}
+}
+
+var _ = Describe("CMStateCreator tracking audiences per owner", func() {
+	var (
+		ctx  = context.Background()
+		hook *cmStateCreator
+	)
+
+	BeforeEach(func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.AudienceTracking = cachev1alpha2.AudienceTrackingOwner
+		replicaSet := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Name:            "web-5d8f7",
+			Namespace:       testNamespace,
+			OwnerReferences: []metav1.OwnerReference{controllerRef("apps/v1", "Deployment", "web")},
+		}}
+		hook = newTestHook(cmTemplate, replicaSet)
+	})
+
+	// replica returns a pod as the API server sends it at admission, without a
+	// name yet and with its owner's UID
+	replica := func(kind, owner string) *corev1.Pod {
+		pod := newTestPod("")
+		pod.GenerateName = owner + "-"
+		pod.UID = ""
+		pod.OwnerReferences = []metav1.OwnerReference{controllerRef("apps/v1", kind, owner)}
+		return pod
+	}
+
+	admitted := func(pod *corev1.Pod, i int) *corev1.Pod {
+		out := review(hook, testutil.NewPodCreateRequest(pod))
+		Expect(out.Response.Allowed).To(BeTrue())
+
+		created := pod.DeepCopy()
+		created.Name = fmt.Sprintf("%s%d", pod.GenerateName, i)
+		created.UID = types.UID(created.Name + "-uid")
+		created = applyPatch(created, out)
+		return created
+	}
+
+	audience := func() []cachev1alpha2.CMAudience {
+		cmState := newTestCMState()
+		Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+		return cmState.Spec.Audience
+	}
+
+	It("counts the replicas of a Deployment in a single entry", func() {
+		var pods []*corev1.Pod
+		for i := 0; i < 3; i++ {
+			pods = append(pods, admitted(replica("ReplicaSet", "web-5d8f7"), i))
+		}
+		Expect(audience()).To(ConsistOf(And(
+			HaveField("Kind", "Deployment"),
+			HaveField("Name", "web"),
+			HaveField("UID", types.UID("web-uid")),
+			HaveField("Count", int32(3)),
+		)))
+
+		for _, pod := range pods[:2] {
+			Expect(review(hook, testutil.NewPodDeleteRequest(pod)).Response.Allowed).To(BeTrue())
+		}
+		Expect(audience()).To(ConsistOf(HaveField("Count", int32(1))))
+
+		Expect(review(hook, testutil.NewPodDeleteRequest(pods[2])).Response.Allowed).To(BeTrue())
+		Expect(audience()).To(BeEmpty())
+	})
+
+	It("still finds the Deployment entry once the ReplicaSet is gone", func() {
+		pod := admitted(replica("ReplicaSet", "web-5d8f7"), 0)
+		Expect(hook.Client.Delete(ctx, &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "web-5d8f7", Namespace: testNamespace}})).To(Succeed())
+
+		Expect(review(hook, testutil.NewPodDeleteRequest(pod)).Response.Allowed).To(BeTrue())
+		Expect(audience()).To(BeEmpty())
+	})
+
+	It("tracks Job pods under the Job", func() {
+		pod := replica("Job", "backup")
+		pod.OwnerReferences[0].APIVersion = batchv1.SchemeGroupVersion.String()
+		admitted(pod, 0)
+		admitted(replica("Job", "backup"), 1)
+
+		Expect(audience()).To(ConsistOf(And(HaveField("Kind", "Job"), HaveField("Name", "backup"), HaveField("Count", int32(2)))))
+	})
+
+	It("falls back to per-pod tracking for bare pods", func() {
+		pod := newTestPod("bare")
+		out := review(hook, testutil.NewPodCreateRequest(pod))
+		Expect(out.Response.Allowed).To(BeTrue())
+		Expect(string(out.Response.Patch)).NotTo(ContainSubstring("audience-owner"))
+
+		Expect(audience()).To(ConsistOf(And(HaveField("Kind", "Pod"), HaveField("Name", "bare"))))
+
+		Expect(review(hook, testutil.NewPodDeleteRequest(pod)).Response.Allowed).To(BeTrue())
+		Expect(audience()).To(BeEmpty())
+	})
+
+	It("records the tracking on the cmstates it creates", func() {
+		admitted(replica("ReplicaSet", "web-5d8f7"), 0)
+
+		cmState := newTestCMState()
+		Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+		Expect(cmState.Spec.AudienceTracking).To(Equal(cachev1alpha2.AudienceTrackingOwner))
+	})
+
+	It("keeps tracking pods in cmstates created while the template tracked pods", func() {
+		cmState := newTestCMState("app-1")
+		cmState.Spec.AudienceTracking = cachev1alpha2.AudienceTrackingPod
+		Expect(hook.Client.Create(ctx, cmState)).To(Succeed())
+
+		admitted(replica("ReplicaSet", "web-5d8f7"), 0)
+
+		Expect(audience()).To(ConsistOf(
+			HaveField("Name", "app-1"),
+			And(HaveField("Kind", "Pod"), HaveField("Name", "web-5d8f7-"), HaveField("Count", int32(1))),
+		))
+	})
+
+	It("tracks pods of workload kinds an audience can't record themselves", func() {
+		pod := replica("Rollout", "canary")
+		pod.OwnerReferences[0].APIVersion = "argoproj.io/v1alpha1"
+		admitted(pod, 0)
+
+		Expect(audience()).To(ConsistOf(And(HaveField("Kind", "Pod"), HaveField("Name", "canary-"))))
+	})
+
+	It("doesn't count a reinvoked replica twice", func() {
+		pod := replica("ReplicaSet", "web-5d8f7")
+		created := admitted(pod, 0)
+
+		reinvoked := pod.DeepCopy()
+		reinvoked.Annotations = created.Annotations
+		reinvoked.Annotations[testTargetAnnotation] = "cmstate-vault-agent"
+		Expect(review(hook, testutil.NewPodCreateRequest(reinvoked)).Response.Patch).To(BeEmpty())
+
+		Expect(audience()).To(ConsistOf(HaveField("Count", int32(1))))
+	})
+})
+
+var _ = Describe("CMStateCreator tracking Job pods", func() {
+	var (
+		ctx  = context.Background()
+		hook *cmStateCreator
+	)
+
+	BeforeEach(func() {
+		hook = newTestHook(newTestTemplate())
+	})
+
+	jobPod := func() *corev1.Pod {
+		pod := newTestPod("")
+		pod.GenerateName = "backup-"
+		pod.UID = ""
+		pod.OwnerReferences = []metav1.OwnerReference{controllerRef(batchv1.SchemeGroupVersion.String(), "Job", "backup")}
+		return pod
+	}
+
+	// admitted applies the annotations the webhook patched onto the pod
+	admitted := func(pod *corev1.Pod, i int) *corev1.Pod {
+		out := review(hook, testutil.NewPodCreateRequest(pod))
+		Expect(out.Response.Allowed).To(BeTrue())
+
+		created := pod.DeepCopy()
+		created.Name = fmt.Sprintf("%s%d", pod.GenerateName, i)
+		created.UID = types.UID(created.Name + "-uid")
+		created = applyPatch(created, out)
+		return created
+	}
+
+	audience := func() []cachev1alpha2.CMAudience {
+		cmState := newTestCMState()
+		Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+		return cmState.Spec.Audience
+	}
+
+	It("keeps the Job entry until the last of its pods finished", func() {
+		var pods []*corev1.Pod
+		for i := 0; i < 3; i++ {
+			pods = append(pods, admitted(jobPod(), i))
+		}
+		Expect(audience()).To(ConsistOf(And(
+			HaveField("Kind", "Job"),
+			HaveField("Name", "backup"),
+			HaveField("UID", types.UID("backup-uid")),
+			HaveField("Count", int32(3)),
+			HaveField("Members", HaveLen(3)),
+		)))
+		for _, pod := range pods {
+			Expect(pod.Annotations).To(HaveKeyWithValue(AudienceOwnerAnnotation, "Job/backup"))
+			Expect(pod.Annotations).To(HaveKey(AudienceMemberAnnotation))
+		}
+
+		// the first pod finishes and its deletion is retried
+		for i := 0; i < 2; i++ {
+			Expect(review(hook, testutil.NewPodDeleteRequest(pods[0])).Response.Allowed).To(BeTrue())
+		}
+		Expect(audience()).To(ConsistOf(And(
+			HaveField("Count", int32(2)),
+			HaveField("Members", ConsistOf(
+				types.UID(pods[1].Annotations[AudienceMemberAnnotation]),
+				types.UID(pods[2].Annotations[AudienceMemberAnnotation]),
+			)),
+		)))
+
+		Expect(review(hook, testutil.NewPodDeleteRequest(pods[2])).Response.Allowed).To(BeTrue())
+		Expect(audience()).To(ConsistOf(HaveField("Count", int32(1))))
+
+		Expect(review(hook, testutil.NewPodDeleteRequest(pods[1])).Response.Allowed).To(BeTrue())
+		Expect(audience()).To(BeEmpty())
+	})
+
+	It("doesn't count a reinvoked Job pod twice", func() {
+		pod := jobPod()
+		created := admitted(pod, 0)
+
+		reinvoked := pod.DeepCopy()
+		reinvoked.Annotations = created.Annotations
+		Expect(review(hook, testutil.NewPodCreateRequest(reinvoked)).Response.Patch).To(BeEmpty())
+
+		Expect(audience()).To(ConsistOf(HaveField("Members", HaveLen(1))))
+	})
+})
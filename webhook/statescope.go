@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	"context"
+	"strings"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// templateStateScope returns which pods of the template share a cmstate, all
+// of them unless set
+func templateStateScope(cmTemplate *cachev1alpha2.CMTemplate) cachev1alpha2.StateScope {
+	if cmTemplate.Spec.StateScope == "" {
+		return cachev1alpha2.StateScopeTemplate
+	}
+	return cmTemplate.Spec.StateScope
+}
+
+// cmStateNameFor is the name of the cmstate the pod joins for the template.
+// Templates scoped to owners or pods name it after the owner or the pod, and
+// pods overriding values render a ConfigMap of their own on top of that.
+func (hook *cmStateCreator) cmStateNameFor(ctx context.Context, cmTemplate *cachev1alpha2.CMTemplate, pod *corev1.Pod) string {
+	var scope string
+	switch templateStateScope(cmTemplate) {
+	case cachev1alpha2.StateScopeOwner:
+		scope = hook.ownerIdentity(ctx, pod)
+	case cachev1alpha2.StateScopePod:
+		scope = podIdentity(pod)
+	}
+	return cmTemplate.CMStateName(scope, overridesHash(cmTemplate, pod))
+}
+
+// ownerIdentity returns the kind and name of the workload controlling the pod,
+// a Deployment rather than its ReplicaSet. Pods without a controller are
+// their own owner.
+func (hook *cmStateCreator) ownerIdentity(ctx context.Context, pod *corev1.Pod) string {
+	if owner := hook.resolveOwner(ctx, pod); owner != nil {
+		return strings.ToLower(owner.Kind) + "-" + owner.Name
+	}
+	// workload kinds an audience can't record still own their pods
+	if ref := metav1.GetControllerOf(pod); ref != nil {
+		return strings.ToLower(ref.Kind) + "-" + ref.Name
+	}
+	return podIdentity(pod)
+}
+
+// podIdentity returns the name of the pod. Pods named by the API server after
+// admission go by their generateName followed by the start of their member id,
+// which is stamped on the pod so a reinvocation names the same cmstate.
+func podIdentity(pod *corev1.Pod) string {
+	if pod.Name != "" {
+		return pod.Name
+	}
+	member := string(podMember(pod))
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[AudienceMemberAnnotation] = member
+	return pod.GenerateName + strings.ReplaceAll(member, "-", "")[:labelHashLength]
+}
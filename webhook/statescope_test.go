@@ -0,0 +1,158 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	"github.com/stollenaar/cmstate-injector-operator/webhook/testutil"
+)
+
+var _ = Describe("State scopes", func() {
+	ctx := context.Background()
+
+	scopedHook := func(scope cachev1alpha2.StateScope, objs ...client.Object) *cmStateCreator {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Spec.StateScope = scope
+		return newTestHook(append(objs, cmTemplate)...)
+	}
+
+	cmStates := func(hook *cmStateCreator) []cachev1alpha2.CMState {
+		list := &cachev1alpha2.CMStateList{}
+		Expect(hook.Client.List(ctx, list, client.InNamespace(testNamespace))).To(Succeed())
+		return list.Items
+	}
+
+	// replica returns a pod of the ReplicaSet as the API server sends it at
+	// admission, without a name yet
+	replica := func(replicaSet string) *corev1.Pod {
+		pod := newTestPod("")
+		pod.GenerateName = replicaSet + "-"
+		pod.UID = ""
+		pod.OwnerReferences = []metav1.OwnerReference{controllerRef("apps/v1", "ReplicaSet", replicaSet)}
+		return pod
+	}
+
+	// scopedName is the name of the cmstate of the owner or pod
+	scopedName := func(scope string) string {
+		return newTestTemplate().CMStateName(scope, "")
+	}
+
+	admit := func(hook *cmStateCreator, pod *corev1.Pod) *corev1.Pod {
+		out := review(hook, testutil.NewPodCreateRequest(pod))
+		Expect(out.Response.Allowed).To(BeTrue())
+		return applyPatch(pod, out)
+	}
+
+	It("shares a cmstate between the pods of a Deployment", func() {
+		hook := scopedHook(cachev1alpha2.StateScopeOwner,
+			&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+				Name:            "web-5d8f7",
+				Namespace:       testNamespace,
+				OwnerReferences: []metav1.OwnerReference{controllerRef("apps/v1", "Deployment", "web")},
+			}},
+		)
+
+		for i := 0; i < 2; i++ {
+			Expect(admit(hook, replica("web-5d8f7")).Annotations).To(HaveKeyWithValue(testTargetAnnotation, scopedName("deployment-web")))
+		}
+		admit(hook, replica("api-7c9d4"))
+
+		Expect(cmStates(hook)).To(ConsistOf(
+			And(
+				HaveField("Name", scopedName("deployment-web")),
+				HaveField("Spec.StateScope", cachev1alpha2.StateScopeOwner),
+				HaveField("Spec.Audience", ConsistOf(HaveField("Count", int32(2)))),
+			),
+			HaveField("Name", scopedName("replicaset-api-7c9d4")),
+		))
+	})
+
+	It("gives every pod a cmstate of its own", func() {
+		hook := scopedHook(cachev1alpha2.StateScopePod)
+
+		pod := admit(hook, newTestPod("app-1"))
+		admit(hook, newTestPod("app-2"))
+
+		Expect(cmStates(hook)).To(ConsistOf(
+			And(HaveField("Name", scopedName("app-1")), HaveField("Spec.StateScope", cachev1alpha2.StateScopePod)),
+			HaveField("Name", scopedName("app-2")),
+		))
+
+		Expect(review(hook, testutil.NewPodDeleteRequest(pod)).Response.Allowed).To(BeTrue())
+		cmState := &cachev1alpha2.CMState{}
+		Expect(hook.Client.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: scopedName("app-1")}, cmState)).To(Succeed())
+		Expect(cmState.Spec.Audience).To(BeEmpty())
+	})
+
+	It("names the cmstate of a pod named after admission by its member id", func() {
+		hook := scopedHook(cachev1alpha2.StateScopePod)
+
+		pod := replica("web-5d8f7")
+		created := admit(hook, pod)
+		Expect(created.Annotations).To(HaveKey(AudienceMemberAnnotation))
+		name := created.Annotations[testTargetAnnotation]
+		Expect(name).To(HavePrefix("cmstate-vault-agent-web-5d8f7-"))
+		Expect(admit(hook, replica("web-5d8f7")).Annotations[testTargetAnnotation]).NotTo(Equal(name))
+
+		// a reinvocation finds the cmstate it already joined
+		reinvoked := pod.DeepCopy()
+		reinvoked.Annotations = created.Annotations
+		Expect(review(hook, testutil.NewPodCreateRequest(reinvoked)).Response.Patch).To(BeEmpty())
+		Expect(cmStates(hook)).To(HaveLen(2))
+	})
+
+	It("appends the pod to the ConfigMap name of the template", func() {
+		hook := scopedHook(cachev1alpha2.StateScopePod)
+		cmTemplate := &cachev1alpha2.CMTemplate{}
+		Expect(hook.Client.Get(ctx, client.ObjectKey{Name: testTemplateName}, cmTemplate)).To(Succeed())
+		cmTemplate.Spec.ConfigMapName = "vault-agent-config"
+		Expect(hook.Client.Update(ctx, cmTemplate)).To(Succeed())
+
+		annotations := admit(hook, newTestPod("app-1")).Annotations
+		Expect(annotations[testTargetAnnotation]).To(HavePrefix("vault-agent-config-"))
+		Expect(annotations[testTargetAnnotation]).To(Equal(cmTemplate.ConfigMapName(annotations[CMStateAnnotation])))
+	})
+
+	It("keeps the cmstates of other templates and scopes apart", func() {
+		cmTemplate := newTestTemplate()
+		cmTemplate.Name = "vault"
+		Expect(cmTemplate.CMStateName("agent-app-1", "")).NotTo(Equal(scopedName("app-1")))
+		Expect(scopedName("app-1")).NotTo(Equal(newTestTemplate().CMStateName("app", "1")))
+		Expect(scopedName("app-1")).NotTo(Equal(newTestTemplate().CMStateName("", "app-1")))
+	})
+
+	It("denies pods whose cmstate name is taken by another template", func() {
+		cmState := newTestCMState()
+		cmState.Name = scopedName("app-1")
+		cmState.Spec.TemplateRef.Name = "vault"
+		hook := scopedHook(cachev1alpha2.StateScopePod, cmState)
+
+		out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+		Expect(out.Response.Allowed).To(BeFalse())
+		Expect(string(out.Response.Result.Reason)).To(ContainSubstring("is rendered from template 'vault'"))
+	})
+})
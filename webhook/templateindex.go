@@ -0,0 +1,145 @@
+package webhook
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// aliasField indexes CMTemplates by the aliases they go by, so resolving an
+// alias doesn't list every template
+const aliasField = "spec.aliases"
+
+// IndexAliases adds the index of CMTemplates by their aliases to the cache,
+// it has to be called before the cache starts
+func IndexAliases(ctx context.Context, indexer client.FieldIndexer) error {
+	return indexer.IndexField(ctx, &cachev1alpha2.CMTemplate{}, aliasField, templateAliases)
+}
+
+func templateAliases(obj client.Object) []string {
+	cmTemplate, ok := obj.(*cachev1alpha2.CMTemplate)
+	if !ok {
+		return nil
+	}
+	return cmTemplate.Spec.Aliases
+}
+
+// aliasedBy lists the CMTemplates going by the alias
+func aliasedBy(ctx context.Context, c client.Reader, alias string) ([]cachev1alpha2.CMTemplate, error) {
+	cmTemplates := &cachev1alpha2.CMTemplateList{}
+	if err := c.List(ctx, cmTemplates, client.MatchingFields{aliasField: alias}); err != nil {
+		return nil, err
+	}
+	return cmTemplates.Items, nil
+}
+
+// indexedTemplate is what the index keeps of a CMTemplate with a pod selector
+type indexedTemplate struct {
+	selector labels.Selector
+	targets  []string
+}
+
+// templateIndex keeps the pod selectors of all CMTemplates in memory, fed by
+// the CMTemplate informer, so admissions don't list templates.
+type templateIndex struct {
+	mu        sync.RWMutex
+	templates map[string]indexedTemplate
+}
+
+func newTemplateIndex() *templateIndex {
+	return &templateIndex{templates: make(map[string]indexedTemplate)}
+}
+
+// handler returns the informer event handler keeping the index up to date
+func (i *templateIndex) handler() toolscache.ResourceEventHandler {
+	return toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if cmTemplate, ok := obj.(*cachev1alpha2.CMTemplate); ok {
+				i.upsert(cmTemplate)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if cmTemplate, ok := obj.(*cachev1alpha2.CMTemplate); ok {
+				i.upsert(cmTemplate)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if cmTemplate, ok := obj.(*cachev1alpha2.CMTemplate); ok {
+				i.remove(cmTemplate.Name)
+			}
+		},
+	}
+}
+
+// upsert indexes the template, templates without a usable selector are dropped
+func (i *templateIndex) upsert(cmTemplate *cachev1alpha2.CMTemplate) {
+	var selector labels.Selector
+	if cmTemplate.Spec.PodSelector != nil {
+		var err error
+		selector, err = metav1.LabelSelectorAsSelector(cmTemplate.Spec.PodSelector)
+		if err != nil {
+			selector = nil
+		}
+	}
+	if selector == nil || selector.Empty() {
+		// an empty selector would match every pod in the cluster
+		i.remove(cmTemplate.Name)
+		return
+	}
+
+	targets := append([]string{}, cmTemplate.Spec.TargetAnnotations()...)
+	for _, output := range cmTemplate.Spec.Outputs {
+		targets = append(targets, output.TargetAnnotation)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.templates[cmTemplate.Name] = indexedTemplate{selector: selector, targets: targets}
+}
+
+func (i *templateIndex) remove(name string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.templates, name)
+}
+
+// match returns the templates selecting the pod labels, by name. When several
+// write the same target annotation the first by name wins.
+func (i *templateIndex) match(podLabels map[string]string) []string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var names []string
+	for name, t := range i.templates {
+		if t.selector.Matches(labels.Set(podLabels)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var matched []string
+	claimed := make(map[string]bool)
+	for _, name := range names {
+		conflict := false
+		for _, target := range i.templates[name].targets {
+			conflict = conflict || claimed[target]
+		}
+		if conflict {
+			continue
+		}
+		for _, target := range i.templates[name].targets {
+			claimed[target] = true
+		}
+		matched = append(matched, name)
+	}
+	return matched
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	"github.com/stollenaar/cmstate-injector-operator/webhook/testutil"
+)
+
+func newSelectingTemplate(name, target string, matchLabels map[string]string) *cachev1alpha2.CMTemplate {
+	cmTemplate := newTestTemplate()
+	cmTemplate.Name = name
+	cmTemplate.Spec.Template.TargetAnnotation = target
+	cmTemplate.Spec.PodSelector = &metav1.LabelSelector{MatchLabels: matchLabels}
+	return cmTemplate
+}
+
+var _ = Describe("templateIndex", func() {
+	var index *templateIndex
+
+	BeforeEach(func() {
+		index = newTemplateIndex()
+	})
+
+	It("follows template events", func() {
+		handler := index.handler()
+		app := newSelectingTemplate("app-config", "example.com/app", map[string]string{"app": "web"})
+
+		handler.OnAdd(app)
+		Expect(index.match(map[string]string{"app": "web"})).To(ConsistOf("app-config"))
+
+		updated := app.DeepCopy()
+		updated.Spec.PodSelector.MatchLabels = map[string]string{"app": "api"}
+		handler.OnUpdate(app, updated)
+		Expect(index.match(map[string]string{"app": "web"})).To(BeEmpty())
+
+		handler.OnDelete(toolscache.DeletedFinalStateUnknown{Key: "app-config", Obj: updated})
+		Expect(index.match(map[string]string{"app": "api"})).To(BeEmpty())
+	})
+
+	It("never indexes templates without a selector", func() {
+		index.upsert(newTestTemplate())
+		index.upsert(newSelectingTemplate("everything", "example.com/all", nil))
+
+		Expect(index.match(map[string]string{"app": "web"})).To(BeEmpty())
+	})
+
+	It("returns every match by name and lets the first win a shared target annotation", func() {
+		index.upsert(newSelectingTemplate("b-config", "example.com/config", map[string]string{"app": "web"}))
+		index.upsert(newSelectingTemplate("a-config", "example.com/config", map[string]string{"app": "web"}))
+		index.upsert(newSelectingTemplate("c-config", "example.com/other", map[string]string{"app": "web"}))
+
+		for i := 0; i < 5; i++ {
+			Expect(index.match(map[string]string{"app": "web"})).To(Equal([]string{"a-config", "c-config"}))
+		}
+	})
+})
+
+var _ = Describe("CMStateCreator with pod selectors", func() {
+	var hook *cmStateCreator
+
+	BeforeEach(func() {
+		appTemplate := newSelectingTemplate("app-config", "example.com/app-configmap", map[string]string{"app": "web"})
+		hook = newTestHook(newTestTemplate(), appTemplate)
+		hook.templates = newTemplateIndex()
+		hook.templates.upsert(appTemplate)
+	})
+
+	It("injects pods selected by their labels", func() {
+		pod := newTestPod("app-1")
+		delete(pod.Annotations, DefaultTriggerAnnotation)
+		pod.Labels = map[string]string{"app": "web"}
+
+		out := review(hook, testutil.NewPodCreateRequest(pod))
+		Expect(out.Response.Patch).NotTo(BeEmpty())
+		Expect(hook.Client.Get(context.Background(), types.NamespacedName{Namespace: testNamespace, Name: "cmstate-app-config"}, &cachev1alpha2.CMState{})).To(Succeed())
+	})
+
+	It("lets the annotation take precedence over selectors", func() {
+		pod := newTestPod("app-1")
+		pod.Labels = map[string]string{"app": "web"}
+
+		review(hook, testutil.NewPodCreateRequest(pod))
+		Expect(hook.Client.Get(context.Background(), types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, &cachev1alpha2.CMState{})).To(Succeed())
+		Expect(hook.Client.Get(context.Background(), types.NamespacedName{Namespace: testNamespace, Name: "cmstate-app-config"}, &cachev1alpha2.CMState{})).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,99 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"encoding/json"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PatchOperation is a single JSONPatch operation of an admission response
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// DecodePatch decodes the JSONPatch of an admission response. An empty patch
+// decodes to no operations.
+func DecodePatch(patch []byte) ([]PatchOperation, error) {
+	if len(patch) == 0 {
+		return nil, nil
+	}
+	var ops []PatchOperation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, errors.Wrap(err, "error decoding patch")
+	}
+	return ops, nil
+}
+
+// FindPatch returns the first operation on the path
+func FindPatch(ops []PatchOperation, path string) (PatchOperation, bool) {
+	for _, op := range ops {
+		if op.Path == path {
+			return op, true
+		}
+	}
+	return PatchOperation{}, false
+}
+
+// AnnotationPath is the JSONPatch path of a pod annotation, with the '~' and
+// '/' in the key escaped
+func AnnotationPath(key string) string {
+	return "/metadata/annotations/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// PatchValue decodes the value of an operation into the type it was encoded
+// from, such as the []corev1.Volume added to /spec/volumes
+func PatchValue[T any](op PatchOperation) (T, error) {
+	var value T
+	raw, err := json.Marshal(op.Value)
+	if err != nil {
+		return value, err
+	}
+	err = json.Unmarshal(raw, &value)
+	return value, err
+}
+
+// ApplyPatch returns the pod the API server ends up with after applying the
+// patch, which is what the webhook sees when it is reinvoked.
+func ApplyPatch(pod *corev1.Pod, patch []byte) (*corev1.Pod, error) {
+	patched := pod.DeepCopy()
+	if len(patch) == 0 {
+		return patched, nil
+	}
+
+	decoded, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding patch")
+	}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		return nil, err
+	}
+	raw, err = decoded.Apply(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "error applying patch")
+	}
+
+	patched = &corev1.Pod{}
+	return patched, json.Unmarshal(raw, patched)
+}
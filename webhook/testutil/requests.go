@@ -0,0 +1,106 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package testutil builds the admission requests the API server sends the pod
+// webhook and inspects the patches it answers with, for tests of the webhook
+// and of handlers built around it.
+package testutil
+
+import (
+	"encoding/json"
+	"fmt"
+
+	v1admission "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// NewPodCreateRequest builds the request admitting the creation of the pod,
+// which the API server sends as Object.
+func NewPodCreateRequest(pod *corev1.Pod) admission.Request {
+	req := newPodRequest(v1admission.Create, pod)
+	req.Object = RawPod(pod)
+	return req
+}
+
+// NewPodUpdateRequest builds the request admitting an update of oldPod into
+// pod, sent as OldObject and Object.
+func NewPodUpdateRequest(oldPod, pod *corev1.Pod) admission.Request {
+	req := newPodRequest(v1admission.Update, pod)
+	req.Object = RawPod(pod)
+	req.OldObject = RawPod(oldPod)
+	return req
+}
+
+// NewPodDeleteRequest builds the request admitting the deletion of the pod,
+// which the API server sends as OldObject.
+func NewPodDeleteRequest(pod *corev1.Pod) admission.Request {
+	req := newPodRequest(v1admission.Delete, pod)
+	req.OldObject = RawPod(pod)
+	return req
+}
+
+// NewPodEvictionRequest builds the request admitting the eviction of the pod,
+// as a node drain sends it. The Eviction sent as Object only names the pod.
+func NewPodEvictionRequest(pod *corev1.Pod) admission.Request {
+	req := newPodRequest(v1admission.Create, pod)
+	req.Kind = metav1.GroupVersionKind{Group: "policy", Version: "v1", Kind: "Eviction"}
+	req.SubResource = "eviction"
+	raw, err := json.Marshal(&policyv1.Eviction{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "policy/v1", Kind: "Eviction"},
+		ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+	})
+	if err != nil {
+		panic(fmt.Sprintf("encoding eviction of pod %s/%s: %s", pod.Namespace, pod.Name, err))
+	}
+	req.Object = runtime.RawExtension{Raw: raw}
+	return req
+}
+
+// DryRun marks the request as a dry run, as `kubectl apply --dry-run=server`
+// sends it.
+func DryRun(req admission.Request) admission.Request {
+	dryRun := true
+	req.DryRun = &dryRun
+	return req
+}
+
+// RawPod encodes the pod the way the API server embeds it in a request. It
+// panics when the pod can't be encoded, which only a broken test pod does.
+func RawPod(pod *corev1.Pod) runtime.RawExtension {
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		panic(fmt.Sprintf("encoding pod %s/%s: %s", pod.Namespace, pod.Name, err))
+	}
+	return runtime.RawExtension{Raw: raw}
+}
+
+func newPodRequest(op v1admission.Operation, pod *corev1.Pod) admission.Request {
+	return admission.Request{
+		AdmissionRequest: v1admission.AdmissionRequest{
+			UID:       types.UID("req-" + pod.Name),
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+			Operation: op,
+		},
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	v1admission "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newPod(name string) *corev1.Pod {
+	return &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Annotations: map[string]string{"example.com/config": "app"},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app"}}},
+	}
+}
+
+var _ = Describe("Pod requests", func() {
+	decode := func(raw []byte) *corev1.Pod {
+		pod := &corev1.Pod{}
+		Expect(json.Unmarshal(raw, pod)).To(Succeed())
+		return pod
+	}
+
+	It("sends a created pod as Object", func() {
+		req := NewPodCreateRequest(newPod("app-1"))
+		Expect(req.Operation).To(Equal(v1admission.Create))
+		Expect(req.Name).To(Equal("app-1"))
+		Expect(req.Namespace).To(Equal("default"))
+		Expect(req.Kind).To(Equal(metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}))
+		Expect(decode(req.Object.Raw)).To(Equal(newPod("app-1")))
+		Expect(req.OldObject.Raw).To(BeEmpty())
+	})
+
+	It("sends a deleted pod as OldObject", func() {
+		req := NewPodDeleteRequest(newPod("app-1"))
+		Expect(req.Operation).To(Equal(v1admission.Delete))
+		Expect(decode(req.OldObject.Raw)).To(Equal(newPod("app-1")))
+		Expect(req.Object.Raw).To(BeEmpty())
+	})
+
+	It("sends both sides of an update", func() {
+		updated := newPod("app-1")
+		updated.Labels = map[string]string{"version": "2"}
+
+		req := NewPodUpdateRequest(newPod("app-1"), updated)
+		Expect(req.Operation).To(Equal(v1admission.Update))
+		Expect(decode(req.Object.Raw)).To(Equal(updated))
+		Expect(decode(req.OldObject.Raw)).To(Equal(newPod("app-1")))
+	})
+
+	It("only names the pod in an eviction", func() {
+		req := NewPodEvictionRequest(newPod("app-1"))
+		Expect(req.Operation).To(Equal(v1admission.Create))
+		Expect(req.SubResource).To(Equal("eviction"))
+		Expect(req.Kind).To(Equal(metav1.GroupVersionKind{Group: "policy", Version: "v1", Kind: "Eviction"}))
+		Expect(req.Name).To(Equal("app-1"))
+
+		eviction := &policyv1.Eviction{}
+		Expect(json.Unmarshal(req.Object.Raw, eviction)).To(Succeed())
+		Expect(eviction.Name).To(Equal("app-1"))
+		Expect(eviction.Namespace).To(Equal("default"))
+	})
+
+	It("marks a dry run", func() {
+		req := DryRun(NewPodCreateRequest(newPod("app-1")))
+		Expect(req.DryRun).To(HaveValue(BeTrue()))
+	})
+})
+
+var _ = Describe("Patches", func() {
+	patch := []byte(`[
+		{"op": "add", "path": "/metadata/annotations/example.com~1configmap", "value": "cmstate-app"},
+		{"op": "add", "path": "/spec/volumes", "value": [{"name": "config", "configMap": {"name": "cmstate-app"}}]}
+	]`)
+
+	It("decodes the operations", func() {
+		ops, err := DecodePatch(patch)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ops).To(HaveLen(2))
+		Expect(ops[0]).To(Equal(PatchOperation{Op: "add", Path: AnnotationPath("example.com/configmap"), Value: "cmstate-app"}))
+
+		ops, err = DecodePatch(nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ops).To(BeEmpty())
+	})
+
+	It("decodes an operation's value into its type", func() {
+		ops, err := DecodePatch(patch)
+		Expect(err).NotTo(HaveOccurred())
+
+		op, ok := FindPatch(ops, "/spec/volumes")
+		Expect(ok).To(BeTrue())
+		volumes, err := PatchValue[[]corev1.Volume](op)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(volumes).To(ConsistOf(HaveField("ConfigMap.Name", "cmstate-app")))
+
+		_, ok = FindPatch(ops, "/spec/initContainers")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("applies the patch to a copy of the pod", func() {
+		pod := newPod("app-1")
+
+		patched, err := ApplyPatch(pod, patch)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(patched.Annotations).To(HaveKeyWithValue("example.com/configmap", "cmstate-app"))
+		Expect(patched.Spec.Volumes).To(HaveLen(1))
+		Expect(pod).To(Equal(newPod("app-1")))
+	})
+
+	It("fails on a patch that doesn't apply", func() {
+		_, err := ApplyPatch(newPod("app-1"), []byte(`[{"op": "replace", "path": "/spec/volumes/3", "value": {}}]`))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,58 @@
+package webhook
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultTLSMinVersion keeps TLS 1.0 and 1.1 away from the webhook server
+const DefaultTLSMinVersion = "1.2"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig returns the option applying the minimum version and cipher suites
+// to the webhook server's tls.Config. Only the secure suites Go implements are
+// accepted by their IANA name, TLS 1.3 suites can't be configured and always
+// stay enabled.
+func tlsConfig(minVersion string, cipherSuites []string) (func(*tls.Config), error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid TLS min version %q, must be 1.0, 1.1, 1.2 or 1.3", minVersion)
+	}
+
+	secure := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range cipherSuites {
+		id, ok := secure[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q, must be one of %s", name, strings.Join(sortedKeys(secure), ", "))
+		}
+		ids = append(ids, id)
+	}
+
+	return func(config *tls.Config) {
+		config.MinVersion = version
+		if len(ids) > 0 {
+			config.CipherSuites = ids
+		}
+	}, nil
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -2,27 +2,236 @@ package webhook
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
-	cachev1alpha1 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha1"
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
 	ctrl "sigs.k8s.io/controller-runtime"
 
 	v1admission "k8s.io/api/admission/v1"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
-// +kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=ignore,sideEffects=None,groups="",resources=pods,verbs=create;delete,versions=v1,name=cmstate-operator-webhook.spicedelver.me,admissionReviewVersions=v1
+// +kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=ignore,sideEffects=NoneOnDryRun,groups="",resources=pods;pods/ephemeralcontainers;pods/eviction,verbs=create;update;delete,versions=v1,name=cmstate-operator-webhook.spicedelver.me,admissionReviewVersions=v1;v1beta1
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups=apps,resources=replicasets;statefulsets;daemonsets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=replicationcontrollers,verbs=get;list;watch
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch
+
+// DefaultTriggerAnnotation is the pod annotation naming the CMTemplates to
+// inject when no other key is configured
+const DefaultTriggerAnnotation = "cache.spicedelver.me/cmtemplate"
+
+// InjectAnnotation set to "false" on a pod opts it out of injection, whatever
+// else selects it
+const InjectAnnotation = "cache.spicedelver.me/inject"
+
+// AudienceOwnerAnnotation records on a pod the workload it is tracked under in
+// the audience, as <kind>/<name>, so its deletion finds the same entry after
+// intermediate owners like ReplicaSets are gone
+const AudienceOwnerAnnotation = "cache.spicedelver.me/audience-owner"
+
+// AudienceMemberAnnotation records on a pod the id it is counted under in the
+// audience entry of its owner, for owners tracking their pods individually.
+// Pods of templates scoped to pods that are named after admission name their
+// cmstate after it.
+const AudienceMemberAnnotation = "cache.spicedelver.me/audience-member"
+
+// Annotations recording on an injected pod which operator injected it, with
+// which templates and into which cmstates, the last two as comma-separated
+// lists in the same order
+const (
+	InjectedByAnnotation    = "cache.spicedelver.me/injected-by"
+	TemplatesUsedAnnotation = "cache.spicedelver.me/cmtemplate-used"
+	CMStateAnnotation       = "cache.spicedelver.me/cmstate"
+)
+
+// InjectedContainersAnnotation records on an injected pod the containers the
+// templates mounted their volume into or added an envFrom reference to, as a
+// comma-separated list
+const InjectedContainersAnnotation = "cache.spicedelver.me/injected-containers"
+
+// NamespacedTemplatesAnnotation records on an injected pod the templates it
+// got from a NamespacedCMTemplate of its namespace, which take precedence
+// over the CMTemplates of the same name, as a comma-separated list
+const NamespacedTemplatesAnnotation = "cache.spicedelver.me/cmtemplate-namespaced"
+
+// ConfigChecksumAnnotation records on an injected pod a checksum of the
+// ConfigMap data its templates render to with its annotations, so changing
+// the content of a template changes the pods injected with it afterwards
+const ConfigChecksumAnnotation = "cache.spicedelver.me/config-checksum"
+
+// AudienceDeferredAnnotation marks a pod whose cmstates are created or joined
+// by the pod controller instead of during its admission
+const AudienceDeferredAnnotation = "cache.spicedelver.me/audience-deferred"
+
+// NamespaceDefaultTemplateAnnotation on a Namespace names the CMTemplates for
+// pods in it that don't name any themselves
+const NamespaceDefaultTemplateAnnotation = "cache.spicedelver.me/default-cmtemplate"
+
+// PodNamespaceEnv is the environment variable the operator's own namespace is
+// passed in through the downward API
+const PodNamespaceEnv = "POD_NAMESPACE"
+
+// systemNamespaces are never injected unless explicitly allowed, a failing
+// webhook there hurts the most during an outage
+var systemNamespaces = []string{"kube-system", "kube-node-lease"}
+
+// Annotations the kubelet sets on the static pods it read from a manifest file
+// or url, the config source is "api" for pods it got from the API server
+const (
+	kubeletConfigSourceAnnotation = "kubernetes.io/config.source"
+	kubeletConfigHashAnnotation   = "kubernetes.io/config.hash"
+	kubeletConfigSourceAPI        = "api"
+)
+
+// illegalLabelCharacters matches what may not appear in a label value
+var illegalLabelCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// labelHashLength is the number of hex characters of the hash appended to
+// sanitized label values and the names of cmstates with overrides
+const labelHashLength = 8
+
+// labelPlaceholder matches a pod label placeholder in a template name, e.g.
+// {app} in "{app}-vault"
+var labelPlaceholder = regexp.MustCompile(`\{[^{}]+\}`)
+
+// MissingTemplatePolicy decides what happens to a pod referencing a CMTemplate that doesn't exist
+type MissingTemplatePolicy string
+
+const (
+	// MissingTemplateWarn admits the pod without the injection and warns about it
+	MissingTemplateWarn MissingTemplatePolicy = "Warn"
+	// MissingTemplateDeny denies the pod until the template exists
+	MissingTemplateDeny MissingTemplatePolicy = "Deny"
+)
+
+// TimeoutPolicy decides what happens to a pod whose admission ran out of time
+type TimeoutPolicy string
+
+const (
+	// TimeoutWarn admits the pod with a warning, it may be missing injections
+	TimeoutWarn TimeoutPolicy = "Warn"
+	// TimeoutError returns an error and leaves the decision to the webhook's failurePolicy
+	TimeoutError TimeoutPolicy = "Error"
+)
+
+// CMStateWrites decides where the cmstates of an admitted pod are written
+type CMStateWrites string
+
+const (
+	// CMStateWritesAdmission creates or joins the cmstate while admitting the pod
+	CMStateWritesAdmission CMStateWrites = "admission"
+	// CMStateWritesController only stamps the pod at admission, a controller
+	// watching pods creates or joins the cmstate afterwards
+	CMStateWritesController CMStateWrites = "controller"
+)
+
+// DefaultTimeout keeps the handler just under the API server's default webhook timeout of 10s
+const DefaultTimeout = 8 * time.Second
+
+const (
+	// DefaultWebhookPath is the path the webhook is served on, it has to match
+	// the path of the kubebuilder marker above
+	DefaultWebhookPath = "/mutate-v1-pod"
+	// DefaultWebhookPort is the port the webhook server listens on
+	DefaultWebhookPort = 9443
+)
+
+// Options configures the pod webhook
+type Options struct {
+	// TriggerAnnotation is the pod annotation naming the CMTemplates to inject
+	TriggerAnnotation string
+	// InjectNamespaces are glob patterns of the namespaces to inject pods in,
+	// all namespaces are enabled when empty
+	InjectNamespaces []string
+	// ExcludeNamespaces are glob patterns of namespaces never to inject pods in,
+	// they take precedence over InjectNamespaces
+	ExcludeNamespaces []string
+	// NamespaceSelector is a label selector the pod namespace has to match
+	NamespaceSelector string
+	// AllowSystemNamespaces enables injection in kube-system, kube-node-lease
+	// and the operator's own namespace
+	AllowSystemNamespaces bool
+	// MissingTemplatePolicy decides whether pods referencing a missing
+	// CMTemplate are denied or admitted with a warning
+	MissingTemplatePolicy MissingTemplatePolicy
+	// Timeout bounds the API calls made for a single admission, it should stay
+	// below the timeoutSeconds of the MutatingWebhookConfiguration
+	Timeout time.Duration
+	// TimeoutPolicy decides whether an admission running out of time is
+	// admitted with a warning or returns an error
+	TimeoutPolicy TimeoutPolicy
+	// NamespaceDefaultTemplate lets the namespace default-cmtemplate annotation
+	// apply to pods without a trigger annotation
+	NamespaceDefaultTemplate bool
+	// Version of the operator, recorded on the pods it injected
+	Version string
+	// MutationMode decides whether pods are mutated or the mutations only
+	// logged, to shadow a rollout
+	MutationMode MutationMode
+	// CMStateWrites decides whether the cmstate is written during admission or
+	// by the pod controller afterwards
+	CMStateWrites CMStateWrites
+	// MaxAudienceSize is the number of pods a cmstate lists before new ones are
+	// denied, 0 disables the limit
+	MaxAudienceSize int
+	// AudienceSizeWarning is the number of pods above which admissions warn
+	// about the size of the audience, 0 disables the warning
+	AudienceSizeWarning int
+	// Path is the path the webhook is served on
+	Path string
+	// Port is the port the webhook server listens on
+	Port int
+	// CertDir is the directory holding the serving certificate, the webhook
+	// server's default is used when empty
+	CertDir string
+	// TLSMinVersion is the lowest TLS version the webhook server accepts
+	TLSMinVersion string
+	// TLSCipherSuites are the IANA names of the cipher suites the webhook
+	// server accepts below TLS 1.3, Go's defaults are used when empty
+	TLSCipherSuites []string
+	// BreakerThreshold is the number of consecutive cmstate write failures
+	// that suspend the writes, pods are admitted without injection meanwhile.
+	// 0 disables the breaker.
+	BreakerThreshold int
+	// BreakerWindow is the window the failures have to happen in
+	BreakerWindow time.Duration
+	// BreakerCooldown is how long the writes stay suspended
+	BreakerCooldown time.Duration
+	// AllowCrossNamespaceDataFrom lets the dataFrom of templates read
+	// ConfigMaps in other namespaces than the one of the pod, it has to match
+	// the controller's
+	AllowCrossNamespaceDataFrom bool
+	// MaxBaseTemplateDepth is how many base templates a template may inherit
+	// from through spec.baseTemplate, it has to match the controller's
+	MaxBaseTemplateDepth int
+}
 
 type PatchOperation struct {
 	Op    string      `json:"op"`
@@ -31,185 +240,1695 @@ type PatchOperation struct {
 }
 
 type cmStateCreator struct {
-	Client  client.Client
-	decoder *admission.Decoder
+	Client client.Client
+	// APIReader reads straight from the API server, it double checks CMStates
+	// the cache reports missing
+	APIReader client.Reader
+	Options   Options
+	// Recorder records the outcome of the injection as events on the pod
+	Recorder          record.EventRecorder
+	namespaceSelector labels.Selector
+	excludedSystem    []string
+	// templates indexes the CMTemplate pod selectors, nil disables label selection
+	templates *templateIndex
+	decoder   *admission.Decoder
+	// logOnly marks the copy evaluating a request in log-only mode, its
+	// mutations are counted as decisions it would have made
+	logOnly bool
+	// breaker suspends cmstate writes while they keep failing, nil never does
+	breaker *circuitBreaker
+	// logOnlyBreaker suspends the dry run writes of log-only mode, which only
+	// share the API server with the enforcing writes
+	logOnlyBreaker *circuitBreaker
+	// operatorNamespace receives the events about the webhook itself
+	operatorNamespace string
 }
 
-func CMStateCreator(mgr ctrl.Manager) error {
+func CMStateCreator(mgr ctrl.Manager, opts Options) error {
+	if opts.TriggerAnnotation == "" {
+		opts.TriggerAnnotation = DefaultTriggerAnnotation
+	}
+	if err := validateTriggerAnnotation(opts.TriggerAnnotation); err != nil {
+		return err
+	}
+	switch opts.MissingTemplatePolicy {
+	case "":
+		opts.MissingTemplatePolicy = MissingTemplateWarn
+	case MissingTemplateWarn, MissingTemplateDeny:
+	default:
+		return fmt.Errorf("invalid missing template policy %q, must be %s or %s", opts.MissingTemplatePolicy, MissingTemplateWarn, MissingTemplateDeny)
+	}
+	if opts.Path == "" {
+		opts.Path = DefaultWebhookPath
+	}
+	if !strings.HasPrefix(opts.Path, "/") {
+		return fmt.Errorf("invalid webhook path %q, must start with /", opts.Path)
+	}
+	if opts.Port == 0 {
+		opts.Port = DefaultWebhookPort
+	}
+	if opts.Port < 0 || opts.Port > 65535 {
+		return fmt.Errorf("invalid webhook port %d", opts.Port)
+	}
+	if opts.BreakerThreshold < 0 {
+		return fmt.Errorf("invalid breaker threshold %d, must not be negative", opts.BreakerThreshold)
+	}
+	if opts.BreakerWindow <= 0 {
+		opts.BreakerWindow = DefaultBreakerWindow
+	}
+	if opts.BreakerCooldown <= 0 {
+		opts.BreakerCooldown = DefaultBreakerCooldown
+	}
+	if opts.TLSMinVersion == "" {
+		opts.TLSMinVersion = DefaultTLSMinVersion
+	}
+	tlsOpt, err := tlsConfig(opts.TLSMinVersion, opts.TLSCipherSuites)
+	if err != nil {
+		return err
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	switch opts.TimeoutPolicy {
+	case "":
+		opts.TimeoutPolicy = TimeoutWarn
+	case TimeoutWarn, TimeoutError:
+	default:
+		return fmt.Errorf("invalid timeout policy %q, must be %s or %s", opts.TimeoutPolicy, TimeoutWarn, TimeoutError)
+	}
+	switch opts.MutationMode {
+	case "":
+		opts.MutationMode = MutationEnforce
+	case MutationEnforce, MutationLogOnly:
+	default:
+		return fmt.Errorf("invalid mutation mode %q, must be %s or %s", opts.MutationMode, MutationEnforce, MutationLogOnly)
+	}
+	switch opts.CMStateWrites {
+	case "":
+		opts.CMStateWrites = CMStateWritesAdmission
+	case CMStateWritesAdmission, CMStateWritesController:
+	default:
+		return fmt.Errorf("invalid cmstate writes %q, must be %s or %s", opts.CMStateWrites, CMStateWritesAdmission, CMStateWritesController)
+	}
+	if opts.MaxAudienceSize < 0 || opts.AudienceSizeWarning < 0 {
+		return fmt.Errorf("invalid audience size limits %d and %d, must not be negative", opts.MaxAudienceSize, opts.AudienceSizeWarning)
+	}
+	if opts.MaxAudienceSize > 0 && opts.AudienceSizeWarning > opts.MaxAudienceSize {
+		return fmt.Errorf("invalid audience size warning %d, must not exceed the limit of %d", opts.AudienceSizeWarning, opts.MaxAudienceSize)
+	}
+	if opts.AudienceSizeWarning == 0 {
+		opts.AudienceSizeWarning = opts.MaxAudienceSize * 4 / 5
+	}
+	namespaceSelector, err := parseNamespaceScope(append(opts.InjectNamespaces, opts.ExcludeNamespaces...), opts.NamespaceSelector)
+	if err != nil {
+		return err
+	}
+
+	// The decoder is built up front so the handler never depends on the
+	// webhook server injecting one before the first request comes in.
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return errors.Wrap(err, "error creating admission decoder")
+	}
+
+	// CMTemplates are read through the manager's cache, start their informer
+	// with the manager instead of lazily on the first admission
+	informer, err := mgr.GetCache().GetInformer(context.Background(), &cachev1alpha2.CMTemplate{})
+	if err != nil {
+		return errors.Wrap(err, "error creating cmtemplate informer")
+	}
+	templates := newTemplateIndex()
+	if _, err := informer.AddEventHandler(templates.handler()); err != nil {
+		return errors.Wrap(err, "error watching cmtemplates")
+	}
+
+	hook := &cmStateCreator{
+		Client:            mgr.GetClient(),
+		APIReader:         mgr.GetAPIReader(),
+		Options:           opts,
+		Recorder:          mgr.GetEventRecorderFor(eventSource),
+		namespaceSelector: namespaceSelector,
+		excludedSystem:    excludedSystemNamespaces(opts),
+		templates:         templates,
+		decoder:           decoder,
+		operatorNamespace: os.Getenv(PodNamespaceEnv),
+	}
+	if opts.BreakerThreshold > 0 {
+		hook.breaker = newCircuitBreaker(opts.BreakerThreshold, opts.BreakerWindow, opts.BreakerCooldown)
+		hook.logOnlyBreaker = newCircuitBreaker(opts.BreakerThreshold, opts.BreakerWindow, opts.BreakerCooldown)
+	}
+	if opts.CMStateWrites == CMStateWritesController {
+		if err := setupAudienceController(mgr, hook); err != nil {
+			return errors.Wrap(err, "error creating pod audience controller")
+		}
+	}
+
+	// the server only reads its address and certificates once the manager starts it
 	hookServer := mgr.GetWebhookServer()
-	hookServer.Register("/mutate-v1-pod", &webhook.Admission{Handler: &cmStateCreator{Client: mgr.GetClient()}})
+	hookServer.Port = opts.Port
+	if opts.CertDir != "" {
+		hookServer.CertDir = opts.CertDir
+	}
+	hookServer.TLSOpts = append(hookServer.TLSOpts, tlsOpt)
+	hookServer.Register(opts.Path, &webhook.Admission{Handler: hook})
+	return nil
+}
+
+// validateTriggerAnnotation checks the trigger annotation is a valid
+// annotation key
+func validateTriggerAnnotation(key string) error {
+	if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+		return fmt.Errorf("invalid trigger annotation %q: %s", key, strings.Join(errs, ", "))
+	}
 	return nil
 }
 
+// parseNamespaceScope checks the namespace patterns and parses the namespace
+// selector, nil when there is none
+func parseNamespaceScope(patterns []string, namespaceSelector string) (labels.Selector, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid namespace pattern %q: %s", pattern, err)
+		}
+	}
+	if namespaceSelector == "" {
+		return nil, nil
+	}
+	selector, err := labels.Parse(namespaceSelector)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid namespace selector")
+	}
+	return selector, nil
+}
+
+// CacheSyncedCheck reports ready once the informer cache has synced, so
+// admissions only arrive when CMTemplate reads are cache hits.
+func CacheSyncedCheck(c cache.Cache) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), time.Second)
+		defer cancel()
+		if !c.WaitForCacheSync(ctx) {
+			return errors.New("informer cache not synced yet")
+		}
+		return nil
+	}
+}
+
 // cmStateCreator creates the cmstate if needed or patches the audience.
+// A response returned by the inner handlers always wins, the error next to it
+// is only logged. An error without a response becomes a 500 so the API server
+// applies the failure policy.
 func (hook *cmStateCreator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	start := time.Now()
+	defer func() {
+		admissionDuration.WithLabelValues(string(req.Operation)).Observe(time.Since(start).Seconds())
+	}()
+
+	if hook.Options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hook.Options.Timeout)
+		defer cancel()
+	}
+
 	resp, err := hook.handleInner(ctx, req)
+	if ctx.Err() == context.DeadlineExceeded {
+		// nobody is waiting for the outcome anymore, whatever was decided
+		recordError(errorTimeout)
+		ctrl.Log.WithName("webhooks").WithName("CMStateCreator").Error(err, "Request timed out", "timeout", hook.Options.Timeout)
+		if hook.Options.TimeoutPolicy == TimeoutError && hook.Options.MutationMode != MutationLogOnly {
+			return admission.Errored(http.StatusGatewayTimeout, errors.Errorf("timed out after %s", hook.Options.Timeout))
+		}
+		return admission.Allowed("skipping cmstate check due to timeout").
+			WithWarnings(warnf("timed out after %s, pod admitted without injection", hook.Options.Timeout))
+	}
+	if resp != nil {
+		if err != nil {
+			ctrl.Log.WithName("webhooks").WithName("CMStateCreator").Error(err, "Request denied", "reason", resp.Result.Reason)
+		}
+		return *resp
+	}
 	if err != nil {
+		recordAdmission(req.Operation, decisionErrored, "")
 		return admission.Errored(http.StatusInternalServerError, err)
 	}
-	return *resp
+	return admission.Allowed("")
+}
+
+// skip admits the pod untouched, for requests that don't concern any template
+func skip(req admission.Request, reason string) *admission.Response {
+	recordAdmission(req.Operation, decisionSkipped, "")
+	resp := admission.Allowed(reason)
+	return &resp
 }
 
 func (hook *cmStateCreator) handleInner(ctx context.Context, req admission.Request) (*admission.Response, error) {
 	log := ctrl.Log.WithName("webhooks").WithName("CMStateCreator")
+	if hook.Options.MutationMode == MutationLogOnly {
+		return hook.handleLogOnly(ctx, req)
+	}
+
+	if _, guarded := hook.Client.(*dryRunClient); isDryRun(req) && !guarded {
+		// the webhook declares NoneOnDryRun, whatever a handler misses
+		// writing on a dry run is dropped. The writes it drops say nothing
+		// about the API server, so they stay out of the breaker.
+		shadow := *hook
+		shadow.Client = &dryRunClient{Client: hook.Client, log: log}
+		shadow.breaker = nil
+		return shadow.handleInner(ctx, req)
+	}
+
+	if req.SubResource == evictionSubResource && req.Operation != v1admission.Delete {
+		return hook.handleEviction(ctx, req)
+	}
+	if req.SubResource != "" && req.SubResource != evictionSubResource {
+		// kubectl debug adds ephemeral containers through their own subresource,
+		// which can't touch annotations or the cmstate. Older API servers send an
+		// EphemeralContainers object there, so don't decode it as a pod.
+		return skip(req, fmt.Sprintf("skipping cmstate check for the %s subresource", req.SubResource)), nil
+	}
 
 	var err error
 	pod := &corev1.Pod{}
-	if req.Operation == v1admission.Create {
+	oldPod := &corev1.Pod{}
+	switch req.Operation {
+	case v1admission.Create:
 		err = hook.decoder.Decode(req, pod)
-	} else if req.Operation == v1admission.Delete {
-		err = hook.decoder.DecodeRaw(req.OldObject, pod)
-	} else {
-		resp := admission.Allowed("skipping cmstate check due to bad operation")
-		return &resp, nil
+	case v1admission.Update:
+		err = hook.decoder.Decode(req, pod)
+		if err == nil {
+			err = hook.decoder.DecodeRaw(req.OldObject, oldPod)
+		}
+	case v1admission.Delete:
+		err = hook.decodeDeletedPod(ctx, req, pod)
+	default:
+		return skip(req, "skipping cmstate check due to bad operation"), nil
 	}
 	if err != nil {
+		recordError(errorDecode)
 		log.Error(err, "Error decoding request into Pod")
 		return nil, errors.Wrap(err, "error decoding request into Pod")
 	}
 
-	cmState := &cachev1alpha1.CMState{}
-	cmTemplate := &cachev1alpha1.CMTemplate{}
-	if pod.Annotations["cache.spicedelver.me/cmtemplate"] != "" {
+	if kubeletOwned(pod) {
+		// nothing would ever remove the audience entries of these pods
+		return skip(req, "skipping cmstate check due to static or mirror pod"), nil
+	}
+	if optedOut(pod) {
+		if req.Operation == v1admission.Delete {
+			hook.warnOptedOutAudience(ctx, pod)
+		}
+		return hook.skipPod(req, pod, fmt.Sprintf("skipping cmstate check due to %s annotation", InjectAnnotation)), nil
+	}
+	if req.Operation != v1admission.Delete && pod.DeletionTimestamp != nil {
+		return skip(req, "skipping cmstate check due to terminating pod"), nil
+	}
+	// generateName pods can come without a namespace, the request always has it
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+	if hook.isSystemNamespace(pod.Namespace) {
+		log.Info("Skipping pod in system namespace", "namespace", pod.Namespace, "name", audienceName(pod))
+		return hook.skipPod(req, pod, fmt.Sprintf("skipping cmstate check due to system namespace '%s'", pod.Namespace)), nil
+	}
+	if !hook.namespaceEnabled(pod.Namespace) {
+		return hook.skipPod(req, pod, "skipping cmstate check due to namespace not enabled"), nil
+	}
 
-		crdName := generateName(pod.Annotations["cache.spicedelver.me/cmtemplate"])
-		err = hook.Client.Get(
-			ctx,
-			types.NamespacedName{
-				Namespace: pod.Namespace,
-				Name:      crdName,
-			},
-			cmState,
-		)
+	namespace, err := hook.fetchNamespace(ctx, pod.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if namespace == nil || namespace.Status.Phase == corev1.NamespaceTerminating {
+		return hook.skipPod(req, pod, "skipping cmstate check due to terminating namespace"), nil
+	}
+	if hook.namespaceSelector != nil && !hook.namespaceSelector.Matches(labels.Set(namespace.Labels)) {
+		return hook.skipPod(req, pod, "skipping cmstate check due to namespace not enabled"), nil
+	}
 
-		if err != nil && !apierrors.IsNotFound(err) {
-			log.Error(err, "fetching cmstate has resulted in an error")
-			return nil, errors.Wrap(err, "fetching cmstate has resulted in an error")
+	if req.Operation == v1admission.Update {
+		return hook.handlePodUpdate(req, oldPod, pod, ctx)
+	}
+
+	templates, err := hook.resolveTemplateNames(pod)
+	if err != nil && req.Operation == v1admission.Create {
+		recordAdmission(req.Operation, decisionDenied, "")
+		hook.event(req, pod, corev1.EventTypeWarning, eventInjectionFailed, "Injection failed: %s", err)
+		resp := admission.Denied(fmt.Sprintf("cmstate-injector: %s", err))
+		return &resp, nil
+	}
+	if len(templates) == 0 && req.Operation == v1admission.Create && hook.templates != nil {
+		templates = hook.templates.match(pod.Labels)
+	}
+	if len(templates) == 0 && req.Operation == v1admission.Create && hook.Options.NamespaceDefaultTemplate {
+		templates = splitTemplateNames(namespace.Annotations[NamespaceDefaultTemplateAnnotation])
+	}
+	if len(templates) == 0 {
+		resp := skip(req, "skipping cmstate check due to missing annotation")
+		if _, ok := pod.Annotations[hook.Options.TriggerAnnotation]; ok && req.Operation == v1admission.Create {
+			*resp = resp.WithWarnings(warnf("annotation '%s' is empty, pod admitted without injection", hook.Options.TriggerAnnotation))
+			hook.event(req, pod, corev1.EventTypeWarning, eventInjectionSkipped, "Injection skipped: annotation '%s' is empty", hook.Options.TriggerAnnotation)
 		}
-		err = hook.Client.Get(
-			ctx,
-			types.NamespacedName{
-				Name: pod.Annotations["cache.spicedelver.me/cmtemplate"],
-			},
-			cmTemplate,
-		)
+		return resp, nil
+	}
+	if req.Operation == v1admission.Create {
+		return hook.handlePodCreate(req, templates, pod, ctx)
+	}
+	if isDryRun(req) {
+		resp := skip(req, "skipping cmstate patch due to dry run").WithWarnings(warnf("dry run, cmstate audience not updated"))
+		return &resp, nil
+	}
+	return hook.handlePodDelete(req, templates, pod, ctx)
+}
+
+// kubeletOwned reports whether the pod is a static pod or its mirror. The
+// kubelet owns those, they carry its annotations, are controlled by their node
+// and named after it. Deleted pods come without a spec, their mirror
+// annotation tells them apart.
+func kubeletOwned(pod *corev1.Pod) bool {
+	if _, ok := pod.Annotations[corev1.MirrorPodAnnotationKey]; ok {
+		return true
+	}
+	if source, ok := pod.Annotations[kubeletConfigSourceAnnotation]; ok && source != kubeletConfigSourceAPI {
+		return true
+	}
+	if owner := metav1.GetControllerOf(pod); owner != nil && owner.Kind == "Node" && owner.APIVersion == "v1" {
+		return true
+	}
+	_, hashed := pod.Annotations[kubeletConfigHashAnnotation]
+	return hashed && pod.Spec.NodeName != "" && strings.HasSuffix(pod.Name, "-"+pod.Spec.NodeName)
+}
+
+// optedOut reports whether the pod opted out of injection
+func optedOut(pod *corev1.Pod) bool {
+	return strings.EqualFold(pod.Annotations[InjectAnnotation], "false")
+}
+
+// warnOptedOutAudience logs the audiences an opted-out pod somehow ended up
+// in. They are left alone, patching them for pods that never should have
+// been there only causes churn.
+func (hook *cmStateCreator) warnOptedOutAudience(ctx context.Context, pod *corev1.Pod) {
+	log := ctrl.Log.WithName("webhooks").WithName("CMStateCreator")
+	for _, name := range hook.templateNames(pod) {
+		cmState, err := hook.lookupCMState(ctx, pod.Namespace, name)
+		if err != nil || cmState.Name == "" {
+			continue
+		}
+		if findIndex(cmState.Spec.Audience, pod.GetUID(), audienceName(pod)) != -1 {
+			log.Info("Opted-out pod found in cmstate audience, leaving it", "cmstate", cmState.Name, "namespace", pod.Namespace, "name", audienceName(pod))
+		}
+	}
+}
+
+// excludedSystemNamespaces returns the namespaces skipped by default, including
+// the operator's own namespace when it is known
+func excludedSystemNamespaces(opts Options) []string {
+	if opts.AllowSystemNamespaces {
+		return nil
+	}
+	namespaces := append([]string{}, systemNamespaces...)
+	if self := os.Getenv(PodNamespaceEnv); self != "" {
+		namespaces = append(namespaces, self)
+	}
+	return namespaces
+}
+
+func (hook *cmStateCreator) isSystemNamespace(name string) bool {
+	for _, namespace := range hook.excludedSystem {
+		if namespace == name {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceEnabled checks the namespace name against the include and exclude patterns
+func (hook *cmStateCreator) namespaceEnabled(name string) bool {
+	for _, pattern := range hook.Options.ExcludeNamespaces {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+	if len(hook.Options.InjectNamespaces) == 0 {
+		return true
+	}
+	for _, pattern := range hook.Options.InjectNamespaces {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchNamespace returns the pod namespace, or nil when it is already gone.
+// Creating or patching cmstates in a namespace being torn down would only fail.
+func (hook *cmStateCreator) fetchNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	namespace := &corev1.Namespace{}
+	err := hook.Client.Get(ctx, types.NamespacedName{Name: name}, namespace)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		recordError(errorNamespaceLookup)
+		return nil, errors.Wrap(err, "error fetching namespace")
+	}
+	return namespace, nil
+}
+
+// namespaceAllowed reports whether pods of the namespace may use the template,
+// the namespace is only read when the template selects namespaces by label
+func (hook *cmStateCreator) namespaceAllowed(ctx context.Context, cmTemplate *cachev1alpha2.CMTemplate, name string) (bool, error) {
+	var namespaceLabels map[string]string
+	if cmTemplate.Spec.SelectsNamespaces() {
+		namespace, err := hook.fetchNamespace(ctx, name)
+		if err != nil {
+			return false, err
+		}
+		if namespace != nil {
+			namespaceLabels = namespace.Labels
+		}
+	}
+	return cmTemplate.Spec.NamespaceAllowed(name, namespaceLabels), nil
+}
+
+// warnf formats an admission warning, prefixed so users can tell where it came from
+func warnf(format string, args ...interface{}) string {
+	return "cmstate-injector: " + fmt.Sprintf(format, args...)
+}
+
+// isDryRun reports whether the request must not have side effects, e.g. from
+// kubectl apply --dry-run=server
+func isDryRun(req admission.Request) bool {
+	return req.DryRun != nil && *req.DryRun
+}
+
+// dryRunClient drops every write of a dry run, logging the object it would
+// have written. Reads go straight through.
+type dryRunClient struct {
+	client.Client
+	log logr.Logger
+}
+
+func (c *dryRunClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	c.log.Info("Skipping create on dry run", "objectNamespace", obj.GetNamespace(), "objectName", obj.GetName())
+	return nil
+}
+
+func (c *dryRunClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	c.log.Info("Skipping update on dry run", "objectNamespace", obj.GetNamespace(), "objectName", obj.GetName())
+	return nil
+}
+
+func (c *dryRunClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	c.log.Info("Skipping patch on dry run", "objectNamespace", obj.GetNamespace(), "objectName", obj.GetName())
+	return nil
+}
+
+func (c *dryRunClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	c.log.Info("Skipping delete on dry run", "objectNamespace", obj.GetNamespace(), "objectName", obj.GetName())
+	return nil
+}
+
+// templateNames returns the CMTemplates the pod asks for, the annotation holds
+// a comma-separated list of template names. Names referencing a label the pod
+// doesn't have are left out, resolveTemplateNames reports them.
+func (hook *cmStateCreator) templateNames(pod *corev1.Pod) []string {
+	names, _ := hook.resolveTemplateNames(pod)
+	return names
+}
+
+// resolveTemplateNames returns the CMTemplates the pod asks for with the label
+// placeholders in their names, like {app} in "{app}-vault", filled in from the
+// pod's labels. An error names the first placeholder the pod has no label for.
+func (hook *cmStateCreator) resolveTemplateNames(pod *corev1.Pod) ([]string, error) {
+	var names []string
+	var missing error
+	seen := make(map[string]bool)
+	for _, name := range splitTemplateNames(pod.Annotations[hook.Options.TriggerAnnotation]) {
+		resolved := true
+		expanded := labelPlaceholder.ReplaceAllStringFunc(name, func(placeholder string) string {
+			key := placeholder[1 : len(placeholder)-1]
+			value, ok := pod.Labels[key]
+			if !ok && resolved {
+				resolved = false
+				if missing == nil {
+					missing = fmt.Errorf("template '%s' references label '%s' the pod doesn't have", name, key)
+				}
+			}
+			return value
+		})
+		if !resolved || seen[expanded] {
+			continue
+		}
+		seen[expanded] = true
+		names = append(names, expanded)
+	}
+	return names, missing
+}
+
+// splitTemplateNames splits a comma-separated list of template names, dropping
+// empty and duplicate entries
+func splitTemplateNames(value string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// fetchState fetches the CMState of the pod's namespace for the template, and
+// the template itself. A missing CMState is returned empty and a missing
+// template as nil, only genuine API failures are returned as errors.
+func (hook *cmStateCreator) fetchState(ctx context.Context, pod *corev1.Pod, templateName string) (*cachev1alpha2.CMState, *cachev1alpha2.CMTemplate, error) {
+	log := ctrl.Log.WithName("webhooks").WithName("CMStateCreator")
+
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	err := hook.getCMTemplate(ctx, pod.Namespace, templateName, cmTemplate)
+	// a template being deleted counts as missing, new pods can't hold it up
+	if apierrors.IsNotFound(err) || (err == nil && cmTemplate.DeletionTimestamp != nil) {
+		cmState, err := hook.lookupCMState(ctx, pod.Namespace, templateName)
+		return cmState, nil, err
+	}
+	if err != nil {
+		recordError(errorCMTemplateLookup)
+		log.Error(err, "fetching cmtemplate has resulted in an error")
+		return nil, nil, errors.Wrap(err, "fetching cmtemplate has resulted in an error")
+	}
+
+	var cmState *cachev1alpha2.CMState
+	if cmTemplate.Scope() == cachev1alpha2.TemplateScopeNamespaced {
+		cmState, err = hook.fetchCMState(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: cmTemplate.CMStateName("", "")})
+	} else {
+		// pods asking for an alias share the cmstate of the template
+		cmState, err = hook.lookupCMState(ctx, pod.Namespace, cmTemplate.Name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := hook.resolveBase(ctx, cmTemplate); err != nil {
+		return nil, nil, err
+	}
+	if err := hook.resolveDataFrom(ctx, cmTemplate, pod.Namespace); err != nil {
+		return nil, nil, err
+	}
+	if name := hook.cmStateNameFor(ctx, cmTemplate, pod); name != cmTemplate.CMStateName("", "") {
+		// the pod's owner, the pod itself or its overrides render a ConfigMap
+		// of their own
+		cmState, err = hook.fetchCMState(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: name})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if cmState.Name != "" && cmState.Spec.TemplateRef.Name != cmTemplate.Name {
+		// joining it would inject the pod with the ConfigMap of another template
+		return nil, nil, errors.Wrapf(errForeignCMState, "cmstate '%s' is rendered from template '%s'", cmState.Name, cmState.Spec.TemplateRef.Name)
+	}
+	return cmState, cmTemplate, nil
+}
+
+// getCMTemplate fetches the template the pods of the namespace get under the
+// name, the NamespacedCMTemplate of the namespace taking precedence over the
+// CMTemplate and the CMTemplate over one with the name as alias. It is
+// returned as a CMTemplate keeping the namespace, under its own name.
+func (hook *cmStateCreator) getCMTemplate(ctx context.Context, namespace, name string, cmTemplate *cachev1alpha2.CMTemplate) error {
+	namespaced := &cachev1alpha2.NamespacedCMTemplate{}
+	err := hook.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, namespaced)
+	if err == nil {
+		*cmTemplate = *namespaced.CMTemplate()
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+	err = hook.Client.Get(ctx, types.NamespacedName{Name: name}, cmTemplate)
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+	return hook.getAliasedCMTemplate(ctx, name, cmTemplate)
+}
+
+// getAliasedCMTemplate fetches the CMTemplate going by the alias, the
+// validating webhook keeps aliases unique. None is a NotFound error.
+func (hook *cmStateCreator) getAliasedCMTemplate(ctx context.Context, alias string, cmTemplate *cachev1alpha2.CMTemplate) error {
+	aliased, err := aliasedBy(ctx, hook.Client, alias)
+	if err != nil {
+		return err
+	}
+	if len(aliased) > 0 {
+		*cmTemplate = aliased[0]
+		return nil
+	}
+	return apierrors.NewNotFound(cachev1alpha2.GroupVersion.WithResource("cmtemplates").GroupResource(), alias)
+}
+
+// resolveBase merges the base templates of the template under it the way the
+// controller renders it. A chain that can't be resolved is returned as a
+// *cachev1alpha2.BaseTemplateError.
+func (hook *cmStateCreator) resolveBase(ctx context.Context, cmTemplate *cachev1alpha2.CMTemplate) error {
+	return resolveBase(ctx, hook.Client, hook.Options.MaxBaseTemplateDepth, cmTemplate)
+}
+
+func resolveBase(ctx context.Context, c client.Reader, maxDepth int, cmTemplate *cachev1alpha2.CMTemplate) error {
+	err := cmTemplate.ResolveBase(maxDepth, func(name string) (*cachev1alpha2.CMTemplate, error) {
+		base := &cachev1alpha2.CMTemplate{}
+		return base, c.Get(ctx, types.NamespacedName{Name: name}, base)
+	})
+	var baseErr *cachev1alpha2.BaseTemplateError
+	if errors.As(err, &baseErr) {
+		return err
+	}
+	return errors.Wrap(err, "fetching the base templates of the cmtemplate has resulted in an error")
+}
+
+// resolveDataFrom adds the data the template references through dataFrom to
+// its template data, so the checksum and the name of immutable ConfigMaps
+// come out the way the controller renders them. The controller reports the
+// references it can't resolve.
+func (hook *cmStateCreator) resolveDataFrom(ctx context.Context, cmTemplate *cachev1alpha2.CMTemplate, namespace string) error {
+	_, err := cmTemplate.ResolveDataFrom(namespace, hook.Options.AllowCrossNamespaceDataFrom, func(key types.NamespacedName, obj client.Object) error {
+		return hook.Client.Get(ctx, key, obj)
+	})
+	return errors.Wrap(err, "fetching the dataFrom of the cmtemplate has resulted in an error")
+}
+
+// lookupCMState fetches the CMState of the namespace for the template, falling
+// back to the name it had before names were sanitized. A missing one is
+// returned empty.
+func (hook *cmStateCreator) lookupCMState(ctx context.Context, namespace, templateName string) (*cachev1alpha2.CMState, error) {
+	cmState, err := hook.fetchCMState(ctx, types.NamespacedName{Namespace: namespace, Name: generateName(templateName)})
+	if err != nil || cmState.Name != "" {
+		return cmState, err
+	}
+	if legacy := legacyName(templateName); legacy != generateName(templateName) {
+		return hook.fetchCMState(ctx, types.NamespacedName{Namespace: namespace, Name: legacy})
+	}
+	return cmState, nil
+}
+
+// errForeignCMState is returned when the cmstate under the name a pod would
+// join is rendered from another template
+var errForeignCMState = errors.New("foreign cmstate")
+
+// fetchCMState fetches the CMState, a missing one is returned empty
+func (hook *cmStateCreator) fetchCMState(ctx context.Context, key client.ObjectKey) (*cachev1alpha2.CMState, error) {
+	cmState := &cachev1alpha2.CMState{}
+	err := hook.getCMState(ctx, key, cmState)
+	if err != nil && !apierrors.IsNotFound(err) {
+		recordError(errorCMStateLookup)
+		ctrl.Log.WithName("webhooks").WithName("CMStateCreator").Error(err, "fetching cmstate has resulted in an error")
+		return nil, errors.Wrap(err, "fetching cmstate has resulted in an error")
+	}
+	return cmState, nil
+}
+
+// getCMState reads the CMState from the cache, the cache can lag behind a
+// cmstate another replica just created so a miss is double checked with the
+// API server before anyone creates a duplicate.
+func (hook *cmStateCreator) getCMState(ctx context.Context, key client.ObjectKey, cmState *cachev1alpha2.CMState) error {
+	err := hook.Client.Get(ctx, key, cmState)
+	if apierrors.IsNotFound(err) && hook.APIReader != nil {
+		err = hook.APIReader.Get(ctx, key, cmState)
+	}
+	return err
+}
+
+// latestCMState reads the CMState for an attempt at updating its audience. The
+// first attempt reads the cache, a conflict means the cache is behind so
+// retries read from the API server instead of failing against it again.
+func (hook *cmStateCreator) latestCMState(ctx context.Context, key client.ObjectKey, cmState *cachev1alpha2.CMState, retried bool) error {
+	if retried && hook.APIReader != nil {
+		return hook.APIReader.Get(ctx, key, cmState)
+	}
+	return hook.getCMState(ctx, key, cmState)
+}
+
+// handlePodUpdate follows templates being added to or removed from the
+// cmtemplate annotation of an existing pod. Updates leaving it untouched are ignored.
+func (hook *cmStateCreator) handlePodUpdate(req admission.Request, oldPod, pod *corev1.Pod, ctx context.Context) (*admission.Response, error) {
+	removed := difference(hook.templateNames(oldPod), hook.templateNames(pod))
+	added := difference(hook.templateNames(pod), hook.templateNames(oldPod))
+	if len(removed) == 0 && len(added) == 0 {
+		return skip(req, "skipping cmstate check due to unchanged annotation"), nil
+	}
+
+	if len(removed) > 0 && !isDryRun(req) {
+		resp, err := hook.handlePodDelete(req, removed, oldPod, ctx)
+		if err != nil || len(added) == 0 {
+			return resp, err
+		}
+	}
+	return hook.handlePodCreate(req, added, pod, ctx)
+}
+
+// difference returns the names in a that are not in b
+func difference(a, b []string) []string {
+	var names []string
+	for _, name := range a {
+		found := false
+		for _, other := range b {
+			if name == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// decodeDeletedPod decodes the pod out of a DELETE request. The API server sends
+// the pod being deleted as OldObject, but older API servers leave it empty, in
+// which case the pod is fetched since it still exists at admission time.
+//
+// Leaving the audience only takes the pod's metadata, so only that is decoded
+// from OldObject and the spec stays empty. Mass deletions like node drains
+// and namespace teardowns don't pay for decoding every container.
+func (hook *cmStateCreator) decodeDeletedPod(ctx context.Context, req admission.Request, pod *corev1.Pod) error {
+	if len(req.OldObject.Raw) != 0 {
+		metadata := &metav1.PartialObjectMetadata{}
+		if err := json.Unmarshal(req.OldObject.Raw, metadata); err != nil {
+			return err
+		}
+		pod.TypeMeta = metadata.TypeMeta
+		pod.ObjectMeta = metadata.ObjectMeta
+		return nil
+	}
+	return hook.Client.Get(
+		ctx,
+		types.NamespacedName{
+			Namespace: req.Namespace,
+			Name:      req.Name,
+		},
+		pod,
+	)
+}
 
-		if err != nil && !apierrors.IsNotFound(err) {
-			log.Error(err, "fetching cmtemplate has resulted in an error")
-			return nil, errors.Wrap(err, "fetching cmtemplate has resulted in an error")
-		} else if err != nil {
-			log.Error(err, "fetching cmtemplate has resulted in an error")
-			return nil, errors.Wrap(err, "fetching cmtemplate has resulted in an error")
+func (hook *cmStateCreator) handlePodDelete(req admission.Request, templates []string, pod *corev1.Pod, ctx context.Context) (*admission.Response, error) {
+	var warnings []string
+	reason := "skipping cmstate patch due to missing cmstate"
+	left := make(map[string]bool, len(templates))
+	for _, name := range templates {
+		// the template may be gone already, the cmstate is all that's needed
+		// here. The pod recorded which one it joined.
+		key := types.NamespacedName{Namespace: pod.Namespace, Name: recordedCMState(pod, hook.recordedTemplateName(ctx, pod, name))}
+		if left[key.Name] {
+			// asked for under its name and an alias
+			continue
+		}
+		left[key.Name] = true
+		cmState, err := hook.fetchCMState(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if cmState.Name == "" {
+			recordAdmission(req.Operation, decisionSkipped, "")
+			continue
+		}
+		if !hook.breaker.allow() {
+			// the writes keep failing, spare the API server another one
+			recordAdmission(req.Operation, decisionSkipped, cmState.Spec.TemplateRef.Name)
+			warnings = append(warnings, warnf("cmstate writes are suspended after repeated failures, pod deleted with a stale audience entry in cmstate '%s'", cmState.Name))
+			reason = "skipping cmstate patch due to suspended cmstate writes"
+			continue
 		}
 
-		if req.Operation == v1admission.Create {
-			return hook.handlePodCreate(req, cmState, cmTemplate, pod, ctx)
-		} else if req.Operation == v1admission.Delete {
-			return hook.handlePodDelete(cmState, pod, ctx)
+		reason, err = hook.removeFromAudience(ctx, cmState, pod, req.SubResource == evictionSubResource)
+		if err == nil {
+			hook.breaker.success()
+			recordAdmission(req.Operation, hook.mutatingDecision(decisionRemoved), cmState.Spec.TemplateRef.Name)
+		} else {
+			recordError(errorCMStateUpdate)
+			hook.writeFailed(err)
+			recordAdmission(req.Operation, decisionErrored, cmState.Spec.TemplateRef.Name)
+			// holding up the deletion doesn't fix the audience, let the pod go
+			ctrl.Log.WithName("webhooks").WithName("CMStateCreator").Error(err, "Error removing pod from cmstate audience", "cmstate", cmState.Name)
+			warnings = append(warnings, warnf("removing pod from cmstate '%s' failed, pod deleted with a stale audience entry", cmState.Name))
+			hook.event(req, pod, corev1.EventTypeWarning, eventRemovalFailed, "Removing pod from cmstate '%s' failed: %s", cmState.Name, err)
+			reason = "patching cmstate has resulted in an error"
 		}
 	}
-	resp := admission.Allowed("skipping cmstate check due to missing annotation")
+
+	resp := admission.Allowed(reason).WithWarnings(warnings...)
 	return &resp, nil
 }
 
-func (hook *cmStateCreator) handlePodDelete(cmState *cachev1alpha1.CMState, pod *corev1.Pod, ctx context.Context) (*admission.Response, error) {
-	if cmState.Name == "" {
-		resp := admission.Allowed("skipping cmstate patch due to missing cmstate")
+// removeFromAudience drops the pod from the audience of the CMState. The
+// audience is updated against the latest version of the CMState, retrying when
+// another admission changed it in the meantime. An evicted pod is recorded as
+// such, its deletion only drops the record.
+func (hook *cmStateCreator) removeFromAudience(ctx context.Context, cmState *cachev1alpha2.CMState, pod *corev1.Pod, evicted bool) (string, error) {
+	var reason string
+	retried := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest := &cachev1alpha2.CMState{}
+		err := hook.latestCMState(ctx, client.ObjectKeyFromObject(cmState), latest, retried)
+		retried = true
+		if err != nil {
+			return err
+		}
+
+		if index := findEvicted(latest.Spec.Evicted, pod.GetUID()); index != -1 {
+			if evicted {
+				reason = "skipping cmstate patch due to pod already evicted"
+				return nil
+			}
+			// its eviction already removed it from the audience
+			latest.Spec.Evicted = append(latest.Spec.Evicted[:index], latest.Spec.Evicted[index+1:]...)
+			reason = "cmstate has been patched, no need to mutate pod"
+			return hook.Client.Update(ctx, latest)
+		}
+
+		// pods are tracked by their owner when the template said so, by their
+		// own name when it was known at admission, otherwise they share a
+		// counted entry under their generateName
+		index := -1
+		if owner := parseAudienceOwner(pod); owner != nil {
+			index = findOwnerIndex(latest.Spec.Audience, owner.Kind, owner.Name)
+			if index != -1 && !owner.leave(&latest.Spec.Audience[index]) {
+				reason = "skipping cmstate patch due to pod not in audience"
+				return nil
+			}
+		}
+		if index == -1 {
+			index = findIndex(latest.Spec.Audience, pod.GetUID(), pod.GetName())
+		}
+		if index == -1 && pod.GetGenerateName() != "" {
+			index = findIndex(latest.Spec.Audience, "", pod.GetGenerateName())
+		}
+		if index == -1 {
+			reason = "skipping cmstate patch due to pod not in audience"
+			return nil
+		}
+
+		entry := &latest.Spec.Audience[index]
+		if entry.Count > 1 {
+			entry.Count--
+		} else {
+			// entries written before replicas were counted are shared by every
+			// replica, only drop those once the owners are gone
+			if entry.Count == 0 && entry.Name == pod.GetGenerateName() &&
+				len(pod.OwnerReferences) > 0 && hook.checkOwners(pod, ctx) {
+				reason = "skipping cmstate patch due to pod being kept around"
+				return nil
+			}
+			latest.Spec.Audience = append(latest.Spec.Audience[:index], latest.Spec.Audience[index+1:]...)
+		}
+		if evicted && pod.GetUID() != "" {
+			latest.Spec.Evicted = append(latest.Spec.Evicted, cachev1alpha2.EvictedPod{
+				Name:      pod.GetName(),
+				UID:       pod.GetUID(),
+				EvictedAt: metav1.Now(),
+			})
+		}
+
+		reason = "cmstate has been patched, no need to mutate pod"
+		return hook.Client.Update(ctx, latest)
+	})
+	return reason, err
+}
+
+// handlePodCreate injects every template the pod asks for. A missing template
+// among several is skipped with a warning so the pod still gets the others.
+func (hook *cmStateCreator) handlePodCreate(req admission.Request, templates []string, pod *corev1.Pod, ctx context.Context) (*admission.Response, error) {
+	var warnings []string
+	var injected []*cachev1alpha2.CMTemplate
+	original := pod
+	pod = pod.DeepCopy()
+	if len(hook.templateNames(pod)) == 0 {
+		// the templates came from elsewhere, record them on the pod so its
+		// deletion finds the same audiences
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		pod.Annotations[hook.Options.TriggerAnnotation] = strings.Join(templates, ",")
+	}
+	// every template is checked before the first cmstate is written, a pod
+	// denied by one of them leaves no audience entry behind
+	var admitted []admittedTemplate
+	if unknown := hook.unknownOverrides(ctx, templates, pod); len(unknown) > 0 {
+		recordAdmission(req.Operation, decisionDenied, "")
+		hook.event(req, pod, corev1.EventTypeWarning, eventInjectionFailed, "Injection failed: %s override values none of the templates replace", strings.Join(unknown, ", "))
+		resp := admission.Denied(fmt.Sprintf("cmstate-injector: %s override values none of the templates replace", strings.Join(unknown, ", ")))
 		return &resp, nil
 	}
-	podName := pod.GetName()
-	if pod.GetGenerateName() != "" {
-		podName = pod.GetGenerateName()
+	injectedNames := make(map[string]bool, len(templates))
+	for _, name := range templates {
+		cmState, cmTemplate, err := hook.fetchState(ctx, pod, name)
+		var baseErr *cachev1alpha2.BaseTemplateError
+		if errors.As(err, &baseErr) {
+			recordAdmission(req.Operation, decisionDenied, name)
+			hook.event(req, pod, corev1.EventTypeWarning, eventInjectionFailed, "Injection failed: template '%s' is invalid: %s", name, baseErr)
+			resp := admission.Denied(fmt.Sprintf("cmtemplate '%s' is invalid: %s", name, baseErr))
+			return &resp, nil
+		}
+		if errors.Is(err, errForeignCMState) {
+			recordAdmission(req.Operation, decisionDenied, name)
+			hook.event(req, pod, corev1.EventTypeWarning, eventInjectionFailed, "Injection failed: %s", err)
+			resp := admission.Denied(fmt.Sprintf("cmstate-injector: %s", err))
+			return &resp, nil
+		}
+		if err != nil {
+			// left to the API server to retry
+			hook.event(req, pod, corev1.EventTypeWarning, eventInjectionFailed, "Injection failed: %s", err)
+			return nil, err
+		}
+		if cmTemplate == nil {
+			// a missing template is a decision for the policy
+			hook.event(req, pod, corev1.EventTypeWarning, eventInjectionFailed, "Injection failed: template '%s' not found", name)
+			if hook.Options.MissingTemplatePolicy == MissingTemplateDeny {
+				recordAdmission(req.Operation, decisionDenied, "")
+				resp := admission.Denied(fmt.Sprintf("cmstate-injector: template '%s' not found", name))
+				return &resp, nil
+			}
+			recordAdmission(req.Operation, decisionSkipped, "")
+			warnings = append(warnings, warnf("template '%s' not found, pod admitted without its injection", name))
+			continue
+		}
+
+		if injectedNames[cmTemplate.Name] {
+			// asked for under its name and an alias
+			continue
+		}
+		injectedNames[cmTemplate.Name] = true
+
+		if cmTemplate.Spec.Disabled {
+			// stopped during an incident, the cmstates of other pods are left alone
+			recordAdmission(req.Operation, decisionSkipped, name)
+			hook.event(req, pod, corev1.EventTypeNormal, eventInjectionSkipped, "Injection skipped: template '%s' is disabled", name)
+			warnings = append(warnings, warnf("template '%s' is disabled, pod admitted without its injection", name))
+			continue
+		}
+
+		if resp, err := hook.policyDenial(ctx, req, name, cmTemplate, pod); resp != nil || err != nil {
+			return resp, err
+		}
+		admitted = append(admitted, admittedTemplate{name: name, cmState: cmState, cmTemplate: cmTemplate})
 	}
 
-	if len(pod.OwnerReferences) > 0 && hook.checkOwners(pod, ctx) {
-		resp := admission.Allowed("skipping cmstate patch due to pod being kept around")
-		return &resp, nil
+	for _, admit := range admitted {
+		name, cmState, cmTemplate := admit.name, admit.cmState, admit.cmTemplate
+		if alreadyInjected(cmState, cmTemplate, pod) {
+			// reinvoked after another webhook changed the pod, only restore
+			// what that webhook may have dropped
+			recordAdmission(req.Operation, decisionSkipped, name)
+			if err := applyInjection(cmTemplate, configMapNameFor(cmTemplate, cmState, cmState.Name, pod), pod); err != nil {
+				recordError(errorEncode)
+				return nil, err
+			}
+			hook.recordInjection(pod, cmTemplate, cmState.Name)
+			injected = append(injected, cmTemplate)
+			continue
+		}
+
+		if isDryRun(req) {
+			// only predict the mutation, the cmstate is left untouched
+			recordAdmission(req.Operation, decisionSkipped, name)
+			if cmState.Name == "" {
+				warnings = append(warnings, warnf("dry run, cmstate for template '%s' doesn't exist yet, pod admitted without its injection", name))
+				continue
+			}
+			warnings = append(warnings, warnf("dry run, cmstate '%s' not updated", cmState.Name))
+			if err := applyInjection(cmTemplate, configMapNameFor(cmTemplate, cmState, cmState.Name, pod), pod); err != nil {
+				recordError(errorEncode)
+				return nil, err
+			}
+			hook.recordInjection(pod, cmTemplate, cmState.Name)
+			injected = append(injected, cmTemplate)
+			continue
+		}
+
+		if hook.Options.CMStateWrites != CMStateWritesController && !hook.breaker.allow() {
+			// the writes keep failing, spare the API server another one
+			recordAdmission(req.Operation, decisionSkipped, name)
+			hook.event(req, pod, corev1.EventTypeWarning, eventInjectionSkipped, "Injection skipped: cmstate writes are suspended after repeated failures")
+			warnings = append(warnings, warnf("cmstate writes are suspended after repeated failures, pod admitted without the injection of template '%s'", name))
+			continue
+		}
+
+		resp, sizeWarnings, err := hook.injectTemplate(ctx, cmState, cmTemplate, pod)
+		if err != nil {
+			recordAdmission(req.Operation, decisionDenied, name)
+			hook.event(req, pod, corev1.EventTypeWarning, eventInjectionFailed, "Injection failed: template '%s': %s", name, err)
+			return resp, err
+		}
+		recordAdmission(req.Operation, hook.mutatingDecision(decisionInjected), name)
+		warnings = append(warnings, sizeWarnings...)
+		injected = append(injected, cmTemplate)
+		hook.event(req, pod, corev1.EventTypeNormal, eventInjected, "Injected ConfigMap %s from template %s", recordedCMState(pod, name), name)
+	}
+
+	if len(injected) > 0 {
+		checksum, err := configChecksum(injected, pod)
+		if err != nil {
+			recordError(errorEncode)
+			return nil, errors.Wrap(err, "error computing config checksum")
+		}
+		pod.Annotations[ConfigChecksumAnnotation] = checksum
+		if containers := injectedContainers(injected, pod); len(containers) > 0 {
+			pod.Annotations[InjectedContainersAnnotation] = strings.Join(containers, ",")
+		}
+		warnings = append(warnings, unselectedWarnings(injected, pod)...)
 	}
 
-	index := findIndex(cmState.Spec.Audience, podName)
-	if index == -1 {
-		resp := admission.Allowed("skipping cmstate patch due to pod not in audience")
+	patch := podPatch(original, pod)
+	if len(patch) == 0 {
+		resp := admission.Allowed("pod already carries the cmstate injection").WithWarnings(warnings...)
 		return &resp, nil
 	}
-	cmState.Spec.Audience = append(cmState.Spec.Audience[:index], cmState.Spec.Audience[index+1:]...)
 
-	err := hook.Client.Patch(ctx, cmState, client.Merge)
+	pData, err := json.Marshal(patch)
 	if err != nil {
-		resp := admission.Denied("patching cmstate has resulted in an error")
-		return &resp, err
+		recordError(errorEncode)
+		return nil, errors.Wrap(err, "error encoding response patch")
 	}
 
-	resp := admission.Allowed("cmstate has been patched, no need to mutate pod")
+	patchType := v1admission.PatchTypeJSONPatch
+	resp := admission.Allowed("").WithWarnings(warnings...)
+	resp.Patch = pData
+	resp.PatchType = &patchType
 	return &resp, nil
 }
 
-func (hook *cmStateCreator) handlePodCreate(req admission.Request, cmState *cachev1alpha1.CMState, cmTemplate *cachev1alpha1.CMTemplate, pod *corev1.Pod, ctx context.Context) (*admission.Response, error) {
-	if cmState.Name == "" {
+// admittedTemplate is a template the pod passed every policy check of
+type admittedTemplate struct {
+	name       string
+	cmState    *cachev1alpha2.CMState
+	cmTemplate *cachev1alpha2.CMTemplate
+}
+
+// policyDenial runs the checks of the template against the pod, returning the
+// denial of the first one failing
+func (hook *cmStateCreator) policyDenial(ctx context.Context, req admission.Request, name string, cmTemplate *cachev1alpha2.CMTemplate, pod *corev1.Pod) (*admission.Response, error) {
+	if errs := cmTemplate.Validate(); len(errs) > 0 {
+		recordAdmission(req.Operation, decisionDenied, name)
+		hook.event(req, pod, corev1.EventTypeWarning, eventInjectionFailed, "Injection failed: template '%s' is invalid: %s", name, errs.ToAggregate())
+		resp := admission.Denied(fmt.Sprintf("cmtemplate '%s' is invalid: %s", name, errs.ToAggregate()))
+		return &resp, nil
+	}
+
+	if !cmTemplate.Spec.ServiceAccountAllowed(pod.Namespace, serviceAccountName(pod)) {
+		recordAdmission(req.Operation, decisionDenied, name)
+		hook.event(req, pod, corev1.EventTypeWarning, eventInjectionFailed, "Injection failed: service account '%s' may not use template '%s'", serviceAccountName(pod), name)
+		resp := admission.Denied(fmt.Sprintf("cmstate-injector: policy violation, service account '%s/%s' is not allowed to use template '%s'", pod.Namespace, serviceAccountName(pod), name))
+		return &resp, nil
+	}
+
+	if allowed, err := hook.namespaceAllowed(ctx, cmTemplate, pod.Namespace); err != nil {
+		return nil, err
+	} else if !allowed {
+		recordAdmission(req.Operation, decisionDenied, name)
+		hook.event(req, pod, corev1.EventTypeWarning, eventInjectionFailed, "Injection failed: namespace '%s' may not use template '%s'", pod.Namespace, name)
+		resp := admission.Denied(fmt.Sprintf("cmstate-injector: policy violation, namespace '%s' is not allowed to use template '%s'", pod.Namespace, name))
+		return &resp, nil
+	}
+
+	if missing := missingAnnotations(cmTemplate, pod); len(missing) > 0 {
+		recordAdmission(req.Operation, decisionDenied, name)
+		hook.event(req, pod, corev1.EventTypeWarning, eventInjectionFailed, "Injection failed: missing the annotations required by template '%s': %s", name, strings.Join(missing, ", "))
+		resp := admission.Denied(fmt.Sprintf("cmstate-injector: pod is missing the annotations required by template '%s': %s", name, strings.Join(missing, ", ")))
+		return &resp, nil
+	}
+
+	if missing := missingLabels(cmTemplate, pod); len(missing) > 0 {
+		recordAdmission(req.Operation, decisionDenied, name)
+		hook.event(req, pod, corev1.EventTypeWarning, eventInjectionFailed, "Injection failed: missing the labels required by template '%s': %s", name, strings.Join(missing, ", "))
+		resp := admission.Denied(fmt.Sprintf("cmstate-injector: pod is missing the labels required by template '%s': %s", name, strings.Join(missing, ", ")))
+		return &resp, nil
+	}
+
+	if mismatched := mismatchedAnnotations(cmTemplate, pod); len(mismatched) > 0 {
+		recordAdmission(req.Operation, decisionDenied, name)
+		hook.event(req, pod, corev1.EventTypeWarning, eventInjectionFailed, "Injection failed: annotations not matching the patterns of template '%s': %s", name, strings.Join(mismatched, ", "))
+		resp := admission.Denied(fmt.Sprintf("cmstate-injector: pod annotations don't match the patterns of template '%s': %s", name, strings.Join(mismatched, ", ")))
+		return &resp, nil
+	}
+	return nil, nil
+}
+
+// annotationPatch builds the JSONPatch operations turning the original pod
+// annotations into the updated ones, touching only the keys that changed.
+func annotationPatch(original, updated map[string]string) []PatchOperation {
+	var changed []string
+	for key, value := range updated {
+		if current, ok := original[key]; !ok || current != value {
+			changed = append(changed, key)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	sort.Strings(changed)
+
+	if original == nil {
+		// the whole map has to be created before keys can be added to it
+		annotations := make(map[string]string, len(changed))
+		for _, key := range changed {
+			annotations[key] = updated[key]
+		}
+		return []PatchOperation{{Op: "add", Path: "/metadata/annotations", Value: annotations}}
+	}
+
+	patch := make([]PatchOperation, 0, len(changed))
+	for _, key := range changed {
+		op := "add"
+		if _, ok := original[key]; ok {
+			op = "replace"
+		}
+		patch = append(patch, PatchOperation{
+			Op:    op,
+			Path:  annotationPath(key),
+			Value: updated[key],
+		})
+	}
+	return patch
+}
+
+// annotationPath is the JSONPatch path of a pod annotation
+func annotationPath(key string) string {
+	return "/metadata/annotations/" + escapeJSONPointer(key)
+}
+
+// escapeJSONPointer escapes a key for use as a JSON pointer reference token
+// (RFC 6901). The replacer doesn't rescan its output, so the '~' of an escaped
+// '/' isn't escaped again.
+func escapeJSONPointer(key string) string {
+	return jsonPointerEscaper.Replace(key)
+}
+
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// injectTemplate creates the CMState for the template or joins its audience,
+// and points the template's target annotation on the pod at it.
+func (hook *cmStateCreator) injectTemplate(ctx context.Context, cmState *cachev1alpha2.CMState, cmTemplate *cachev1alpha2.CMTemplate, pod *corev1.Pod) (*admission.Response, []string, error) {
+	owner := hook.audienceOwnerFor(ctx, audienceTrackingOf(cmState, cmTemplate), pod)
+
+	// mutate the pod first, nothing is written when it can't be injected
+	cmStateName := cmState.Name
+	if cmStateName == "" {
+		cmStateName = hook.cmStateNameFor(ctx, cmTemplate, pod)
+	}
+	if err := applyInjection(cmTemplate, configMapNameFor(cmTemplate, cmState, cmStateName, pod), pod); err != nil {
+		recordError(errorEncode)
+		return nil, nil, err
+	}
+
+	var warnings []string
+	if hook.Options.CMStateWrites == CMStateWritesController {
+		// the pod controller writes the cmstate once the pod exists, the
+		// admission stays free of side effects
+		pod.Annotations[AudienceDeferredAnnotation] = "true"
+	} else if cmState.Name == "" {
 		// create the cmstate
-		cmState = generateCMState(cmTemplate, pod)
+		cmState = generateCMState(cmTemplate, cmStateName, pod, owner)
 
 		err := hook.Client.Create(ctx, cmState)
 
+		size := 1
+		if apierrors.IsAlreadyExists(err) {
+			// another replica won the race to create it, join its audience instead
+			size, err = hook.addToAudience(ctx, cmState, pod, owner, injectedConfigMap(cmTemplate, pod))
+		}
+		if errors.Is(err, errAudienceFull) {
+			return hook.audienceFullResponse(cmState.Name), nil, err
+		}
+		if err != nil {
+			recordError(errorCMStateCreate)
+			hook.writeFailed(err)
+			resp := admission.Denied(fmt.Sprintf("creating cmstate '%s' has resulted in an error: %s", cmState.Name, err))
+			return &resp, nil, err
+		}
+		hook.breaker.success()
+		warnings = hook.checkAudienceSize(cmState, size)
+	} else {
+		size, err := hook.addToAudience(ctx, cmState, pod, owner, injectedConfigMap(cmTemplate, pod))
+		if errors.Is(err, errAudienceFull) {
+			return hook.audienceFullResponse(cmState.Name), nil, err
+		}
 		if err != nil {
-			resp := admission.Denied("creating cmstate has resulted in an error")
-			return &resp, err
+			recordError(errorCMStateUpdate)
+			hook.writeFailed(err)
+			resp := admission.Denied(fmt.Sprintf("patching cmstate '%s' has resulted in an error: %s", cmState.Name, err))
+			return &resp, nil, err
 		}
+		hook.breaker.success()
+		warnings = hook.checkAudienceSize(cmState, size)
 	}
 
-	pod.Annotations[cmTemplate.Spec.Template.TargetAnnotation] = cmState.Name
+	if owner != nil {
+		pod.Annotations[AudienceOwnerAnnotation] = owner.String()
+	}
+	if owner != nil && owner.Member != "" {
+		pod.Annotations[AudienceMemberAnnotation] = string(owner.Member)
+	}
+	hook.recordInjection(pod, cmTemplate, cmStateName)
+	return nil, warnings, nil
+}
 
-	pData, err := json.Marshal(pod)
-	if err != nil {
-		return nil, errors.Wrap(err, "error encoding response object")
+// recordInjection stamps the pod with the operator version and the template
+// it was injected with into the cmstate, once per template. Templates of the
+// namespace overriding the cluster ones are recorded as such.
+func (hook *cmStateCreator) recordInjection(pod *corev1.Pod, cmTemplate *cachev1alpha2.CMTemplate, cmStateName string) {
+	injectedBy := "cmstate-injector-operator"
+	if hook.Options.Version != "" {
+		injectedBy += "/" + hook.Options.Version
+	}
+	pod.Annotations[InjectedByAnnotation] = injectedBy
+	templateName := cmTemplate.Name
+	if cmTemplate.Scope() == cachev1alpha2.TemplateScopeNamespaced {
+		recordNamespacedTemplate(pod, templateName)
 	}
 
-	resp := admission.PatchResponseFromRaw(req.Object.Raw, pData)
-	return &resp, nil
+	templates, cmStates := recordedInjections(pod)
+	for i, name := range templates {
+		if name == templateName {
+			cmStates[i] = cmStateName
+			pod.Annotations[CMStateAnnotation] = strings.Join(cmStates, ",")
+			return
+		}
+	}
+	pod.Annotations[TemplatesUsedAnnotation] = strings.Join(append(templates, templateName), ",")
+	pod.Annotations[CMStateAnnotation] = strings.Join(append(cmStates, cmStateName), ",")
 }
 
-// Generating a CMState used for later
-func generateCMState(cmTemplate *cachev1alpha1.CMTemplate, pod *corev1.Pod) *cachev1alpha1.CMState {
-	annotations := pod.GetAnnotations()
+// recordNamespacedTemplate adds the template to the namespaced templates
+// recorded on the pod, once
+func recordNamespacedTemplate(pod *corev1.Pod, templateName string) {
+	var names []string
+	if recorded := pod.Annotations[NamespacedTemplatesAnnotation]; recorded != "" {
+		names = strings.Split(recorded, ",")
+	}
+	for _, name := range names {
+		if name == templateName {
+			return
+		}
+	}
+	pod.Annotations[NamespacedTemplatesAnnotation] = strings.Join(append(names, templateName), ",")
+}
 
+// recordedInjections returns the templates and cmstates recorded on the pod,
+// the cmstates are only trusted when there is one for every template
+func recordedInjections(pod *corev1.Pod) ([]string, []string) {
+	templates, cmStates := pod.GetAnnotations()[TemplatesUsedAnnotation], pod.GetAnnotations()[CMStateAnnotation]
+	if templates == "" || cmStates == "" {
+		return nil, nil
+	}
+	templateNames, cmStateNames := strings.Split(templates, ","), strings.Split(cmStates, ",")
+	if len(templateNames) != len(cmStateNames) {
+		return nil, nil
+	}
+	return templateNames, cmStateNames
+}
+
+// recordedJoining reports whether the pod recorded joining the cmstate for the
+// template
+func recordedJoining(pod *corev1.Pod, templateName, cmStateName string) bool {
+	templates, cmStates := recordedInjections(pod)
+	for i, name := range templates {
+		if name == templateName {
+			return cmStates[i] == cmStateName
+		}
+	}
+	return false
+}
+
+// recordedCMState returns the cmstate the pod recorded joining for the
+// template, pods injected before that was recorded joined the one under the
+// legacy name
+func recordedCMState(pod *corev1.Pod, templateName string) string {
+	templates, cmStates := recordedInjections(pod)
+	for i, name := range templates {
+		if name == templateName {
+			return cmStates[i]
+		}
+	}
+	return legacyName(templateName)
+}
+
+// recordedTemplateName is the name the pod recorded the template it asked for
+// under, the template itself for an alias. Templates that are gone keep the
+// name asked for.
+func (hook *cmStateCreator) recordedTemplateName(ctx context.Context, pod *corev1.Pod, name string) string {
+	templates, _ := recordedInjections(pod)
+	for _, recorded := range templates {
+		if recorded == name {
+			return name
+		}
+	}
+	cmTemplate := &cachev1alpha2.CMTemplate{}
+	if err := hook.getCMTemplate(ctx, pod.Namespace, name, cmTemplate); err != nil {
+		return name
+	}
+	return cmTemplate.Name
+}
+
+// alreadyInjected reports whether an earlier invocation for the same pod
+// already set its target annotations and joined the cmstate audience. It
+// goes by the cmstate the pod records joining, a replica created through
+// generateName has no name yet and would match the entry of its siblings.
+func alreadyInjected(cmState *cachev1alpha2.CMState, cmTemplate *cachev1alpha2.CMTemplate, pod *corev1.Pod) bool {
+	if cmState.Name == "" || !recordedJoining(pod, cmTemplate.Name, cmState.Name) {
+		return false
+	}
+	configMapName := configMapNameFor(cmTemplate, cmState, cmState.Name, pod)
+	for _, key := range cmTemplate.Spec.TargetAnnotations() {
+		if pod.GetAnnotations()[key] != configMapName {
+			return false
+		}
+	}
+	for _, output := range cmTemplate.Spec.Outputs {
+		if pod.GetAnnotations()[output.TargetAnnotation] != cachev1alpha2.OutputName(configMapName, output.Name) {
+			return false
+		}
+	}
+	if owner := parseAudienceOwner(pod); owner != nil {
+		if index := findOwnerIndex(cmState.Spec.Audience, owner.Kind, owner.Name); index != -1 {
+			return owner.Member == "" || hasMember(&cmState.Spec.Audience[index], owner.Member)
+		}
+	}
+	return findIndex(cmState.Spec.Audience, pod.GetUID(), audienceName(pod)) != -1
+}
+
+// configMapNameFor is the name of the ConfigMap the pod is injected with for
+// the cmstate, as named by the template. Immutable and hash versioned
+// templates render ConfigMaps named after what they are rendered from, the
+// cmstate points at the current one once the controller rendered it. Until
+// then the name is computed the way the controller does, from the values of
+// the cmstate or of the pod creating it. CMStates of templates only rendered
+// on create keep the ConfigMap they have.
+func configMapNameFor(cmTemplate *cachev1alpha2.CMTemplate, cmState *cachev1alpha2.CMState, cmStateName string, pod *corev1.Pod) string {
+	if cmTemplate.Spec.UpdateStrategy == cachev1alpha2.UpdateStrategyOnCreate && cmState.Name != "" && cmState.Spec.Target != "" {
+		return cmState.Spec.Target
+	}
+	name := cmTemplate.ConfigMapName(cmStateName)
+	if !cmTemplate.Spec.HashVersioned() {
+		return name
+	}
+	if cmState.Name == "" {
+		return cachev1alpha2.ImmutableName(name, cmTemplate.Spec.ContentHash(replacementValues(cmTemplate, pod)))
+	}
+	if cmState.Status.ConfigMap != "" {
+		return cmState.Status.ConfigMap
+	}
+	return cachev1alpha2.ImmutableName(name, cmTemplate.Spec.ContentHash(cmState.ReplacementValues(&cmTemplate.Spec.Template)))
+}
+
+// injectedConfigMap is the ConfigMap the pod was injected with for the
+// template, read back from its first target annotation
+func injectedConfigMap(cmTemplate *cachev1alpha2.CMTemplate, pod *corev1.Pod) string {
+	if keys := cmTemplate.Spec.TargetAnnotations(); len(keys) > 0 {
+		return pod.GetAnnotations()[keys[0]]
+	}
+	return ""
+}
+
+// setTargetAnnotations points the template's target annotations on the pod at
+// the cmstate, and the annotation of every output at its ConfigMap
+func setTargetAnnotations(cmTemplate *cachev1alpha2.CMTemplate, cmStateName string, pod *corev1.Pod) {
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	for _, key := range cmTemplate.Spec.TargetAnnotations() {
+		pod.Annotations[key] = cmStateName
+	}
+	for _, output := range cmTemplate.Spec.Outputs {
+		pod.Annotations[output.TargetAnnotation] = cachev1alpha2.OutputName(cmStateName, output.Name)
+	}
+}
+
+// addToAudience appends the pod, or its owner when given, to the audience of
+// an existing CMState along with the ConfigMap it was injected with,
+// refetching and retrying when another admission updated it concurrently.
+func (hook *cmStateCreator) addToAudience(ctx context.Context, cmState *cachev1alpha2.CMState, pod *corev1.Pod, owner *audienceOwner, configMap string) (int, error) {
+	size := 0
+	retried := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest := &cachev1alpha2.CMState{}
+		err := hook.latestCMState(ctx, client.ObjectKeyFromObject(cmState), latest, retried)
+		retried = true
+		if err != nil {
+			return err
+		}
+		size = latest.Spec.AudienceSize()
+
+		var entry *cachev1alpha2.CMAudience
+		if owner != nil {
+			index := findOwnerIndex(latest.Spec.Audience, owner.Kind, owner.Name)
+			if index == -1 {
+				latest.Spec.Audience = append(latest.Spec.Audience, owner.newAudience(pod.GetNamespace()))
+				entry = &latest.Spec.Audience[len(latest.Spec.Audience)-1]
+			} else if entry = &latest.Spec.Audience[index]; !owner.join(entry) && entry.ConfigMap == configMap {
+				return nil
+			}
+		} else {
+			index := findIndex(latest.Spec.Audience, pod.GetUID(), audienceName(pod))
+			switch {
+			case index == -1:
+				latest.Spec.Audience = append(latest.Spec.Audience, newAudience(pod))
+				entry = &latest.Spec.Audience[len(latest.Spec.Audience)-1]
+			case pod.GetName() == "":
+				// another replica sharing the generateName, uncounted entries
+				// already stand for at least one
+				entry = &latest.Spec.Audience[index]
+				if entry.Count == 0 {
+					entry.Count = 1
+				}
+				entry.Count++
+			default:
+				if entry = &latest.Spec.Audience[index]; entry.ConfigMap == configMap {
+					return nil
+				}
+			}
+		}
+		// the controller keeps the ConfigMaps the audience was injected with
+		entry.ConfigMap = configMap
+
+		// replicas only counted in an entry don't grow it
+		if grown := latest.Spec.AudienceSize(); grown > size {
+			if hook.audienceFull(grown) {
+				return errors.Wrapf(errAudienceFull, "cmstate '%s' lists %d pods", latest.Name, size)
+			}
+			size = grown
+		}
+		return hook.Client.Update(ctx, latest)
+	})
+	return size, err
+}
+
+// labelValue turns an annotation value into a valid label value. Values that
+// aren't valid already get their illegal characters replaced and are
+// truncated, with a hash of the original appended to keep them apart.
+func labelValue(value string) string {
+	if len(validation.IsValidLabelValue(value)) == 0 {
+		return value
+	}
+
+	hash := sha256.Sum256([]byte(value))
+	suffix := hex.EncodeToString(hash[:])[:labelHashLength]
+
+	sanitized := illegalLabelCharacters.ReplaceAllString(value, "-")
+	if limit := validation.LabelValueMaxLength - labelHashLength - 1; len(sanitized) > limit {
+		sanitized = sanitized[:limit]
+	}
+	sanitized = strings.Trim(sanitized, "-_.")
+	if sanitized == "" {
+		return suffix
+	}
+	return sanitized + "-" + suffix
+}
+
+// serviceAccountName is the service account the pod runs as, the API server
+// defaults it before webhooks get the pod but a pod without one runs as default
+func serviceAccountName(pod *corev1.Pod) string {
+	if pod.Spec.ServiceAccountName == "" {
+		return "default"
+	}
+	return pod.Spec.ServiceAccountName
+}
+
+// missingAnnotations lists the annotations the template replaces that the
+// pod neither sets nor overrides and the template doesn't mark as optional,
+// sorted by key. A key also replaced as label counts as annotation.
+func missingAnnotations(cmTemplate *cachev1alpha2.CMTemplate, pod *corev1.Pod) []string {
+	return missingReplacements(cmTemplate, pod, cmTemplate.Spec.Template.AnnotationReplace)
+}
+
+// missingLabels lists the labels the template replaces that the pod neither
+// sets nor overrides and the template doesn't mark as optional, sorted by key
+func missingLabels(cmTemplate *cachev1alpha2.CMTemplate, pod *corev1.Pod) []string {
+	var labels []cachev1alpha2.KeyedReplacement
+	for _, replacement := range cmTemplate.Spec.Template.LabelReplace {
+		if _, ok := cachev1alpha2.FindReplacement(cmTemplate.Spec.Template.AnnotationReplace, replacement.Key); !ok {
+			labels = append(labels, replacement)
+		}
+	}
+	return missingReplacements(cmTemplate, pod, labels)
+}
+
+func missingReplacements(cmTemplate *cachev1alpha2.CMTemplate, pod *corev1.Pod, replacements []cachev1alpha2.KeyedReplacement) []string {
+	values := replacementValues(cmTemplate, pod)
+	var missing []string
+	for _, replacement := range replacements {
+		if _, ok := values[replacement.Key]; !ok && !cmTemplate.Spec.Template.Optional(replacement.Key) {
+			missing = append(missing, replacement.Key)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// mismatchedAnnotations lists the annotations and labels the pod sets or
+// overrides to a value not of their type or enum, or not matching their
+// pattern, with what they have to be, sorted by key. The defaults of the
+// template are checked when it is validated.
+func mismatchedAnnotations(cmTemplate *cachev1alpha2.CMTemplate, pod *corev1.Pod) []string {
+	defaulted := make(map[string]bool)
+	for _, key := range defaultedAnnotations(cmTemplate, pod) {
+		defaulted[key] = true
+	}
+
+	var mismatched []string
+	for key, value := range replacementValues(cmTemplate, pod) {
+		replacement, _ := cmTemplate.Spec.Template.Replacement(key)
+		if defaulted[key] {
+			continue
+		}
+		// the values are normalized already, only those that failed to
+		// still fail
+		if _, err := replacement.Normalize(value); err != nil {
+			mismatched = append(mismatched, fmt.Sprintf("%s %s", key, err))
+		} else if !replacement.Matches(value) {
+			mismatched = append(mismatched, fmt.Sprintf("%s must match '%s'", key, replacement.Pattern))
+		}
+	}
+	sort.Strings(mismatched)
+	return mismatched
+}
+
+// Generating a CMState used for later
+func generateCMState(cmTemplate *cachev1alpha2.CMTemplate, name string, pod *corev1.Pod, owner *audienceOwner) *cachev1alpha2.CMState {
+	// only the values the pod actually carries, overrides or takes the
+	// default of are copied. The annotations keep them verbatim for
+	// rendering, the labels only have to stay selectable.
 	labels := make(map[string]string)
-	for annotation := range cmTemplate.Spec.Template.AnnotationReplace {
-		labels[annotation] = annotations[annotation]
+	values := replacementValues(cmTemplate, pod)
+	for annotation, value := range values {
+		labels[annotation] = labelValue(value)
+	}
+
+	annotations := make(map[string]string, len(values)+1)
+	for annotation, value := range values {
+		annotations[annotation] = value
+	}
+	if defaulted := defaultedAnnotations(cmTemplate, pod); len(defaulted) > 0 {
+		annotations[DefaultedAnnotation] = strings.Join(defaulted, ",")
 	}
 
-	podName := pod.GetName()
-	if podName == "" {
-		podName = pod.GetGenerateName()
+	audience := newAudience(pod)
+	if owner != nil {
+		audience = owner.newAudience(pod.GetNamespace())
 	}
-	return &cachev1alpha1.CMState{
+	audience.ConfigMap = injectedConfigMap(cmTemplate, pod)
+
+	cmState := &cachev1alpha2.CMState{
 		TypeMeta: metav1.TypeMeta{
-			APIVersion: "cache.spicedelver.me/v1alpha1",
+			APIVersion: "cache.spicedelver.me/v1alpha2",
 			Kind:       "CMState",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      generateName(cmTemplate.Name),
-			Namespace: pod.GetNamespace(),
-			Labels:    labels,
+			Name:        name,
+			Namespace:   pod.GetNamespace(),
+			Labels:      labels,
+			Annotations: annotations,
 		},
-		Spec: cachev1alpha1.CMStateSpec{
-			Audience: []cachev1alpha1.CMAudience{
-				{
-					Kind: "Pod",
-					Name: podName,
-				},
+		Spec: cachev1alpha2.CMStateSpec{
+			Audience: []cachev1alpha2.CMAudience{
+				audience,
 			},
-			CMTemplate: cmTemplate.Name,
+			TemplateRef:      cachev1alpha2.TemplateRef{Name: cmTemplate.Name},
+			AudienceTracking: templateAudienceTracking(cmTemplate),
 		},
 	}
+	if cmTemplate.Scope() == cachev1alpha2.TemplateScopeNamespaced {
+		cmState.Spec.TemplateRef.Scope = cachev1alpha2.TemplateScopeNamespaced
+	}
+	if scope := templateStateScope(cmTemplate); scope != cachev1alpha2.StateScopeTemplate {
+		cmState.Spec.StateScope = scope
+	}
+	cmTemplate.ApplyMetadata(cmState)
+	return cmState
 }
 
+// generateName returns the name of the cmstate for the template
 func generateName(cmTemplateName string) string {
-	return strings.ToLower(strings.ReplaceAll(fmt.Sprintf("cmstate-%s", cmTemplateName), "_", "-"))
+	return cachev1alpha2.CMStateName(cmTemplateName)
 }
 
-func findIndex(slice []cachev1alpha1.CMAudience, name string) int {
+// legacyName returns the name cmstates were created under before names were
+// sanitized
+func legacyName(cmTemplateName string) string {
+	return cachev1alpha2.LegacyCMStateName(cmTemplateName)
+}
+
+// audienceName is the name a pod is tracked under in the audience, pods
+// created through generateName don't have their name assigned yet.
+func audienceName(pod *corev1.Pod) string {
+	if pod.GetName() == "" {
+		return pod.GetGenerateName()
+	}
+	return pod.GetName()
+}
+
+// newAudience returns the audience entry for a pod, pods without a name yet
+// start the replica count of their generateName.
+func newAudience(pod *corev1.Pod) cachev1alpha2.CMAudience {
+	now := metav1.Now()
+	audience := cachev1alpha2.CMAudience{
+		Kind:      "Pod",
+		Name:      audienceName(pod),
+		Namespace: pod.GetNamespace(),
+		AddedAt:   &now,
+	}
+	if pod.GetName() == "" {
+		audience.Count = 1
+	} else {
+		audience.UID = pod.GetUID()
+	}
+	return audience
+}
+
+// findIndex looks up an audience entry, matching on UID first and falling
+// back to the name for entries recorded without one.
+func findIndex(slice []cachev1alpha2.CMAudience, uid types.UID, name string) int {
+	if uid != "" {
+		for i, aud := range slice {
+			if aud.UID == uid {
+				return i
+			}
+		}
+	}
 	for i, aud := range slice {
-		if aud.Name == name {
+		// owner entries can share a name with a pod
+		if aud.Name == name && aud.Kind == "Pod" {
+			return i
+		}
+	}
+	return -1
+}
+
+// findEvicted returns the index of the evicted pod with the uid, -1 if none
+func findEvicted(evicted []cachev1alpha2.EvictedPod, uid types.UID) int {
+	if uid == "" {
+		return -1
+	}
+	for i, entry := range evicted {
+		if entry.UID == uid {
 			return i
 		}
 	}
@@ -225,6 +1944,7 @@ func (hook *cmStateCreator) InjectDecoder(d *admission.Decoder) error {
 	return nil
 }
 
+// checkOwners reports whether every owner of the pod still asks for pods
 func (hook *cmStateCreator) checkOwners(pod *corev1.Pod, ctx context.Context) bool {
 	for _, owner := range pod.OwnerReferences {
 		if !hook.checkOwner(owner, pod, ctx) {
@@ -234,76 +1954,53 @@ func (hook *cmStateCreator) checkOwners(pod *corev1.Pod, ctx context.Context) bo
 	return true
 }
 
+// checkOwner reports whether the owner of the pod still exists and asks for
+// pods, an owner that is gone, being deleted or scaled to zero doesn't
 func (hook *cmStateCreator) checkOwner(owner metav1.OwnerReference, pod *corev1.Pod, ctx context.Context) bool {
+	var ownerObject client.Object
 	switch owner.Kind {
-	case "Deployment":
-		ownerObject := &appsv1.Deployment{}
-		err := hook.Client.Get(
-			ctx,
-			types.NamespacedName{
-				Namespace: pod.Namespace,
-				Name:      owner.Name,
-			},
-			ownerObject,
-		)
-		if err != nil {
-			fmt.Println(err)
-			return false
-		}
-		return *ownerObject.Spec.Replicas != 0
-	case "DaemonSet":
-		ownerObject := &appsv1.Deployment{}
-		err := hook.Client.Get(
-			ctx,
-			types.NamespacedName{
-				Namespace: pod.Namespace,
-				Name:      owner.Name,
-			},
-			ownerObject,
-		)
-		if err != nil {
-			fmt.Println(err)
-			return false
-		}
-		return *ownerObject.Spec.Replicas != 0
-	case "StatefulSet":
-		ownerObject := &appsv1.Deployment{}
-		err := hook.Client.Get(
-			ctx,
-			types.NamespacedName{
-				Namespace: pod.Namespace,
-				Name:      owner.Name,
-			},
-			ownerObject,
-		)
-		if err != nil {
-			fmt.Println(err)
-			return false
-		}
-		return *ownerObject.Spec.Replicas != 0
 	case "ReplicaSet":
-		ownerObject := &appsv1.Deployment{}
-		err := hook.Client.Get(
-			ctx,
-			types.NamespacedName{
-				Namespace: pod.Namespace,
-				Name:      owner.Name,
-			},
-			ownerObject,
-		)
-		if err != nil {
-			fmt.Println(err)
-			return false
+		ownerObject = &appsv1.ReplicaSet{}
+	case "StatefulSet":
+		ownerObject = &appsv1.StatefulSet{}
+	case "DaemonSet":
+		ownerObject = &appsv1.DaemonSet{}
+	case "ReplicationController":
+		ownerObject = &corev1.ReplicationController{}
+	case "Job":
+		ownerObject = &batchv1.Job{}
+	default:
+		return false
+	}
+
+	err := hook.Client.Get(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: owner.Name}, ownerObject)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			ctrl.Log.WithName("webhooks").WithName("CMStateCreator").Error(err, "fetching the owner of the pod has resulted in an error",
+				"kind", owner.Kind, "owner", owner.Name)
 		}
-		return *ownerObject.Spec.Replicas != 0
+		return false
 	}
-	return false
+	if ownerObject.GetDeletionTimestamp() != nil || (owner.UID != "" && ownerObject.GetUID() != owner.UID) {
+		return false
+	}
+
+	switch ownerObject := ownerObject.(type) {
+	case *appsv1.ReplicaSet:
+		return wantsReplicas(ownerObject.Spec.Replicas)
+	case *appsv1.StatefulSet:
+		return wantsReplicas(ownerObject.Spec.Replicas)
+	case *corev1.ReplicationController:
+		return wantsReplicas(ownerObject.Spec.Replicas)
+	case *batchv1.Job:
+		return wantsReplicas(ownerObject.Spec.Parallelism)
+	}
+	// a DaemonSet runs its pods for as long as it exists
+	return true
 }
 
-// err = hook.Client.Get(
-// 	ctx,
-// 	types.NamespacedName{
-// 		Name: pod.Annotations["cache.spicedelver.me/cmtemplate"],
-// 	},
-// 	cmTemplate,
-// )
+// wantsReplicas reports whether a workload asks for any replicas, unset
+// meaning the default of one
+func wantsReplicas(replicas *int32) bool {
+	return replicas == nil || *replicas != 0
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	"github.com/stollenaar/cmstate-injector-operator/webhook/testutil"
+)
+
+const (
+	// burstSize is the number of pod admissions sent at once, like a large rollout
+	burstSize = 500
+	// burstNamespaces spreads the burst so it isn't dominated by conflicts on a single CMState
+	burstNamespaces = 50
+)
+
+func benchHook(b *testing.B) *cmStateCreator {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(cachev1alpha2.AddToScheme(scheme))
+
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	objs := []client.Object{
+		&cachev1alpha2.CMTemplate{
+			ObjectMeta: metav1.ObjectMeta{Name: testTemplateName},
+			Spec: cachev1alpha2.CMTemplateSpec{Template: cachev1alpha2.Template{
+				Data:             map[string]string{"config.hcl": "role = \"{role}\""},
+				TargetAnnotation: testTargetAnnotation,
+			}},
+		},
+	}
+	for i := 0; i < burstNamespaces; i++ {
+		objs = append(objs, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: benchNamespace(i)}})
+	}
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+	return &cmStateCreator{Client: c, Options: Options{TriggerAnnotation: DefaultTriggerAnnotation}, decoder: decoder}
+}
+
+func benchNamespace(i int) string {
+	return fmt.Sprintf("team-%d", i%burstNamespaces)
+}
+
+func benchRequests(b *testing.B) []admission.Request {
+	reqs := make([]admission.Request, burstSize)
+	for i := range reqs {
+		pod := &corev1.Pod{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        fmt.Sprintf("app-%d", i),
+				Namespace:   benchNamespace(i),
+				UID:         types.UID(fmt.Sprintf("app-%d-uid", i)),
+				Annotations: map[string]string{DefaultTriggerAnnotation: testTemplateName},
+			},
+		}
+		reqs[i] = testutil.NewPodCreateRequest(pod)
+	}
+	return reqs
+}
+
+// BenchmarkAdmissionBurst measures a burst of concurrent pod admissions
+// creating and joining the CMStates of their namespaces.
+func BenchmarkAdmissionBurst(b *testing.B) {
+	reqs := benchRequests(b)
+	var total int64
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		hook := benchHook(b)
+		b.StartTimer()
+
+		var wg sync.WaitGroup
+		for _, req := range reqs {
+			wg.Add(1)
+			go func(req admission.Request) {
+				defer wg.Done()
+				start := time.Now()
+				if resp := hook.Handle(context.Background(), req); !resp.Allowed {
+					b.Errorf("pod %s denied: %v", req.Name, resp.Result)
+				}
+				atomic.AddInt64(&total, int64(time.Since(start)))
+			}(req)
+		}
+		wg.Wait()
+	}
+	b.ReportMetric(float64(total)/float64(b.N*burstSize), "ns/admission")
+}
+
+// benchDeletedPod is a pod with a spec the size of a typical workload with a
+// sidecar, which a delete admission used to decode in full
+func benchDeletedPod() *corev1.Pod {
+	pod := &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app-1",
+			Namespace:   benchNamespace(0),
+			UID:         "app-1-uid",
+			Annotations: map[string]string{DefaultTriggerAnnotation: testTemplateName},
+		},
+	}
+	for c := 0; c < 2; c++ {
+		container := corev1.Container{
+			Name:    fmt.Sprintf("container-%d", c),
+			Image:   "registry.example.com/app:1.2.3",
+			Command: []string{"/bin/app", "--config", "/etc/app/config.yaml"},
+		}
+		for e := 0; e < 20; e++ {
+			container.Env = append(container.Env, corev1.EnvVar{Name: fmt.Sprintf("APP_SETTING_%d", e), Value: "value"})
+		}
+		for v := 0; v < 5; v++ {
+			name := fmt.Sprintf("volume-%d", v)
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: name, MountPath: "/mnt/" + name})
+			if c == 0 {
+				pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+					Name:         name,
+					VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+				})
+			}
+		}
+		pod.Spec.Containers = append(pod.Spec.Containers, container)
+	}
+	return pod
+}
+
+// BenchmarkDeleteAdmission measures the allocations of a delete admission
+// decoding the full pod against decoding only its metadata.
+func BenchmarkDeleteAdmission(b *testing.B) {
+	req := testutil.NewPodDeleteRequest(benchDeletedPod())
+	hook := benchHook(b)
+
+	b.Run("decode-pod", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			if err := hook.decoder.DecodeRaw(req.OldObject, &corev1.Pod{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("decode-metadata", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			if err := hook.decodeDeletedPod(context.Background(), req, &corev1.Pod{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("admission", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			if resp := hook.Handle(context.Background(), req); !resp.Allowed {
+				b.Fatalf("pod denied: %v", resp.Result)
+			}
+		}
+	})
+}
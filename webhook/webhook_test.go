@@ -0,0 +1,2524 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+
+	v1admission "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sigs.k8s.io/yaml"
+
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	"github.com/stollenaar/cmstate-injector-operator/webhook/testutil"
+)
+
+const (
+	testNamespace        = "default"
+	testTemplateName     = "vault-agent"
+	testTargetAnnotation = "vault.hashicorp.com/agent-configmap"
+)
+
+func newTestTemplate() *cachev1alpha2.CMTemplate {
+	return &cachev1alpha2.CMTemplate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: testTemplateName,
+		},
+		Spec: cachev1alpha2.CMTemplateSpec{
+			Template: cachev1alpha2.Template{
+				AnnotationReplace: []cachev1alpha2.KeyedReplacement{
+					{Key: "vault.hashicorp.com/role", Replacement: cachev1alpha2.Replacement{Placeholder: "{role}"}},
+				},
+				Data: map[string]string{
+					"config.hcl": "role = \"{role}\"",
+				},
+				TargetAnnotation: testTargetAnnotation,
+			},
+		},
+	}
+}
+
+func newTestPod(name string) *corev1.Pod {
+	return &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Pod",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			UID:       types.UID(name + "-uid"),
+			Annotations: map[string]string{
+				DefaultTriggerAnnotation:   testTemplateName,
+				"vault.hashicorp.com/role": "reader",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "busybox"}},
+		},
+	}
+}
+
+// testChecksum is the config checksum of the pod injected with the templates
+func testChecksum(pod *corev1.Pod, templates ...*cachev1alpha2.CMTemplate) string {
+	checksum, err := configChecksum(templates, pod)
+	Expect(err).NotTo(HaveOccurred())
+	return checksum
+}
+
+func newTestCMState(audience ...string) *cachev1alpha2.CMState {
+	cmState := &cachev1alpha2.CMState{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "cmstate-vault-agent",
+			Namespace: testNamespace,
+		},
+		Spec: cachev1alpha2.CMStateSpec{
+			Audience:    []cachev1alpha2.CMAudience{},
+			TemplateRef: cachev1alpha2.TemplateRef{Name: testTemplateName},
+		},
+	}
+	for _, name := range audience {
+		cmState.Spec.Audience = append(cmState.Spec.Audience, cachev1alpha2.CMAudience{Kind: "Pod", Name: name})
+	}
+	return cmState
+}
+
+// racingClient simulates another webhook replica creating the same CMState
+// between our Get and Create.
+type racingClient struct {
+	client.Client
+	winner *cachev1alpha2.CMState
+}
+
+func (c *racingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if _, ok := obj.(*cachev1alpha2.CMState); ok && c.winner != nil {
+		if err := c.Client.Create(ctx, c.winner); err != nil {
+			return err
+		}
+		c.winner = nil
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+// interferingClient lets another writer update the CMState right before our
+// first update goes through, so it fails with a conflict.
+type interferingClient struct {
+	client.Client
+	interfere func(ctx context.Context, c client.Client)
+}
+
+func (c *interferingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if c.interfere != nil {
+		c.interfere(ctx, c.Client)
+		c.interfere = nil
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+// failingGetClient fails every Get for objects of the same type as kind
+type failingGetClient struct {
+	client.Client
+	kind client.Object
+	err  error
+}
+
+func (c *failingGetClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if reflect.TypeOf(obj) == reflect.TypeOf(c.kind) {
+		return c.err
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+// failingUpdateClient fails every Update with err
+type failingUpdateClient struct {
+	client.Client
+	err error
+}
+
+func (c *failingUpdateClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return c.err
+}
+
+// failingCreateClient fails every Create with err
+type failingCreateClient struct {
+	client.Client
+	err error
+}
+
+func (c *failingCreateClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	return c.err
+}
+
+// staleCacheClient behaves like an informer cache that hasn't seen the
+// CMStates created by other replicas yet
+type staleCacheClient struct {
+	client.Client
+}
+
+func (c *staleCacheClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if _, ok := obj.(*cachev1alpha2.CMState); ok {
+		return apierrors.NewNotFound(cachev1alpha2.GroupVersion.WithResource("cmstates").GroupResource(), key.Name)
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+// laggingCacheClient behaves like an informer cache that hasn't seen the
+// latest update of the CMState yet, returning the version it was given
+type laggingCacheClient struct {
+	client.Client
+	cmState *cachev1alpha2.CMState
+}
+
+func (c *laggingCacheClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if cmState, ok := obj.(*cachev1alpha2.CMState); ok && key == client.ObjectKeyFromObject(c.cmState) {
+		c.cmState.DeepCopyInto(cmState)
+		return nil
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+// slowClient adds latency to every Get, giving up when the context is done
+// like a real client would
+type slowClient struct {
+	client.Client
+	latency time.Duration
+}
+
+func (c *slowClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	select {
+	case <-time.After(c.latency):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+// writeCountingClient counts the writes going through it
+type writeCountingClient struct {
+	client.Client
+	writes int
+}
+
+func (c *writeCountingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	c.writes++
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *writeCountingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	c.writes++
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c *writeCountingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	c.writes++
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func (c *writeCountingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	c.writes++
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+// newTestHook builds a hook whose client holds the objects and the test
+// namespace, unless the objects already contain a namespace.
+func newTestHook(objs ...client.Object) *cmStateCreator {
+	decoder, err := admission.NewDecoder(testScheme)
+	Expect(err).NotTo(HaveOccurred())
+
+	hasNamespace := false
+	for _, obj := range objs {
+		if _, ok := obj.(*corev1.Namespace); ok {
+			hasNamespace = true
+		}
+	}
+	if !hasNamespace {
+		objs = append(objs, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace}})
+	}
+
+	c := fake.NewClientBuilder().WithScheme(testScheme).WithObjects(objs...).
+		WithIndex(&cachev1alpha2.CMTemplate{}, aliasField, templateAliases).Build()
+	return &cmStateCreator{
+		Client:  c,
+		Options: Options{TriggerAnnotation: DefaultTriggerAnnotation},
+		decoder: decoder,
+	}
+}
+
+// review posts the request as an AdmissionReview to the handler over HTTP and
+// returns the review the API server would have received.
+func review(hook admission.Handler, req admission.Request) *v1admission.AdmissionReview {
+	wh := &webhook.Admission{Handler: hook}
+	Expect(wh.InjectLogger(logf.Log.WithName("test"))).To(Succeed())
+	server := httptest.NewServer(wh)
+	defer server.Close()
+
+	body, err := json.Marshal(v1admission.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+		},
+		Request: &req.AdmissionRequest,
+	})
+	Expect(err).NotTo(HaveOccurred())
+
+	resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+	Expect(err).NotTo(HaveOccurred())
+	defer resp.Body.Close()
+	Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+	out := &v1admission.AdmissionReview{}
+	Expect(json.NewDecoder(resp.Body).Decode(out)).To(Succeed())
+	Expect(out.Response).NotTo(BeNil())
+	return out
+}
+
+// applyPatch returns the pod the API server ends up with, the way it would
+// reinvoke the webhook with
+func applyPatch(pod *corev1.Pod, out *v1admission.AdmissionReview) *corev1.Pod {
+	patched, err := testutil.ApplyPatch(pod, out.Response.Patch)
+	Expect(err).NotTo(HaveOccurred())
+	return patched
+}
+
+func decodePatch(out *v1admission.AdmissionReview) []testutil.PatchOperation {
+	patch, err := testutil.DecodePatch(out.Response.Patch)
+	Expect(err).NotTo(HaveOccurred())
+	return patch
+}
+
+var _ = Describe("CMStateCreator", func() {
+	ctx := context.Background()
+
+	Context("when a pod with the cmtemplate annotation is created", func() {
+		It("decodes the pod, creates the cmstate and injects the target annotation", func() {
+			hook := newTestHook(newTestTemplate())
+			pod := newTestPod("app-1")
+
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(out.Response.UID).To(Equal(types.UID("req-app-1")))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.PatchType).NotTo(BeNil())
+
+			patch := decodePatch(out)
+			Expect(patch).To(ContainElement(testutil.PatchOperation{
+				Op:    "add",
+				Path:  "/metadata/annotations/vault.hashicorp.com~1agent-configmap",
+				Value: "cmstate-vault-agent",
+			}))
+
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			Expect(cmState.Spec.TemplateRef.Name).To(Equal(testTemplateName))
+			Expect(cmState.Labels).To(HaveKeyWithValue("vault.hashicorp.com/role", "reader"))
+			Expect(cmState.Spec.Audience).To(ConsistOf(And(
+				HaveField("Name", "app-1"),
+				HaveField("Namespace", testNamespace),
+				HaveField("UID", types.UID("app-1-uid")),
+				HaveField("AddedAt", Not(BeNil())),
+			)))
+		})
+
+		It("adds every pod using the template to the audience", func() {
+			hook := newTestHook(newTestTemplate())
+
+			for _, name := range []string{"app-1", "app-2"} {
+				out := review(hook, testutil.NewPodCreateRequest(newTestPod(name)))
+				Expect(out.Response.Allowed).To(BeTrue())
+			}
+			// a repeated admission of the same pod must not duplicate the entry
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-2"))).Response.Allowed).To(BeTrue())
+
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(ConsistOf(
+				HaveField("UID", types.UID("app-1-uid")),
+				HaveField("UID", types.UID("app-2-uid")),
+			))
+		})
+	})
+
+	Context("when replicas race to create the same cmstate", func() {
+		It("treats AlreadyExists as success and joins the audience", func() {
+			hook := newTestHook(newTestTemplate())
+			hook.Client = &racingClient{Client: hook.Client, winner: newTestCMState("app-1")}
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-2")))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).NotTo(BeEmpty())
+
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(ConsistOf(
+				HaveField("Name", "app-1"),
+				HaveField("Name", "app-2"),
+			))
+		})
+	})
+
+	Context("when the audience grows large", func() {
+		It("denies pods joining a full audience", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState("app-1", "app-2"))
+			hook.Options.MaxAudienceSize = 2
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-3")))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(string(out.Response.Result.Reason)).To(ContainSubstring("cmstate 'cmstate-vault-agent' reached its audience limit of 2 pods"))
+
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(HaveLen(2))
+		})
+
+		It("still admits replicas counted in an existing entry", func() {
+			cmState := newTestCMState()
+			cmState.Spec.Audience = append(cmState.Spec.Audience, cachev1alpha2.CMAudience{Kind: "Pod", Name: "app-", Count: 3})
+			hook := newTestHook(newTestTemplate(), cmState)
+			hook.Options.MaxAudienceSize = 1
+
+			pod := newTestPod("")
+			pod.GenerateName = "app-"
+			Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Allowed).To(BeTrue())
+		})
+
+		It("warns above the warning threshold", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState("app-1"))
+			recorder := record.NewFakeRecorder(10)
+			hook.Recorder = recorder
+			hook.Options.MaxAudienceSize = 10
+			hook.Options.AudienceSizeWarning = 1
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-2")))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Warnings).To(ConsistOf("cmstate-injector: cmstate 'cmstate-vault-agent' lists 2 pods, new pods are denied above 10"))
+			Expect(recorder.Events).To(Receive(Equal("Warning AudienceSizeWarning Audience is above 1 pods, new pods are denied above 10")))
+		})
+	})
+
+	Context("when a pod without the cmtemplate annotation is created", func() {
+		It("allows the pod without a patch", func() {
+			hook := newTestHook(newTestTemplate())
+			pod := newTestPod("plain")
+			pod.Annotations = map[string]string{}
+
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).To(BeEmpty())
+		})
+	})
+
+	Context("when a pod with the cmtemplate annotation is deleted", func() {
+		It("decodes the pod from OldObject and removes it from the audience", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState("app-1", "app-2"))
+			pod := newTestPod("app-1")
+
+			out := review(hook, testutil.NewPodDeleteRequest(pod))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).To(BeEmpty())
+
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(ConsistOf(HaveField("Name", "app-2")))
+		})
+
+		It("only decrements the shared entry of a generateName replica", func() {
+			hook := newTestHook(newTestTemplate())
+
+			for i := 0; i < 3; i++ {
+				pod := newTestPod("")
+				pod.GenerateName = "app-5d9f-"
+				Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Allowed).To(BeTrue())
+			}
+
+			pod := newTestPod("app-5d9f-x7k2p")
+			pod.GenerateName = "app-5d9f-"
+			Expect(review(hook, testutil.NewPodDeleteRequest(pod)).Response.Allowed).To(BeTrue())
+
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(ConsistOf(And(
+				HaveField("Name", "app-5d9f-"),
+				HaveField("Count", BeEquivalentTo(2)),
+			)))
+		})
+
+		Context("and its cmstate has an entry written before replicas were counted", func() {
+			legacyState := func() *cachev1alpha2.CMState {
+				cmState := newTestCMState()
+				cmState.Spec.Audience = []cachev1alpha2.CMAudience{{Kind: "Pod", Name: "app-5d9f-"}}
+				return cmState
+			}
+			replica := func() *corev1.Pod {
+				pod := newTestPod("app-5d9f-x7k2p")
+				pod.GenerateName = "app-5d9f-"
+				pod.OwnerReferences = []metav1.OwnerReference{controllerRef("apps/v1", "ReplicaSet", "app-5d9f")}
+				return pod
+			}
+			replicaSet := func(replicas *int32) *appsv1.ReplicaSet {
+				return &appsv1.ReplicaSet{
+					ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "app-5d9f", UID: "app-5d9f-uid"},
+					Spec:       appsv1.ReplicaSetSpec{Replicas: replicas},
+				}
+			}
+
+			It("keeps the entry while the ReplicaSet of the pod asks for replicas", func() {
+				cmState := legacyState()
+				hook := newTestHook(newTestTemplate(), cmState, replicaSet(pointer.Int32(2)))
+
+				Expect(review(hook, testutil.NewPodDeleteRequest(replica())).Response.Allowed).To(BeTrue())
+
+				Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+				Expect(cmState.Spec.Audience).To(ConsistOf(HaveField("Name", "app-5d9f-")))
+			})
+
+			It("keeps the entry when the ReplicaSet leaves its replicas unset", func() {
+				cmState := legacyState()
+				hook := newTestHook(newTestTemplate(), cmState, replicaSet(nil))
+
+				Expect(review(hook, testutil.NewPodDeleteRequest(replica())).Response.Allowed).To(BeTrue())
+
+				Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+				Expect(cmState.Spec.Audience).To(HaveLen(1))
+			})
+
+			It("drops the entry once the ReplicaSet is scaled to zero", func() {
+				cmState := legacyState()
+				hook := newTestHook(newTestTemplate(), cmState, replicaSet(pointer.Int32(0)))
+
+				Expect(review(hook, testutil.NewPodDeleteRequest(replica())).Response.Allowed).To(BeTrue())
+
+				Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+				Expect(cmState.Spec.Audience).To(BeEmpty())
+			})
+
+			It("drops the entry once the ReplicaSet is gone", func() {
+				cmState := legacyState()
+				hook := newTestHook(newTestTemplate(), cmState)
+
+				Expect(review(hook, testutil.NewPodDeleteRequest(replica())).Response.Allowed).To(BeTrue())
+
+				Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+				Expect(cmState.Spec.Audience).To(BeEmpty())
+			})
+		})
+
+		It("matches the audience entry by UID before the name", func() {
+			cmState := newTestCMState("app-1")
+			cmState.Spec.Audience[0].UID = "app-1-uid"
+			cmState.Spec.Audience = append(cmState.Spec.Audience, cachev1alpha2.CMAudience{Kind: "Pod", Name: "app-1", UID: "stale-uid"})
+			hook := newTestHook(newTestTemplate(), cmState)
+
+			Expect(review(hook, testutil.NewPodDeleteRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+
+			Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(ConsistOf(HaveField("UID", types.UID("stale-uid"))))
+		})
+
+		It("retries against the latest audience when another replica updated it", func() {
+			cmState := newTestCMState("app-1", "app-2")
+			hook := newTestHook(newTestTemplate(), cmState)
+			hook.Client = &interferingClient{
+				Client: hook.Client,
+				interfere: func(ctx context.Context, c client.Client) {
+					other := &cachev1alpha2.CMState{}
+					Expect(c.Get(ctx, client.ObjectKeyFromObject(cmState), other)).To(Succeed())
+					other.Spec.Audience = append(other.Spec.Audience, cachev1alpha2.CMAudience{Kind: "Pod", Name: "app-3"})
+					Expect(c.Update(ctx, other)).To(Succeed())
+				},
+			}
+
+			Expect(review(hook, testutil.NewPodDeleteRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+
+			Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(ConsistOf(
+				HaveField("Name", "app-2"),
+				HaveField("Name", "app-3"),
+			))
+		})
+
+		It("only decodes the pod's metadata", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState("app-1"))
+
+			// a spec that doesn't decode as a pod spec is never looked at
+			req := testutil.NewPodDeleteRequest(newTestPod("app-1"))
+			raw := map[string]interface{}{}
+			Expect(json.Unmarshal(req.OldObject.Raw, &raw)).To(Succeed())
+			raw["spec"] = map[string]interface{}{"containers": "not a list"}
+			var err error
+			req.OldObject.Raw, err = json.Marshal(raw)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(review(hook, req).Response.Allowed).To(BeTrue())
+
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(BeEmpty())
+		})
+
+		It("falls back to fetching the pod when OldObject is absent", func() {
+			pod := newTestPod("app-1")
+			hook := newTestHook(newTestTemplate(), newTestCMState("app-1"), pod.DeepCopy())
+
+			req := testutil.NewPodDeleteRequest(pod)
+			req.OldObject = runtime.RawExtension{}
+
+			out := review(hook, req)
+			Expect(out.Response.Allowed).To(BeTrue())
+
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(BeEmpty())
+		})
+	})
+
+	Context("when a pod is evicted", func() {
+		latest := func(hook *cmStateCreator) *cachev1alpha2.CMState {
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			return cmState
+		}
+
+		It("fetches the pod, removes it from the audience and records it on the cmstate", func() {
+			pod := newTestPod("app-1")
+			hook := newTestHook(newTestTemplate(), newTestCMState("app-1", "app-2"), pod.DeepCopy())
+
+			out := review(hook, testutil.NewPodEvictionRequest(pod))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).To(BeEmpty())
+			cmState := latest(hook)
+			Expect(cmState.Spec.Audience).To(ConsistOf(HaveField("Name", "app-2")))
+			Expect(cmState.Spec.Evicted).To(ConsistOf(And(HaveField("Name", "app-1"), HaveField("UID", pod.UID))))
+
+			// the pod itself is left as it is
+			stored := &corev1.Pod{}
+			Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(pod), stored)).To(Succeed())
+			Expect(stored.Annotations).To(Equal(pod.Annotations))
+		})
+
+		It("doesn't count the pod down again on a retried eviction or its deletion", func() {
+			pod := newTestPod("app-5d9f-x7k2p")
+			pod.GenerateName = "app-5d9f-"
+			cmState := newTestCMState()
+			cmState.Spec.Audience = []cachev1alpha2.CMAudience{{Kind: "Pod", Name: "app-5d9f-", Count: 3}}
+			hook := newTestHook(newTestTemplate(), cmState, pod.DeepCopy())
+
+			Expect(review(hook, testutil.NewPodEvictionRequest(pod)).Response.Allowed).To(BeTrue())
+			out := review(hook, testutil.NewPodEvictionRequest(pod))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(string(out.Response.Result.Reason)).To(ContainSubstring("already evicted"))
+			Expect(latest(hook).Spec.Audience).To(ConsistOf(HaveField("Count", BeEquivalentTo(2))))
+			Expect(latest(hook).Spec.Evicted).To(HaveLen(1))
+
+			Expect(review(hook, testutil.NewPodDeleteRequest(pod)).Response.Allowed).To(BeTrue())
+			Expect(latest(hook).Spec.Audience).To(ConsistOf(HaveField("Count", BeEquivalentTo(2))))
+			Expect(latest(hook).Spec.Evicted).To(BeEmpty())
+		})
+
+		It("admits the eviction of a pod that is already gone", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState("app-1"))
+
+			out := review(hook, testutil.NewPodEvictionRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(string(out.Response.Result.Reason)).To(ContainSubstring("already gone"))
+			Expect(latest(hook).Spec.Audience).To(HaveLen(1))
+			Expect(latest(hook).Spec.Evicted).To(BeEmpty())
+		})
+
+		It("doesn't write on a dry run", func() {
+			pod := newTestPod("app-1")
+			hook := newTestHook(newTestTemplate(), newTestCMState("app-1"), pod.DeepCopy())
+			counter := &writeCountingClient{Client: hook.Client}
+			hook.Client = counter
+
+			Expect(review(hook, testutil.DryRun(testutil.NewPodEvictionRequest(pod))).Response.Allowed).To(BeTrue())
+			Expect(counter.writes).To(BeZero())
+			Expect(latest(hook).Spec.Evicted).To(BeEmpty())
+		})
+	})
+
+	Context("when the pod has no annotations map", func() {
+		It("initializes the annotations instead of panicking", func() {
+			hook := newTestHook(newTestTemplate())
+			pod := newTestPod("bare")
+			pod.Annotations = nil
+
+			_, _, err := hook.injectTemplate(ctx, &cachev1alpha2.CMState{}, newTestTemplate(), pod)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pod.Annotations).To(HaveKeyWithValue(testTargetAnnotation, "cmstate-vault-agent"))
+		})
+
+		It("generates a cmstate with only the labels of the operator", func() {
+			pod := newTestPod("bare")
+			pod.Annotations = nil
+
+			cmState := generateCMState(newTestTemplate(), "cmstate-vault-agent", pod, nil)
+			Expect(cmState.Name).To(Equal("cmstate-vault-agent"))
+			Expect(cmState.Labels).To(Equal(map[string]string{
+				cachev1alpha2.ManagedByLabel: cachev1alpha2.ManagedByValue,
+				cachev1alpha2.TemplateLabel:  testTemplateName,
+			}))
+		})
+
+		It("propagates the metadata of the template with the keys of the operator winning", func() {
+			cmTemplate := newTestTemplate()
+			cmTemplate.Spec.Metadata = &cachev1alpha2.Metadata{
+				Labels: map[string]string{
+					"team":                       "payments",
+					cachev1alpha2.ManagedByLabel: "argocd",
+					"vault.hashicorp.com/role":   "admin",
+				},
+				Annotations: map[string]string{"argocd.argoproj.io/compare-options": "IgnoreExtraneous"},
+			}
+
+			cmState := generateCMState(cmTemplate, "cmstate-vault-agent", newTestPod("app-1"), nil)
+			Expect(cmState.Labels).To(HaveKeyWithValue("team", "payments"))
+			Expect(cmState.Labels).To(HaveKeyWithValue(cachev1alpha2.ManagedByLabel, cachev1alpha2.ManagedByValue))
+			Expect(cmState.Labels).To(HaveKeyWithValue("vault.hashicorp.com/role", "reader"))
+			Expect(cmState.Annotations).To(HaveKeyWithValue("argocd.argoproj.io/compare-options", "IgnoreExtraneous"))
+		})
+
+		DescribeTable("keeps the label values of the cmstate valid",
+			func(value string) {
+				pod := newTestPod("app-1")
+				pod.Annotations["vault.hashicorp.com/role"] = value
+
+				cmState := generateCMState(newTestTemplate(), "cmstate-vault-agent", pod, nil)
+				label := cmState.Labels["vault.hashicorp.com/role"]
+				Expect(validation.IsValidLabelValue(label)).To(BeEmpty())
+				Expect(cmState.Annotations).To(HaveKeyWithValue("vault.hashicorp.com/role", value))
+
+				pod.Annotations["vault.hashicorp.com/role"] = value + "x"
+				Expect(generateCMState(newTestTemplate(), "cmstate-vault-agent", pod, nil).Labels["vault.hashicorp.com/role"]).NotTo(Equal(label))
+			},
+			Entry("a url", "https://vault.example.com:8200/v1/auth"),
+			Entry("an email", "team-platform@example.com"),
+			Entry("a long string", strings.Repeat("reader", 20)),
+			Entry("spaces and leading punctuation", "  read only "),
+		)
+
+		It("leaves valid label values as they are", func() {
+			cmState := generateCMState(newTestTemplate(), "cmstate-vault-agent", newTestPod("app-1"), nil)
+			Expect(cmState.Labels).To(HaveKeyWithValue("vault.hashicorp.com/role", "reader"))
+		})
+	})
+
+	Context("when the template name has label placeholders", func() {
+		newLabeledPod := func(name string) *corev1.Pod {
+			pod := newTestPod(name)
+			pod.Labels = map[string]string{"app": "vault", "team": "agent"}
+			pod.Annotations[DefaultTriggerAnnotation] = "{app}-{team}"
+			return pod
+		}
+
+		It("injects the template named after the pod's labels", func() {
+			hook := newTestHook(newTestTemplate())
+			pod := newLabeledPod("app-1")
+
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(out.Response.Allowed).To(BeTrue())
+			patched := applyPatch(pod, out)
+			Expect(patched.Annotations).To(HaveKeyWithValue(TemplatesUsedAnnotation, testTemplateName))
+			Expect(patched.Annotations).To(HaveKeyWithValue(CMStateAnnotation, "cmstate-vault-agent"))
+			Expect(patched.Annotations).To(HaveKeyWithValue(DefaultTriggerAnnotation, "{app}-{team}"))
+
+			out = review(hook, testutil.NewPodDeleteRequest(patched))
+			Expect(out.Response.Allowed).To(BeTrue())
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(BeEmpty())
+		})
+
+		It("denies the pod when a referenced label is missing", func() {
+			hook := newTestHook(newTestTemplate())
+			pod := newLabeledPod("app-1")
+			delete(pod.Labels, "team")
+
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(string(out.Response.Result.Reason)).To(Equal("cmstate-injector: template '{app}-{team}' references label 'team' the pod doesn't have"))
+		})
+
+		It("collapses placeholders resolving to the same template", func() {
+			hook := newTestHook()
+			pod := newLabeledPod("app-1")
+			pod.Annotations[DefaultTriggerAnnotation] = "{app}-agent,vault-{team}"
+
+			Expect(hook.templateNames(pod)).To(Equal([]string{testTemplateName}))
+		})
+	})
+
+	Context("when naming the cmstate", func() {
+		It("keeps names that are valid already", func() {
+			Expect(generateName("vault-agent")).To(Equal("cmstate-vault-agent"))
+		})
+
+		DescribeTable("generates valid names that don't collide",
+			func(templateName, other string) {
+				name := generateName(templateName)
+				Expect(validation.IsDNS1123Subdomain(name)).To(BeEmpty())
+				Expect(name).To(HavePrefix("cmstate-"))
+				Expect(name).NotTo(Equal(generateName(other)))
+				Expect(generateName(templateName)).To(Equal(name))
+			},
+			Entry("dots", "my.config", "my-config"),
+			Entry("underscores", "my_config", "my-config"),
+			Entry("a long name", strings.Repeat("a", 250), strings.Repeat("a", 251)),
+		)
+
+		It("joins the cmstate created under the legacy name", func() {
+			cmTemplate := newTestTemplate()
+			cmTemplate.Name = "vault.agent"
+			cmState := newTestCMState("app-1")
+			cmState.Name = "cmstate-vault.agent"
+			cmState.Spec.TemplateRef.Name = "vault.agent"
+			hook := newTestHook(cmTemplate, cmState)
+			pod := newTestPod("app-2")
+			pod.Annotations[DefaultTriggerAnnotation] = "vault.agent"
+
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(applyPatch(pod, out).Annotations).To(HaveKeyWithValue(CMStateAnnotation, "cmstate-vault.agent"))
+
+			list := &cachev1alpha2.CMStateList{}
+			Expect(hook.Client.List(ctx, list)).To(Succeed())
+			Expect(list.Items).To(ConsistOf(HaveField("Spec.Audience", HaveLen(2))))
+		})
+
+		It("removes pods injected before the cmstate was recorded from the legacy name", func() {
+			pod := newTestPod("app-1")
+			pod.Annotations[DefaultTriggerAnnotation] = "vault.agent"
+			Expect(recordedCMState(pod, "vault.agent")).To(Equal("cmstate-vault.agent"))
+		})
+	})
+
+	Context("when an existing pod is updated", func() {
+		It("injects the pod when the annotation is added", func() {
+			hook := newTestHook(newTestTemplate())
+			oldPod := newTestPod("app-1")
+			delete(oldPod.Annotations, DefaultTriggerAnnotation)
+
+			out := review(hook, testutil.NewPodUpdateRequest(oldPod, newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).NotTo(BeEmpty())
+
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(ConsistOf(HaveField("Name", "app-1")))
+		})
+
+		It("drops the pod from the audience when the annotation is removed", func() {
+			cmState := newTestCMState("app-1", "app-2")
+			hook := newTestHook(newTestTemplate(), cmState)
+			pod := newTestPod("app-1")
+			delete(pod.Annotations, DefaultTriggerAnnotation)
+
+			out := review(hook, testutil.NewPodUpdateRequest(newTestPod("app-1"), pod))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).To(BeEmpty())
+
+			Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(ConsistOf(HaveField("Name", "app-2")))
+		})
+
+		It("ignores updates that leave the annotation alone", func() {
+			cmState := newTestCMState("app-1")
+			hook := newTestHook(newTestTemplate(), cmState)
+			pod := newTestPod("app-1")
+			pod.Labels = map[string]string{"touched": "true"}
+
+			out := review(hook, testutil.NewPodUpdateRequest(newTestPod("app-1"), pod))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).To(BeEmpty())
+
+			Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(HaveLen(1))
+		})
+	})
+
+	Context("when a pod asks for several templates", func() {
+		It("injects each template into its own annotation", func() {
+			appTemplate := newTestTemplate()
+			appTemplate.Name = "app-config"
+			appTemplate.Spec.Template.TargetAnnotation = "example.com/app-configmap"
+			hook := newTestHook(newTestTemplate(), appTemplate)
+			pod := newTestPod("app-1")
+			pod.Annotations[DefaultTriggerAnnotation] = "vault-agent, app-config"
+
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Warnings).To(BeEmpty())
+
+			patch := decodePatch(out)
+			Expect(patch).To(ContainElements(
+				HaveField("Value", "cmstate-vault-agent"),
+				HaveField("Value", "cmstate-app-config"),
+			))
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-app-config"}, &cachev1alpha2.CMState{})).To(Succeed())
+		})
+
+		It("still injects the others with a warning when one is missing", func() {
+			hook := newTestHook(newTestTemplate())
+			pod := newTestPod("app-1")
+			pod.Annotations[DefaultTriggerAnnotation] = "vault-agent,missing"
+
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).NotTo(BeEmpty())
+			Expect(out.Response.Warnings).To(ConsistOf(ContainSubstring("'missing' not found")))
+		})
+
+		It("writes none of the cmstates when a later template denies the pod", func() {
+			appTemplate := newTestTemplate()
+			appTemplate.Name = "app-config"
+			appTemplate.Spec.Template.TargetAnnotation = "example.com/app-configmap"
+			appTemplate.Spec.AllowedServiceAccounts = []string{"default/app-reader"}
+			hook := newTestHook(newTestTemplate(), appTemplate, newTestCMState())
+			pod := newTestPod("app-1")
+			pod.Annotations[DefaultTriggerAnnotation] = "vault-agent,app-config"
+
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(string(out.Response.Result.Reason)).To(ContainSubstring("not allowed to use template 'app-config'"))
+
+			list := &cachev1alpha2.CMStateList{}
+			Expect(hook.Client.List(ctx, list)).To(Succeed())
+			Expect(list.Items).To(ConsistOf(And(
+				HaveField("Name", "cmstate-vault-agent"),
+				HaveField("Spec.Audience", BeEmpty()),
+			)))
+		})
+	})
+
+	Context("when recording the injection on the pod", func() {
+		It("stamps the operator version, templates and cmstates", func() {
+			appTemplate := newTestTemplate()
+			appTemplate.Name = "app-config"
+			appTemplate.Spec.Template.TargetAnnotation = "example.com/app-configmap"
+			hook := newTestHook(newTestTemplate(), appTemplate)
+			hook.Options.Version = "v0.2.0"
+			pod := newTestPod("app-1")
+			pod.Annotations[DefaultTriggerAnnotation] = "vault-agent,app-config"
+
+			pod = applyPatch(pod, review(hook, testutil.NewPodCreateRequest(pod)))
+			Expect(pod.Annotations).To(HaveKeyWithValue(InjectedByAnnotation, "cmstate-injector-operator/v0.2.0"))
+			Expect(pod.Annotations).To(HaveKeyWithValue(TemplatesUsedAnnotation, "vault-agent,app-config"))
+			Expect(pod.Annotations).To(HaveKeyWithValue(CMStateAnnotation, "cmstate-vault-agent,cmstate-app-config"))
+		})
+
+		It("removes the pod from the recorded cmstate on delete", func() {
+			recorded := newTestCMState("app-1")
+			recorded.Name = "cmstate-renamed"
+			hook := newTestHook(newTestTemplate(), recorded, newTestCMState("app-1"))
+			pod := newTestPod("app-1")
+			pod.Annotations[TemplatesUsedAnnotation] = testTemplateName
+			pod.Annotations[CMStateAnnotation] = "cmstate-renamed"
+
+			Expect(review(hook, testutil.NewPodDeleteRequest(pod)).Response.Allowed).To(BeTrue())
+
+			Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(recorded), recorded)).To(Succeed())
+			Expect(recorded.Spec.Audience).To(BeEmpty())
+			generated := newTestCMState()
+			Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(generated), generated)).To(Succeed())
+			Expect(generated.Spec.Audience).To(HaveLen(1))
+		})
+
+		It("falls back to the generated name for pods injected before", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState("app-1"))
+			pod := newTestPod("app-1")
+			pod.Annotations[TemplatesUsedAnnotation] = "vault-agent,app-config"
+			pod.Annotations[CMStateAnnotation] = "cmstate-vault-agent"
+
+			Expect(review(hook, testutil.NewPodDeleteRequest(pod)).Response.Allowed).To(BeTrue())
+
+			cmState := newTestCMState()
+			Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(BeEmpty())
+		})
+	})
+
+	Context("when the pod or its namespace is terminating", func() {
+		It("skips terminating pods", func() {
+			hook := newTestHook(newTestTemplate())
+			pod := newTestPod("app-1")
+			pod.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+
+			out := review(hook, testutil.NewPodUpdateRequest(newTestPod("app-1"), pod))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(string(out.Response.Result.Reason)).To(ContainSubstring("terminating pod"))
+		})
+
+		It("skips creates and deletes in a terminating namespace", func() {
+			namespace := &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{Name: testNamespace},
+				Status:     corev1.NamespaceStatus{Phase: corev1.NamespaceTerminating},
+			}
+			hook := newTestHook(namespace, newTestTemplate(), newTestCMState("app-1"))
+			counter := &writeCountingClient{Client: hook.Client}
+			hook.Client = counter
+
+			for _, newRequest := range []func(*corev1.Pod) admission.Request{testutil.NewPodCreateRequest, testutil.NewPodDeleteRequest} {
+				out := review(hook, newRequest(newTestPod("app-2")))
+				Expect(out.Response.Allowed).To(BeTrue())
+				Expect(out.Response.Patch).To(BeEmpty())
+				Expect(string(out.Response.Result.Reason)).To(ContainSubstring("terminating namespace"))
+			}
+			Expect(counter.writes).To(BeZero())
+		})
+	})
+
+	Context("when the namespace names a default template", func() {
+		var hook *cmStateCreator
+
+		BeforeEach(func() {
+			namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:        testNamespace,
+				Annotations: map[string]string{NamespaceDefaultTemplateAnnotation: testTemplateName},
+			}}
+			appTemplate := newTestTemplate()
+			appTemplate.Name = "app-config"
+			appTemplate.Spec.Template.TargetAnnotation = "example.com/app-configmap"
+			hook = newTestHook(namespace, newTestTemplate(), appTemplate)
+			hook.Options.NamespaceDefaultTemplate = true
+		})
+
+		unannotatedPod := func() *corev1.Pod {
+			pod := newTestPod("app-1")
+			delete(pod.Annotations, DefaultTriggerAnnotation)
+			return pod
+		}
+
+		It("is ignored unless enabled", func() {
+			hook.Options.NamespaceDefaultTemplate = false
+			Expect(review(hook, testutil.NewPodCreateRequest(unannotatedPod())).Response.Patch).To(BeEmpty())
+		})
+
+		It("injects pods without the annotation and records the template on them", func() {
+			out := review(hook, testutil.NewPodCreateRequest(unannotatedPod()))
+
+			patch := decodePatch(out)
+			Expect(patch).To(ConsistOf(
+				testutil.PatchOperation{Op: "add", Path: "/metadata/annotations/cache.spicedelver.me~1cmstate", Value: "cmstate-vault-agent"},
+				testutil.PatchOperation{Op: "add", Path: "/metadata/annotations/cache.spicedelver.me~1cmtemplate-used", Value: testTemplateName},
+				testutil.PatchOperation{Op: "add", Path: "/metadata/annotations/cache.spicedelver.me~1config-checksum", Value: testChecksum(unannotatedPod(), newTestTemplate())},
+				testutil.PatchOperation{Op: "add", Path: "/metadata/annotations/cache.spicedelver.me~1injected-by", Value: "cmstate-injector-operator"},
+				testutil.PatchOperation{Op: "add", Path: "/metadata/annotations/cache.spicedelver.me~1cmtemplate", Value: testTemplateName},
+				testutil.PatchOperation{Op: "add", Path: "/metadata/annotations/vault.hashicorp.com~1agent-configmap", Value: "cmstate-vault-agent"},
+			))
+		})
+
+		It("lets the pod annotation override the namespace default", func() {
+			pod := newTestPod("app-1")
+			pod.Annotations[DefaultTriggerAnnotation] = "app-config"
+
+			review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-app-config"}, &cachev1alpha2.CMState{})).To(Succeed())
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, &cachev1alpha2.CMState{})).NotTo(Succeed())
+		})
+	})
+
+	Context("when the pod opts out", func() {
+		optedOutPod := func() *corev1.Pod {
+			pod := newTestPod("app-1")
+			pod.Annotations[InjectAnnotation] = "false"
+			return pod
+		}
+
+		It("wins over the trigger annotation and namespace default", func() {
+			namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:        testNamespace,
+				Annotations: map[string]string{NamespaceDefaultTemplateAnnotation: testTemplateName},
+			}}
+			hook := newTestHook(namespace, newTestTemplate())
+			hook.Options.NamespaceDefaultTemplate = true
+			counter := &writeCountingClient{Client: hook.Client}
+			hook.Client = counter
+
+			out := review(hook, testutil.NewPodCreateRequest(optedOutPod()))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).To(BeEmpty())
+			Expect(string(out.Response.Result.Reason)).To(ContainSubstring(InjectAnnotation))
+			Expect(counter.writes).To(BeZero())
+		})
+
+		It("leaves the audience alone on delete", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState("app-1"))
+
+			Expect(review(hook, testutil.NewPodDeleteRequest(optedOutPod())).Response.Allowed).To(BeTrue())
+
+			cmState := newTestCMState()
+			Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(HaveLen(1))
+		})
+	})
+
+	Context("when the pod is owned by the kubelet", func() {
+		DescribeTable("admits it without touching the cmstate",
+			func(newRequest func(*corev1.Pod) admission.Request, mirror func(pod *corev1.Pod)) {
+				hook := newTestHook(newTestTemplate(), newTestCMState("kube-apiserver-node-1"))
+				counter := &writeCountingClient{Client: hook.Client}
+				hook.Client = counter
+
+				pod := newTestPod("kube-apiserver-node-1")
+				mirror(pod)
+
+				out := review(hook, newRequest(pod))
+				Expect(out.Response.Allowed).To(BeTrue())
+				Expect(out.Response.Patch).To(BeEmpty())
+				Expect(string(out.Response.Result.Reason)).To(Equal("skipping cmstate check due to static or mirror pod"))
+				Expect(counter.writes).To(BeZero())
+			},
+			Entry("a mirror pod on create", testutil.NewPodCreateRequest, func(pod *corev1.Pod) {
+				pod.Annotations[corev1.MirrorPodAnnotationKey] = "0a1b2c3d"
+			}),
+			Entry("a mirror pod on delete", testutil.NewPodDeleteRequest, func(pod *corev1.Pod) {
+				pod.Annotations[corev1.MirrorPodAnnotationKey] = "0a1b2c3d"
+			}),
+			Entry("a pod read from a manifest", testutil.NewPodCreateRequest, func(pod *corev1.Pod) {
+				pod.Annotations["kubernetes.io/config.source"] = "file"
+			}),
+			Entry("a pod controlled by its node", testutil.NewPodCreateRequest, func(pod *corev1.Pod) {
+				pod.OwnerReferences = []metav1.OwnerReference{{
+					APIVersion: "v1",
+					Kind:       "Node",
+					Name:       "node-1",
+					Controller: pointer.Bool(true),
+				}}
+			}),
+			Entry("a static pod named after its node", testutil.NewPodCreateRequest, func(pod *corev1.Pod) {
+				pod.Annotations["kubernetes.io/config.hash"] = "0a1b2c3d"
+				pod.Spec.NodeName = "node-1"
+			}),
+		)
+
+		It("still injects pods that are only named like a static pod", func() {
+			hook := newTestHook(newTestTemplate())
+			pod := newTestPod("web-node-1")
+			pod.Spec.NodeName = "node-1"
+
+			Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Patch).NotTo(BeEmpty())
+		})
+	})
+
+	Context("when a subresource is updated", func() {
+		It("admits ephemeral containers without decoding or writing", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState("app-1"))
+			counter := &writeCountingClient{Client: hook.Client}
+			hook.Client = counter
+
+			req := testutil.NewPodUpdateRequest(newTestPod("app-1"), newTestPod("app-1"))
+			req.SubResource = "ephemeralcontainers"
+			// what API servers before 1.25 send for the subresource
+			req.Object = runtime.RawExtension{Raw: []byte(`{"apiVersion":"v1","kind":"EphemeralContainers","ephemeralContainers":[{"name":"debugger"}]}`)}
+
+			out := review(hook, req)
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).To(BeEmpty())
+			Expect(string(out.Response.Result.Reason)).To(ContainSubstring("ephemeralcontainers subresource"))
+			Expect(counter.writes).To(BeZero())
+		})
+	})
+
+	Context("when the API server is slow", func() {
+		var hook *cmStateCreator
+
+		BeforeEach(func() {
+			hook = newTestHook(newTestTemplate())
+			hook.Client = &slowClient{Client: hook.Client, latency: 50 * time.Millisecond}
+			hook.Options.Timeout = 20 * time.Millisecond
+		})
+
+		It("admits the pod with a warning once the timeout passes", func() {
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).To(BeEmpty())
+			Expect(out.Response.Warnings).To(ConsistOf("cmstate-injector: timed out after 20ms, pod admitted without injection"))
+		})
+
+		It("fails the admission with the error policy", func() {
+			hook.Options.TimeoutPolicy = TimeoutError
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(out.Response.Result.Code).To(BeEquivalentTo(http.StatusGatewayTimeout))
+		})
+
+		It("doesn't get in the way of calls finishing in time", func() {
+			hook.Options.Timeout = time.Second
+
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Patch).NotTo(BeEmpty())
+		})
+	})
+
+	Context("when recording events", func() {
+		var (
+			hook     *cmStateCreator
+			recorder *record.FakeRecorder
+		)
+
+		newRecordingHook := func(objs ...client.Object) *cmStateCreator {
+			hook := newTestHook(objs...)
+			recorder = record.NewFakeRecorder(10)
+			recorder.IncludeObject = true
+			hook.Recorder = recorder
+			return hook
+		}
+
+		// replica returns a pod of the ReplicaSet as the API server sends it
+		// at admission, without a name or UID yet
+		replica := func() *corev1.Pod {
+			pod := newTestPod("")
+			pod.GenerateName = "app-5d8f7-"
+			pod.UID = ""
+			pod.OwnerReferences = []metav1.OwnerReference{controllerRef("apps/v1", "ReplicaSet", "app-5d8f7")}
+			return pod
+		}
+
+		It("records the injected configmap on the workload creating the pod", func() {
+			hook = newRecordingHook(newTestTemplate())
+
+			Expect(review(hook, testutil.NewPodCreateRequest(replica())).Response.Allowed).To(BeTrue())
+			Expect(recorder.Events).To(Receive(Equal("Normal Injected Pod app-5d8f7-: Injected ConfigMap cmstate-vault-agent from template vault-agent involvedObject{kind=ReplicaSet,apiVersion=apps/v1}")))
+		})
+
+		It("records a missing template as a warning", func() {
+			hook = newRecordingHook()
+
+			Expect(review(hook, testutil.NewPodCreateRequest(replica())).Response.Allowed).To(BeTrue())
+			Expect(recorder.Events).To(Receive(HavePrefix("Warning InjectionFailed Pod app-5d8f7-: Injection failed: template 'vault-agent' not found")))
+		})
+
+		It("records why an opted out pod is skipped", func() {
+			hook = newRecordingHook(newTestTemplate())
+			pod := replica()
+			pod.Annotations[InjectAnnotation] = "false"
+
+			Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Allowed).To(BeTrue())
+			Expect(recorder.Events).To(Receive(HavePrefix("Normal InjectionSkipped Pod app-5d8f7-: ")))
+		})
+
+		It("records a failed audience removal", func() {
+			hook = newRecordingHook(newTestTemplate(), newTestCMState("app-1"))
+			hook.Client = &failingUpdateClient{Client: hook.Client, err: apierrors.NewServiceUnavailable("etcd is down")}
+
+			Expect(review(hook, testutil.NewPodDeleteRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+			Expect(recorder.Events).To(Receive(And(
+				HavePrefix("Warning AudienceRemovalFailed Removing pod from cmstate 'cmstate-vault-agent' failed"),
+				HaveSuffix("involvedObject{kind=Pod,apiVersion=v1}"),
+			)))
+		})
+
+		It("records nothing for dry runs or pods created without a workload", func() {
+			hook = newRecordingHook(newTestTemplate(), newTestCMState())
+			req := testutil.DryRun(testutil.NewPodCreateRequest(replica()))
+			Expect(review(hook, req).Response.Allowed).To(BeTrue())
+
+			pod := newTestPod("app-1")
+			pod.UID = ""
+			Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Allowed).To(BeTrue())
+			Expect(recorder.Events).To(BeEmpty())
+		})
+	})
+
+	Context("when running in log-only mode", func() {
+		admissions := func(op v1admission.Operation, decision string) float64 {
+			return promtestutil.ToFloat64(admissionsTotal.WithLabelValues(string(op), decision, testTemplateName))
+		}
+
+		newLogOnlyHook := func(objs ...client.Object) *cmStateCreator {
+			hook := newTestHook(objs...)
+			hook.Options.MutationMode = MutationLogOnly
+			return hook
+		}
+
+		It("admits the pod unmodified without creating the cmstate", func() {
+			hook := newLogOnlyHook(newTestTemplate())
+			wouldInject := admissions(v1admission.Create, decisionWouldInject)
+			injected := admissions(v1admission.Create, decisionInjected)
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).To(BeEmpty())
+			Expect(string(out.Response.Result.Reason)).To(Equal("log-only mode, pod admitted unmodified"))
+
+			cmStates := &cachev1alpha2.CMStateList{}
+			Expect(hook.Client.List(ctx, cmStates)).To(Succeed())
+			Expect(cmStates.Items).To(BeEmpty())
+			Expect(admissions(v1admission.Create, decisionWouldInject)).To(Equal(wouldInject + 1))
+			Expect(admissions(v1admission.Create, decisionInjected)).To(Equal(injected))
+		})
+
+		It("leaves the audience alone on delete", func() {
+			hook := newLogOnlyHook(newTestTemplate(), newTestCMState("app-1"))
+			wouldRemove := admissions(v1admission.Delete, decisionWouldRemove)
+
+			Expect(review(hook, testutil.NewPodDeleteRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+
+			cmState := newTestCMState()
+			Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(HaveLen(1))
+			Expect(admissions(v1admission.Delete, decisionWouldRemove)).To(Equal(wouldRemove + 1))
+		})
+
+		It("admits pods it would have denied", func() {
+			hook := newLogOnlyHook()
+			hook.Options.MissingTemplatePolicy = MissingTemplateDeny
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).To(BeEmpty())
+		})
+
+		It("records no events", func() {
+			hook := newLogOnlyHook(newTestTemplate())
+			recorder := record.NewFakeRecorder(10)
+			hook.Recorder = recorder
+
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+			Expect(recorder.Events).To(BeEmpty())
+		})
+	})
+
+	Context("when recording metrics", func() {
+		admissions := func(op v1admission.Operation, decision, template string) float64 {
+			return promtestutil.ToFloat64(admissionsTotal.WithLabelValues(string(op), decision, template))
+		}
+
+		It("counts decisions per template", func() {
+			hook := newTestHook(newTestTemplate())
+			injected := admissions(v1admission.Create, decisionInjected, testTemplateName)
+			removed := admissions(v1admission.Delete, decisionRemoved, testTemplateName)
+
+			review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			review(hook, testutil.NewPodDeleteRequest(newTestPod("app-1")))
+
+			Expect(admissions(v1admission.Create, decisionInjected, testTemplateName)).To(Equal(injected + 1))
+			Expect(admissions(v1admission.Delete, decisionRemoved, testTemplateName)).To(Equal(removed + 1))
+		})
+
+		It("never labels with names of missing templates", func() {
+			hook := newTestHook()
+			pod := newTestPod("app-1")
+			pod.Annotations[DefaultTriggerAnnotation] = "does-not-exist"
+
+			review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(admissions(v1admission.Create, decisionSkipped, "does-not-exist")).To(BeZero())
+		})
+
+		It("counts errors by reason", func() {
+			hook := newTestHook(newTestTemplate())
+			hook.Client = &failingGetClient{Client: hook.Client, kind: &cachev1alpha2.CMTemplate{}, err: apierrors.NewServiceUnavailable("etcd is down")}
+			before := promtestutil.ToFloat64(errorsTotal.WithLabelValues(errorCMTemplateLookup))
+
+			review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(promtestutil.ToFloat64(errorsTotal.WithLabelValues(errorCMTemplateLookup))).To(Equal(before + 1))
+		})
+	})
+
+	Context("when the API server speaks an older review version", func() {
+		DescribeTable("answers in the version of the review",
+			func(apiVersion string) {
+				hook := newTestHook(newTestTemplate())
+				pod := newTestPod("app-1")
+				req := testutil.NewPodCreateRequest(pod)
+
+				wh := &webhook.Admission{Handler: hook}
+				Expect(wh.InjectLogger(logf.Log.WithName("test"))).To(Succeed())
+				server := httptest.NewServer(wh)
+				defer server.Close()
+
+				body, err := json.Marshal(map[string]interface{}{
+					"apiVersion": apiVersion,
+					"kind":       "AdmissionReview",
+					"request":    req.AdmissionRequest,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+				Expect(err).NotTo(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				out := &v1admission.AdmissionReview{}
+				Expect(json.NewDecoder(resp.Body).Decode(out)).To(Succeed())
+				Expect(out.APIVersion).To(Equal(apiVersion))
+				Expect(out.Kind).To(Equal("AdmissionReview"))
+				Expect(out.Response.UID).To(Equal(req.UID))
+				Expect(out.Response.Allowed).To(BeTrue())
+				Expect(out.Response.PatchType).To(HaveValue(Equal(v1admission.PatchTypeJSONPatch)))
+				Expect(applyPatch(pod, out).Annotations).To(HaveKeyWithValue(testTargetAnnotation, "cmstate-vault-agent"))
+			},
+			Entry("admission.k8s.io/v1", "admission.k8s.io/v1"),
+			Entry("admission.k8s.io/v1beta1", "admission.k8s.io/v1beta1"),
+		)
+
+		It("registers both review versions", func() {
+			raw, err := os.ReadFile("../config/webhook/manifests.yaml")
+			Expect(err).NotTo(HaveOccurred())
+			config := &admissionregistrationv1.MutatingWebhookConfiguration{}
+			Expect(yaml.Unmarshal(raw, config)).To(Succeed())
+			Expect(config.Webhooks[0].AdmissionReviewVersions).To(ConsistOf("v1", "v1beta1"))
+		})
+	})
+
+	Context("when configuring the webhook server", func() {
+		It("serves the path of the generated webhook configuration by default", func() {
+			raw, err := os.ReadFile("../config/webhook/manifests.yaml")
+			Expect(err).NotTo(HaveOccurred())
+			config := &admissionregistrationv1.MutatingWebhookConfiguration{}
+			Expect(yaml.Unmarshal(raw, config)).To(Succeed())
+
+			paths := make([]string, 0, len(config.Webhooks))
+			for _, wh := range config.Webhooks {
+				paths = append(paths, *wh.ClientConfig.Service.Path)
+			}
+			Expect(paths).To(ConsistOf(DefaultWebhookPath, TemplateDefaultingWebhookPath))
+		})
+
+		It("fails fast on a path not starting with a slash", func() {
+			Expect(CMStateCreator(nil, Options{Path: "mutate-v1-pod"})).To(MatchError(ContainSubstring("must start with /")))
+		})
+
+		It("fails fast on an invalid port", func() {
+			Expect(CMStateCreator(nil, Options{Port: 70000})).To(MatchError(ContainSubstring("invalid webhook port")))
+		})
+
+		It("applies the TLS min version and cipher suites", func() {
+			opt, err := tlsConfig("1.2", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"})
+			Expect(err).NotTo(HaveOccurred())
+
+			config := &tls.Config{}
+			opt(config)
+			Expect(config.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+			Expect(config.CipherSuites).To(Equal([]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}))
+		})
+
+		It("keeps Go's cipher suites when none are given", func() {
+			opt, err := tlsConfig(DefaultTLSMinVersion, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			config := &tls.Config{}
+			opt(config)
+			Expect(config.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+			Expect(config.CipherSuites).To(BeNil())
+		})
+
+		It("fails fast on unknown TLS settings", func() {
+			Expect(CMStateCreator(nil, Options{TLSMinVersion: "1.4"})).To(MatchError(ContainSubstring("invalid TLS min version")))
+			Expect(CMStateCreator(nil, Options{TLSCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}})).To(MatchError(ContainSubstring("unknown or insecure TLS cipher suite")))
+			Expect(CMStateCreator(nil, Options{TLSCipherSuites: []string{"AES128"}})).To(MatchError(ContainSubstring("unknown or insecure TLS cipher suite")))
+		})
+	})
+
+	Context("when checking readiness", func() {
+		It("only reports ready once the informer cache synced", func() {
+			synced := false
+			check := CacheSyncedCheck(&informertest.FakeInformers{Synced: &synced})
+			req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+			Expect(check(req)).NotTo(Succeed())
+
+			synced = true
+			Expect(check(req)).To(Succeed())
+		})
+	})
+
+	Context("when the cache hasn't seen the cmstate yet", func() {
+		It("finds it through the API reader instead of creating a duplicate", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState("app-1"))
+			hook.APIReader = hook.Client
+			counter := &writeCountingClient{Client: &staleCacheClient{Client: hook.Client}}
+			hook.Client = counter
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-2")))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).NotTo(BeEmpty())
+			// only the audience update, no create attempt
+			Expect(counter.writes).To(Equal(1))
+
+			cmState := newTestCMState()
+			Expect(hook.APIReader.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(ConsistOf(HaveField("Name", "app-1"), HaveField("Name", "app-2")))
+		})
+
+		It("retries updating the audience against the API server once the cache lags behind", func() {
+			cmState := newTestCMState("app-1", "app-2")
+			hook := newTestHook(newTestTemplate(), cmState)
+			live := hook.Client
+			cached := &cachev1alpha2.CMState{}
+			Expect(live.Get(ctx, client.ObjectKeyFromObject(cmState), cached)).To(Succeed())
+			hook.APIReader = live
+			hook.Client = &interferingClient{
+				Client: &laggingCacheClient{Client: live, cmState: cached},
+				interfere: func(ctx context.Context, _ client.Client) {
+					other := &cachev1alpha2.CMState{}
+					Expect(live.Get(ctx, client.ObjectKeyFromObject(cmState), other)).To(Succeed())
+					other.Spec.Audience = append(other.Spec.Audience, cachev1alpha2.CMAudience{Kind: "Pod", Name: "app-3"})
+					Expect(live.Update(ctx, other)).To(Succeed())
+				},
+			}
+
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-4"))).Response.Allowed).To(BeTrue())
+			Expect(review(hook, testutil.NewPodDeleteRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+
+			Expect(live.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(ConsistOf(
+				HaveField("Name", "app-2"),
+				HaveField("Name", "app-3"),
+				HaveField("Name", "app-4"),
+			))
+		})
+
+		It("fails without the API reader", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState("app-1"))
+			hook.Client = &staleCacheClient{Client: hook.Client}
+
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-2"))).Response.Allowed).To(BeFalse())
+		})
+	})
+
+	Context("when writing the cmstate fails", func() {
+		It("returns the denial for a failed create instead of a 500", func() {
+			hook := newTestHook(newTestTemplate())
+			hook.Client = &failingCreateClient{Client: hook.Client, err: apierrors.NewForbidden(
+				cachev1alpha2.GroupVersion.WithResource("cmstates").GroupResource(), "cmstate-vault-agent", nil)}
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(out.Response.Result.Code).To(BeEquivalentTo(http.StatusForbidden))
+			Expect(string(out.Response.Result.Reason)).To(HavePrefix("creating cmstate 'cmstate-vault-agent' has resulted in an error: "))
+		})
+
+		It("returns the denial for a failed audience patch instead of a 500", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState())
+			hook.Client = &failingUpdateClient{Client: hook.Client, err: apierrors.NewServiceUnavailable("etcd is down")}
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(out.Response.Result.Code).To(BeEquivalentTo(http.StatusForbidden))
+			Expect(string(out.Response.Result.Reason)).To(Equal("patching cmstate 'cmstate-vault-agent' has resulted in an error: etcd is down"))
+		})
+	})
+
+	Context("when cmstate writes keep failing", func() {
+		var now time.Time
+
+		newBreaker := func() *circuitBreaker {
+			now = time.Now()
+			breaker := newCircuitBreaker(2, time.Minute, 30*time.Second)
+			breaker.now = func() time.Time { return now }
+			return breaker
+		}
+
+		It("opens after consecutive failures within the window", func() {
+			breaker := newBreaker()
+			Expect(breaker.failure()).To(BeFalse())
+			now = now.Add(2 * time.Minute)
+			Expect(breaker.failure()).To(BeFalse())
+			Expect(breaker.allow()).To(BeTrue())
+
+			Expect(breaker.failure()).To(BeTrue())
+			Expect(breaker.allow()).To(BeFalse())
+			Expect(promtestutil.ToFloat64(circuitOpen)).To(Equal(1.0))
+		})
+
+		It("lets a write through after the cooldown and closes once it succeeds", func() {
+			breaker := newBreaker()
+			breaker.failure()
+			breaker.failure()
+
+			now = now.Add(31 * time.Second)
+			Expect(breaker.allow()).To(BeTrue())
+			Expect(breaker.failure()).To(BeTrue())
+			Expect(breaker.allow()).To(BeFalse())
+
+			now = now.Add(31 * time.Second)
+			breaker.success()
+			Expect(breaker.failure()).To(BeFalse())
+			Expect(breaker.allow()).To(BeTrue())
+			Expect(promtestutil.ToFloat64(circuitOpen)).To(Equal(0.0))
+		})
+
+		It("lets a single probe through once the cooldown is over", func() {
+			breaker := newBreaker()
+			breaker.failure()
+			breaker.failure()
+
+			now = now.Add(31 * time.Second)
+			Expect(breaker.allow()).To(BeTrue())
+			Expect(breaker.allow()).To(BeFalse())
+
+			// a probe that never reported back is replaced
+			now = now.Add(31 * time.Second)
+			Expect(breaker.allow()).To(BeTrue())
+			breaker.success()
+			Expect(breaker.allow()).To(BeTrue())
+			Expect(breaker.allow()).To(BeTrue())
+		})
+
+		It("deletes pods without removing them from the audience while open", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState("app-1"))
+			hook.breaker = newBreaker()
+			hook.breaker.failure()
+			hook.breaker.failure()
+			counter := &writeCountingClient{Client: hook.Client}
+			hook.Client = counter
+
+			out := review(hook, testutil.NewPodDeleteRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Warnings).To(ConsistOf(ContainSubstring("pod deleted with a stale audience entry in cmstate 'cmstate-vault-agent'")))
+			Expect(counter.writes).To(BeZero())
+		})
+
+		It("opens on failed removals", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState("app-1", "app-2"))
+			hook.Client = &failingUpdateClient{Client: hook.Client, err: apierrors.NewServiceUnavailable("etcd is down")}
+			hook.breaker = newBreaker()
+
+			for _, name := range []string{"app-1", "app-2"} {
+				Expect(review(hook, testutil.NewPodDeleteRequest(newTestPod(name))).Response.Allowed).To(BeTrue())
+			}
+			Expect(hook.breaker.allow()).To(BeFalse())
+		})
+
+		It("suspends the writes of log-only mode on a breaker of their own", func() {
+			hook := newTestHook(newTestTemplate())
+			hook.Options.MutationMode = MutationLogOnly
+			hook.breaker = newBreaker()
+			hook.logOnlyBreaker = newBreaker()
+			hook.logOnlyBreaker.failure()
+			hook.logOnlyBreaker.failure()
+			counter := &writeCountingClient{Client: hook.Client}
+			hook.Client = counter
+
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+			Expect(counter.writes).To(BeZero())
+
+			hook.logOnlyBreaker.success()
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+			Expect(counter.writes).To(Equal(1))
+			Expect(hook.breaker.allow()).To(BeTrue())
+		})
+
+		It("admits pods without injection while open", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState())
+			hook.Client = &failingUpdateClient{Client: hook.Client, err: apierrors.NewServiceUnavailable("etcd is down")}
+			hook.breaker = newBreaker()
+			recorder := record.NewFakeRecorder(10)
+			hook.Recorder = recorder
+			hook.operatorNamespace = "cmstate-operator"
+
+			for _, name := range []string{"app-1", "app-2"} {
+				Expect(review(hook, testutil.NewPodCreateRequest(newTestPod(name))).Response.Allowed).To(BeFalse())
+			}
+			var events []string
+			for len(recorder.Events) > 0 {
+				events = append(events, <-recorder.Events)
+			}
+			Expect(events).To(ContainElement(HavePrefix("Warning CMStateWritesSuspended CMState writes keep failing")))
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-3")))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).To(BeEmpty())
+			Expect(out.Response.Warnings).To(ConsistOf("cmstate-injector: cmstate writes are suspended after repeated failures, pod admitted without the injection of template 'vault-agent'"))
+		})
+
+		It("still denies invalid pods while open", func() {
+			hook := newTestHook(newTestTemplate())
+			hook.breaker = newBreaker()
+			hook.breaker.failure()
+			hook.breaker.failure()
+			pod := newTestPod("app-1")
+			delete(pod.Annotations, "vault.hashicorp.com/role")
+
+			Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Allowed).To(BeFalse())
+		})
+	})
+
+	Context("when fetching the cmstate and template", func() {
+		transient := apierrors.NewServiceUnavailable("etcd is down")
+
+		DescribeTable("distinguishes missing objects from API failures",
+			func(objs []client.Object, failing client.Object, expectState, expectTemplate, expectErr bool) {
+				hook := newTestHook(objs...)
+				if failing != nil {
+					hook.Client = &failingGetClient{Client: hook.Client, kind: failing, err: transient}
+				}
+
+				cmState, cmTemplate, err := hook.fetchState(ctx, newTestPod("app-1"), testTemplateName)
+				if expectErr {
+					Expect(err).To(HaveOccurred())
+					Expect(apierrors.IsNotFound(err)).To(BeFalse())
+					return
+				}
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cmState.Name != "").To(Equal(expectState))
+				Expect(cmTemplate != nil).To(Equal(expectTemplate))
+			},
+			Entry("both found", []client.Object{newTestCMState(), newTestTemplate()}, nil, true, true, false),
+			Entry("cmstate not found", []client.Object{newTestTemplate()}, nil, false, true, false),
+			Entry("cmstate lookup fails", []client.Object{newTestTemplate()}, &cachev1alpha2.CMState{}, false, false, true),
+			Entry("template not found", []client.Object{newTestCMState()}, nil, true, false, false),
+			Entry("template lookup fails", []client.Object{newTestCMState()}, &cachev1alpha2.CMTemplate{}, false, false, true),
+		)
+
+		It("still removes the pod from the audience after its template is gone", func() {
+			hook := newTestHook(newTestCMState("app-1"))
+
+			Expect(review(hook, testutil.NewPodDeleteRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+
+			cmState := newTestCMState()
+			Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(BeEmpty())
+		})
+	})
+
+	Context("when injection is skipped or degraded", func() {
+		It("warns about an empty trigger annotation", func() {
+			hook := newTestHook(newTestTemplate())
+			pod := newTestPod("app-1")
+			pod.Annotations[DefaultTriggerAnnotation] = " "
+
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Warnings).To(ConsistOf("cmstate-injector: annotation 'cache.spicedelver.me/cmtemplate' is empty, pod admitted without injection"))
+		})
+
+		It("warns that a dry run doesn't touch the cmstate", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState())
+			req := testutil.DryRun(testutil.NewPodCreateRequest(newTestPod("app-1")))
+
+			Expect(review(hook, req).Response.Warnings).To(ConsistOf("cmstate-injector: dry run, cmstate 'cmstate-vault-agent' not updated"))
+		})
+
+		It("warns that a dry run can't preview a missing cmstate", func() {
+			hook := newTestHook(newTestTemplate())
+			req := testutil.DryRun(testutil.NewPodCreateRequest(newTestPod("app-1")))
+
+			Expect(review(hook, req).Response.Warnings).To(ConsistOf(ContainSubstring("doesn't exist yet")))
+		})
+
+		It("admits a delete with a warning when the audience patch fails", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState("app-1"))
+			hook.Client = &failingUpdateClient{Client: hook.Client, err: apierrors.NewServiceUnavailable("etcd is down")}
+
+			out := review(hook, testutil.NewPodDeleteRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Warnings).To(ConsistOf(ContainSubstring("removing pod from cmstate 'cmstate-vault-agent' failed")))
+		})
+	})
+
+	Context("when the template restricts its service accounts", func() {
+		newRestrictedHook := func(allowed ...string) *cmStateCreator {
+			cmTemplate := newTestTemplate()
+			cmTemplate.Spec.AllowedServiceAccounts = allowed
+			return newTestHook(cmTemplate)
+		}
+
+		It("denies pods running as another service account before writing the cmstate", func() {
+			hook := newRestrictedHook("default/vault-reader")
+			pod := newTestPod("app-1")
+			pod.Spec.ServiceAccountName = "builder"
+
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(string(out.Response.Result.Reason)).To(Equal("cmstate-injector: policy violation, service account 'default/builder' is not allowed to use template 'vault-agent'"))
+
+			list := &cachev1alpha2.CMStateList{}
+			Expect(hook.Client.List(ctx, list)).To(Succeed())
+			Expect(list.Items).To(BeEmpty())
+		})
+
+		It("matches namespace and name globs", func() {
+			hook := newRestrictedHook("kube-*/*", "def*/vault-*")
+			pod := newTestPod("app-1")
+			pod.Spec.ServiceAccountName = "vault-reader"
+
+			Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Allowed).To(BeTrue())
+		})
+
+		It("treats pods without a service account as running as default", func() {
+			hook := newRestrictedHook("default/default")
+
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+		})
+
+		It("denies pods when an entry is malformed", func() {
+			hook := newRestrictedHook("vault-reader")
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(string(out.Response.Result.Reason)).To(ContainSubstring("must be namespace/name"))
+		})
+	})
+
+	Context("when the template restricts its namespaces", func() {
+		newRestrictedHook := func(targets cachev1alpha2.TargetNamespaces, namespaceLabels map[string]string) *cmStateCreator {
+			cmTemplate := newTestTemplate()
+			cmTemplate.Spec.TargetNamespaces = &targets
+			namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace, Labels: namespaceLabels}}
+			return newTestHook(namespace, cmTemplate)
+		}
+
+		It("denies pods of other namespaces before writing the cmstate", func() {
+			hook := newRestrictedHook(cachev1alpha2.TargetNamespaces{Names: []string{"team-a"}}, nil)
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(string(out.Response.Result.Reason)).To(Equal("cmstate-injector: policy violation, namespace 'default' is not allowed to use template 'vault-agent'"))
+
+			list := &cachev1alpha2.CMStateList{}
+			Expect(hook.Client.List(ctx, list)).To(Succeed())
+			Expect(list.Items).To(BeEmpty())
+		})
+
+		It("admits pods of listed or selected namespaces", func() {
+			hook := newRestrictedHook(cachev1alpha2.TargetNamespaces{Names: []string{"team-a", testNamespace}}, nil)
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+
+			selector := &metav1.LabelSelector{MatchLabels: map[string]string{"vault-access": "true"}}
+			hook = newRestrictedHook(cachev1alpha2.TargetNamespaces{Names: []string{"team-a"}, Selector: selector}, map[string]string{"vault-access": "true"})
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+
+			hook = newRestrictedHook(cachev1alpha2.TargetNamespaces{Selector: selector}, map[string]string{"vault-access": "false"})
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Allowed).To(BeFalse())
+		})
+
+		It("leaves templates without targets unrestricted", func() {
+			hook := newRestrictedHook(cachev1alpha2.TargetNamespaces{}, nil)
+
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+		})
+	})
+
+	Context("when the template is disabled", func() {
+		It("admits the pod unmodified with a warning", func() {
+			cmTemplate := newTestTemplate()
+			cmTemplate.Spec.Disabled = true
+			hook := newTestHook(cmTemplate)
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).To(BeEmpty())
+			Expect(out.Response.Warnings).To(ConsistOf("cmstate-injector: template 'vault-agent' is disabled, pod admitted without its injection"))
+
+			list := &cachev1alpha2.CMStateList{}
+			Expect(hook.Client.List(ctx, list)).To(Succeed())
+			Expect(list.Items).To(BeEmpty())
+		})
+
+		It("still removes pods injected before from the audience", func() {
+			cmTemplate := newTestTemplate()
+			cmTemplate.Spec.Disabled = true
+			hook := newTestHook(cmTemplate, newTestCMState("app-1", "app-2"))
+
+			Expect(review(hook, testutil.NewPodDeleteRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(ConsistOf(HaveField("Name", "app-2")))
+		})
+	})
+
+	Context("when the referenced template doesn't exist", func() {
+		It("admits the pod with a warning by default", func() {
+			hook := newTestHook()
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).To(BeEmpty())
+			Expect(out.Response.Warnings).To(ConsistOf("cmstate-injector: template 'vault-agent' not found, pod admitted without its injection"))
+		})
+
+		It("treats a template being deleted as missing", func() {
+			cmTemplate := newTestTemplate()
+			cmTemplate.Finalizers = []string{"cache.spicedelver.me/cmstates"}
+			hook := newTestHook(cmTemplate)
+			Expect(hook.Client.Delete(ctx, cmTemplate)).To(Succeed())
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).To(BeEmpty())
+			Expect(out.Response.Warnings).To(ConsistOf("cmstate-injector: template 'vault-agent' not found, pod admitted without its injection"))
+		})
+
+		It("denies the pod with the deny policy", func() {
+			hook := newTestHook()
+			hook.Options.MissingTemplatePolicy = MissingTemplateDeny
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(out.Response.Result.Code).To(BeEquivalentTo(http.StatusForbidden))
+			Expect(string(out.Response.Result.Reason)).To(Equal("cmstate-injector: template 'vault-agent' not found"))
+		})
+
+		It("keeps returning 500 for transient errors", func() {
+			hook := newTestHook(newTestTemplate())
+			hook.Client = &failingGetClient{
+				Client: hook.Client,
+				kind:   &cachev1alpha2.CMTemplate{},
+				err:    apierrors.NewServiceUnavailable("etcd is down"),
+			}
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(out.Response.Result.Code).To(BeEquivalentTo(http.StatusInternalServerError))
+		})
+	})
+
+	Context("when the template has a base template", func() {
+		newBaseTemplate := func(name, base string) *cachev1alpha2.CMTemplate {
+			cmTemplate := newTestTemplate()
+			cmTemplate.Name = name
+			cmTemplate.Spec.BaseTemplate = base
+			cmTemplate.Spec.Inject = &cachev1alpha2.Inject{PodAnnotations: map[string]string{"vault.hashicorp.com/agent-inject": "true"}}
+			return cmTemplate
+		}
+		newChildTemplate := func() *cachev1alpha2.CMTemplate {
+			cmTemplate := newTestTemplate()
+			cmTemplate.Spec.Template.AnnotationReplace = nil
+			cmTemplate.Spec.BaseTemplate = "vault-agent-base"
+			return cmTemplate
+		}
+
+		It("injects the pod with what the template inherits", func() {
+			hook := newTestHook(newChildTemplate(), newBaseTemplate("vault-agent-base", ""))
+
+			patch := decodePatch(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))))
+			Expect(patch).To(ContainElement(
+				testutil.PatchOperation{Op: "add", Path: "/metadata/annotations/vault.hashicorp.com~1agent-inject", Value: "true"},
+			))
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			Expect(cmState.Annotations).To(HaveKey("vault.hashicorp.com/role"))
+		})
+
+		It("denies the pod while the base is missing", func() {
+			hook := newTestHook(newChildTemplate())
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(out.Response.Result.Code).To(BeEquivalentTo(http.StatusForbidden))
+			Expect(string(out.Response.Result.Reason)).To(Equal("cmtemplate 'vault-agent' is invalid: base template 'vault-agent-base' not found"))
+		})
+
+		It("denies the pod when the chain is deeper than allowed", func() {
+			hook := newTestHook(newChildTemplate(), newBaseTemplate("vault-agent-base", "vault-agent-root"), newBaseTemplate("vault-agent-root", ""))
+			hook.Options.MaxBaseTemplateDepth = 1
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(string(out.Response.Result.Reason)).To(ContainSubstring("base templates are nested deeper than 1: vault-agent -> vault-agent-base -> vault-agent-root"))
+
+			hook.Options.MaxBaseTemplateDepth = 2
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+		})
+	})
+
+	Context("when the pod lacks annotations the template replaces", func() {
+		newReplaceTemplate := func() *cachev1alpha2.CMTemplate {
+			cmTemplate := newTestTemplate()
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/auth-path", cachev1alpha2.Replacement{Placeholder: "{auth_path}"})
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/namespace", cachev1alpha2.Replacement{Placeholder: "{namespace}"})
+			return cmTemplate
+		}
+
+		It("denies the pod naming every missing annotation", func() {
+			hook := newTestHook(newReplaceTemplate())
+			pod := newTestPod("app-1")
+			delete(pod.Annotations, "vault.hashicorp.com/role")
+
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(string(out.Response.Result.Reason)).To(Equal("cmstate-injector: pod is missing the annotations required by template 'vault-agent': " +
+				"vault.hashicorp.com/auth-path, vault.hashicorp.com/namespace, vault.hashicorp.com/role"))
+
+			cmStates := &cachev1alpha2.CMStateList{}
+			Expect(hook.Client.List(ctx, cmStates)).To(Succeed())
+			Expect(cmStates.Items).To(BeEmpty())
+		})
+
+		It("admits the pod when the missing annotations are optional", func() {
+			cmTemplate := newReplaceTemplate()
+			cmTemplate.Spec.Template.OptionalAnnotations = []string{"vault.hashicorp.com/auth-path", "vault.hashicorp.com/namespace"}
+			hook := newTestHook(cmTemplate)
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).NotTo(BeEmpty())
+		})
+
+		It("lets the required field of an entry decide over the optional annotations", func() {
+			cmTemplate := newReplaceTemplate()
+			required, optional := true, false
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/auth-path", cachev1alpha2.Replacement{Placeholder: "{auth_path}", Required: &optional})
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/namespace", cachev1alpha2.Replacement{Placeholder: "{namespace}", Required: &required})
+			hook := newTestHook(cmTemplate)
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(string(out.Response.Result.Reason)).To(Equal("cmstate-injector: pod is missing the annotations required by template 'vault-agent': " +
+				"vault.hashicorp.com/namespace"))
+		})
+
+		It("rejects required annotations with a default", func() {
+			cmTemplate := newTestTemplate()
+			required, role := true, "reader"
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/role", cachev1alpha2.Replacement{Placeholder: "{role}", Required: &required, Default: &role})
+
+			Expect(cmTemplate.Validate()).To(ConsistOf(
+				HaveField("Field", "spec.template.annotationReplace[0].required"),
+			))
+		})
+
+		It("denies pods setting values that don't match the pattern", func() {
+			cmTemplate := newTestTemplate()
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/role", cachev1alpha2.Replacement{Placeholder: "{role}", Pattern: "[a-z-]+"})
+			hook := newTestHook(cmTemplate)
+			pod := newTestPod("app-1")
+			pod.Annotations["vault.hashicorp.com/role"] = "reader\"\n}\nauto_auth {"
+
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(string(out.Response.Result.Reason)).To(Equal("cmstate-injector: pod annotations don't match the patterns of template 'vault-agent': " +
+				"vault.hashicorp.com/role must match '[a-z-]+'"))
+
+			pod.Annotations["vault.hashicorp.com/role"] = "reader"
+			Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Allowed).To(BeTrue())
+		})
+
+		It("denies pods setting values not of the type of the parameter", func() {
+			cmTemplate := newTestTemplate()
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/ttl", cachev1alpha2.Replacement{Placeholder: "{ttl}", Type: cachev1alpha2.ReplacementTypeInt})
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/tier", cachev1alpha2.Replacement{Placeholder: "{tier}", Enum: []string{"gold", "silver"}})
+			hook := newTestHook(cmTemplate)
+			pod := newTestPod("app-1")
+			pod.Annotations["vault.hashicorp.com/ttl"] = "1h"
+			pod.Annotations["vault.hashicorp.com/tier"] = "bronze"
+
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(string(out.Response.Result.Reason)).To(Equal("cmstate-injector: pod annotations don't match the patterns of template 'vault-agent': " +
+				"vault.hashicorp.com/tier must be one of 'gold', 'silver', vault.hashicorp.com/ttl must be an int"))
+		})
+
+		It("normalizes typed values before they reach the cmstate", func() {
+			cmTemplate := newTestTemplate()
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/tls-skip-verify", cachev1alpha2.Replacement{Placeholder: "{skip}", Type: cachev1alpha2.ReplacementTypeBool})
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/ttl", cachev1alpha2.Replacement{Placeholder: "{ttl}", Type: cachev1alpha2.ReplacementTypeInt})
+			hook := newTestHook(cmTemplate)
+			pod := newTestPod("app-1")
+			pod.Annotations["vault.hashicorp.com/tls-skip-verify"] = "True"
+			pod.Annotations["vault.hashicorp.com/ttl"] = " 0300"
+
+			Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Allowed).To(BeTrue())
+
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			Expect(cmState.Annotations).To(HaveKeyWithValue("vault.hashicorp.com/tls-skip-verify", "true"))
+			Expect(cmState.Annotations).To(HaveKeyWithValue("vault.hashicorp.com/ttl", "300"))
+		})
+
+		It("rejects enums and defaults not of the type of the parameter", func() {
+			cmTemplate := newReplaceTemplate()
+			ttl := "1h"
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/ttl", cachev1alpha2.Replacement{Placeholder: "{ttl}", Type: cachev1alpha2.ReplacementTypeInt, Default: &ttl})
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/tls-skip-verify", cachev1alpha2.Replacement{Placeholder: "{skip}", Type: cachev1alpha2.ReplacementTypeBool, Enum: []string{"true", "False"}})
+
+			Expect(cmTemplate.Validate()).To(ConsistOf(
+				HaveField("Field", "spec.template.annotationReplace[3].default"),
+				HaveField("Field", "spec.template.annotationReplace[4].enum[1]"),
+			))
+		})
+
+		It("rejects replacements applying to data keys the template doesn't have", func() {
+			cmTemplate := newReplaceTemplate()
+			cmTemplate.Spec.Outputs = []cachev1alpha2.Output{{Name: "init", CMTemplate: map[string]string{"config-init.hcl": "{role}"}, TargetAnnotation: "init-config"}}
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/role", cachev1alpha2.Replacement{Placeholder: "{role}", AppliesTo: []string{"config-init.hcl", "app.json"}})
+
+			Expect(cmTemplate.Validate()).To(ConsistOf(
+				HaveField("Field", "spec.template.annotationReplace[0].appliesTo[1]"),
+			))
+		})
+
+		It("rejects patterns that don't compile and defaults that don't match", func() {
+			cmTemplate := newReplaceTemplate()
+			role := "Reader"
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/role", cachev1alpha2.Replacement{Placeholder: "{role}", Pattern: "[a-z]+", Default: &role})
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/namespace", cachev1alpha2.Replacement{Placeholder: "{namespace}", Pattern: "[a-z"})
+
+			Expect(cmTemplate.Validate()).To(ConsistOf(
+				HaveField("Field", "spec.template.annotationReplace[0].default"),
+				HaveField("Field", "spec.template.annotationReplace[2].pattern"),
+			))
+		})
+
+		It("renders the missing annotations with their defaults", func() {
+			cmTemplate := newReplaceTemplate()
+			authPath, namespace := "auth/kubernetes", "admin"
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/auth-path", cachev1alpha2.Replacement{Placeholder: "{auth_path}", Default: &authPath})
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/namespace", cachev1alpha2.Replacement{Placeholder: "{namespace}", Default: &namespace})
+			hook := newTestHook(cmTemplate)
+			pod := newTestPod("app-1")
+			pod.Annotations["vault.hashicorp.com/namespace"] = "team-a"
+
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(out.Response.Allowed).To(BeTrue())
+
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			Expect(cmState.Annotations).To(HaveKeyWithValue("vault.hashicorp.com/auth-path", "auth/kubernetes"))
+			Expect(cmState.Annotations).To(HaveKeyWithValue("vault.hashicorp.com/namespace", "team-a"))
+			Expect(cmState.Annotations).To(HaveKeyWithValue(DefaultedAnnotation, "vault.hashicorp.com/auth-path"))
+		})
+
+		It("leaves the defaulted annotation off cmstates using no default", func() {
+			cmTemplate := newTestTemplate()
+			role := "reader"
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.AnnotationReplace, "vault.hashicorp.com/role", cachev1alpha2.Replacement{Placeholder: "{role}", Default: &role})
+			hook := newTestHook(cmTemplate)
+
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			Expect(cmState.Annotations).NotTo(HaveKey(DefaultedAnnotation))
+		})
+	})
+
+	Context("when the template replaces labels", func() {
+		newLabelTemplate := func() *cachev1alpha2.CMTemplate {
+			cmTemplate := newTestTemplate()
+			cmTemplate.Spec.Template.LabelReplace = []cachev1alpha2.KeyedReplacement{
+				{Key: "team", Replacement: cachev1alpha2.Replacement{Placeholder: "{team}"}},
+				{Key: "vault.hashicorp.com/role", Replacement: cachev1alpha2.Replacement{Placeholder: "{role}"}},
+			}
+			return cmTemplate
+		}
+		fetchValues := func(hook *cmStateCreator) map[string]string {
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			return cmState.Annotations
+		}
+
+		It("copies the label values to the cmstate", func() {
+			hook := newTestHook(newLabelTemplate())
+			pod := newTestPod("app-1")
+			pod.Labels = map[string]string{"team": "payments"}
+
+			Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Allowed).To(BeTrue())
+			Expect(fetchValues(hook)).To(HaveKeyWithValue("team", "payments"))
+		})
+
+		It("prefers the annotation of a key replaced as both", func() {
+			hook := newTestHook(newLabelTemplate())
+			pod := newTestPod("app-1")
+			pod.Labels = map[string]string{"team": "payments", "vault.hashicorp.com/role": "label-role"}
+
+			Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Allowed).To(BeTrue())
+			Expect(fetchValues(hook)).To(HaveKeyWithValue("vault.hashicorp.com/role", "reader"))
+		})
+
+		It("falls back to the label of a key replaced as both", func() {
+			hook := newTestHook(newLabelTemplate())
+			pod := newTestPod("app-1")
+			delete(pod.Annotations, "vault.hashicorp.com/role")
+			pod.Labels = map[string]string{"team": "payments", "vault.hashicorp.com/role": "label-role"}
+
+			Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Allowed).To(BeTrue())
+			Expect(fetchValues(hook)).To(HaveKeyWithValue("vault.hashicorp.com/role", "label-role"))
+		})
+
+		It("denies pods missing a required label", func() {
+			hook := newTestHook(newLabelTemplate())
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(string(out.Response.Result.Reason)).To(Equal("cmstate-injector: pod is missing the labels required by template 'vault-agent': team"))
+		})
+
+		It("admits pods missing an optional label", func() {
+			cmTemplate := newLabelTemplate()
+			optional := false
+			cachev1alpha2.SetReplacement(&cmTemplate.Spec.Template.LabelReplace, "team", cachev1alpha2.Replacement{Placeholder: "{team}", Required: &optional})
+			hook := newTestHook(cmTemplate)
+
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Allowed).To(BeTrue())
+			Expect(fetchValues(hook)).NotTo(HaveKey("team"))
+		})
+	})
+
+	Context("when the template replaces pod fields", func() {
+		newFieldTemplate := func() *cachev1alpha2.CMTemplate {
+			cmTemplate := newTestTemplate()
+			cmTemplate.Spec.Template.FieldReplace = map[string]cachev1alpha2.FieldReplacement{
+				"namespace":      {FieldPath: "metadata.namespace", Placeholder: "{namespace}"},
+				"serviceaccount": {FieldPath: "spec.serviceAccountName", Placeholder: "{serviceaccount}"},
+				"node":           {FieldPath: "spec.nodeName", Placeholder: "{node}"},
+			}
+			return cmTemplate
+		}
+
+		It("carries the values read at admission into the cmstate", func() {
+			hook := newTestHook(newFieldTemplate())
+			pod := newTestPod("app-1")
+			pod.Spec.ServiceAccountName = "vault-auth"
+
+			Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Allowed).To(BeTrue())
+
+			cmState := &cachev1alpha2.CMState{}
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, cmState)).To(Succeed())
+			Expect(cmState.Annotations).To(HaveKeyWithValue("namespace", testNamespace))
+			Expect(cmState.Annotations).To(HaveKeyWithValue("serviceaccount", "vault-auth"))
+			Expect(cmState.Annotations).NotTo(HaveKey("node"))
+		})
+
+		It("rejects unknown field paths and keys replaced otherwise", func() {
+			cmTemplate := newFieldTemplate()
+			cmTemplate.Spec.Template.FieldReplace["node"] = cachev1alpha2.FieldReplacement{FieldPath: "status.hostIP", Placeholder: "{node}"}
+			cmTemplate.Spec.Template.FieldReplace["vault.hashicorp.com/role"] = cachev1alpha2.FieldReplacement{FieldPath: "metadata.name", Placeholder: "{role}"}
+
+			Expect(cmTemplate.Validate()).To(ConsistOf(
+				HaveField("Field", "spec.template.fieldReplace[node].fieldPath"),
+				HaveField("Field", "spec.template.fieldReplace[vault.hashicorp.com/role]"),
+			))
+		})
+	})
+
+	Context("when namespaces are scoped", func() {
+		It("only injects pods in the included namespaces", func() {
+			hook := newTestHook(newTestTemplate())
+			hook.Options.InjectNamespaces = []string{"team-*"}
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Patch).To(BeEmpty())
+			Expect(string(out.Response.Result.Reason)).To(ContainSubstring("namespace not enabled"))
+
+			hook.Options.InjectNamespaces = []string{"team-*", testNamespace}
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Patch).NotTo(BeEmpty())
+		})
+
+		It("lets exclusions win over inclusions", func() {
+			hook := newTestHook(newTestTemplate())
+			hook.Options.InjectNamespaces = []string{"*"}
+			hook.Options.ExcludeNamespaces = []string{"def*"}
+
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Patch).To(BeEmpty())
+		})
+
+		It("matches the namespace labels against the selector", func() {
+			namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   testNamespace,
+				Labels: map[string]string{"injection": "enabled"},
+			}}
+			hook := newTestHook(namespace, newTestTemplate())
+
+			hook.namespaceSelector = labels.SelectorFromSet(labels.Set{"injection": "disabled"})
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Patch).To(BeEmpty())
+
+			hook.namespaceSelector = labels.SelectorFromSet(labels.Set{"injection": "enabled"})
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Patch).NotTo(BeEmpty())
+		})
+
+		It("takes the namespace from the request when the pod omits it", func() {
+			hook := newTestHook(newTestTemplate())
+			hook.Options.InjectNamespaces = []string{testNamespace}
+
+			pod := newTestPod("")
+			pod.GenerateName = "app-"
+			pod.Namespace = ""
+			req := testutil.NewPodCreateRequest(pod)
+			req.Namespace = testNamespace
+
+			Expect(review(hook, req).Response.Patch).NotTo(BeEmpty())
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, &cachev1alpha2.CMState{})).To(Succeed())
+		})
+	})
+
+	Context("when the pod is in a system namespace", func() {
+		It("skips kube-system and the operator's own namespace", func() {
+			os.Setenv(PodNamespaceEnv, "cmstate-operator")
+			DeferCleanup(os.Unsetenv, PodNamespaceEnv)
+
+			hook := newTestHook(newTestTemplate())
+			hook.excludedSystem = excludedSystemNamespaces(hook.Options)
+			Expect(hook.excludedSystem).To(ConsistOf("kube-system", "kube-node-lease", "cmstate-operator"))
+
+			for _, namespace := range []string{"kube-system", "cmstate-operator"} {
+				pod := newTestPod("app-1")
+				pod.Namespace = namespace
+				out := review(hook, testutil.NewPodCreateRequest(pod))
+				Expect(out.Response.Allowed).To(BeTrue())
+				Expect(out.Response.Patch).To(BeEmpty())
+				Expect(string(out.Response.Result.Reason)).To(ContainSubstring("system namespace '" + namespace + "'"))
+			}
+			Expect(review(hook, testutil.NewPodCreateRequest(newTestPod("app-1"))).Response.Patch).NotTo(BeEmpty())
+		})
+
+		It("leaves out the own namespace when the env var is unset", func() {
+			Expect(excludedSystemNamespaces(Options{})).To(ConsistOf("kube-system", "kube-node-lease"))
+		})
+
+		It("excludes nothing when system namespaces are allowed", func() {
+			Expect(excludedSystemNamespaces(Options{AllowSystemNamespaces: true})).To(BeEmpty())
+		})
+	})
+
+	Context("when the webhook is reinvoked", func() {
+		It("doesn't patch or count the pod twice", func() {
+			hook := newTestHook(newTestTemplate())
+			counter := &writeCountingClient{Client: hook.Client}
+			hook.Client = counter
+
+			pod := newTestPod("app-1")
+			first := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(first.Response.Patch).NotTo(BeEmpty())
+			writes := counter.writes
+
+			pod = applyPatch(pod, first)
+			pod.Labels = map[string]string{"injected-by": "another-webhook"}
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).To(BeEmpty())
+			Expect(counter.writes).To(Equal(writes))
+
+			cmState := newTestCMState()
+			Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(HaveLen(1))
+		})
+
+		It("still joins the audience when only the annotation is present", func() {
+			hook := newTestHook(newTestTemplate(), newTestCMState())
+			pod := newTestPod("app-1")
+			pod.Annotations[testTargetAnnotation] = "cmstate-vault-agent"
+
+			Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Allowed).To(BeTrue())
+
+			cmState := newTestCMState()
+			Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(ConsistOf(HaveField("Name", "app-1")))
+		})
+
+		It("counts a new replica that shares the entry of its siblings", func() {
+			cmState := newTestCMState()
+			cmState.Spec.Audience = append(cmState.Spec.Audience, cachev1alpha2.CMAudience{Kind: "Pod", Name: "app-5d9f-", Count: 1})
+			hook := newTestHook(newTestTemplate(), cmState)
+
+			pod := newTestPod("")
+			pod.GenerateName = "app-5d9f-"
+			pod.UID = ""
+			pod.Annotations[testTargetAnnotation] = "cmstate-vault-agent"
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(applyPatch(pod, out).Annotations).To(HaveKeyWithValue(CMStateAnnotation, "cmstate-vault-agent"))
+
+			Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(ConsistOf(And(HaveField("Name", "app-5d9f-"), HaveField("Count", int32(2)))))
+		})
+	})
+
+	Context("when the request is a dry run", func() {
+		var (
+			hook    *cmStateCreator
+			counter *writeCountingClient
+		)
+
+		It("returns the patch without joining an existing cmstate", func() {
+			hook = newTestHook(newTestTemplate(), newTestCMState())
+			counter = &writeCountingClient{Client: hook.Client}
+			hook.Client = counter
+
+			out := review(hook, testutil.DryRun(testutil.NewPodCreateRequest(newTestPod("app-1"))))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).NotTo(BeEmpty())
+			Expect(counter.writes).To(BeZero())
+
+			cmState := newTestCMState()
+			Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(BeEmpty())
+		})
+
+		It("skips the pod when the cmstate doesn't exist yet", func() {
+			hook = newTestHook(newTestTemplate())
+			counter = &writeCountingClient{Client: hook.Client}
+			hook.Client = counter
+
+			out := review(hook, testutil.DryRun(testutil.NewPodCreateRequest(newTestPod("app-1"))))
+			Expect(out.Response.Allowed).To(BeTrue())
+			Expect(out.Response.Patch).To(BeEmpty())
+			Expect(counter.writes).To(BeZero())
+			Expect(hook.Client.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: "cmstate-vault-agent"}, &cachev1alpha2.CMState{})).NotTo(Succeed())
+		})
+
+		It("leaves the audience alone on delete and update", func() {
+			hook = newTestHook(newTestTemplate(), newTestCMState("app-1"))
+			counter = &writeCountingClient{Client: hook.Client}
+			hook.Client = counter
+
+			Expect(review(hook, testutil.DryRun(testutil.NewPodDeleteRequest(newTestPod("app-1")))).Response.Allowed).To(BeTrue())
+
+			pod := newTestPod("app-1")
+			delete(pod.Annotations, DefaultTriggerAnnotation)
+			Expect(review(hook, testutil.DryRun(testutil.NewPodUpdateRequest(newTestPod("app-1"), pod))).Response.Allowed).To(BeTrue())
+			Expect(counter.writes).To(BeZero())
+		})
+
+		It("drops whatever would be written on a dry run", func() {
+			hook = newTestHook(newTestTemplate(), newTestCMState("app-1"))
+			counter = &writeCountingClient{Client: hook.Client}
+
+			dryRunClient := &dryRunClient{Client: counter, log: logr.Discard()}
+			Expect(dryRunClient.Create(ctx, newTestCMState())).To(Succeed())
+			Expect(dryRunClient.Update(ctx, newTestCMState("app-1", "app-2"))).To(Succeed())
+			Expect(dryRunClient.Patch(ctx, newTestCMState(), client.MergeFrom(newTestCMState("app-1")))).To(Succeed())
+			Expect(dryRunClient.Delete(ctx, newTestCMState())).To(Succeed())
+			Expect(counter.writes).To(BeZero())
+
+			cmState := newTestCMState()
+			Expect(hook.Client.Get(ctx, client.ObjectKeyFromObject(cmState), cmState)).To(Succeed())
+			Expect(cmState.Spec.Audience).To(HaveLen(1))
+		})
+	})
+
+	Context("when building the response patch", func() {
+		It("only adds the target and audit annotations to existing annotations", func() {
+			hook := newTestHook(newTestTemplate())
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(*out.Response.PatchType).To(Equal(v1admission.PatchTypeJSONPatch))
+
+			patch := decodePatch(out)
+			Expect(patch).To(Equal([]testutil.PatchOperation{
+				{Op: "add", Path: "/metadata/annotations/cache.spicedelver.me~1cmstate", Value: "cmstate-vault-agent"},
+				{Op: "add", Path: "/metadata/annotations/cache.spicedelver.me~1cmtemplate-used", Value: testTemplateName},
+				{Op: "add", Path: "/metadata/annotations/cache.spicedelver.me~1config-checksum", Value: testChecksum(newTestPod("app-1"), newTestTemplate())},
+				{Op: "add", Path: "/metadata/annotations/cache.spicedelver.me~1injected-by", Value: "cmstate-injector-operator"},
+				{Op: "add", Path: "/metadata/annotations/vault.hashicorp.com~1agent-configmap", Value: "cmstate-vault-agent"},
+			}))
+		})
+
+		It("replaces a target annotation that is already set", func() {
+			hook := newTestHook(newTestTemplate())
+			pod := newTestPod("app-1")
+			pod.Annotations[testTargetAnnotation] = "stale"
+
+			out := review(hook, testutil.NewPodCreateRequest(pod))
+
+			patch := decodePatch(out)
+			Expect(patch).To(Equal([]testutil.PatchOperation{
+				{Op: "add", Path: "/metadata/annotations/cache.spicedelver.me~1cmstate", Value: "cmstate-vault-agent"},
+				{Op: "add", Path: "/metadata/annotations/cache.spicedelver.me~1cmtemplate-used", Value: testTemplateName},
+				{Op: "add", Path: "/metadata/annotations/cache.spicedelver.me~1config-checksum", Value: testChecksum(newTestPod("app-1"), newTestTemplate())},
+				{Op: "add", Path: "/metadata/annotations/cache.spicedelver.me~1injected-by", Value: "cmstate-injector-operator"},
+				{Op: "replace", Path: "/metadata/annotations/vault.hashicorp.com~1agent-configmap", Value: "cmstate-vault-agent"},
+			}))
+		})
+
+		It("creates the annotations map when the pod has none", func() {
+			Expect(annotationPatch(nil, map[string]string{testTargetAnnotation: "cmstate-vault-agent"})).To(Equal([]PatchOperation{
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]string{testTargetAnnotation: "cmstate-vault-agent"}},
+			}))
+		})
+
+		DescribeTable("escapes annotation keys in patch paths",
+			func(key, path string) {
+				Expect(annotationPath(key)).To(Equal(path))
+
+				pod := newTestPod("app-1")
+				patch, err := json.Marshal(annotationPatch(pod.Annotations, map[string]string{key: "cmstate-vault-agent"}))
+				Expect(err).NotTo(HaveOccurred())
+				patched, err := testutil.ApplyPatch(pod, patch)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(patched.Annotations).To(HaveKeyWithValue(key, "cmstate-vault-agent"))
+			},
+			Entry("a prefixed key", "vault.hashicorp.com/agent-configmap", "/metadata/annotations/vault.hashicorp.com~1agent-configmap"),
+			Entry("a tilde", "example.com/a~b", "/metadata/annotations/example.com~1a~0b"),
+			Entry("dots only", "example.com", "/metadata/annotations/example.com"),
+			Entry("escape sequences in the key", "example.com/~1", "/metadata/annotations/example.com~1~01"),
+		)
+	})
+
+	Context("when the template sets inject.annotationKeys", func() {
+		It("writes the cmstate name into every listed annotation", func() {
+			cmTemplate := newTestTemplate()
+			cmTemplate.Spec.Inject = &cachev1alpha2.Inject{
+				AnnotationKeys: []string{"example.com/configmap", "example.com/configmap-copy"},
+			}
+			hook := newTestHook(cmTemplate)
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeTrue())
+
+			patch := decodePatch(out)
+			Expect(patch).To(ContainElements(
+				HaveField("Path", ContainSubstring("example.com~1configmap")),
+				HaveField("Path", ContainSubstring("example.com~1configmap-copy")),
+			))
+			Expect(patch).NotTo(ContainElement(HaveField("Path", ContainSubstring("agent-configmap"))))
+		})
+
+		It("denies the pod when a key is not a valid annotation name", func() {
+			cmTemplate := newTestTemplate()
+			cmTemplate.Spec.Inject = &cachev1alpha2.Inject{
+				AnnotationKeys: []string{"not a valid/key/"},
+			}
+			hook := newTestHook(cmTemplate)
+
+			out := review(hook, testutil.NewPodCreateRequest(newTestPod("app-1")))
+			Expect(out.Response.Allowed).To(BeFalse())
+			Expect(string(out.Response.Result.Reason)).To(ContainSubstring("spec.inject.annotationKeys[0]"))
+		})
+	})
+
+	Context("when a custom trigger annotation is configured", func() {
+		It("only looks at the configured annotation", func() {
+			hook := newTestHook(newTestTemplate())
+			hook.Options.TriggerAnnotation = "platform.example.com/config-template"
+
+			pod := newTestPod("app-1")
+			Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Patch).To(BeEmpty())
+
+			pod.Annotations["platform.example.com/config-template"] = testTemplateName
+			Expect(review(hook, testutil.NewPodCreateRequest(pod)).Response.Patch).NotTo(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,223 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	cachev1alpha2 "github.com/stollenaar/cmstate-injector-operator/api/v1alpha2"
+	v1admission "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// +kubebuilder:webhook:path=/validate-workload-cmtemplates,mutating=false,failurePolicy=ignore,sideEffects=None,groups=apps,resources=deployments;statefulsets;daemonsets,verbs=create;update,versions=v1,name=cmstate-workload-validator.spicedelver.me,admissionReviewVersions=v1;v1beta1
+
+// WorkloadWebhookPath is the path the workload validation is served on, it
+// has to match the path of the kubebuilder marker above
+const WorkloadWebhookPath = "/validate-workload-cmtemplates"
+
+// WorkloadOptions configures the workload validating webhook. The trigger
+// annotation and namespaces have to match the pod webhook's, workloads are
+// only checked where it injects their pods.
+type WorkloadOptions struct {
+	// TriggerAnnotation is the pod annotation naming the CMTemplates to inject
+	TriggerAnnotation string
+	// InjectNamespaces are glob patterns of the namespaces pods are injected
+	// in, all namespaces when empty
+	InjectNamespaces []string
+	// ExcludeNamespaces are glob patterns of namespaces pods are never
+	// injected in
+	ExcludeNamespaces []string
+	// NamespaceSelector is a label selector the namespace has to match
+	NamespaceSelector string
+	// AllowSystemNamespaces checks workloads in the system namespaces too
+	AllowSystemNamespaces bool
+	// MaxBaseTemplateDepth is how many base templates a template may inherit
+	// from through spec.baseTemplate, it has to match the controller's
+	MaxBaseTemplateDepth int
+	// Policy decides whether workloads whose pod template references a
+	// missing or disabled CMTemplate are denied or admitted with a warning
+	Policy MissingTemplatePolicy
+	// Timeout bounds the API calls made checking a single workload
+	Timeout time.Duration
+}
+
+// WorkloadValidator registers the webhook checking the templates the pod
+// templates of Deployments, StatefulSets and DaemonSets ask for
+func WorkloadValidator(mgr ctrl.Manager, opts WorkloadOptions) error {
+	if opts.TriggerAnnotation == "" {
+		opts.TriggerAnnotation = DefaultTriggerAnnotation
+	}
+	if err := validateTriggerAnnotation(opts.TriggerAnnotation); err != nil {
+		return err
+	}
+	switch opts.Policy {
+	case "":
+		opts.Policy = MissingTemplateWarn
+	case MissingTemplateWarn, MissingTemplateDeny:
+	default:
+		return fmt.Errorf("invalid workload template policy %q, must be %s or %s", opts.Policy, MissingTemplateWarn, MissingTemplateDeny)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	namespaceSelector, err := parseNamespaceScope(append(opts.InjectNamespaces, opts.ExcludeNamespaces...), opts.NamespaceSelector)
+	if err != nil {
+		return err
+	}
+
+	// the templates are looked up the way the pod webhook does, through a
+	// cmStateCreator that never writes
+	podOpts := Options{
+		TriggerAnnotation:     opts.TriggerAnnotation,
+		InjectNamespaces:      opts.InjectNamespaces,
+		ExcludeNamespaces:     opts.ExcludeNamespaces,
+		AllowSystemNamespaces: opts.AllowSystemNamespaces,
+		MaxBaseTemplateDepth:  opts.MaxBaseTemplateDepth,
+	}
+	lookup := &cmStateCreator{
+		Client:            mgr.GetClient(),
+		Options:           podOpts,
+		namespaceSelector: namespaceSelector,
+		excludedSystem:    excludedSystemNamespaces(podOpts),
+	}
+	mgr.GetWebhookServer().Register(WorkloadWebhookPath, &webhook.Admission{Handler: &workloadValidator{hook: lookup, Options: opts}})
+	return nil
+}
+
+// workloadValidator checks the templates the pod template of a Deployment,
+// StatefulSet or DaemonSet asks for, so a wrong name shows up when the
+// workload is applied instead of when its pods start. It never mutates.
+type workloadValidator struct {
+	hook    *cmStateCreator
+	Options WorkloadOptions
+}
+
+// workloadPodTemplate is the part of a workload the validation reads, all
+// three kinds keep their pod template under spec.template
+type workloadPodTemplate struct {
+	Spec struct {
+		Template struct {
+			metav1.ObjectMeta `json:"metadata,omitempty"`
+		} `json:"template"`
+	} `json:"spec"`
+}
+
+func (v *workloadValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if v.Options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.Options.Timeout)
+		defer cancel()
+	}
+
+	pod, err := workloadPod(req.Object.Raw, req.Namespace)
+	if err != nil {
+		recordError(errorDecode)
+		return admission.Errored(http.StatusBadRequest, errors.Wrapf(err, "error decoding %s", req.Kind.Kind))
+	}
+	if req.Operation == v1admission.Update {
+		oldPod, err := workloadPod(req.OldObject.Raw, req.Namespace)
+		if err == nil && !v.templatesChanged(oldPod, pod) {
+			// only updates changing the templates are checked, a template
+			// gone since doesn't hold up scaling or an image bump
+			return admission.Allowed("cmtemplate references unchanged")
+		}
+	}
+
+	problems, err := v.check(ctx, pod)
+	if err != nil {
+		return admission.Allowed("skipping cmtemplate check due to an error").
+			WithWarnings(warnf("checking the cmtemplates of %s '%s' failed: %s", req.Kind.Kind, req.Name, err))
+	}
+	if len(problems) == 0 {
+		return admission.Allowed("")
+	}
+	if v.Options.Policy == MissingTemplateDeny {
+		return admission.Denied(fmt.Sprintf("cmstate-injector: %s '%s': %s", req.Kind.Kind, req.Name, strings.Join(problems, "; ")))
+	}
+	warnings := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		warnings = append(warnings, warnf("%s '%s': %s", req.Kind.Kind, req.Name, problem))
+	}
+	return admission.Allowed("").WithWarnings(warnings...)
+}
+
+// workloadPod decodes the metadata of the workload's pod template as the pod
+// it stamps out, in the namespace of the workload
+func workloadPod(raw []byte, namespace string) (*corev1.Pod, error) {
+	workload := &workloadPodTemplate{}
+	if err := json.Unmarshal(raw, workload); err != nil {
+		return nil, err
+	}
+	pod := &corev1.Pod{ObjectMeta: workload.Spec.Template.ObjectMeta}
+	pod.Namespace = namespace
+	return pod, nil
+}
+
+// templatesChanged reports whether the pods of the updated workload ask for
+// other templates than before, or stopped resolving them
+func (v *workloadValidator) templatesChanged(oldPod, pod *corev1.Pod) bool {
+	oldNames, oldErr := v.hook.resolveTemplateNames(oldPod)
+	names, err := v.hook.resolveTemplateNames(pod)
+	if (oldErr == nil) != (err == nil) || optedOut(oldPod) != optedOut(pod) {
+		return true
+	}
+	return strings.Join(oldNames, ",") != strings.Join(names, ",")
+}
+
+// check lists what is wrong with the templates the pods of the workload ask
+// for. Workloads the pod webhook wouldn't inject aren't checked.
+func (v *workloadValidator) check(ctx context.Context, pod *corev1.Pod) ([]string, error) {
+	hook := v.hook
+	if optedOut(pod) || hook.isSystemNamespace(pod.Namespace) || !hook.namespaceEnabled(pod.Namespace) {
+		return nil, nil
+	}
+	if hook.namespaceSelector != nil {
+		namespace, err := hook.fetchNamespace(ctx, pod.Namespace)
+		if err != nil || namespace == nil || !hook.namespaceSelector.Matches(labels.Set(namespace.Labels)) {
+			return nil, err
+		}
+	}
+
+	var problems []string
+	names, err := hook.resolveTemplateNames(pod)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, name := range names {
+		cmTemplate := &cachev1alpha2.CMTemplate{}
+		err := hook.getCMTemplate(ctx, pod.Namespace, name, cmTemplate)
+		switch {
+		case apierrors.IsNotFound(err):
+			problems = append(problems, fmt.Sprintf("template '%s' not found", name))
+		case err != nil:
+			recordError(errorCMTemplateLookup)
+			return nil, errors.Wrap(err, "fetching cmtemplate has resulted in an error")
+		case cmTemplate.Spec.Disabled:
+			problems = append(problems, fmt.Sprintf("template '%s' is disabled", name))
+		default:
+			if allowed, err := hook.namespaceAllowed(ctx, cmTemplate, pod.Namespace); err != nil {
+				return nil, err
+			} else if !allowed {
+				problems = append(problems, fmt.Sprintf("namespace '%s' is not allowed to use template '%s'", pod.Namespace, name))
+			}
+			var baseErr *cachev1alpha2.BaseTemplateError
+			if err := hook.resolveBase(ctx, cmTemplate); errors.As(err, &baseErr) {
+				problems = append(problems, fmt.Sprintf("template '%s' is invalid: %s", name, baseErr))
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	v1admission "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sigs.k8s.io/yaml"
+)
+
+func newTestDeployment(annotations map[string]string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: testNamespace},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      map[string]string{"app": "web"},
+					Annotations: annotations,
+				},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "busybox"}}},
+			},
+		},
+	}
+}
+
+// newWorkloadRequest builds the request admitting the workload, with the old
+// one for updates
+func newWorkloadRequest(op v1admission.Operation, workload, old runtime.Object) admission.Request {
+	encode := func(obj runtime.Object) runtime.RawExtension {
+		raw, err := json.Marshal(obj)
+		Expect(err).NotTo(HaveOccurred())
+		return runtime.RawExtension{Raw: raw}
+	}
+	req := admission.Request{AdmissionRequest: v1admission.AdmissionRequest{
+		UID:       "req-web",
+		Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: workload.GetObjectKind().GroupVersionKind().Kind},
+		Name:      "web",
+		Namespace: testNamespace,
+		Operation: op,
+		Object:    encode(workload),
+	}}
+	if old != nil {
+		req.OldObject = encode(old)
+	}
+	return req
+}
+
+var _ = Describe("Workload validation", func() {
+	triggered := func(templates string) map[string]string {
+		return map[string]string{DefaultTriggerAnnotation: templates}
+	}
+
+	validate := func(validator *workloadValidator, req admission.Request) *v1admission.AdmissionResponse {
+		return review(validator, req).Response
+	}
+
+	It("admits workloads referencing existing templates", func() {
+		validator := &workloadValidator{hook: newTestHook(newTestTemplate())}
+
+		resp := validate(validator, newWorkloadRequest(v1admission.Create, newTestDeployment(triggered(testTemplateName)), nil))
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(resp.Warnings).To(BeEmpty())
+		Expect(resp.Patch).To(BeEmpty())
+	})
+
+	It("warns about missing and disabled templates", func() {
+		disabled := newTestTemplate()
+		disabled.Name = "paused"
+		disabled.Spec.Disabled = true
+		validator := &workloadValidator{hook: newTestHook(disabled)}
+
+		resp := validate(validator, newWorkloadRequest(v1admission.Create, newTestDeployment(triggered("vault-agnet,paused")), nil))
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(resp.Warnings).To(ConsistOf(
+			"cmstate-injector: Deployment 'web': template 'vault-agnet' not found",
+			"cmstate-injector: Deployment 'web': template 'paused' is disabled",
+		))
+	})
+
+	It("resolves label placeholders from the pod template", func() {
+		web := newTestTemplate()
+		web.Name = "web-vault"
+		validator := &workloadValidator{hook: newTestHook(web)}
+
+		resp := validate(validator, newWorkloadRequest(v1admission.Create, newTestDeployment(triggered("{app}-vault,{team}-vault")), nil))
+		Expect(resp.Warnings).To(ConsistOf(ContainSubstring("references label 'team'")))
+	})
+
+	It("denies when configured to", func() {
+		hook := newTestHook()
+		validator := &workloadValidator{hook: hook, Options: WorkloadOptions{Policy: MissingTemplateDeny}}
+
+		statefulSet := &appsv1.StatefulSet{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"},
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: testNamespace},
+			Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Annotations: triggered(testTemplateName)},
+			}},
+		}
+		resp := validate(validator, newWorkloadRequest(v1admission.Create, statefulSet, nil))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(Equal("cmstate-injector: StatefulSet 'web': template 'vault-agent' not found"))
+	})
+
+	It("doesn't check updates leaving the templates alone", func() {
+		hook := newTestHook()
+		validator := &workloadValidator{hook: hook, Options: WorkloadOptions{Policy: MissingTemplateDeny}}
+
+		old := newTestDeployment(triggered(testTemplateName))
+		scaled := newTestDeployment(triggered(testTemplateName))
+		scaled.Spec.Replicas = new(int32)
+		scaled.Spec.Template.Spec.Containers[0].Image = "busybox:latest"
+		Expect(validate(validator, newWorkloadRequest(v1admission.Update, scaled, old)).Allowed).To(BeTrue())
+
+		renamed := newTestDeployment(triggered("vault-agnet"))
+		Expect(validate(validator, newWorkloadRequest(v1admission.Update, renamed, old)).Allowed).To(BeFalse())
+	})
+
+	It("skips workloads the pod webhook wouldn't inject", func() {
+		hook := newTestHook()
+		hook.Options.ExcludeNamespaces = []string{testNamespace}
+		validator := &workloadValidator{hook: hook, Options: WorkloadOptions{Policy: MissingTemplateDeny}}
+
+		Expect(validate(validator, newWorkloadRequest(v1admission.Create, newTestDeployment(triggered(testTemplateName)), nil)).Allowed).To(BeTrue())
+
+		hook.Options.ExcludeNamespaces = nil
+		optedOut := triggered(testTemplateName)
+		optedOut[InjectAnnotation] = "false"
+		Expect(validate(validator, newWorkloadRequest(v1admission.Create, newTestDeployment(optedOut), nil)).Allowed).To(BeTrue())
+	})
+
+	It("serves the path of the generated validating configuration", func() {
+		raw, err := os.ReadFile("../config/webhook/manifests.yaml")
+		Expect(err).NotTo(HaveOccurred())
+		config := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+		for _, doc := range strings.Split(string(raw), "\n---\n") {
+			if strings.Contains(doc, "kind: ValidatingWebhookConfiguration") {
+				Expect(yaml.Unmarshal([]byte(doc), config)).To(Succeed())
+			}
+		}
+
+		paths := make([]string, 0, len(config.Webhooks))
+		for _, wh := range config.Webhooks {
+			paths = append(paths, *wh.ClientConfig.Service.Path)
+		}
+		Expect(paths).To(ConsistOf(WorkloadWebhookPath, TemplateWebhookPath))
+	})
+
+	It("fails fast on an invalid policy", func() {
+		Expect(WorkloadValidator(nil, WorkloadOptions{Policy: "Block"})).To(MatchError(ContainSubstring("invalid workload template policy")))
+	})
+})